@@ -0,0 +1,93 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"main/storage"
+	"net/http"
+	"time"
+)
+
+// BackupHandlers back up and restore every account of the storage over
+// HTTP, while the server keeps serving transfers.
+type BackupHandlers struct {
+	storage storage.Storage
+	// database, when set, is the SQLite database behind storage, which is
+	// backed up as a copy of the whole database.
+	database *storage.SqliteStorage
+	// keyring, when set, encrypts backups and decrypts those restored.
+	keyring *storage.Keyring
+}
+
+// NewBackupHandlers returns handlers for s, whose backups are encrypted
+// with keyring if it is not nil.
+func NewBackupHandlers(s storage.Storage, keyring *storage.Keyring) *BackupHandlers {
+	return &BackupHandlers{storage: s, keyring: keyring}
+}
+
+// NewSqliteBackupHandlers returns handlers for s, which stores its accounts
+// in db. Backups are copies of db (see storage.SqliteStorage.Backup), whose
+// balances keyring decrypts on restore.
+func NewSqliteBackupHandlers(s storage.Storage, db *storage.SqliteStorage, keyring *storage.Keyring) *BackupHandlers {
+	return &BackupHandlers{storage: s, database: db, keyring: keyring}
+}
+
+// Backup handles GET requests for a backup of every account, as of a
+// single point in time (see storage.WriteBackup and
+// storage.SqliteStorage.Backup).
+// Response: the backup file
+func (h *BackupHandlers) Backup(rw http.ResponseWriter, r *http.Request) {
+	// The backup is taken in full before any of it is sent, so that a
+	// failure can still be reported with a status code.
+	var backup bytes.Buffer
+	start := time.Now()
+	var count int
+	var err error
+	extension := "snap"
+	if h.database != nil {
+		count, err = h.database.Backup(r.Context(), &backup)
+		extension = "db"
+	} else {
+		count, err = storage.WriteBackup(r.Context(), h.storage, &backup, h.keyring)
+	}
+	if err != nil {
+		writeCommitError(rw, err)
+		return
+	}
+	slog.Info("Took backup", "accounts", count, "bytes", backup.Len(), "duration", time.Since(start))
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	rw.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="backup-%s.%s"`, start.UTC().Format("20060102T150405Z"), extension))
+	rw.Write(backup.Bytes())
+}
+
+// Restore handles POST requests that replace every account with those of
+// a backup. The whole backup is verified before any account is touched.
+// Request Body: a backup file
+// Response: {"accounts": 42} or error
+func (h *BackupHandlers) Restore(rw http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	accounts, err := storage.ReadBackup(r.Body, h.keyring)
+	if errors.Is(err, storage.ErrCorruptRecord) || errors.Is(err, storage.ErrDecrypt) || errors.Is(err, storage.ErrSchemaTooNew) {
+		http.Error(rw, fmt.Sprintf("Invalid backup: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(rw, "Failed to read request body", http.StatusInternalServerError)
+		return
+	}
+	err = storage.Restore(r.Context(), h.storage, accounts)
+	if errors.Is(err, storage.ErrInvalidAccount) {
+		http.Error(rw, fmt.Sprintf("Invalid backup: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		writeCommitError(rw, err)
+		return
+	}
+	slog.Info("Restored backup", "accounts", len(accounts))
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(map[string]int{"accounts": len(accounts)})
+}
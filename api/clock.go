@@ -0,0 +1,30 @@
+package api
+
+import (
+	"context"
+	"time"
+)
+
+// Clock tells the handlers the time and waits out their retry backoffs.
+// A simulation replaces it to run requests in virtual time.
+type Clock interface {
+	Now() time.Time
+	// Sleep waits for d, or returns the error of ctx once it is done.
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+// realClock is the Clock of the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
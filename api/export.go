@@ -0,0 +1,347 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"main/model"
+	"main/storage"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// exportColumns are the CSV columns of an export, in order: the fields of
+// model.AccountResponse.
+var exportColumns = []string{"account_id", "balance", "currency", "status", "version", "created_at", "updated_at", "owner"}
+
+// defaultImportChunkSize is how many rows an import creates per
+// transaction unless chunk_size says otherwise.
+const defaultImportChunkSize = 1000
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// Export handles GET requests that stream every account in key order, as
+// NDJSON with one AccountResponse per line, or as CSV with exportColumns
+// for a header if format=csv. The accounts are read in one read-only
+// transaction, at snapshot isolation if the storage supports it and
+// otherwise at serializable isolation. An export that a transfer committed
+// into halfway then fails its commit: with 409 if none of it was sent yet,
+// and otherwise by aborting the response.
+// Response: the accounts, or error
+func (h *AccountHandlers) Export(rw http.ResponseWriter, r *http.Request) {
+	out := &countingWriter{w: rw}
+	w := bufio.NewWriter(out)
+	var write func(model.AccountResponse) error
+	flush := w.Flush
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "ndjson":
+		rw.Header().Set("Content-Type", "application/x-ndjson")
+		encoder := json.NewEncoder(w)
+		write = func(account model.AccountResponse) error { return encoder.Encode(account) }
+	case "csv":
+		rw.Header().Set("Content-Type", "text/csv")
+		cw := csv.NewWriter(w)
+		cw.Write(exportColumns)
+		write = func(account model.AccountResponse) error {
+			return cw.Write([]string{
+				strconv.FormatUint(account.AccountId, 10),
+				account.Balance,
+				account.Currency,
+				account.Status,
+				strconv.FormatUint(account.Version, 10),
+				account.CreatedAt.Format(time.RFC3339Nano),
+				account.UpdatedAt.Format(time.RFC3339Nano),
+				account.Owner,
+			})
+		}
+		flush = func() error {
+			cw.Flush()
+			if err := cw.Error(); err != nil {
+				return err
+			}
+			return w.Flush()
+		}
+	default:
+		http.Error(rw, fmt.Sprintf("Unknown export format %q: want 'ndjson' or 'csv'", format), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.storage.Begin(r.Context(), storage.TxOptions{ReadOnly: true, Isolation: storage.Snapshot})
+	if errors.Is(err, storage.ErrUnsupportedTxOptions) {
+		tx, err = h.storage.Begin(r.Context(), storage.TxOptions{ReadOnly: true, Isolation: storage.Serializable})
+	}
+	if err != nil {
+		writeBeginError(rw, err)
+		return
+	}
+	defer tx.Rollback()
+
+	exported := 0
+	var writeErr error
+	err = tx.Scan(storage.KeyRange{}, func(key storage.Key, account storage.Value) bool {
+		if writeErr = write(accountResponse(key, account)); writeErr != nil {
+			return false
+		}
+		exported++
+		return true
+	})
+	if err == nil {
+		err = writeErr
+	}
+	// Committed before the rest of the export is flushed, so that an
+	// export that saw a transfer halfway is not sent in full.
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		if out.n == 0 {
+			writeCommitError(rw, err)
+			return
+		}
+		// Part of the export has been sent with a 200 status; abort the
+		// response so that the client sees it is incomplete.
+		slog.Error("Export failed", "exported", exported, "error", err)
+		panic(http.ErrAbortHandler)
+	}
+	slog.Info("Exported accounts", "accounts", exported)
+}
+
+// importRow is an account to create, from the row of an import file that
+// starts on line.
+type importRow struct {
+	line    int
+	id      uint64
+	account storage.Account
+}
+
+// errImportHeader is returned for a CSV import without the columns it
+// needs.
+var errImportHeader = errors.New("CSV header must name the account_id and balance columns")
+
+// rowReader returns the rows of an import file one at a time: the line
+// each starts on and the request it makes. It fails with a rowError for a
+// row that cannot be parsed, and returns io.EOF at the end of the file.
+type rowReader func() (line int, req model.AccountRequest, err error)
+
+// rowError reports a row of an import file that cannot be parsed; the
+// import carries on with the next row.
+type rowError struct {
+	msg string
+}
+
+func (e rowError) Error() string { return e.msg }
+
+// exportRecord holds the fields of an NDJSON export that an import reads.
+type exportRecord struct {
+	AccountId uint64 `json:"account_id"`
+	Balance   string `json:"balance"`
+	Currency  string `json:"currency"`
+	Owner     string `json:"owner"`
+}
+
+func ndjsonRows(r io.Reader) rowReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	line := 0
+	return func() (int, model.AccountRequest, error) {
+		for scanner.Scan() {
+			line++
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			var record exportRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				return line, model.AccountRequest{}, rowError{fmt.Sprintf("Invalid row: %s", err)}
+			}
+			return line, model.AccountRequest{AccountId: record.AccountId, InitialBalance: record.Balance, Currency: record.Currency, Owner: record.Owner}, nil
+		}
+		if err := scanner.Err(); err != nil {
+			return line, model.AccountRequest{}, err
+		}
+		return line, model.AccountRequest{}, io.EOF
+	}
+}
+
+func csvRows(r io.Reader) (rowReader, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, errImportHeader
+	}
+	id, balance := slices.Index(header, "account_id"), slices.Index(header, "balance")
+	currency, owner := slices.Index(header, "currency"), slices.Index(header, "owner")
+	if id < 0 || balance < 0 {
+		return nil, errImportHeader
+	}
+	field := func(record []string, i int) string {
+		if i < 0 || i >= len(record) {
+			return ""
+		}
+		return record[i]
+	}
+	return func() (int, model.AccountRequest, error) {
+		record, err := reader.Read()
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return parseErr.StartLine, model.AccountRequest{}, rowError{fmt.Sprintf("Invalid row: %s", err)}
+		}
+		if err != nil {
+			return 0, model.AccountRequest{}, err
+		}
+		line, _ := reader.FieldPos(0)
+		accountID, err := strconv.ParseUint(field(record, id), 10, 64)
+		if err != nil {
+			return line, model.AccountRequest{}, rowError{"Invalid account ID"}
+		}
+		return line, model.AccountRequest{AccountId: accountID, InitialBalance: field(record, balance), Currency: field(record, currency), Owner: field(record, owner)}, nil
+	}, nil
+}
+
+// Import handles POST requests that create the accounts of a file in the
+// format Export writes: NDJSON, or CSV if format=csv. Each row is taken as
+// a CreateAccount request for its account_id, balance, currency and owner,
+// and validated by the same rules; the other fields are ignored, so every
+// account is created active at version 1. Rows are created chunk_size at a
+// time (1000 by default), each chunk in one transaction, so an import
+// that stops part-way leaves whole chunks behind.
+// Response: NDJSON, with an ImportRowError for every row that was not
+// created, then an ImportSummary
+func (h *AccountHandlers) Import(rw http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	chunkSize := defaultImportChunkSize
+	if value := r.URL.Query().Get("chunk_size"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size <= 0 {
+			http.Error(rw, "Invalid chunk size", http.StatusBadRequest)
+			return
+		}
+		chunkSize = size
+	}
+	var next rowReader
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "ndjson":
+		next = ndjsonRows(r.Body)
+	case "csv":
+		var err error
+		if next, err = csvRows(r.Body); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(rw, fmt.Sprintf("Unknown import format %q: want 'ndjson' or 'csv'", format), http.StatusBadRequest)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(rw)
+	var summary model.ImportSummary
+	reject := func(rejected model.ImportRowError) {
+		summary.Failed++
+		encoder.Encode(rejected)
+	}
+	now := h.now()
+	chunk := make([]importRow, 0, chunkSize)
+	createChunk := func() error {
+		rejected, err := h.importChunk(r.Context(), chunk)
+		if err != nil {
+			return fmt.Errorf("import stopped at line %d: %w", chunk[0].line, err)
+		}
+		for _, row := range rejected {
+			reject(row)
+		}
+		summary.Created += len(chunk) - len(rejected)
+		chunk = chunk[:0]
+		return nil
+	}
+	err := func() error {
+		for {
+			line, req, err := next()
+			if err == io.EOF {
+				break
+			}
+			var invalid rowError
+			if errors.As(err, &invalid) {
+				reject(model.ImportRowError{Line: line, Error: invalid.msg})
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			account, err := h.newAccount(req, now)
+			if err != nil {
+				reject(model.ImportRowError{Line: line, AccountId: req.AccountId, Error: err.Error()})
+				continue
+			}
+			chunk = append(chunk, importRow{line: line, id: req.AccountId, account: account})
+			if len(chunk) == chunkSize {
+				if err := createChunk(); err != nil {
+					return err
+				}
+			}
+		}
+		if len(chunk) > 0 {
+			return createChunk()
+		}
+		return nil
+	}()
+	if err != nil {
+		summary.Error = err.Error()
+	}
+	slog.Info("Imported accounts", "created", summary.Created, "failed", summary.Failed, "error", summary.Error)
+	encoder.Encode(summary)
+}
+
+// importChunk creates the accounts of rows in one transaction, and returns
+// the rows that were left out because they were invalid or their account
+// already existed. It is run again while it conflicts with concurrent
+// transactions.
+func (h *AccountHandlers) importChunk(ctx context.Context, rows []importRow) ([]model.ImportRowError, error) {
+	var rejected []model.ImportRowError
+	err := h.retryConflicts(ctx, func() error {
+		rejected = rejected[:0]
+		tx, err := h.storage.Begin(ctx, storage.TxOptions{})
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		for _, row := range rows {
+			err := tx.Insert(row.id, row.account)
+			if errors.Is(err, storage.ErrInvalidAccount) || errors.Is(err, storage.ErrKeyExists) {
+				rejected = append(rejected, model.ImportRowError{Line: row.line, AccountId: row.id, Error: err.Error()})
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		err = tx.Commit()
+		if errors.Is(err, storage.ErrKeyExists) {
+			// A concurrent request created one of the accounts; the next
+			// attempt leaves it out.
+			return fmt.Errorf("%w: %w", storage.ErrConflict, err)
+		}
+		return err
+	})
+	return rejected, err
+}
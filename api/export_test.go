@@ -0,0 +1,191 @@
+package api_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"main/api"
+	"main/model"
+	"main/storage"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// importReport splits the report of an import into its row errors and its
+// summary.
+func importReport(t *testing.T, body string) ([]model.ImportRowError, model.ImportSummary) {
+	t.Helper()
+	var rows []model.ImportRowError
+	var summary model.ImportSummary
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		if strings.Contains(scanner.Text(), `"created"`) {
+			json.Unmarshal(scanner.Bytes(), &summary)
+			continue
+		}
+		var row model.ImportRowError
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			t.Fatalf("Unexpected report line %q", scanner.Text())
+		}
+		rows = append(rows, row)
+	}
+	return rows, summary
+}
+
+func TestExportImport_RoundTrips(t *testing.T) {
+	for _, format := range []string{"ndjson", "csv"} {
+		t.Run(format, func(t *testing.T) {
+			source := newMockStorage()
+			tx := begin(source)
+			for id, balance := range map[uint64]string{1: "10", 2: "0.5", 3: "1234567.89"} {
+				account := seedAccount(balance)
+				account.Owner = "owner, \"quoted\""
+				tx.Insert(id, account)
+			}
+			tx.Commit()
+
+			rr := httptest.NewRecorder()
+			api.NewAccountHandlers(source).Export(rr, httptest.NewRequest("GET", "/export?format="+format, nil))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body.String())
+			}
+
+			destination := newMockStorage()
+			imported := httptest.NewRecorder()
+			api.NewAccountHandlers(destination).Import(imported, httptest.NewRequest("POST", "/import?chunk_size=2&format="+format, rr.Body))
+			rows, summary := importReport(t, imported.Body.String())
+			if len(rows) != 0 || summary.Created != 3 || summary.Error != "" {
+				t.Fatalf("Expected 3 accounts created, got %v, %+v", rows, summary)
+			}
+			for _, id := range []uint64{1, 2, 3} {
+				want, _ := source.Get(context.Background(), id)
+				got, err := destination.Get(context.Background(), id)
+				if err != nil || got.Balance.Cmp(want.Balance) != 0 || got.Owner != want.Owner || got.Currency != want.Currency {
+					t.Errorf("Expected account %d to be %+v, got %+v, %v", id, want, got, err)
+				}
+			}
+		})
+	}
+}
+
+func TestImport_ReportsRowErrors(t *testing.T) {
+	mockStorage := newMockStorage()
+	tx := begin(mockStorage)
+	tx.Insert(2, seedAccount("1"))
+	tx.Commit()
+
+	body := strings.Join([]string{
+		`{"account_id":1,"balance":"10"}`,
+		`{"account_id":2,"balance":"10"}`,
+		`{"account_id":3,"balance":"-5"}`,
+		`not json`,
+		``,
+		`{"account_id":4,"balance":"10","currency":"euro"}`,
+		`{"account_id":5,"balance":"10"}`,
+	}, "\n")
+	rr := httptest.NewRecorder()
+	api.NewAccountHandlers(mockStorage).Import(rr, httptest.NewRequest("POST", "/import?chunk_size=2", strings.NewReader(body)))
+
+	rows, summary := importReport(t, rr.Body.String())
+	if summary.Created != 2 || summary.Failed != 4 || summary.Error != "" {
+		t.Errorf("Expected 2 accounts created and 4 failed, got %+v", summary)
+	}
+	lines := map[int]bool{}
+	for _, row := range rows {
+		lines[row.Line] = true
+	}
+	for _, line := range []int{2, 3, 4, 6} {
+		if !lines[line] {
+			t.Errorf("Expected an error for line %d, got %v", line, rows)
+		}
+	}
+	for _, id := range []uint64{1, 5} {
+		if _, err := mockStorage.Get(context.Background(), id); err != nil {
+			t.Errorf("Expected account %d to be created, got %v", id, err)
+		}
+	}
+	if account, _ := mockStorage.Get(context.Background(), 2); account.Balance.String() != seedAccount("1").Balance.String() {
+		t.Errorf("Expected the existing account to be kept, got %s", account.Balance)
+	}
+}
+
+func TestImport_CSV(t *testing.T) {
+	mockStorage := newMockStorage()
+	handlers := api.NewAccountHandlers(mockStorage)
+
+	rr := httptest.NewRecorder()
+	handlers.Import(rr, httptest.NewRequest("POST", "/import?format=csv", strings.NewReader("id,amount\n1,10\n")))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without account_id and balance columns, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	handlers.Import(rr, httptest.NewRequest("POST", "/import?format=csv", strings.NewReader("balance,account_id\n10,1\nabc,2\n5,x\n")))
+	rows, summary := importReport(t, rr.Body.String())
+	if summary.Created != 1 || len(rows) != 2 || rows[0].Line != 3 || rows[1].Line != 4 {
+		t.Errorf("Expected line 2 created and lines 3 and 4 rejected, got %v, %+v", rows, summary)
+	}
+
+	rr = httptest.NewRecorder()
+	handlers.Import(rr, httptest.NewRequest("POST", "/import?format=csv", strings.NewReader("balance,account_id\n\"unterminated,7\n")))
+	rows, summary = importReport(t, rr.Body.String())
+	if len(rows) != 1 || rows[0].Line != 2 || summary.Created != 0 {
+		t.Errorf("Expected a parse error on line 2, got %v, %+v", rows, summary)
+	}
+}
+
+// transferDuringScan is a storage whose transactions commit a transfer
+// from account 1 to account 2 as soon as a scan has visited account 1.
+type transferDuringScan struct {
+	storage.Storage
+}
+
+func (s transferDuringScan) Begin(ctx context.Context, opts storage.TxOptions) (storage.StorageTransaction, error) {
+	tx, err := s.Storage.Begin(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return transferDuringScanTransaction{tx, s.Storage}, nil
+}
+
+type transferDuringScanTransaction struct {
+	storage.StorageTransaction
+	storage storage.Storage
+}
+
+func (tx transferDuringScanTransaction) Scan(r storage.KeyRange, fn func(key storage.Key, value storage.Value) bool) error {
+	return tx.StorageTransaction.Scan(r, func(key storage.Key, value storage.Value) bool {
+		more := fn(key, value)
+		if key == 1 {
+			var batch storage.Batch
+			batch.Set(1, seedAccount("90"))
+			batch.Set(2, seedAccount("10"))
+			if err := tx.storage.WriteBatch(context.Background(), batch); err != nil {
+				panic(err)
+			}
+		}
+		return more
+	})
+}
+
+func TestExport_ConflictsWithATransferHalfway(t *testing.T) {
+	// Bitcask has no snapshots, so the export is read at serializable
+	// isolation, which the transfer fails.
+	db, err := storage.NewBitcaskStorage(t.TempDir(), storage.BitcaskOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tx := begin(db)
+	tx.Insert(1, seedAccount("100"))
+	tx.Insert(2, seedAccount("0"))
+	tx.Commit()
+
+	rr := httptest.NewRecorder()
+	api.NewAccountHandlers(transferDuringScan{db}).Export(rr, httptest.NewRequest("GET", "/export", nil))
+	if rr.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
@@ -1,37 +1,77 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io" // Added for transaction logging
 	"main/model"
+	"main/money"
 	"main/storage"
-	"math/big"
-	"sync"
+	"math/rand/v2"
 
 	"net/http"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux" // Using mux for more advanced routing, especially for path variables
 )
 
-const PRECISION uint = 64
-
-var SPRINTF_FORMAT = "%.19f"
-
 // AccountHandlers provides HTTP handlers for account-related operations.
+// They take no locks of their own: concurrent requests are kept apart by
+// the storage transactions and their conditional writes.
 type AccountHandlers struct {
 	storage storage.Storage
-	lock    sync.RWMutex
+	clock   Clock
+	scale   int
+	// randomLock guards random, which is not safe for concurrent use.
+	randomLock sync.Mutex
+	random     *rand.Rand
+}
+
+// Options configures AccountHandlers. The zero Options gives the real
+// clock and a randomly seeded source.
+type Options struct {
+	// Clock stamps accounts and times retry backoffs.
+	Clock Clock
+	// Rand draws the jitter of retry backoffs.
+	Rand *rand.Rand
+	// Scale is the number of fractional digits amounts and initial
+	// balances may have, from 1 to money.DefaultScale; 0 means
+	// money.DefaultScale. Balances are stored at money.DefaultScale
+	// whatever the scale, so it can change between restarts.
+	Scale int
 }
 
 // NewAccountHandlers creates and returns a new AccountHandlers instance.
 func NewAccountHandlers(s storage.Storage) *AccountHandlers {
-	return &AccountHandlers{storage: s}
+	return NewAccountHandlersWithOptions(s, Options{})
+}
+
+// NewAccountHandlersWithOptions returns handlers that take their time and
+// randomness from options, so that a simulation can replay them exactly.
+func NewAccountHandlersWithOptions(s storage.Storage, options Options) *AccountHandlers {
+	if options.Clock == nil {
+		options.Clock = realClock{}
+	}
+	if options.Rand == nil {
+		options.Rand = rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+	}
+	if options.Scale == 0 {
+		options.Scale = money.DefaultScale
+	}
+	return &AccountHandlers{storage: s, clock: options.Clock, random: options.Rand, scale: options.Scale}
+}
+
+// now returns the current time of the handlers' clock, in UTC.
+func (h *AccountHandlers) now() time.Time {
+	return h.clock.Now().UTC()
 }
 
 // CreateAccount handles POST requests to create a new account.
-// Request Body: {"account_id": 123, "initial_balance": "100.23"}
+// Request Body: {"account_id": 123, "initial_balance": "100.23", "currency": "USD", "owner": "alice"}
 // Response: Empty or error
 func (h *AccountHandlers) CreateAccount(rw http.ResponseWriter, r *http.Request) {
 	body, err := io.ReadAll(r.Body)
@@ -47,30 +87,64 @@ func (h *AccountHandlers) CreateAccount(rw http.ResponseWriter, r *http.Request)
 		http.Error(rw, "Invalid request body format", http.StatusBadRequest)
 		return
 	}
-	initialBalanceFloat, _, err := big.ParseFloat(req.InitialBalance, 10, PRECISION, big.ToNearestEven)
-	if initialBalanceFloat.Cmp(big.NewFloat(0.0)) < 0 || err != nil {
-		http.Error(rw, "Invalid Initial Balance", http.StatusBadRequest)
+	account, err := h.newAccount(req, h.now())
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	initialBalanceStr := fmt.Sprintf(SPRINTF_FORMAT, initialBalanceFloat)
-
-	h.lock.Lock()
-	defer h.lock.Unlock()
-	tx := h.storage.Begin()
+	tx, err := h.storage.Begin(r.Context(), storage.TxOptions{})
+	if err != nil {
+		writeBeginError(rw, err)
+		return
+	}
 	defer tx.Rollback()
-	err = tx.Set(req.AccountId, initialBalanceStr)
+	err = tx.Insert(req.AccountId, account)
+	if errors.Is(err, storage.ErrInvalidAccount) {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, storage.ErrKeyExists) {
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	}
+	if isRetryable(err) {
+		writeCommitError(rw, err)
+		return
+	}
 	if err != nil {
-		http.Error(rw, err.Error(), http.StatusConflict) // Using StatusConflict for existing account
+		http.Error(rw, fmt.Sprintf("Failed to create account: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		writeCommitError(rw, err)
 		return
 	}
-	tx.Commit()
 
 	rw.WriteHeader(http.StatusOK)
 }
 
+// newAccount returns the account that req creates at now. The backend
+// validates the rest of the account, failing Insert with ErrInvalidAccount.
+func (h *AccountHandlers) newAccount(req model.AccountRequest, now time.Time) (storage.Account, error) {
+	initialBalance, err := money.ParseScale(req.InitialBalance, h.scale)
+	if err != nil || initialBalance.Sign() < 0 {
+		return storage.Account{}, errors.New("Invalid Initial Balance")
+	}
+	return storage.Account{
+		Balance:   initialBalance,
+		Currency:  req.Currency,
+		Status:    storage.StatusActive,
+		Version:   1,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Owner:     req.Owner,
+	}, nil
+}
+
 // GetAccount handles GET requests to retrieve account details.
-// Response: {"account_id": 123, "balance": "100.23"} or error
+// Response: {"account_id": 123, "balance": "100.23", "currency": "USD", "status": "active", "version": 1,
+// "created_at": "2025-11-12T03:04:21Z", "updated_at": "2025-11-12T03:04:21Z", "owner": "alice"} or error
 func (h *AccountHandlers) GetAccount(rw http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	accountIDStr := vars["account_id"]
@@ -80,21 +154,31 @@ func (h *AccountHandlers) GetAccount(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	h.lock.RLock()
-	defer h.lock.RUnlock()
-	balance, err := h.storage.Get(accountID)
+	account, err := h.storage.Get(r.Context(), accountID)
+	if isContextError(err) {
+		writeContextError(rw, err)
+		return
+	}
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	resp := model.AccountResponse{
-		AccountId: accountID,
-		Balance:   balance,
-	}
-
 	rw.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(rw).Encode(resp)
+	json.NewEncoder(rw).Encode(accountResponse(accountID, account))
+}
+
+func accountResponse(id uint64, account storage.Account) model.AccountResponse {
+	return model.AccountResponse{
+		AccountId: id,
+		Balance:   account.Balance.String(),
+		Currency:  account.Currency,
+		Status:    string(account.Status),
+		Version:   account.Version,
+		CreatedAt: account.CreatedAt,
+		UpdatedAt: account.UpdatedAt,
+		Owner:     account.Owner,
+	}
 }
 
 // SubmitTransaction handles POST requests to process transactions.
@@ -115,8 +199,8 @@ func (h *AccountHandlers) SubmitTransaction(rw http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	amountFloat, _, err := big.ParseFloat(req.Amount, 10, PRECISION, big.ToNearestEven)
-	if err != nil || amountFloat.Cmp(big.NewFloat(0.0)) <= 0 {
+	amount, err := money.ParseScale(req.Amount, h.scale)
+	if err != nil || amount.Sign() <= 0 {
 		http.Error(rw, "Invalid transaction amount", http.StatusBadRequest)
 		return
 	}
@@ -126,46 +210,169 @@ func (h *AccountHandlers) SubmitTransaction(rw http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	h.lock.Lock()
-	defer h.lock.Unlock()
-	sourceBalance, err := h.storage.Get(req.SourceAccountId)
+	err = h.retryConflicts(r.Context(), func() error {
+		return h.transfer(r.Context(), req, amount)
+	})
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		http.Error(rw, reqErr.Error(), reqErr.status)
+		return
+	}
 	if err != nil {
-		http.Error(rw, fmt.Sprintf("Source account not found: %s", err.Error()), http.StatusNotFound)
+		writeCommitError(rw, err)
 		return
 	}
 
-	destinationBalance, err := h.storage.Get(req.DestinationAccountId)
+	rw.WriteHeader(http.StatusOK)
+}
+
+// requestError is an error that is reported to the client as it is, with
+// its own status code.
+type requestError struct {
+	status int
+	msg    string
+}
+
+func (e *requestError) Error() string { return e.msg }
+
+// transfer moves amount between the accounts of req in one transaction.
+// Both accounts are updated with CompareAndSet against the values the
+// transfer was computed from, so a concurrent update to either makes it
+// fail with ErrCompareFailed or ErrConflict rather than be lost. Errors
+// that are not for h.retryConflicts or writeCommitError are requestErrors.
+func (h *AccountHandlers) transfer(ctx context.Context, req model.TransactionRequest, amount money.Amount) error {
+	tx, err := h.storage.Begin(ctx, storage.TxOptions{})
+	if err != nil {
+		if isContextError(err) {
+			return err
+		}
+		return &requestError{http.StatusInternalServerError, fmt.Sprintf("Failed to begin transaction: %s", err.Error())}
+	}
+	defer tx.Rollback()
+	source, err := tx.Get(req.SourceAccountId)
+	if isRetryable(err) {
+		return err
+	}
+	if err != nil {
+		return &requestError{http.StatusNotFound, fmt.Sprintf("Source account not found: %s", err.Error())}
+	}
+
+	destination, err := tx.Get(req.DestinationAccountId)
+	if isRetryable(err) {
+		return err
+	}
 	if err != nil {
-		http.Error(rw, fmt.Sprintf("Destination account not found: %s", err.Error()), http.StatusNotFound)
-		return
+		return &requestError{http.StatusNotFound, fmt.Sprintf("Destination account not found: %s", err.Error())}
 	}
 
-	sourceBalanceAmount, _, err := big.ParseFloat(sourceBalance, 10, PRECISION, big.ToNearestEven)
-	destinationBalanceAmount, _, err := big.ParseFloat(destinationBalance, 10, PRECISION, big.ToNearestEven)
+	if source.Status != storage.StatusActive || destination.Status != storage.StatusActive {
+		return &requestError{http.StatusBadRequest, "Source and destination accounts must be active"}
+	}
 
-	if sourceBalanceAmount.Cmp(amountFloat) < 0 {
-		err = fmt.Errorf("insufficient funds in source account")
-		http.Error(rw, err.Error(), http.StatusBadRequest)
-		return
+	if source.Currency != destination.Currency {
+		return &requestError{http.StatusBadRequest, "Source and destination accounts must have the same currency"}
 	}
 
-	newSourceBalance := sourceBalanceAmount.Sub(sourceBalanceAmount, amountFloat)
-	newDestinationBalance := destinationBalanceAmount.Add(destinationBalanceAmount, amountFloat)
+	if source.Balance.Cmp(amount) < 0 {
+		return &requestError{http.StatusBadRequest, "insufficient funds in source account"}
+	}
 
-	tx := h.storage.Begin()
-	defer tx.Rollback()
-	err = tx.Set(req.SourceAccountId, fmt.Sprintf(SPRINTF_FORMAT, newSourceBalance))
+	now := h.now()
+	newSource, newDestination := source, destination
+	newSource.Balance = source.Balance.Sub(amount)
+	newSource.Version++
+	newSource.UpdatedAt = now
+	newDestination.Balance = destination.Balance.Add(amount)
+	newDestination.Version++
+	newDestination.UpdatedAt = now
+
+	err = tx.CompareAndSet(req.SourceAccountId, source, newSource)
+	if isRetryable(err) {
+		return err
+	}
 	if err != nil {
-		http.Error(rw, fmt.Sprintf("Failed to update source account balance: %s", err.Error()), http.StatusInternalServerError)
-		return
+		return &requestError{http.StatusInternalServerError, fmt.Sprintf("Failed to update source account balance: %s", err.Error())}
 	}
 
-	err = tx.Set(req.DestinationAccountId, fmt.Sprintf(SPRINTF_FORMAT, newDestinationBalance))
+	err = tx.CompareAndSet(req.DestinationAccountId, destination, newDestination)
+	if isRetryable(err) {
+		return err
+	}
 	if err != nil {
-		http.Error(rw, fmt.Sprintf("Failed to update destination account balance: %s", err.Error()), http.StatusInternalServerError)
+		return &requestError{http.StatusInternalServerError, fmt.Sprintf("Failed to update destination account balance: %s", err.Error())}
+	}
+	return tx.Commit()
+}
+
+// maxAttempts bounds how often retryConflicts runs an operation. The
+// backoff between attempts starts at minRetryBackoff and doubles up to
+// maxRetryBackoff.
+const (
+	maxAttempts     = 100
+	minRetryBackoff = time.Millisecond
+	maxRetryBackoff = 50 * time.Millisecond
+)
+
+// retryConflicts runs op until it does not fail with ErrConflict or
+// ErrCompareFailed, which mean that a concurrent request changed the same
+// accounts first, sleeping a jittered, growing backoff between attempts.
+func (h *AccountHandlers) retryConflicts(ctx context.Context, op func() error) error {
+	backoff := minRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if !isConflict(err) || attempt == maxAttempts {
+			return err
+		}
+		h.randomLock.Lock()
+		delay := time.Duration(h.random.Int64N(int64(backoff))) + 1
+		h.randomLock.Unlock()
+		if err := h.clock.Sleep(ctx, delay); err != nil {
+			return err
+		}
+		backoff = min(2*backoff, maxRetryBackoff)
+	}
+}
+
+func isConflict(err error) bool {
+	return errors.Is(err, storage.ErrConflict) || errors.Is(err, storage.ErrCompareFailed)
+}
+
+// writeCommitError reports a failed Commit, or a transaction that storage
+// aborted part-way. Conflicts with concurrent transactions are the
+// client's to retry, anything else is a server error.
+func writeCommitError(rw http.ResponseWriter, err error) {
+	if isContextError(err) {
+		writeContextError(rw, err)
+		return
+	}
+	if isConflict(err) {
+		http.Error(rw, fmt.Sprintf("Transaction conflict, please retry: %s", err.Error()), http.StatusConflict)
 		return
 	}
-	tx.Commit()
+	http.Error(rw, fmt.Sprintf("Failed to commit transaction: %s", err.Error()), http.StatusInternalServerError)
+}
 
-	rw.WriteHeader(http.StatusOK)
+// writeBeginError reports a transaction that could not be started.
+func writeBeginError(rw http.ResponseWriter, err error) {
+	if isContextError(err) {
+		writeContextError(rw, err)
+		return
+	}
+	http.Error(rw, fmt.Sprintf("Failed to begin transaction: %s", err.Error()), http.StatusInternalServerError)
+}
+
+// isRetryable reports whether err means the request can be retried as it
+// is: it conflicted with a concurrent transaction, or ran out of time.
+func isRetryable(err error) bool {
+	return isConflict(err) || isContextError(err)
+}
+
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// writeContextError reports a request that was cancelled by the client or
+// ran past the server's request timeout before storage finished with it.
+func writeContextError(rw http.ResponseWriter, err error) {
+	http.Error(rw, fmt.Sprintf("Request cancelled or timed out: %s", err.Error()), http.StatusServiceUnavailable)
 }
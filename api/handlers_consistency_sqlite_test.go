@@ -2,13 +2,12 @@ package api_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"fmt"
 	"main/api"
 	"main/model"
 	"main/storage"
 	"math"
-	"math/rand/v2"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
@@ -17,39 +16,8 @@ import (
 	// Added for potential delays
 )
 
-// FlakySqlite implements the storage.Storage interface for testing purposes.
-// It deliberately does NOT use any locks to expose race conditions.
-type FlakySqlite struct {
-	*storage.SqliteStorage
-}
-
-type FlakySqliteTransaction struct {
-	*storage.SqliteStorageTransaction
-}
-
-// NewMockSqlite creates a new MockStorage instance.
-func NewMockSqlite() *FlakySqlite {
-	return &FlakySqlite{
-		storage.NewSqliteStorage(""),
-	}
-}
-
-func (ms *FlakySqlite) Begin() storage.StorageTransaction {
-	tx := ms.SqliteStorage.Begin()
-	return &FlakySqliteTransaction{tx.(*storage.SqliteStorageTransaction)}
-}
-
-// Set sets the balance for a given account ID.
-func (mst *FlakySqliteTransaction) Set(accountID uint64, balance string) error {
-	if rand.Float64() < 0.01 {
-		// Simulate a failure 1% of the time
-		return fmt.Errorf("simulated storage failure for account %d", accountID)
-	}
-	return mst.SqliteStorageTransaction.Set(accountID, balance)
-}
-
 func TestSubmitTransaction_InconsistententBalance_Sqlite(t *testing.T) {
-	mockStorage := NewMockSqlite()
+	mockStorage := storage.NewFaultyStorage(storage.NewSqliteStorage(""), flakyWrites)
 	handlers := api.NewAccountHandlers(mockStorage)
 
 	// Create initial accounts
@@ -57,9 +25,9 @@ func TestSubmitTransaction_InconsistententBalance_Sqlite(t *testing.T) {
 	account2ID := uint64(1002)
 	initialBalance := "1000.000000000" // Use high precision string
 
-	tx := mockStorage.Begin()
-	tx.Set(account1ID, initialBalance)
-	tx.Set(account2ID, initialBalance)
+	tx := begin(mockStorage)
+	tx.Set(account1ID, seedAccount(initialBalance))
+	tx.Set(account2ID, seedAccount(initialBalance))
 	tx.Commit()
 
 	numConcurrentTransactions := 1000
@@ -97,17 +65,17 @@ func TestSubmitTransaction_InconsistententBalance_Sqlite(t *testing.T) {
 	wg.Wait()
 
 	// Verify final balances after all transactions
-	finalBalance1Str, err := mockStorage.Get(account1ID)
+	finalAccount1, err := mockStorage.Get(context.Background(), account1ID)
 	if err != nil {
 		t.Fatalf("Failed to get final balance for account %d: %v", account1ID, err)
 	}
-	finalBalance2Str, err := mockStorage.Get(account2ID)
+	finalAccount2, err := mockStorage.Get(context.Background(), account2ID)
 	if err != nil {
 		t.Fatalf("Failed to get final balance for account %d: %v", account2ID, err)
 	}
 
-	finalBalance1Float, _ := strconv.ParseFloat(finalBalance1Str, 64)
-	finalBalance2Float, _ := strconv.ParseFloat(finalBalance2Str, 64)
+	finalBalance1Float, _ := strconv.ParseFloat(finalAccount1.Balance.String(), 64)
+	finalBalance2Float, _ := strconv.ParseFloat(finalAccount2.Balance.String(), 64)
 
 	t.Logf("Initial balance (Account 1): %s", initialBalance)
 	t.Logf("Initial balance (Account 2): %s", initialBalance)
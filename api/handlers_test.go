@@ -2,9 +2,11 @@ package api_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"main/api"
 	"main/model"
+	"main/money"
 	"main/storage"
 	"math"
 	"net/http"
@@ -28,6 +30,27 @@ func newMockStorage() *mockStorage {
 	}
 }
 
+// seedAccount returns an active account holding balance, for test setup.
+func seedAccount(balance string) storage.Account {
+	amount, _ := money.Parse(balance)
+	return storage.Account{Balance: amount}
+}
+
+// begin starts a default transaction, for test setup.
+func begin(s storage.Storage) storage.StorageTransaction {
+	tx, err := s.Begin(context.Background(), storage.TxOptions{})
+	if err != nil {
+		panic(err)
+	}
+	return tx
+}
+
+// flakyWrites fails 1% of the writes made in transactions.
+var flakyWrites = storage.FaultOptions{
+	ErrorRates: map[string]float64{storage.OpTxSet: 0.01, storage.OpTxCompareAndSet: 0.01},
+	Seed:       1,
+}
+
 // TestSubmitTransaction_RaceCondition tests for race conditions in SubmitTransaction.
 // This test is designed to be run with the Go race detector: `go test -race ./...`
 func TestSubmitTransaction_RaceCondition(t *testing.T) {
@@ -40,9 +63,9 @@ func TestSubmitTransaction_RaceCondition(t *testing.T) {
 	account2ID := uint64(1002)
 	initialBalance := "1000.000000000" // Use high precision string
 
-	tx := mockStorage.Begin()
-	tx.Set(account1ID, initialBalance)
-	tx.Set(account2ID, initialBalance)
+	tx := begin(mockStorage)
+	tx.Set(account1ID, seedAccount(initialBalance))
+	tx.Set(account2ID, seedAccount(initialBalance))
 	tx.Commit()
 
 	numConcurrentTransactions := 1000
@@ -80,17 +103,17 @@ func TestSubmitTransaction_RaceCondition(t *testing.T) {
 	wg.Wait()
 
 	// Verify final balances after all transactions
-	finalBalance1Str, err := mockStorage.Get(account1ID)
+	finalAccount1, err := mockStorage.Get(context.Background(), account1ID)
 	if err != nil {
 		t.Fatalf("Failed to get final balance for account %d: %v", account1ID, err)
 	}
-	finalBalance2Str, err := mockStorage.Get(account2ID)
+	finalAccount2, err := mockStorage.Get(context.Background(), account2ID)
 	if err != nil {
 		t.Fatalf("Failed to get final balance for account %d: %v", account2ID, err)
 	}
 
-	finalBalance1Float, _ := strconv.ParseFloat(finalBalance1Str, 64)
-	finalBalance2Float, _ := strconv.ParseFloat(finalBalance2Str, 64)
+	finalBalance1Float, _ := strconv.ParseFloat(finalAccount1.Balance.String(), 64)
+	finalBalance2Float, _ := strconv.ParseFloat(finalAccount2.Balance.String(), 64)
 
 	expectedFinalBalance1 := 0.0
 	expectedFinalBalance2 := 2000.0
@@ -114,3 +137,70 @@ func TestSubmitTransaction_RaceCondition(t *testing.T) {
 			account2ID, expectedFinalBalance2, finalBalance2Float)
 	}
 }
+
+func TestSubmitTransaction_CancelledRequest(t *testing.T) {
+	mockStorage := newMockStorage()
+	handlers := api.NewAccountHandlers(mockStorage)
+	tx := begin(mockStorage)
+	tx.Set(1, seedAccount("10"))
+	tx.Set(2, seedAccount("10"))
+	tx.Commit()
+
+	body, _ := json.Marshal(model.TransactionRequest{SourceAccountId: 1, DestinationAccountId: 2, Amount: "1"})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest("POST", "/transactions", bytes.NewReader(body)).WithContext(ctx)
+	rr := httptest.NewRecorder()
+	handlers.SubmitTransaction(rr, req)
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 for a cancelled request, got %d: %s", rr.Code, rr.Body.String())
+	}
+	account, _ := mockStorage.Get(context.Background(), 1)
+	if account.Balance.String() != "10.0000000000000000000" {
+		t.Errorf("Expected the cancelled transfer not to move money, got %s", account.Balance)
+	}
+}
+
+func TestCreateAccount_DuplicateIsRejected(t *testing.T) {
+	mockStorage := newMockStorage()
+	handlers := api.NewAccountHandlers(mockStorage)
+	tx := begin(mockStorage)
+	tx.Set(1, seedAccount("10"))
+	tx.Commit()
+
+	body, _ := json.Marshal(model.AccountRequest{AccountId: 1, InitialBalance: "500"})
+	rr := httptest.NewRecorder()
+	handlers.CreateAccount(rr, httptest.NewRequest("POST", "/accounts", bytes.NewReader(body)))
+
+	if rr.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 for an existing account, got %d: %s", rr.Code, rr.Body.String())
+	}
+	account, _ := mockStorage.Get(context.Background(), 1)
+	if account.Balance.String() != "10.0000000000000000000" {
+		t.Errorf("Expected the existing balance to be kept, got %s", account.Balance)
+	}
+}
+
+func TestSubmitTransaction_ScaleLimitsAmountsOnly(t *testing.T) {
+	mockStorage := newMockStorage()
+	tx := begin(mockStorage)
+	// Written by a server that accepted all 19 digits.
+	tx.Set(1, seedAccount("10.0000000000000000001"))
+	tx.Set(2, seedAccount("10"))
+	tx.Commit()
+	handlers := api.NewAccountHandlersWithOptions(mockStorage, api.Options{Scale: 2})
+
+	for amount, expected := range map[string]int{"1.001": http.StatusBadRequest, "1.25": http.StatusOK} {
+		body, _ := json.Marshal(model.TransactionRequest{SourceAccountId: 1, DestinationAccountId: 2, Amount: amount})
+		rr := httptest.NewRecorder()
+		handlers.SubmitTransaction(rr, httptest.NewRequest("POST", "/transactions", bytes.NewReader(body)))
+		if rr.Code != expected {
+			t.Errorf("Expected status %d for amount %s, got %d: %s", expected, amount, rr.Code, rr.Body.String())
+		}
+	}
+	account, _ := mockStorage.Get(context.Background(), 1)
+	if account.Balance.String() != "8.7500000000000000001" {
+		t.Errorf("Expected the stored digits to be kept, got %s", account.Balance)
+	}
+}
@@ -1,39 +1,427 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"expvar"
 	"flag"
+	"fmt"
+	"io"
 	"log/slog"
 	"main/api"
+	"main/money"
+	"main/raft"
+	"main/replication"
+	"main/shard"
 	"main/storage"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
 func main() {
-	storageType := flag.String("storage", "sqlite", "Type of storage to use: 'inmemory' or 'sqlite'")
+	// The rebalance subcommand takes the same flags as the server, and
+	// moves the keys of its shards to where -shards and -shard_by put them.
+	rebalance := len(os.Args) > 1 && os.Args[1] == "rebalance"
+	if rebalance {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate(os.Args[2:]); err != nil {
+			slog.Error("Migration failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	storageType := flag.String("storage", "sqlite", "Type of storage to use: 'inmemory', 'sqlite' or 'bitcask'")
 	sqliteDBFile := flag.String("sqlite_db_file", "", "File path for SQLite database: 'store.db'; defaults to :memory: if empty or invalid path")
+	sqliteJournalMode := flag.String("sqlite_journal_mode", storage.DefaultSqliteOptions.JournalMode, "SQLite journal_mode pragma: 'WAL', 'DELETE', 'TRUNCATE', 'PERSIST', 'MEMORY' or 'OFF'")
+	sqliteSynchronous := flag.String("sqlite_synchronous", storage.DefaultSqliteOptions.Synchronous, "SQLite synchronous pragma: 'OFF', 'NORMAL', 'FULL' or 'EXTRA'")
+	sqliteBusyTimeout := flag.Duration("sqlite_busy_timeout", storage.DefaultSqliteOptions.BusyTimeout, "How long a SQLite statement waits for another connection's lock")
+	sqliteMaxOpenConns := flag.Int("sqlite_max_open_conns", storage.DefaultSqliteOptions.MaxOpenConns, "Size of the SQLite connection pool; negative for no limit")
+	sqliteMaxRetries := flag.Int("sqlite_max_retries", storage.DefaultSqliteOptions.MaxRetries, "How often a SQLite operation that fails with a busy or locked error is retried; negative disables retries")
+	sqliteRetryBackoff := flag.Duration("sqlite_retry_backoff", storage.DefaultSqliteOptions.RetryBackoff, "Delay before the first retry of a busy SQLite operation; doubles with every retry")
+	walFile := flag.String("wal_file", "", "Write-ahead log file that makes 'inmemory' storage durable; disabled if empty")
+	walSync := flag.String("wal_sync", "always", "When to fsync the write-ahead log: 'always', 'interval' or 'never'")
+	walSyncInterval := flag.Duration("wal_sync_interval", 100*time.Millisecond, "How often to fsync the write-ahead log or bitcask data file with the 'interval' sync policy")
+	snapshotDir := flag.String("snapshot_dir", "", "Directory for snapshots of 'inmemory' storage; needs -wal_file, disabled if empty")
+	snapshotInterval := flag.Duration("snapshot_interval", 5*time.Minute, "How often to snapshot 'inmemory' storage and compact its write-ahead log; 0 disables periodic snapshots")
+	bitcaskDir := flag.String("bitcask_dir", "bitcask", "Directory for 'bitcask' storage data files")
+	bitcaskSync := flag.String("bitcask_sync", "always", "When to fsync 'bitcask' data files: 'always', 'interval' or 'never'")
+	bitcaskMaxFileSize := flag.Int64("bitcask_max_file_size", 64<<20, "Size in bytes at which the active 'bitcask' data file is rotated")
+	bitcaskMergeInterval := flag.Duration("bitcask_merge_interval", 10*time.Minute, "How often to merge immutable 'bitcask' data files; 0 disables merging")
+	requestTimeout := flag.Duration("request_timeout", 30*time.Second, "Deadline for handling each request, including its storage calls; 0 disables the deadline")
+	chaos := flag.Bool("chaos", false, "Inject storage failures and latency, to rehearse failure handling; see the -chaos_* flags")
+	chaosErrorRate := flag.Float64("chaos_error_rate", 0.01, "With -chaos, probability that a storage or transaction operation other than Commit fails")
+	chaosCommitErrorRate := flag.Float64("chaos_commit_error_rate", 0.01, "With -chaos, probability that a commit fails and is rolled back")
+	chaosPartialCommitRate := flag.Float64("chaos_partial_commit_rate", 0.01, "With -chaos, probability that a commit is applied but reported as failed")
+	chaosLatency := flag.Duration("chaos_latency", 0, "With -chaos, latency added to every storage operation")
+	chaosLatencyJitter := flag.Duration("chaos_latency_jitter", 0, "With -chaos, maximum random latency added on top of -chaos_latency")
+	chaosSeed := flag.Uint64("chaos_seed", 1, "With -chaos, seed for choosing the operations that fail")
+	addr := flag.String("addr", ":8080", "Address the server listens on")
+	adminAddr := flag.String("admin_addr", "", "Address of a separate listener for /backup, /restore, /export and /import, such as 'localhost:8081'; they are not served if empty")
+	replicationPrimary := flag.Bool("replication_primary", false, "Keep a log of committed transactions for replicas to follow; commits then reach the log one at a time")
+	replicateFrom := flag.String("replicate_from", "", "URL of the primary to follow, such as 'http://localhost:8080'")
+	replicationLogSize := flag.Int("replication_log_size", replication.DefaultOptions.LogSize, "Number of committed transactions the primary keeps for replicas that fall behind")
+	raftPeers := flag.String("raft_peers", "", "Comma-separated URLs of every server of a raft cluster, such as 'http://10.0.0.1:8080,http://10.0.0.2:8080,http://10.0.0.3:8080'; the storage, which must start empty, then holds this server's copy of the accounts")
+	raftSelf := flag.String("raft_self", "", "With -raft_peers, URL the other servers reach this one at")
+	raftDir := flag.String("raft_dir", "", "With -raft_peers, directory that keeps the raft term, vote and log across restarts; in memory only if empty")
+	raftElectionTimeout := flag.Duration("raft_election_timeout", raft.DefaultOptions.ElectionTimeout, "With -raft_peers, how long a follower waits to hear from the leader before it stands for election")
+	shards := flag.Int("shards", 1, "Number of shards to spread the accounts over, each in a backend of its own")
+	shardBy := flag.String("shard_by", "hash", "How keys are mapped to shards: 'hash' or 'range'")
+	shardBounds := flag.String("shard_bounds", "", "With -shard_by range, comma-separated first keys of every shard but the first, such as '1000,2000' for 3 shards")
+	shardLogDir := flag.String("shard_log_dir", "", "With -shards, directory of the two-phase commit journals that let transactions across shards survive a crash; not kept if empty")
+	rebalanceFromShards := flag.Int("rebalance_from_shards", 1, "With the rebalance subcommand, number of shards the accounts were spread over before")
+	encryptionKeyFile := flag.String("encryption_key_file", "", "File of the AES-GCM keys that encrypt accounts at rest: balances with -storage sqlite, the write-ahead log and snapshots with -storage inmemory, the data files with -storage bitcask, and the raft log and two-phase commit journals; after adding a key, send SIGHUP to rotate to it")
+	encryptionAllowPlaintext := flag.Bool("encryption_allow_plaintext", false, "With -encryption_key_file, read accounts stored in plain text instead of rejecting them, to encrypt storage kept from before encryption was enabled; drop it once 'Re-encrypted storage' is logged")
+	metrics := flag.Bool("metrics", false, "Record storage latency, error, conflict and open-transaction metrics and serve them at /debug/vars")
+	moneyScale := flag.Int("money_scale", money.DefaultScale, "Number of fractional digits accepted in amounts and initial balances, at most 19; balances are always stored with 19")
 	flag.Parse()
+	if *moneyScale < 1 || *moneyScale > money.DefaultScale {
+		slog.Error("Invalid money scale specified", "money_scale", *moneyScale)
+		return
+	}
 
-	var s storage.Storage
-	switch *storageType {
-	case "inmemory":
-		slog.Info("Using in-memory storage")
-		s = storage.NewInMemoryStorage()
-	case "sqlite":
-		slog.Info("Using SQLite storage", "db_file", *sqliteDBFile)
-		s = storage.NewSqliteStorage(*sqliteDBFile)
-	default:
-		slog.Error("Invalid storage type specified", "storageType", *storageType)
+	partitioner, err := shard.ParsePartitioner(*shardBy, *shards, *shardBounds)
+	if err != nil {
+		slog.Error("Invalid sharding specified", "error", err)
+		return
+	}
+	var keyring *storage.Keyring
+	if *encryptionKeyFile != "" {
+		if keyring, err = storage.LoadKeyring(*encryptionKeyFile); err != nil {
+			slog.Error("Cannot load encryption keys", "error", err)
+			return
+		}
+		keyring.AllowPlaintext(*encryptionAllowPlaintext)
+		slog.Info("Encrypting accounts at rest", "key_file", *encryptionKeyFile, "key_id", keyring.Current(), "allow_plaintext", *encryptionAllowPlaintext)
+	}
+	var reencrypters []reencrypter
+	var closers []io.Closer
+	defer func() {
+		for _, closer := range closers {
+			closer.Close()
+		}
+	}()
+	// openShard opens the backend of shard i. Shard 0 uses the configured
+	// files, so that a server that starts sharding keeps its accounts
+	// there; shard i > 0 gets files of its own with a ".shard<i>" suffix.
+	openShard := func(i int) (storage.Storage, error) {
+		name := func(path string) string {
+			if i == 0 || path == "" {
+				return path
+			}
+			return fmt.Sprintf("%s.shard%d", path, i)
+		}
+		switch *storageType {
+		case "inmemory":
+			slog.Info("Using in-memory storage", "wal_file", name(*walFile))
+			if *walFile == "" {
+				if *snapshotDir != "" {
+					return nil, errors.New("snapshots need a write-ahead log; set -wal_file")
+				}
+				return storage.NewInMemoryStorage(), nil
+			}
+			syncPolicy, err := storage.ParseSyncPolicy(*walSync)
+			if err != nil {
+				return nil, fmt.Errorf("invalid wal sync policy: %w", err)
+			}
+			store, err := storage.NewInMemoryStorageWithWAL(name(*walFile), storage.WALOptions{
+				Sync:             syncPolicy,
+				SyncInterval:     *walSyncInterval,
+				SnapshotDir:      name(*snapshotDir),
+				SnapshotInterval: *snapshotInterval,
+				Keyring:          keyring,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("cannot open write-ahead log: %w", err)
+			}
+			closers = append(closers, store)
+			if keyring != nil {
+				reencrypters = append(reencrypters, reencrypter{fmt.Sprintf("shard %d", i), store})
+			}
+			return store, nil
+		case "sqlite":
+			slog.Info("Using SQLite storage", "db_file", name(*sqliteDBFile))
+			store := storage.NewSqliteStorageWithOptions(name(*sqliteDBFile), storage.SqliteOptions{
+				JournalMode:  *sqliteJournalMode,
+				Synchronous:  *sqliteSynchronous,
+				BusyTimeout:  *sqliteBusyTimeout,
+				MaxOpenConns: *sqliteMaxOpenConns,
+				MaxRetries:   *sqliteMaxRetries,
+				RetryBackoff: *sqliteRetryBackoff,
+				Keyring:      keyring,
+			})
+			if store == nil {
+				return nil, errors.New("cannot open SQLite storage")
+			}
+			closers = append(closers, store)
+			if keyring != nil {
+				reencrypters = append(reencrypters, reencrypter{fmt.Sprintf("shard %d", i), store})
+			}
+			return store, nil
+		case "bitcask":
+			slog.Info("Using bitcask storage", "dir", name(*bitcaskDir))
+			syncPolicy, err := storage.ParseSyncPolicy(*bitcaskSync)
+			if err != nil {
+				return nil, fmt.Errorf("invalid bitcask sync policy: %w", err)
+			}
+			store, err := storage.NewBitcaskStorage(name(*bitcaskDir), storage.BitcaskOptions{
+				Sync:          syncPolicy,
+				SyncInterval:  *walSyncInterval,
+				MaxFileSize:   *bitcaskMaxFileSize,
+				MergeInterval: *bitcaskMergeInterval,
+				Keyring:       keyring,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("cannot open bitcask storage: %w", err)
+			}
+			closers = append(closers, store)
+			if keyring != nil {
+				reencrypters = append(reencrypters, reencrypter{fmt.Sprintf("shard %d", i), store})
+			}
+			return store, nil
+		}
+		return nil, fmt.Errorf("invalid storage type %q", *storageType)
+	}
+
+	if rebalance {
+		backends := make([]storage.Storage, max(*shards, *rebalanceFromShards))
+		for i := range backends {
+			if backends[i], err = openShard(i); err != nil {
+				slog.Error("Cannot open storage", "shard", i, "error", err)
+				return
+			}
+		}
+		moved, err := shard.Rebalance(context.Background(), backends, partitioner)
+		if err != nil {
+			slog.Error("Rebalance failed", "moved", moved, "error", err)
+			return
+		}
+		slog.Info("Rebalanced shards", "shards", *shards, "moved", moved)
 		return
 	}
 
-	accountHandler := api.NewAccountHandlers(s)
+	var s storage.Storage
+	backends := make([]storage.Storage, *shards)
+	for i := range backends {
+		if backends[i], err = openShard(i); err != nil {
+			slog.Error("Cannot open storage", "shard", i, "error", err)
+			return
+		}
+	}
+	s = backends[0]
+	if *shards > 1 {
+		slog.Info("Sharding accounts", "shards", *shards, "by", *shardBy)
+		sharded, err := shard.New(backends, partitioner, shard.Options{LogDir: *shardLogDir, Keyring: keyring})
+		if err != nil {
+			slog.Error("Cannot shard storage", "error", err)
+			return
+		}
+		closers = append(closers, sharded)
+		if keyring != nil {
+			reencrypters = append(reencrypters, reencrypter{"two-phase commit journals", sharded})
+		}
+		s = sharded
+	}
+
+	var raftNode *raft.Node
+	if *raftPeers != "" {
+		if *raftSelf == "" {
+			slog.Error("A raft cluster needs the URL of this server; set -raft_self")
+			return
+		}
+		node, err := raft.NewNode(*raftSelf, strings.Split(*raftPeers, ","), s, raft.Options{
+			ElectionTimeout:   *raftElectionTimeout,
+			HeartbeatInterval: *raftElectionTimeout / 5,
+			Dir:               *raftDir,
+			Keyring:           keyring,
+		})
+		if err != nil {
+			slog.Error("Cannot start raft node", "error", err)
+			return
+		}
+		defer node.Stop()
+		slog.Info("Joining raft cluster", "self", *raftSelf, "peers", *raftPeers, "dir", *raftDir)
+		raftNode, s = node, node
+		if keyring != nil {
+			reencrypters = append(reencrypters, reencrypter{"raft log", node})
+		}
+	}
+
+	if keyring != nil {
+		go reencryptAtRest(keyring, reencrypters)
+	}
+
+	if *chaos {
+		rates := map[string]float64{storage.OpCommit: *chaosCommitErrorRate}
+		for _, op := range []string{storage.OpGet, storage.OpGetMany, storage.OpScan, storage.OpBegin, storage.OpWriteBatch,
+			storage.OpTxGet, storage.OpTxSet, storage.OpTxInsert, storage.OpTxCompareAndSet, storage.OpTxDelete, storage.OpTxScan} {
+			rates[op] = *chaosErrorRate
+		}
+		slog.Warn("Injecting storage faults", "error_rate", *chaosErrorRate, "commit_error_rate", *chaosCommitErrorRate,
+			"partial_commit_rate", *chaosPartialCommitRate, "latency", *chaosLatency, "seed", *chaosSeed)
+		s = storage.NewFaultyStorage(s, storage.FaultOptions{
+			ErrorRates:        rates,
+			PartialCommitRate: *chaosPartialCommitRate,
+			Latency:           *chaosLatency,
+			LatencyJitter:     *chaosLatencyJitter,
+			Seed:              *chaosSeed,
+		})
+	}
+	// Only a server that takes part in replication goes through a node:
+	// the primary's log orders every commit, which a standalone server,
+	// or a cluster of shards or raft nodes, has no reason to pay for.
+	var node *replication.Node
+	replicationOptions := replication.Options{LogSize: *replicationLogSize}
+	switch {
+	case *replicateFrom != "" && *replicationPrimary:
+		slog.Error("A replica cannot also be a primary; set -replicate_from or -replication_primary, not both")
+		return
+	case *replicateFrom != "":
+		slog.Info("Running as replica", "primary", *replicateFrom)
+		node = replication.NewReplica(s, *replicateFrom, replicationOptions)
+		defer node.Close()
+	case *replicationPrimary:
+		node = replication.NewPrimary(s, replicationOptions)
+	}
+	primaryOnly := func(next http.HandlerFunc) http.HandlerFunc { return next }
+	role := replication.RolePrimary
+	if node != nil {
+		s, primaryOnly, role = node, node.PrimaryOnly, node.Role()
+	}
 
 	router := mux.NewRouter()
-	router.HandleFunc("/accounts", accountHandler.CreateAccount).Methods("POST")
+	if *metrics {
+		instrumented := storage.NewInstrumentedStorage(s)
+		expvar.Publish("storage", expvar.Func(func() any { return instrumented.Metrics().Snapshot() }))
+		router.Handle("/debug/vars", expvar.Handler()).Methods("GET")
+		s = instrumented
+	}
+	accountHandler := api.NewAccountHandlersWithOptions(s, api.Options{Scale: *moneyScale})
+	backupHandler := api.NewBackupHandlers(s, keyring)
+	if db, ok := backends[0].(*storage.SqliteStorage); ok && len(backends) == 1 {
+		backupHandler = api.NewSqliteBackupHandlers(s, db, keyring)
+	}
+
+	router.HandleFunc("/accounts", primaryOnly(accountHandler.CreateAccount)).Methods("POST")
 	router.HandleFunc("/accounts/{account_id}", accountHandler.GetAccount).Methods("GET")
-	router.HandleFunc("/transactions", accountHandler.SubmitTransaction).Methods("POST")
-	slog.Info("Starting server on :8080")
-	slog.Error("Server Crashed", "error", http.ListenAndServe(":8080", router))
+	router.HandleFunc("/transactions", primaryOnly(accountHandler.SubmitTransaction)).Methods("POST")
+	var handler http.Handler = router
+	if *requestTimeout > 0 {
+		// TimeoutHandler cancels the request context at the deadline, which
+		// stops the storage calls made on its behalf.
+		handler = http.TimeoutHandler(router, *requestTimeout, "Request timed out")
+	}
+	// The replication log is streamed for as long as a replica follows, so
+	// it is served outside the request timeout, along with the raft routes
+	// that the nodes of a cluster bound with timeouts of their own.
+	root := mux.NewRouter()
+	if node != nil {
+		node.Routes(root)
+	}
+	if raftNode != nil {
+		raftNode.Routes(root)
+	}
+	root.PathPrefix("/").Handler(handler)
+
+	// Backups, exports and imports read or replace every account, so they
+	// are only served on the admin address, which is meant to be reachable
+	// by operators alone, and without the request timeout, since they take
+	// as long as the accounts take to copy.
+	if *adminAddr != "" {
+		admin := mux.NewRouter()
+		admin.HandleFunc("/backup", backupHandler.Backup).Methods("GET")
+		admin.HandleFunc("/restore", primaryOnly(backupHandler.Restore)).Methods("POST")
+		admin.HandleFunc("/export", accountHandler.Export).Methods("GET")
+		admin.HandleFunc("/import", primaryOnly(accountHandler.Import)).Methods("POST")
+		go func() {
+			slog.Error("Admin server crashed", "error", http.ListenAndServe(*adminAddr, admin))
+		}()
+	}
+	slog.Info("Starting server", "addr", *addr, "admin_addr", *adminAddr, "role", role, "replication", node != nil, "request_timeout", *requestTimeout, "metrics", *metrics)
+	slog.Error("Server Crashed", "error", http.ListenAndServe(*addr, root))
+}
+
+// reencrypter is something that keeps accounts on disk and can re-encrypt
+// them: a backend, the journals of the shards or the raft log.
+type reencrypter struct {
+	name    string
+	storage interface {
+		Reencrypt(ctx context.Context) (int, error)
+	}
+}
+
+// reencryptAtRest re-encrypts the accounts of backends with the current key
+// of keyring in the background: on startup, which also encrypts what was
+// stored before encryption was enabled, and whenever SIGHUP reloads the key
+// file after a key was added.
+func reencryptAtRest(keyring *storage.Keyring, backends []reencrypter) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	reencrypt := func() {
+		for _, backend := range backends {
+			start := time.Now()
+			count, err := backend.storage.Reencrypt(context.Background())
+			if err != nil {
+				slog.Error("Cannot re-encrypt storage", "storage", backend.name, "error", err)
+				continue
+			}
+			slog.Info("Re-encrypted storage", "storage", backend.name, "key_id", keyring.Current(), "values", count, "duration", time.Since(start))
+		}
+	}
+	reencrypt()
+	for range hup {
+		if err := keyring.Reload(); err != nil {
+			slog.Error("Cannot reload encryption keys", "error", err)
+			continue
+		}
+		slog.Info("Reloaded encryption keys", "key_id", keyring.Current())
+		reencrypt()
+	}
+}
+
+// migrate implements the migrate subcommand, which brings a SQLite database
+// up to the schema of this binary without starting the server:
+//
+//	go run . migrate -sqlite_db_file store.db [-dry_run]
+func migrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	sqliteDBFile := flags.String("sqlite_db_file", "", "File path for SQLite database to migrate")
+	dryRun := flags.Bool("dry_run", false, "List the pending migrations without applying them")
+	flags.Parse(args)
+
+	store, err := storage.OpenSqliteStorage(*sqliteDBFile, storage.SqliteOptions{})
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	version, err := store.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	slog.Info("Current schema", "version", version, "latest", storage.LatestSchemaVersion())
+	if *dryRun {
+		pending, err := store.PendingMigrations()
+		if err != nil {
+			return err
+		}
+		for _, m := range pending {
+			slog.Info("Pending migration", "version", m.Version, "description", m.Description)
+		}
+		slog.Info("Dry run, nothing applied", "pending", len(pending))
+		return nil
+	}
+	applied, err := store.Migrate()
+	if err != nil {
+		return err
+	}
+	slog.Info("Schema is up to date", "applied", len(applied), "version", storage.LatestSchemaVersion())
+	return nil
 }
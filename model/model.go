@@ -1,13 +1,23 @@
 package model
 
+import "time"
+
 type AccountRequest struct {
 	AccountId      uint64 `json:"account_id"`
 	InitialBalance string `json:"initial_balance"`
+	Currency       string `json:"currency,omitempty"`
+	Owner          string `json:"owner,omitempty"`
 }
 
 type AccountResponse struct {
-	AccountId uint64 `json:"account_id"`
-	Balance   string `json:"balance"`
+	AccountId uint64    `json:"account_id"`
+	Balance   string    `json:"balance"`
+	Currency  string    `json:"currency"`
+	Status    string    `json:"status"`
+	Version   uint64    `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Owner     string    `json:"owner,omitempty"`
 }
 
 type TransactionRequest struct {
@@ -15,3 +25,19 @@ type TransactionRequest struct {
 	DestinationAccountId uint64 `json:"destination_account_id"`
 	Amount               string `json:"amount"`
 }
+
+// ImportRowError reports a row of an import file that was not imported.
+// Line is the line of the file the row starts on.
+type ImportRowError struct {
+	Line      int    `json:"line"`
+	AccountId uint64 `json:"account_id,omitempty"`
+	Error     string `json:"error"`
+}
+
+// ImportSummary ends the report of an import. Error is set if the import
+// stopped before the end of the file.
+type ImportSummary struct {
+	Created int    `json:"created"`
+	Failed  int    `json:"failed"`
+	Error   string `json:"error,omitempty"`
+}
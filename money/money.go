@@ -0,0 +1,216 @@
+package money
+
+import (
+	"errors"
+	"math/big"
+	"strings"
+)
+
+// DefaultScale is the number of fractional digits kept by Parse and by
+// every Amount produced from it, and the scale balances are stored at. It
+// matches the 19 digits the API used to print with "%.19f" so existing
+// balances round-trip unchanged. It is a constant so that stored balances
+// never meet a binary that keeps fewer digits; callers that want coarser
+// amounts parse them with ParseScale.
+const DefaultScale = 19
+
+// MaxIntegerDigits bounds the integer part of a parsed amount so that a
+// hostile request cannot make us allocate arbitrarily large numbers.
+const MaxIntegerDigits = 30
+
+var (
+	ErrInvalidAmount = errors.New("invalid amount")
+	ErrTooPrecise    = errors.New("amount has more fractional digits than allowed")
+	ErrOutOfRange    = errors.New("amount is out of range")
+)
+
+// Amount is an exact decimal number with a fixed number of fractional
+// digits. The zero value is 0 at scale 0; amounts of different scales can
+// be combined and the result takes the larger scale.
+type Amount struct {
+	units *big.Int
+	scale int
+}
+
+// Zero returns 0 at DefaultScale.
+func Zero() Amount {
+	return Amount{units: new(big.Int), scale: DefaultScale}
+}
+
+// Parse strictly parses a plain decimal string such as "-12.34" at
+// DefaultScale. Exponents, NaN, Inf, surrounding spaces and inputs with
+// more than DefaultScale fractional digits are rejected.
+func Parse(s string) (Amount, error) {
+	return ParseScale(s, DefaultScale)
+}
+
+// ParseScale is Parse with an explicit scale.
+func ParseScale(s string, scale int) (Amount, error) {
+	intPart, fracPart, negative, err := split(s)
+	if err != nil {
+		return Amount{}, err
+	}
+	if len(fracPart) > scale {
+		return Amount{}, ErrTooPrecise
+	}
+	return build(intPart, fracPart, negative, scale), nil
+}
+
+// ParseLegacy parses values written before amounts were exact, such as the
+// "%.19f" strings produced from big.Float. It follows the same syntax as
+// Parse but rounds extra fractional digits half-to-even instead of failing.
+func ParseLegacy(s string) (Amount, error) {
+	intPart, fracPart, negative, err := split(s)
+	if err != nil {
+		return Amount{}, err
+	}
+	if len(fracPart) <= DefaultScale {
+		return build(intPart, fracPart, negative, DefaultScale), nil
+	}
+	exact := build(intPart, fracPart, negative, len(fracPart))
+	return exact.Round(DefaultScale), nil
+}
+
+func split(s string) (intPart, fracPart string, negative bool, err error) {
+	if s == "" {
+		return "", "", false, ErrInvalidAmount
+	}
+	switch s[0] {
+	case '-':
+		negative = true
+		s = s[1:]
+	case '+':
+		s = s[1:]
+	}
+	intPart, fracPart, hasDot := strings.Cut(s, ".")
+	if !isDigits(intPart) || (hasDot && !isDigits(fracPart)) {
+		return "", "", false, ErrInvalidAmount
+	}
+	intPart = strings.TrimLeft(intPart, "0")
+	if len(intPart) > MaxIntegerDigits {
+		return "", "", false, ErrOutOfRange
+	}
+	return intPart, fracPart, negative, nil
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func build(intPart, fracPart string, negative bool, scale int) Amount {
+	digits := intPart + fracPart + strings.Repeat("0", scale-len(fracPart))
+	units := new(big.Int)
+	if digits != "" {
+		units.SetString(digits, 10)
+	}
+	if negative {
+		units.Neg(units)
+	}
+	return Amount{units: units, scale: scale}
+}
+
+func (a Amount) int() *big.Int {
+	if a.units == nil {
+		return new(big.Int)
+	}
+	return a.units
+}
+
+// Scale returns the number of fractional digits of a.
+func (a Amount) Scale() int {
+	return a.scale
+}
+
+// Rescale returns a at the given scale. Growing the scale is exact;
+// shrinking it rounds half-to-even.
+func (a Amount) Rescale(scale int) Amount {
+	if scale >= a.scale {
+		units := new(big.Int).Mul(a.int(), pow10(scale-a.scale))
+		return Amount{units: units, scale: scale}
+	}
+	return a.Round(scale)
+}
+
+// Round rounds a half-to-even to the given number of fractional digits.
+func (a Amount) Round(scale int) Amount {
+	if scale >= a.scale {
+		return a.Rescale(scale)
+	}
+	divisor := pow10(a.scale - scale)
+	quo, rem := new(big.Int).QuoRem(a.int(), divisor, new(big.Int))
+	twice := new(big.Int).Abs(rem)
+	twice.Lsh(twice, 1)
+	switch cmp := twice.Cmp(divisor); {
+	case cmp > 0, cmp == 0 && quo.Bit(0) == 1:
+		if a.int().Sign() < 0 {
+			quo.Sub(quo, big.NewInt(1))
+		} else {
+			quo.Add(quo, big.NewInt(1))
+		}
+	}
+	return Amount{units: quo, scale: scale}
+}
+
+func align(a, b Amount) (Amount, Amount) {
+	if a.scale < b.scale {
+		return a.Rescale(b.scale), b
+	}
+	if b.scale < a.scale {
+		return a, b.Rescale(a.scale)
+	}
+	return a, b
+}
+
+// Add returns a + b.
+func (a Amount) Add(b Amount) Amount {
+	a, b = align(a, b)
+	return Amount{units: new(big.Int).Add(a.int(), b.int()), scale: a.scale}
+}
+
+// Sub returns a - b.
+func (a Amount) Sub(b Amount) Amount {
+	a, b = align(a, b)
+	return Amount{units: new(big.Int).Sub(a.int(), b.int()), scale: a.scale}
+}
+
+// Cmp compares a and b and returns -1, 0 or +1.
+func (a Amount) Cmp(b Amount) int {
+	a, b = align(a, b)
+	return a.int().Cmp(b.int())
+}
+
+// Sign returns -1, 0 or +1 depending on the sign of a.
+func (a Amount) Sign() int {
+	return a.int().Sign()
+}
+
+// String formats a with exactly Scale() fractional digits, e.g. "100.2300".
+func (a Amount) String() string {
+	digits := new(big.Int).Abs(a.int()).String()
+	if len(digits) <= a.scale {
+		digits = strings.Repeat("0", a.scale-len(digits)+1) + digits
+	}
+	var sb strings.Builder
+	if a.Sign() < 0 {
+		sb.WriteByte('-')
+	}
+	point := len(digits) - a.scale
+	sb.WriteString(digits[:point])
+	if a.scale > 0 {
+		sb.WriteByte('.')
+		sb.WriteString(digits[point:])
+	}
+	return sb.String()
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
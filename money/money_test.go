@@ -0,0 +1,63 @@
+package money_test
+
+import (
+	"errors"
+	"main/money"
+	"testing"
+)
+
+func TestParse_RejectsNonDecimalInput(t *testing.T) {
+	inputs := []string{"", "Inf", "-Inf", "NaN", "1e400", "1E2", "0x10", " 1", "1 ", ".5", "5.", "1.2.3", "--1", "1,000"}
+	for _, input := range inputs {
+		if _, err := money.Parse(input); !errors.Is(err, money.ErrInvalidAmount) {
+			t.Errorf("Parse(%q): expected ErrInvalidAmount, got %v", input, err)
+		}
+	}
+}
+
+func TestParse_RejectsExcessPrecisionAndRange(t *testing.T) {
+	if _, err := money.ParseScale("1.001", 2); !errors.Is(err, money.ErrTooPrecise) {
+		t.Errorf("expected ErrTooPrecise, got %v", err)
+	}
+	if _, err := money.Parse("1000000000000000000000000000000000"); !errors.Is(err, money.ErrOutOfRange) {
+		t.Errorf("expected ErrOutOfRange, got %v", err)
+	}
+}
+
+func TestAmount_ExactArithmetic(t *testing.T) {
+	total, _ := money.ParseScale("0", 2)
+	tenth, _ := money.ParseScale("0.10", 2)
+	for range 1000 {
+		total = total.Add(tenth)
+	}
+	if got := total.String(); got != "100.00" {
+		t.Errorf("expected 100.00, got %s", got)
+	}
+	if got := total.Sub(tenth).Sub(money.Zero()).String(); got != "99.9000000000000000000" {
+		t.Errorf("expected result at the larger scale, got %s", got)
+	}
+	negative, _ := money.ParseScale("-0.05", 2)
+	if got := negative.String(); got != "-0.05" {
+		t.Errorf("expected -0.05, got %s", got)
+	}
+}
+
+func TestParseLegacy_RoundsHalfToEven(t *testing.T) {
+	cases := map[string]string{
+		"1000.0000000000000000000":  "1000.0000000000000000000",
+		"0.10000000000000000000135": "0.1000000000000000000",
+		"0.00000000000000000005":    "0.0000000000000000000",
+		"0.00000000000000000015":    "0.0000000000000000002",
+		"-0.000000000000000000151":  "-0.0000000000000000002",
+		"12":                        "12.0000000000000000000",
+	}
+	for input, expected := range cases {
+		amount, err := money.ParseLegacy(input)
+		if err != nil {
+			t.Fatalf("ParseLegacy(%q): %v", input, err)
+		}
+		if got := amount.String(); got != expected {
+			t.Errorf("ParseLegacy(%q): expected %s, got %s", input, expected, got)
+		}
+	}
+}
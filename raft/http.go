@@ -0,0 +1,223 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"main/storage"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// VoteRequest is sent by a candidate to ask for a peer's vote.
+type VoteRequest struct {
+	Term         uint64 `json:"term"`
+	Candidate    string `json:"candidate"`
+	LastLogIndex uint64 `json:"last_log_index"`
+	LastLogTerm  uint64 `json:"last_log_term"`
+}
+
+type VoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+// AppendRequest is sent by the leader with the entries after PrevLogIndex,
+// or none as a heartbeat.
+type AppendRequest struct {
+	Term         uint64  `json:"term"`
+	Leader       string  `json:"leader"`
+	PrevLogIndex uint64  `json:"prev_log_index"`
+	PrevLogTerm  uint64  `json:"prev_log_term"`
+	Entries      []Entry `json:"entries,omitempty"`
+	LeaderCommit uint64  `json:"leader_commit"`
+}
+
+// AppendResponse tells the leader whether the entries were stored. If not,
+// ConflictIndex is where the follower's log stops matching the leader's.
+type AppendResponse struct {
+	Term          uint64 `json:"term"`
+	Success       bool   `json:"success"`
+	ConflictIndex uint64 `json:"conflict_index,omitempty"`
+}
+
+// ProposeResponse is the leader's answer to a command forwarded by a
+// follower: the index of its entry once applied, or 0 and the error that
+// kept it from being applied. Code names the kind of error; see errorCodes.
+type ProposeResponse struct {
+	Index uint64 `json:"index"`
+	Error string `json:"error,omitempty"`
+	Code  string `json:"code,omitempty"`
+}
+
+// errorCodes are the errors a forwarded command can fail with that callers
+// test for, so the follower returns them as the leader would.
+var errorCodes = map[string]error{
+	"conflict":        storage.ErrConflict,
+	"invalid_account": storage.ErrInvalidAccount,
+	"key_not_found":   storage.ErrKeyNotFound,
+	"not_leader":      ErrNotLeader,
+	"leadership_lost": ErrLeadershipLost,
+	"stopped":         ErrStopped,
+	"canceled":        context.Canceled,
+	"deadline":        context.DeadlineExceeded,
+}
+
+// remoteError is an error the leader returned for a forwarded command.
+type remoteError struct {
+	message string
+	err     error
+}
+
+func (e *remoteError) Error() string { return e.message }
+func (e *remoteError) Unwrap() error { return e.err }
+
+// Routes registers the endpoints the nodes of a cluster use to talk to each
+// other on router:
+//
+//	POST /raft/vote     RequestVote
+//	POST /raft/append   AppendEntries, and heartbeats
+//	POST /raft/propose  a command forwarded to the leader
+//	GET  /raft/status   role, term, leader and log position
+func (n *Node) Routes(router *mux.Router) {
+	router.HandleFunc("/raft/vote", n.ServeVote).Methods("POST")
+	router.HandleFunc("/raft/append", n.ServeAppend).Methods("POST")
+	router.HandleFunc("/raft/propose", n.ServePropose).Methods("POST")
+	router.HandleFunc("/raft/status", n.ServeStatus).Methods("GET")
+}
+
+// decode reads the JSON body of r into v. It answers the request and
+// returns false if the node is stopped or the body is invalid.
+func (n *Node) decode(rw http.ResponseWriter, r *http.Request, v any) bool {
+	n.lock.Lock()
+	stopped := n.stopped
+	n.lock.Unlock()
+	if stopped {
+		http.Error(rw, ErrStopped.Error(), http.StatusServiceUnavailable)
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(rw, "Invalid request body format", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeJSON(rw http.ResponseWriter, v any) {
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(v)
+}
+
+func (n *Node) ServeVote(rw http.ResponseWriter, r *http.Request) {
+	var req VoteRequest
+	if n.decode(rw, r, &req) {
+		writeJSON(rw, n.requestVote(req))
+	}
+}
+
+func (n *Node) ServeAppend(rw http.ResponseWriter, r *http.Request) {
+	var req AppendRequest
+	if n.decode(rw, r, &req) {
+		writeJSON(rw, n.appendEntries(req))
+	}
+}
+
+// ServePropose applies a command forwarded by a follower, if this node is
+// the leader, and answers a ProposeResponse.
+func (n *Node) ServePropose(rw http.ResponseWriter, r *http.Request) {
+	var cmd Command
+	if !n.decode(rw, r, &cmd) {
+		return
+	}
+	index, err := n.propose(r.Context(), &cmd)
+	resp := ProposeResponse{Index: index}
+	if err != nil {
+		resp.Error = err.Error()
+		for code, target := range errorCodes {
+			if errors.Is(err, target) {
+				resp.Code = code
+			}
+		}
+	}
+	writeJSON(rw, resp)
+}
+
+// forward sends cmd to the leader and returns what ServePropose answers.
+func (n *Node) forward(ctx context.Context, cmd *Command) (uint64, error) {
+	leader := n.Leader()
+	if leader == "" || leader == n.self {
+		return 0, ErrNotLeader
+	}
+	var resp ProposeResponse
+	if err := n.call(ctx, leader, "/raft/propose", cmd, &resp); err != nil {
+		// The leader may have died after applying the command.
+		return 0, fmt.Errorf("%w: %w", ErrLeadershipLost, err)
+	}
+	if resp.Error == "" {
+		return resp.Index, nil
+	}
+	return resp.Index, &remoteError{message: resp.Error, err: errorCodes[resp.Code]}
+}
+
+// rpc makes a request to a peer on behalf of the node, giving up after
+// ElectionTimeout or when the node stops.
+func (n *Node) rpc(peer, path string, req, resp any) error {
+	ctx, cancel := context.WithTimeout(n.ctx, n.options.ElectionTimeout)
+	defer cancel()
+	return n.call(ctx, peer, path, req, resp)
+}
+
+// call posts req as JSON to path on peer and decodes the answer into resp.
+func (n *Node) call(ctx context.Context, peer, path string, req, resp any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, peer+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpResp, err := n.options.Client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", peer, httpResp.Status)
+	}
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
+
+// Status describes a node and its position in the log.
+type Status struct {
+	ID          string `json:"id"`
+	Role        Role   `json:"role"`
+	Term        uint64 `json:"term"`
+	Leader      string `json:"leader,omitempty"`
+	LastIndex   uint64 `json:"last_index"`
+	CommitIndex uint64 `json:"commit_index"`
+	Applied     uint64 `json:"applied"`
+}
+
+// Status returns the role and log position of the node.
+func (n *Node) Status() Status {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return Status{
+		ID:          n.self,
+		Role:        n.role,
+		Term:        n.term,
+		Leader:      n.leader,
+		LastIndex:   n.lastIndex(),
+		CommitIndex: n.commitIndex,
+		Applied:     n.lastApplied,
+	}
+}
+
+func (n *Node) ServeStatus(rw http.ResponseWriter, r *http.Request) {
+	writeJSON(rw, n.Status())
+}
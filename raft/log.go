@@ -0,0 +1,232 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"main/storage"
+	"os"
+	"path/filepath"
+)
+
+// Command is the change one log entry makes to the accounts: a transaction
+// committed on any node, with the values it read. It is applied on every
+// node in log order, and only if every value read is still current, so all
+// nodes accept or reject it alike.
+type Command struct {
+	// Reads are the values the writes were based on; a nil Account means
+	// the key was absent.
+	Reads []Write `json:"reads,omitempty"`
+	// Exists lists keys that must have a value, such as those deleted by
+	// a WriteBatch.
+	Exists []storage.Key `json:"exists,omitempty"`
+	Writes []Write       `json:"writes,omitempty"`
+}
+
+// Write is the new value of a key, or its expected value in Reads.
+type Write struct {
+	Key storage.Key `json:"key"`
+	// Account is nil for a delete, or for a key expected to be absent.
+	Account *storage.Account `json:"account,omitempty"`
+}
+
+// Entry is one entry of the replicated log. A leader starts its term with
+// an entry without a command, which commits the entries of earlier terms.
+type Entry struct {
+	Index   uint64   `json:"index"`
+	Term    uint64   `json:"term"`
+	Command *Command `json:"command,omitempty"`
+}
+
+// persistentState is what a node must remember across restarts for the
+// elections to stay safe.
+type persistentState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for"`
+}
+
+// persister keeps the term, the vote and the log in a directory:
+// state.json, replaced atomically, and log.jsonl, one entry per line,
+// encrypted with keyring if it is not nil. A nil persister keeps nothing.
+type persister struct {
+	dir     string
+	keyring *storage.Keyring
+	log     *os.File
+	// ends holds the size of the log file up to and including the entry
+	// at each index; ends[0] is 0, for the empty log.
+	ends []int64
+}
+
+// openPersister loads what dir holds, creating it if needed. An entry
+// that keyring cannot decrypt fails with storage.ErrDecrypt rather than
+// being dropped like a torn one.
+func openPersister(dir string, keyring *storage.Keyring) (*persister, persistentState, []Entry, error) {
+	var state persistentState
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, state, nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "state.json"))
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, state, nil, fmt.Errorf("cannot read raft state: %w", err)
+	}
+	file, err := os.OpenFile(filepath.Join(dir, "log.jsonl"), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, state, nil, err
+	}
+	var entries []Entry
+	ends := []int64{0}
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// Nothing more, or a torn last line from a crash mid-write;
+			// everything after it was never acknowledged.
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, state, nil, err
+		}
+		data, err := keyring.Open(storage.Key(len(entries)+1), bytes.TrimSuffix(line, []byte("\n")))
+		if err != nil {
+			file.Close()
+			return nil, state, nil, fmt.Errorf("raft log entry %d: %w", len(entries)+1, err)
+		}
+		var entry Entry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			break
+		}
+		entries = append(entries, entry)
+		ends = append(ends, ends[len(ends)-1]+int64(len(line)))
+	}
+	p := &persister{dir: dir, keyring: keyring, log: file, ends: ends}
+	if err := p.truncate(uint64(len(entries)) + 1); err != nil {
+		file.Close()
+		return nil, state, nil, err
+	}
+	return p, state, entries, nil
+}
+
+func (p *persister) saveState(state persistentState) error {
+	if p == nil {
+		return nil
+	}
+	data, _ := json.Marshal(state)
+	tmp := filepath.Join(p.dir, "state.json.tmp")
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(p.dir, "state.json"))
+}
+
+// encode returns the line of entry, encrypted under its index.
+func (p *persister) encode(entry Entry) []byte {
+	data, _ := json.Marshal(entry)
+	return append(p.keyring.Seal(storage.Key(entry.Index), data), '\n')
+}
+
+// append adds entries to the end of the log file and syncs it.
+func (p *persister) append(entries []Entry) error {
+	if p == nil || len(entries) == 0 {
+		return nil
+	}
+	var buf []byte
+	end := p.ends[len(p.ends)-1]
+	ends := make([]int64, 0, len(entries))
+	for _, entry := range entries {
+		buf = append(buf, p.encode(entry)...)
+		ends = append(ends, end+int64(len(buf)))
+	}
+	if _, err := p.log.Write(buf); err != nil {
+		// Cut off whatever part of the entries made it to the file, so
+		// later entries do not follow a torn line.
+		p.log.Truncate(end)
+		return err
+	}
+	if err := p.log.Sync(); err != nil {
+		return err
+	}
+	p.ends = append(p.ends, ends...)
+	return nil
+}
+
+// truncate drops the entries from index on, after a follower found that
+// they conflict with the leader's, or that they were torn by a crash. Only
+// the end of the file is cut off, so a crash in the middle leaves the
+// entries before index intact.
+func (p *persister) truncate(index uint64) error {
+	if p == nil {
+		return nil
+	}
+	if err := p.log.Truncate(p.ends[index-1]); err != nil {
+		return err
+	}
+	if err := p.log.Sync(); err != nil {
+		return err
+	}
+	p.ends = p.ends[:index]
+	return nil
+}
+
+// reencrypt writes entries, the whole log, with the current key of the
+// keyring to a new file that is synced and renamed over the log file, so
+// a crash leaves either the old or the new file behind.
+func (p *persister) reencrypt(entries []Entry) error {
+	if p == nil {
+		return nil
+	}
+	tmp := filepath.Join(p.dir, "log.jsonl.tmp")
+	next, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	ends := []int64{0}
+	w := bufio.NewWriter(next)
+	for _, entry := range entries {
+		n, _ := w.Write(p.encode(entry))
+		ends = append(ends, ends[len(ends)-1]+int64(n))
+	}
+	err = w.Flush()
+	if err == nil {
+		err = next.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(p.dir, "log.jsonl"))
+	}
+	if err != nil {
+		next.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if d, err := os.Open(p.dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	p.log.Close()
+	p.log, p.ends = next, ends
+	return nil
+}
+
+func (p *persister) Close() error {
+	if p == nil {
+		return nil
+	}
+	return p.log.Close()
+}
@@ -0,0 +1,676 @@
+// Package raft replicates the accounts across a cluster of servers with the
+// Raft consensus algorithm. Every node keeps a copy of the log of committed
+// transactions and applies it, in order, to a backend of its own. One node
+// is elected leader: it appends transactions to the log and commits them
+// once a majority of the cluster has stored them, so the cluster keeps
+// serving, with no committed transaction lost, as long as a majority of its
+// nodes is up. The nodes talk JSON over HTTP; see Node.Routes.
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"main/storage"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ErrNotLeader is returned when a command cannot reach a leader, because
+// none has been elected or the node it was sent to is no longer the leader.
+// The command was not applied.
+var ErrNotLeader = errors.New("no leader to accept the command")
+
+// ErrLeadershipLost is returned when the leader steps down before a command
+// it accepted was committed. A new leader may still commit the command, so
+// its outcome is unknown.
+var ErrLeadershipLost = errors.New("leadership lost before the command committed")
+
+// ErrStopped is returned by a node that has been stopped.
+var ErrStopped = errors.New("raft node is stopped")
+
+type Role string
+
+const (
+	RoleFollower  Role = "follower"
+	RoleCandidate Role = "candidate"
+	RoleLeader    Role = "leader"
+)
+
+type Options struct {
+	// ElectionTimeout is how long a follower waits to hear from a leader
+	// before it stands for election. Each wait is chosen at random between
+	// ElectionTimeout and twice that, so that elections rarely tie.
+	ElectionTimeout time.Duration
+	// HeartbeatInterval is how often a leader contacts idle followers. It
+	// must be well below ElectionTimeout.
+	HeartbeatInterval time.Duration
+	// MaxEntries bounds the entries sent to a follower in one request.
+	MaxEntries int
+	// Dir keeps the term, vote and log of the node across restarts. If
+	// empty, the node keeps them in memory only and must not rejoin its
+	// cluster after a restart under the same URL.
+	Dir string
+	// Client makes the requests of the node; http.DefaultClient if nil.
+	Client *http.Client
+	// Keyring, if set, encrypts the log kept in Dir, which holds the
+	// accounts every transaction writes.
+	Keyring *storage.Keyring
+}
+
+var DefaultOptions = Options{
+	ElectionTimeout:   500 * time.Millisecond,
+	HeartbeatInterval: 100 * time.Millisecond,
+	MaxEntries:        256,
+}
+
+func (options Options) withDefaults() Options {
+	if options.ElectionTimeout <= 0 {
+		options.ElectionTimeout = DefaultOptions.ElectionTimeout
+	}
+	if options.HeartbeatInterval <= 0 {
+		options.HeartbeatInterval = DefaultOptions.HeartbeatInterval
+	}
+	if options.MaxEntries <= 0 {
+		options.MaxEntries = DefaultOptions.MaxEntries
+	}
+	if options.Client == nil {
+		options.Client = http.DefaultClient
+	}
+	return options
+}
+
+// applied is the outcome of applying the entry a leader's proposal waits
+// for: the term the entry was appended in, and the error of its command.
+type applied struct {
+	term uint64
+	err  error
+}
+
+// Node is one member of a cluster. It is a storage.Storage: reads are served
+// from its own backend, which may lag behind the leader's, and transactions
+// committed on any node are sent to the leader and applied everywhere. See
+// storage.go.
+type Node struct {
+	backend   storage.Storage
+	self      string
+	peers     []string
+	options   Options
+	persister *persister
+
+	// ctx is canceled, and stop closed, when the node stops.
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stop     chan struct{}
+	routines sync.WaitGroup
+	// replicate wakes the goroutine that sends entries to each peer.
+	replicate map[string]chan struct{}
+	// committed wakes the goroutine that applies committed entries.
+	committed chan struct{}
+
+	// lock guards the fields below.
+	lock     sync.Mutex
+	stopped  bool
+	role     Role
+	term     uint64
+	votedFor string
+	leader   string
+	// log holds every entry, at the position of its Index; log[0] is a
+	// placeholder with term 0.
+	log              []Entry
+	commitIndex      uint64
+	lastApplied      uint64
+	electionDeadline time.Time
+	// nextIndex and matchIndex are, on a leader, the next entry to send to
+	// each peer and the last entry known to be stored by it.
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	// waiters are the proposals of a leader waiting for their entries to
+	// be applied, by index.
+	waiters map[uint64]chan applied
+	// appliedChanged is closed and replaced whenever an entry is applied.
+	appliedChanged chan struct{}
+}
+
+// NewNode starts the member of a cluster reachable at self, such as
+// "http://10.0.0.1:8080", whose other members are at peers; self may be
+// listed in peers too. The node applies the log to backend, which must be
+// empty: when the node restarts from options.Dir, the whole log is applied
+// again.
+func NewNode(self string, peers []string, backend storage.Storage, options Options) (*Node, error) {
+	empty := true
+	err := backend.Scan(context.Background(), storage.KeyRange{Limit: 1}, func(storage.Key, storage.Value) bool {
+		empty = false
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !empty {
+		return nil, errors.New("the backend of a raft node must start empty")
+	}
+	options = options.withDefaults()
+	n := &Node{
+		backend:        backend,
+		self:           self,
+		options:        options,
+		stop:           make(chan struct{}),
+		replicate:      make(map[string]chan struct{}),
+		committed:      make(chan struct{}, 1),
+		role:           RoleFollower,
+		log:            []Entry{{}},
+		nextIndex:      make(map[string]uint64),
+		matchIndex:     make(map[string]uint64),
+		waiters:        make(map[uint64]chan applied),
+		appliedChanged: make(chan struct{}),
+	}
+	if options.Dir != "" {
+		p, state, entries, err := openPersister(options.Dir, options.Keyring)
+		if err != nil {
+			return nil, err
+		}
+		for i, entry := range entries {
+			if entry.Index != uint64(i+1) {
+				p.Close()
+				return nil, fmt.Errorf("raft log in %s has entry %d at position %d", options.Dir, entry.Index, i+1)
+			}
+		}
+		n.persister, n.term, n.votedFor = p, state.Term, state.VotedFor
+		n.log = append(n.log, entries...)
+	}
+	for _, peer := range peers {
+		if peer != self && !slices.Contains(n.peers, peer) {
+			n.peers = append(n.peers, peer)
+			n.replicate[peer] = make(chan struct{}, 1)
+		}
+	}
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+	n.resetElectionTimer()
+	n.routines.Add(2 + len(n.peers))
+	go n.run()
+	go n.applyCommitted()
+	for _, peer := range n.peers {
+		go n.replicateTo(peer)
+	}
+	return n, nil
+}
+
+// Reencrypt rewrites the log kept in Options.Dir with the current key of
+// Options.Keyring, after the keyring was rotated, and returns how many
+// entries it rewrote. The node holds off appending entries meanwhile.
+func (n *Node) Reencrypt(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.stopped {
+		return 0, ErrStopped
+	}
+	if n.persister == nil {
+		return 0, nil
+	}
+	return len(n.log) - 1, n.persister.reencrypt(n.log[1:])
+}
+
+// Stop stops the node, as if its process had died: it no longer takes part
+// in the cluster, and proposals waiting on it fail with ErrStopped.
+func (n *Node) Stop() error {
+	n.lock.Lock()
+	if n.stopped {
+		n.lock.Unlock()
+		return nil
+	}
+	n.stopped = true
+	n.failWaiters(ErrStopped)
+	n.lock.Unlock()
+	n.cancel()
+	close(n.stop)
+	n.routines.Wait()
+	return n.persister.Close()
+}
+
+// Role returns the current role of the node.
+func (n *Node) Role() Role {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.role
+}
+
+// Leader returns the URL of the leader the node last heard from, or "" if
+// it knows of none.
+func (n *Node) Leader() string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.leader
+}
+
+// run starts an election whenever the election timer expires.
+func (n *Node) run() {
+	defer n.routines.Done()
+	ticker := time.NewTicker(n.options.ElectionTimeout / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case now := <-ticker.C:
+			n.lock.Lock()
+			if n.role != RoleLeader && now.After(n.electionDeadline) {
+				n.startElection()
+			}
+			n.lock.Unlock()
+		}
+	}
+}
+
+// resetElectionTimer picks when the node stands for election if it hears
+// from no leader. Callers must hold n.lock.
+func (n *Node) resetElectionTimer() {
+	timeout := n.options.ElectionTimeout
+	n.electionDeadline = time.Now().Add(timeout + rand.N(timeout))
+}
+
+func (n *Node) lastIndex() uint64 {
+	return uint64(len(n.log) - 1)
+}
+
+// majority reports whether count nodes are a majority of the cluster.
+func (n *Node) majority(count int) bool {
+	return 2*count > len(n.peers)+1
+}
+
+// persistState saves the term and vote. Callers must hold n.lock.
+func (n *Node) persistState() error {
+	err := n.persister.saveState(persistentState{Term: n.term, VotedFor: n.votedFor})
+	if err != nil {
+		slog.Error("Cannot save raft state", "error", err)
+	}
+	return err
+}
+
+// startElection makes the node a candidate for the next term and asks the
+// peers for their votes. Callers must hold n.lock.
+func (n *Node) startElection() {
+	n.resetElectionTimer()
+	n.role, n.leader = RoleCandidate, ""
+	n.term++
+	n.votedFor = n.self
+	if n.persistState() != nil {
+		return
+	}
+	slog.Info("Standing for election", "node", n.self, "term", n.term)
+	votes := 1
+	if n.majority(votes) {
+		n.becomeLeader()
+		return
+	}
+	req := VoteRequest{
+		Term:         n.term,
+		Candidate:    n.self,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.log[n.lastIndex()].Term,
+	}
+	n.routines.Add(len(n.peers))
+	for _, peer := range n.peers {
+		go func() {
+			defer n.routines.Done()
+			var resp VoteResponse
+			if err := n.rpc(peer, "/raft/vote", req, &resp); err != nil {
+				return
+			}
+			n.lock.Lock()
+			defer n.lock.Unlock()
+			if resp.Term > n.term {
+				n.stepDown(resp.Term)
+				return
+			}
+			if n.role != RoleCandidate || n.term != req.Term || !resp.Granted {
+				return
+			}
+			votes++
+			if n.majority(votes) {
+				n.becomeLeader()
+			}
+		}()
+	}
+}
+
+// becomeLeader makes a candidate that won the election the leader, and
+// appends an empty entry to commit the entries of earlier terms. Callers
+// must hold n.lock.
+func (n *Node) becomeLeader() {
+	n.role, n.leader = RoleLeader, n.self
+	for _, peer := range n.peers {
+		n.nextIndex[peer] = n.lastIndex() + 1
+		n.matchIndex[peer] = 0
+	}
+	slog.Info("Elected leader", "node", n.self, "term", n.term)
+	if _, err := n.append(nil); err != nil {
+		n.stepDown(n.term)
+	}
+}
+
+// stepDown makes the node a follower, in term if that is later than its
+// own. A leader fails its waiting proposals with ErrLeadershipLost. Callers
+// must hold n.lock.
+func (n *Node) stepDown(term uint64) {
+	if term > n.term {
+		n.term, n.votedFor = term, ""
+		n.persistState()
+	}
+	if n.role == RoleLeader {
+		slog.Info("Stepping down as leader", "node", n.self, "term", n.term)
+		n.failWaiters(ErrLeadershipLost)
+		n.leader = ""
+		n.resetElectionTimer()
+	}
+	n.role = RoleFollower
+}
+
+// failWaiters fails every waiting proposal with err. Callers must hold
+// n.lock.
+func (n *Node) failWaiters(err error) {
+	for index, waiter := range n.waiters {
+		waiter <- applied{err: err}
+		delete(n.waiters, index)
+	}
+}
+
+// append adds an entry with cmd to the log of the leader, and returns its
+// index. Callers must hold n.lock.
+func (n *Node) append(cmd *Command) (uint64, error) {
+	entry := Entry{Index: n.lastIndex() + 1, Term: n.term, Command: cmd}
+	if err := n.persister.append([]Entry{entry}); err != nil {
+		slog.Error("Cannot save raft log", "error", err)
+		return 0, err
+	}
+	n.log = append(n.log, entry)
+	n.triggerReplication()
+	n.advanceCommitIndex()
+	return entry.Index, nil
+}
+
+func (n *Node) triggerReplication() {
+	for _, peer := range n.peers {
+		select {
+		case n.replicate[peer] <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// advanceCommitIndex commits the latest entry of the current term that a
+// majority has stored, and every entry before it. Entries of earlier terms
+// are never counted directly: they commit along with a later one. Callers
+// must hold n.lock.
+func (n *Node) advanceCommitIndex() {
+	for index := n.lastIndex(); index > n.commitIndex && n.log[index].Term == n.term; index-- {
+		count := 1
+		for _, peer := range n.peers {
+			if n.matchIndex[peer] >= index {
+				count++
+			}
+		}
+		if n.majority(count) {
+			n.commitIndex = index
+			n.signalCommitted()
+			// Let the followers know, so they apply it too.
+			n.triggerReplication()
+			return
+		}
+	}
+}
+
+func (n *Node) signalCommitted() {
+	select {
+	case n.committed <- struct{}{}:
+	default:
+	}
+}
+
+// replicateTo sends entries to peer while the node leads: whenever there
+// are new ones, and every HeartbeatInterval otherwise.
+func (n *Node) replicateTo(peer string) {
+	defer n.routines.Done()
+	heartbeat := time.NewTimer(n.options.HeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-n.replicate[peer]:
+		case <-heartbeat.C:
+		}
+		heartbeat.Reset(n.options.HeartbeatInterval)
+		n.sendEntries(peer)
+	}
+}
+
+func (n *Node) sendEntries(peer string) {
+	n.lock.Lock()
+	if n.role != RoleLeader {
+		n.lock.Unlock()
+		return
+	}
+	next := n.nextIndex[peer]
+	end := min(n.lastIndex()+1, next+uint64(n.options.MaxEntries))
+	req := AppendRequest{
+		Term:         n.term,
+		Leader:       n.self,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  n.log[next-1].Term,
+		Entries:      slices.Clone(n.log[next:end]),
+		LeaderCommit: n.commitIndex,
+	}
+	n.lock.Unlock()
+
+	var resp AppendResponse
+	if err := n.rpc(peer, "/raft/append", req, &resp); err != nil {
+		return
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if resp.Term > n.term {
+		n.stepDown(resp.Term)
+		return
+	}
+	if n.role != RoleLeader || n.term != req.Term {
+		return
+	}
+	if !resp.Success {
+		// The peer's log differs at or before PrevLogIndex; back up to
+		// where it suggests and try again.
+		n.nextIndex[peer] = max(1, min(resp.ConflictIndex, req.PrevLogIndex))
+		n.triggerPeer(peer)
+		return
+	}
+	n.matchIndex[peer] = max(n.matchIndex[peer], req.PrevLogIndex+uint64(len(req.Entries)))
+	n.nextIndex[peer] = n.matchIndex[peer] + 1
+	n.advanceCommitIndex()
+	if n.nextIndex[peer] <= n.lastIndex() {
+		n.triggerPeer(peer)
+	}
+}
+
+func (n *Node) triggerPeer(peer string) {
+	select {
+	case n.replicate[peer] <- struct{}{}:
+	default:
+	}
+}
+
+// requestVote answers a candidate's request for a vote. A node votes once
+// per term, and only for a candidate whose log is at least as up to date as
+// its own, so that the winner has every committed entry.
+func (n *Node) requestVote(req VoteRequest) VoteResponse {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if req.Term > n.term {
+		n.stepDown(req.Term)
+	}
+	lastTerm := n.log[n.lastIndex()].Term
+	upToDate := req.LastLogTerm > lastTerm || req.LastLogTerm == lastTerm && req.LastLogIndex >= n.lastIndex()
+	granted := req.Term == n.term && (n.votedFor == "" || n.votedFor == req.Candidate) && upToDate
+	if granted {
+		n.votedFor = req.Candidate
+		if n.persistState() != nil {
+			n.votedFor = ""
+			granted = false
+		} else {
+			n.resetElectionTimer()
+		}
+	}
+	return VoteResponse{Term: n.term, Granted: granted}
+}
+
+// appendEntries stores the entries a leader sent, after dropping those of
+// the follower's log that conflict with them, and learns the commit index.
+func (n *Node) appendEntries(req AppendRequest) AppendResponse {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if req.Term < n.term {
+		return AppendResponse{Term: n.term}
+	}
+	if req.Term > n.term || n.role != RoleFollower {
+		n.stepDown(req.Term)
+	}
+	n.leader = req.Leader
+	n.resetElectionTimer()
+
+	if req.PrevLogIndex > n.lastIndex() {
+		return AppendResponse{Term: n.term, ConflictIndex: n.lastIndex() + 1}
+	}
+	if term := n.log[req.PrevLogIndex].Term; term != req.PrevLogTerm {
+		// Skip back over the whole conflicting term at once.
+		index := req.PrevLogIndex
+		for index > 1 && n.log[index-1].Term == term {
+			index--
+		}
+		return AppendResponse{Term: n.term, ConflictIndex: index}
+	}
+	for i, entry := range req.Entries {
+		if entry.Index <= n.lastIndex() {
+			if n.log[entry.Index].Term == entry.Term {
+				continue
+			}
+			// Committed entries are on a majority, and so on every leader;
+			// only uncommitted ones can conflict.
+			n.log = n.log[:entry.Index]
+			if err := n.persister.truncate(entry.Index); err != nil {
+				slog.Error("Cannot save raft log", "error", err)
+				return AppendResponse{Term: n.term}
+			}
+		}
+		if err := n.persister.append(req.Entries[i:]); err != nil {
+			slog.Error("Cannot save raft log", "error", err)
+			return AppendResponse{Term: n.term}
+		}
+		n.log = append(n.log, req.Entries[i:]...)
+		break
+	}
+	if commit := min(req.LeaderCommit, req.PrevLogIndex+uint64(len(req.Entries))); commit > n.commitIndex {
+		n.commitIndex = commit
+		n.signalCommitted()
+	}
+	return AppendResponse{Term: n.term, Success: true}
+}
+
+// applyCommitted applies the committed entries to the backend in log order,
+// and hands the outcome to the proposal waiting for each.
+func (n *Node) applyCommitted() {
+	defer n.routines.Done()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-n.committed:
+		}
+		for {
+			n.lock.Lock()
+			if n.lastApplied >= n.commitIndex || n.stopped {
+				n.lock.Unlock()
+				break
+			}
+			entry := n.log[n.lastApplied+1]
+			n.lock.Unlock()
+
+			err := n.applyCommand(entry.Command)
+
+			n.lock.Lock()
+			n.lastApplied = entry.Index
+			if waiter, ok := n.waiters[entry.Index]; ok {
+				waiter <- applied{term: entry.Term, err: err}
+				delete(n.waiters, entry.Index)
+			}
+			close(n.appliedChanged)
+			n.appliedChanged = make(chan struct{})
+			n.lock.Unlock()
+		}
+	}
+}
+
+// propose appends cmd to the log of the leader and waits until it is
+// applied. It returns the index of the entry, and the error of the command,
+// or 0 and why the command was not applied.
+func (n *Node) propose(ctx context.Context, cmd *Command) (uint64, error) {
+	n.lock.Lock()
+	if n.stopped {
+		n.lock.Unlock()
+		return 0, ErrStopped
+	}
+	if n.role != RoleLeader {
+		n.lock.Unlock()
+		return 0, ErrNotLeader
+	}
+	done := make(chan applied, 1)
+	index, err := n.append(cmd)
+	if err != nil {
+		n.lock.Unlock()
+		return 0, err
+	}
+	term := n.term
+	n.waiters[index] = done
+	n.lock.Unlock()
+
+	select {
+	case result := <-done:
+		if result.term != term {
+			if result.err != nil {
+				return 0, result.err
+			}
+			return 0, ErrLeadershipLost
+		}
+		return index, result.err
+	case <-ctx.Done():
+		n.lock.Lock()
+		delete(n.waiters, index)
+		n.lock.Unlock()
+		return 0, ctx.Err()
+	}
+}
+
+// waitApplied waits until the node has applied the entry at index.
+func (n *Node) waitApplied(ctx context.Context, index uint64) error {
+	for {
+		n.lock.Lock()
+		lastApplied, changed, stopped := n.lastApplied, n.appliedChanged, n.stopped
+		n.lock.Unlock()
+		if lastApplied >= index {
+			return nil
+		}
+		if stopped {
+			return ErrStopped
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-n.stop:
+		case <-changed:
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package raft_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"main/api"
+	"main/model"
+	"main/money"
+	"main/raft"
+	"main/storage"
+	"main/storage/storagetest"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var testOptions = raft.Options{
+	ElectionTimeout:   150 * time.Millisecond,
+	HeartbeatInterval: 20 * time.Millisecond,
+}
+
+// cluster is a set of nodes, each serving the API and the raft routes on
+// localhost.
+type cluster struct {
+	nodes   []*raft.Node
+	servers []*httptest.Server
+	killed  []bool
+}
+
+func startCluster(t *testing.T, size int) *cluster {
+	c := &cluster{nodes: make([]*raft.Node, size), killed: make([]bool, size)}
+	handlers := make([]atomic.Pointer[http.Handler], size)
+	urls := make([]string, size)
+	for i := range size {
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			handler := handlers[i].Load()
+			if handler == nil {
+				http.Error(rw, "Starting", http.StatusServiceUnavailable)
+				return
+			}
+			(*handler).ServeHTTP(rw, r)
+		}))
+		c.servers = append(c.servers, server)
+		urls[i] = server.URL
+	}
+	for i := range size {
+		node, err := raft.NewNode(urls[i], urls, storage.NewInMemoryStorage(), testOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.nodes[i] = node
+		accounts := api.NewAccountHandlers(node)
+		router := mux.NewRouter()
+		node.Routes(router)
+		router.HandleFunc("/accounts/{account_id}", accounts.GetAccount).Methods("GET")
+		router.HandleFunc("/transactions", accounts.SubmitTransaction).Methods("POST")
+		var handler http.Handler = router
+		handlers[i].Store(&handler)
+	}
+	t.Cleanup(func() {
+		for i := range c.nodes {
+			c.kill(i)
+		}
+	})
+	return c
+}
+
+// kill stops node i and its server, as if its process had died.
+func (c *cluster) kill(i int) {
+	if c.killed[i] {
+		return
+	}
+	c.killed[i] = true
+	c.nodes[i].Stop()
+	c.servers[i].CloseClientConnections()
+	c.servers[i].Close()
+}
+
+// leader waits until exactly one of the live nodes leads, and returns it.
+func (c *cluster) leader(t *testing.T) int {
+	t.Helper()
+	leader := -1
+	eventually(t, "a leader to be elected", func() bool {
+		leader = -1
+		for i, node := range c.nodes {
+			if c.killed[i] || node.Role() != raft.RoleLeader {
+				continue
+			}
+			if leader >= 0 {
+				return false
+			}
+			leader = i
+		}
+		return leader >= 0
+	})
+	return leader
+}
+
+// eventually fails the test if condition does not become true soon.
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRaft_FollowerForwardsWritesToLeader(t *testing.T) {
+	c := startCluster(t, 3)
+	leader := c.leader(t)
+	follower := c.nodes[(leader+1)%3]
+
+	var batch storage.Batch
+	batch.Set(1, storagetest.WithBalance("10"))
+	if err := follower.WriteBatch(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+	// Applied on the follower before WriteBatch returns.
+	if _, err := follower.Get(context.Background(), 1); err != nil {
+		t.Fatalf("Expected the follower to see its own write, got %v", err)
+	}
+	for i, node := range c.nodes {
+		eventually(t, "the write to reach node "+strconv.Itoa(i), func() bool {
+			_, err := node.Get(context.Background(), 1)
+			return err == nil
+		})
+	}
+
+	// A transaction begun on the follower conflicts with a commit made on
+	// the leader after it read.
+	tx, err := follower.Begin(context.Background(), storage.TxOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	current, err := tx.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch.Set(1, storagetest.WithBalance("20"))
+	if err := c.nodes[leader].WriteBatch(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.CompareAndSet(1, current, storagetest.WithBalance("30")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); !errors.Is(err, storage.ErrConflict) {
+		t.Errorf("Expected ErrConflict, got %v", err)
+	}
+}
+
+func TestRaft_KillingTheLeaderConservesBalances(t *testing.T) {
+	const accounts, initial = 5, 100
+	c := startCluster(t, 3)
+	var batch storage.Batch
+	for id := range accounts {
+		batch.Set(uint64(id+1), storagetest.WithBalance(strconv.Itoa(initial)))
+	}
+	if err := c.nodes[c.leader(t)].WriteBatch(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+
+	var live sync.Map // URLs of the servers that have not been killed
+	for i, server := range c.servers {
+		live.Store(i, server.URL)
+	}
+	client := &http.Client{Timeout: 2 * time.Second}
+	var stop atomic.Bool
+	var afterKill atomic.Int64
+	var killed atomic.Bool
+	var wg sync.WaitGroup
+	for worker := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stop.Load() {
+				i := (worker + rand.N(3)) % 3
+				url, ok := live.Load(i)
+				if !ok {
+					continue
+				}
+				body, _ := json.Marshal(model.TransactionRequest{
+					SourceAccountId:      uint64(rand.N(accounts) + 1),
+					DestinationAccountId: uint64(rand.N(accounts) + 1),
+					Amount:               strconv.Itoa(rand.N(10) + 1),
+				})
+				resp, err := client.Post(url.(string)+"/transactions", "application/json", bytes.NewReader(body))
+				if err != nil {
+					continue
+				}
+				resp.Body.Close()
+				if resp.StatusCode == http.StatusOK && killed.Load() {
+					afterKill.Add(1)
+				}
+			}
+		}()
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	leader := c.leader(t)
+	live.Delete(leader)
+	c.kill(leader)
+	killed.Store(true)
+	newLeader := c.leader(t)
+	eventually(t, "transfers to succeed under the new leader", func() bool {
+		return afterKill.Load() >= 20
+	})
+	stop.Store(true)
+	wg.Wait()
+
+	commit := c.nodes[newLeader].Status().CommitIndex
+	for i, node := range c.nodes {
+		if i == leader {
+			continue
+		}
+		eventually(t, "node "+strconv.Itoa(i)+" to apply every commit", func() bool {
+			return node.Status().Applied >= commit
+		})
+		total := money.Zero()
+		err := node.Scan(context.Background(), storage.KeyRange{}, func(key storage.Key, value storage.Value) bool {
+			total = total.Add(value.Balance)
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total.Cmp(storagetest.WithBalance(strconv.Itoa(accounts*initial)).Balance) != 0 {
+			t.Errorf("Expected node %d to hold %d in total, got %s", i, accounts*initial, total)
+		}
+	}
+}
+
+func TestRaft_RestartedNodeRecoversFromItsLog(t *testing.T) {
+	options := testOptions
+	options.Dir = t.TempDir()
+	node, err := raft.NewNode("http://localhost:0", nil, storage.NewInMemoryStorage(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var batch storage.Batch
+	batch.Set(1, storagetest.WithBalance("7"))
+	eventually(t, "the node to lead", func() bool { return node.Role() == raft.RoleLeader })
+	if err := node.WriteBatch(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+	node.Stop()
+
+	node, err = raft.NewNode("http://localhost:0", nil, storage.NewInMemoryStorage(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Stop()
+	eventually(t, "the log to be applied again", func() bool {
+		account, err := node.Get(context.Background(), 1)
+		return err == nil && account.Balance.Cmp(storagetest.WithBalance("7").Balance) == 0
+	})
+}
+
+// TestRaft_ConflictingEntriesAreDroppedFromTheLog has a follower replace
+// an entry that conflicts with the leader's, and checks that the log it
+// reopens holds the leader's entry.
+func TestRaft_ConflictingEntriesAreDroppedFromTheLog(t *testing.T) {
+	options := testOptions
+	options.Dir = t.TempDir()
+	// The follower cannot win an election without its unreachable peer,
+	// and waits long before it tries.
+	options.ElectionTimeout = time.Hour
+	peers := []string{"http://follower", "http://127.0.0.1:1"}
+	open := func() *raft.Node {
+		node, err := raft.NewNode(peers[0], peers, storage.NewInMemoryStorage(), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return node
+	}
+	set := func(index, term uint64, balance string) raft.Entry {
+		account := storagetest.WithBalance(balance)
+		return raft.Entry{Index: index, Term: term, Command: &raft.Command{Writes: []raft.Write{{Key: index, Account: &account}}}}
+	}
+	send := func(node *raft.Node, req raft.AppendRequest) raft.AppendResponse {
+		req.Leader = peers[1]
+		body, _ := json.Marshal(req)
+		rr := httptest.NewRecorder()
+		node.ServeAppend(rr, httptest.NewRequest("POST", "/raft/append", bytes.NewReader(body)))
+		var resp raft.AppendResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return resp
+	}
+
+	node := open()
+	send(node, raft.AppendRequest{Term: 1, Entries: []raft.Entry{set(1, 1, "5"), set(2, 1, "5")}})
+	if resp := send(node, raft.AppendRequest{Term: 2, PrevLogIndex: 1, PrevLogTerm: 1, Entries: []raft.Entry{set(2, 2, "9")}}); !resp.Success {
+		t.Fatalf("Expected the follower to take the leader's entry, got %+v", resp)
+	}
+	node.Stop()
+
+	node = open()
+	defer node.Stop()
+	if resp := send(node, raft.AppendRequest{Term: 2, PrevLogIndex: 2, PrevLogTerm: 2, LeaderCommit: 2}); !resp.Success {
+		t.Fatalf("Expected the reopened log to end with the leader's entry, got %+v", resp)
+	}
+	eventually(t, "the log to be applied", func() bool {
+		account, err := node.Get(context.Background(), 2)
+		return err == nil && account.Balance.Cmp(storagetest.WithBalance("9").Balance) == 0
+	})
+}
+
+func TestRaft_EncryptsItsLog(t *testing.T) {
+	ctx := context.Background()
+	options := testOptions
+	options.Dir = t.TempDir()
+	keyPath := filepath.Join(t.TempDir(), "keys")
+	writeKeys := func(ids ...int) {
+		var lines []string
+		for _, id := range ids {
+			key := make([]byte, 32)
+			for i := range key {
+				key[i] = byte(rand.N(256))
+			}
+			lines = append(lines, fmt.Sprintf("%d %s", id, base64.StdEncoding.EncodeToString(key)))
+		}
+		os.WriteFile(keyPath, []byte(strings.Join(lines, "\n")+"\n"), 0o600)
+	}
+	writeKeys(1)
+	keyring, err := storage.LoadKeyring(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options.Keyring = keyring
+	open := func() (*raft.Node, error) {
+		return raft.NewNode("http://localhost:0", nil, storage.NewInMemoryStorage(), options)
+	}
+
+	node, err := open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the node to lead", func() bool { return node.Role() == raft.RoleLeader })
+	var batch storage.Batch
+	batch.Set(1, storage.Account{Balance: storagetest.WithBalance("123.45").Balance, Owner: "alice"})
+	if err := node.WriteBatch(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+	node.Stop()
+	data, _ := os.ReadFile(filepath.Join(options.Dir, "log.jsonl"))
+	if bytes.Contains(data, []byte("123.45")) || bytes.Contains(data, []byte("alice")) {
+		t.Error("Expected the raft log to be encrypted, found the account in plain text")
+	}
+
+	// Without the key the log is left alone rather than truncated.
+	options.Keyring = nil
+	if _, err := open(); !errors.Is(err, storage.ErrDecrypt) {
+		t.Fatalf("Expected ErrDecrypt without the key, got %v", err)
+	}
+	options.Keyring = keyring
+
+	// Rotate to a new key, then drop the old one.
+	old, _ := os.ReadFile(keyPath)
+	writeKeys(2)
+	fresh, _ := os.ReadFile(keyPath)
+	os.WriteFile(keyPath, append(old, fresh...), 0o600)
+	if err := keyring.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	node, err = open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, err := node.Reencrypt(ctx); err != nil || count == 0 {
+		t.Fatalf("Expected entries re-encrypted, got %d, %v", count, err)
+	}
+	node.Stop()
+	os.WriteFile(keyPath, fresh, 0o600)
+	if err := keyring.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	node, err = open()
+	if err != nil {
+		t.Fatalf("Expected the log to open with key 2 alone, got %v", err)
+	}
+	defer node.Stop()
+	eventually(t, "the log to be applied again", func() bool {
+		account, err := node.Get(ctx, 1)
+		return err == nil && account.Owner == "alice"
+	})
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		c := startCluster(t, 3)
+		return c.nodes[c.leader(t)]
+	})
+}
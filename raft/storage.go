@@ -0,0 +1,394 @@
+package raft
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"main/storage"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Get, GetMany and Scan read the node's own backend. On a follower they may
+// miss the latest commits, but every transaction committed through the node
+// is visible once Commit returns.
+func (n *Node) Get(ctx context.Context, key storage.Key) (storage.Value, error) {
+	return n.backend.Get(ctx, key)
+}
+
+func (n *Node) GetMany(ctx context.Context, keys []storage.Key) (map[storage.Key]storage.Value, error) {
+	return n.backend.GetMany(ctx, keys)
+}
+
+func (n *Node) Scan(ctx context.Context, r storage.KeyRange, fn func(key storage.Key, value storage.Value) bool) error {
+	return n.backend.Scan(ctx, r, fn)
+}
+
+// WriteBatch commits batch as one entry of the log.
+func (n *Node) WriteBatch(ctx context.Context, batch storage.Batch) error {
+	var cmd Command
+	var err error
+	batch.Each(func(key storage.Key, value storage.Value, deleted bool) {
+		if deleted {
+			cmd.Exists = append(cmd.Exists, key)
+			cmd.Writes = append(cmd.Writes, Write{Key: key})
+			return
+		}
+		value, invalid := value.Normalize()
+		if invalid != nil {
+			err = fmt.Errorf("key %d: %w", key, invalid)
+		}
+		cmd.Writes = append(cmd.Writes, Write{Key: key, Account: &value})
+	})
+	if err != nil {
+		return err
+	}
+	if len(cmd.Writes) == 0 {
+		return nil
+	}
+	slices.Sort(cmd.Exists)
+	slices.SortFunc(cmd.Writes, compareWrites)
+	return n.submit(ctx, &cmd)
+}
+
+// submit commits cmd through the leader, forwarding it there from a
+// follower, and waits until the node has applied it. While there is no
+// leader, such as during an election, it retries for a few election
+// timeouts before it fails with ErrNotLeader.
+func (n *Node) submit(ctx context.Context, cmd *Command) error {
+	giveUp := time.Now().Add(4 * n.options.ElectionTimeout)
+	var index uint64
+	var err error
+	for {
+		index, err = n.propose(ctx, cmd)
+		if errors.Is(err, ErrNotLeader) {
+			index, err = n.forward(ctx, cmd)
+		}
+		if !errors.Is(err, ErrNotLeader) || time.Now().After(giveUp) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-n.stop:
+			return ErrStopped
+		case <-time.After(n.options.HeartbeatInterval):
+		}
+	}
+	if index == 0 {
+		return err
+	}
+	if waitErr := n.waitApplied(ctx, index); waitErr != nil {
+		return waitErr
+	}
+	return err
+}
+
+// applyCommand applies the command of a committed entry to the backend.
+// Every node applies the same entries in the same order, so they all find
+// the same values and accept or reject the command alike.
+func (n *Node) applyCommand(cmd *Command) error {
+	if cmd == nil {
+		return nil
+	}
+	ctx := context.Background()
+	for _, read := range cmd.Reads {
+		current, err := n.backend.Get(ctx, read.Key)
+		if err != nil && !errors.Is(err, storage.ErrKeyNotFound) {
+			return n.applyFailed(err)
+		}
+		found := err == nil
+		if found != (read.Account != nil) || found && !current.Equal(*read.Account) {
+			return fmt.Errorf("%w: key %d changed", storage.ErrConflict, read.Key)
+		}
+	}
+	for _, key := range cmd.Exists {
+		if _, err := n.backend.Get(ctx, key); err != nil {
+			if errors.Is(err, storage.ErrKeyNotFound) {
+				return fmt.Errorf("key %d: %w", key, err)
+			}
+			return n.applyFailed(err)
+		}
+	}
+	var batch storage.Batch
+	for _, w := range cmd.Writes {
+		if w.Account == nil {
+			batch.Delete(w.Key)
+		} else {
+			batch.Set(w.Key, *w.Account)
+		}
+	}
+	err := n.backend.WriteBatch(ctx, batch)
+	if errors.Is(err, storage.ErrKeyNotFound) || errors.Is(err, storage.ErrInvalidAccount) {
+		return err
+	}
+	if err != nil {
+		return n.applyFailed(err)
+	}
+	return nil
+}
+
+// applyFailed reports a backend that could not apply a committed entry.
+// The node's copy of the accounts no longer matches the others'.
+func (n *Node) applyFailed(err error) error {
+	slog.Error("Cannot apply committed raft entry", "node", n.self, "error", err)
+	return fmt.Errorf("cannot apply committed entry: %w", err)
+}
+
+func compareWrites(a, b Write) int {
+	return cmp.Compare(a.Key, b.Key)
+}
+
+// Begin starts a transaction that reads a snapshot of the node's backend
+// and buffers its writes. Commit sends them to the leader along with every
+// value the transaction read, and the command fails with ErrConflict if any
+// of those has changed by the time it is applied, so transactions are
+// serializable at every isolation level, except that keys inserted into a
+// scanned range are not detected. Pessimistic transactions are not
+// supported.
+func (n *Node) Begin(ctx context.Context, opts storage.TxOptions) (storage.StorageTransaction, error) {
+	if opts.Isolation < storage.IsolationDefault || opts.Isolation > storage.Serializable {
+		return nil, fmt.Errorf("%w: unknown isolation level %d", storage.ErrUnsupportedTxOptions, int(opts.Isolation))
+	}
+	if opts.Lock != storage.LockOptimistic {
+		return nil, fmt.Errorf("%w: raft transactions are optimistic", storage.ErrUnsupportedTxOptions)
+	}
+	view, err := n.backend.Begin(ctx, storage.TxOptions{ReadOnly: true, Isolation: storage.Snapshot})
+	if err != nil {
+		return nil, err
+	}
+	return &transaction{
+		node:     n,
+		ctx:      ctx,
+		view:     view,
+		readOnly: opts.ReadOnly,
+		reads:    make(map[storage.Key]*storage.Account),
+		writes:   make(map[storage.Key]*storage.Account),
+	}, nil
+}
+
+type transaction struct {
+	node     *Node
+	ctx      context.Context
+	view     storage.StorageTransaction
+	readOnly bool
+
+	lock sync.Mutex
+	done bool
+	// reads are the values the transaction read from view, nil for
+	// absent keys; writes are its own, nil for deletes.
+	reads  map[storage.Key]*storage.Account
+	writes map[storage.Key]*storage.Account
+}
+
+// read returns the value of key the transaction sees, or nil if it has
+// none. Callers must hold tx.lock.
+func (tx *transaction) read(key storage.Key) (*storage.Account, error) {
+	if err := tx.ctx.Err(); err != nil {
+		return nil, err
+	}
+	if account, ok := tx.writes[key]; ok {
+		return account, nil
+	}
+	return tx.readView(key)
+}
+
+// readView returns the value of key in the transaction's snapshot, or nil
+// if it has none, ignoring the transaction's own writes. Callers must hold
+// tx.lock.
+func (tx *transaction) readView(key storage.Key) (*storage.Account, error) {
+	if account, ok := tx.reads[key]; ok {
+		return account, nil
+	}
+	value, err := tx.view.Get(key)
+	if errors.Is(err, storage.ErrKeyNotFound) {
+		tx.reads[key] = nil
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	tx.reads[key] = &value
+	return &value, nil
+}
+
+// write buffers a write of value to key if check accepts the value the
+// transaction sees.
+func (tx *transaction) write(key storage.Key, value *storage.Value, check func(current *storage.Account) error) error {
+	if err := tx.ctx.Err(); err != nil {
+		return err
+	}
+	if tx.readOnly {
+		return storage.ErrReadOnly
+	}
+	if value != nil {
+		normalized, err := value.Normalize()
+		if err != nil {
+			return err
+		}
+		value = &normalized
+	}
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	if check != nil {
+		current, err := tx.read(key)
+		if err != nil {
+			return err
+		}
+		if err := check(current); err != nil {
+			return err
+		}
+	}
+	tx.writes[key] = value
+	return nil
+}
+
+func (tx *transaction) Set(key storage.Key, value storage.Value) error {
+	return tx.write(key, &value, nil)
+}
+
+func (tx *transaction) Insert(key storage.Key, value storage.Value) error {
+	return tx.write(key, &value, func(current *storage.Account) error {
+		if current != nil {
+			return storage.ErrKeyExists
+		}
+		return nil
+	})
+}
+
+func (tx *transaction) CompareAndSet(key storage.Key, expected, value storage.Value) error {
+	return tx.write(key, &value, func(current *storage.Account) error {
+		if current == nil {
+			return storage.ErrKeyNotFound
+		}
+		if !current.Equal(expected) {
+			return storage.ErrCompareFailed
+		}
+		return nil
+	})
+}
+
+// Delete deletes the value the transaction sees. A key the snapshot has
+// no value for, which the transaction wrote itself, is dropped from the
+// writes instead, as the backends reject deletes of keys without a value.
+func (tx *transaction) Delete(key storage.Key) error {
+	err := tx.write(key, nil, func(current *storage.Account) error {
+		if current == nil {
+			return storage.ErrKeyNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	committed, err := tx.readView(key)
+	if err != nil {
+		return err
+	}
+	if committed == nil {
+		delete(tx.writes, key)
+	}
+	return nil
+}
+
+func (tx *transaction) Get(key storage.Key) (storage.Value, error) {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	account, err := tx.read(key)
+	if err != nil {
+		return storage.Value{}, err
+	}
+	if account == nil {
+		return storage.Value{}, storage.ErrKeyNotFound
+	}
+	return *account, nil
+}
+
+// Scan visits the keys in r as of the transaction's snapshot, overlaid
+// with its own writes. The keys visited count as read. fn may use the
+// transaction.
+func (tx *transaction) Scan(r storage.KeyRange, fn func(key storage.Key, value storage.Value) bool) error {
+	visible := make(map[storage.Key]*storage.Account)
+	err := tx.view.Scan(storage.KeyRange{Start: r.Start, End: r.End}, func(key storage.Key, value storage.Value) bool {
+		visible[key] = &value
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	tx.lock.Lock()
+	for key, account := range tx.writes {
+		if r.Contains(key) {
+			visible[key] = account
+		}
+	}
+	tx.lock.Unlock()
+
+	visited := 0
+	for _, key := range slices.Sorted(maps.Keys(visible)) {
+		if visible[key] == nil {
+			continue
+		}
+		if r.Limit > 0 && visited == r.Limit {
+			return nil
+		}
+		visited++
+		value, err := tx.Get(key)
+		if errors.Is(err, storage.ErrKeyNotFound) {
+			// Deleted by fn while scanning.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !fn(key, value) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Commit submits the writes, if any, to the cluster and waits until the
+// node has applied them. A transaction that only read has nothing to check:
+// everything it read came from one snapshot.
+func (tx *transaction) Commit() error {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	if tx.done {
+		return nil
+	}
+	tx.done = true
+	tx.view.Rollback()
+	if err := tx.ctx.Err(); err != nil {
+		return err
+	}
+	if len(tx.writes) == 0 {
+		return nil
+	}
+	var cmd Command
+	for key, account := range tx.reads {
+		cmd.Reads = append(cmd.Reads, Write{Key: key, Account: account})
+	}
+	for key, account := range tx.writes {
+		cmd.Writes = append(cmd.Writes, Write{Key: key, Account: account})
+	}
+	slices.SortFunc(cmd.Reads, compareWrites)
+	slices.SortFunc(cmd.Writes, compareWrites)
+	return tx.node.submit(tx.ctx, &cmd)
+}
+
+func (tx *transaction) Rollback() error {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	if tx.done {
+		return nil
+	}
+	tx.done = true
+	return tx.view.Rollback()
+}
@@ -0,0 +1,190 @@
+package replication
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"main/storage"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Routes registers the replication endpoints on router:
+//
+//	GET  /replication/log?log_id=...&from=N  stream of entries after N (primary)
+//	GET  /replication/snapshot               every account and its Seq (primary)
+//	GET  /replication/status                 role, position and lag
+//	POST /replication/promote                turn a replica into the primary
+//
+// The log is a long-lived response, so the routes must not be wrapped in a
+// request timeout.
+func (n *Node) Routes(router *mux.Router) {
+	router.HandleFunc("/replication/log", n.StreamLog).Methods("GET")
+	router.HandleFunc("/replication/snapshot", n.ServeSnapshot).Methods("GET")
+	router.HandleFunc("/replication/status", n.ServeStatus).Methods("GET")
+	router.HandleFunc("/replication/promote", n.ServePromote).Methods("POST")
+}
+
+// PrimaryOnly wraps a handler that writes, so that a replica answers it
+// with 503 Service Unavailable and points the client to its primary in
+// the X-Primary header.
+func (n *Node) PrimaryOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		n.lock.Lock()
+		role, primaryURL := n.role, n.primaryURL
+		n.lock.Unlock()
+		if role != RolePrimary {
+			rw.Header().Set("X-Primary", primaryURL)
+			http.Error(rw, "This server is a read-only replica; send writes to the primary", http.StatusServiceUnavailable)
+			return
+		}
+		next(rw, r)
+	}
+}
+
+// StreamLog writes the entries after the query parameter from as
+// newline-delimited JSON, then every new entry as it is committed, and a
+// heartbeat entry without writes every HeartbeatInterval. It answers 410
+// Gone if the entries are no longer in the log or log_id names another
+// log.
+func (n *Node) StreamLog(rw http.ResponseWriter, r *http.Request) {
+	log := n.currentLog()
+	if log == nil {
+		http.Error(rw, ErrNotPrimary.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	from, err := strconv.ParseUint(r.URL.Query().Get("from"), 10, 64)
+	if err != nil {
+		http.Error(rw, "Invalid from", http.StatusBadRequest)
+		return
+	}
+	if r.URL.Query().Get("log_id") != log.ID() {
+		http.Error(rw, ErrLogTruncated.Error(), http.StatusGone)
+		return
+	}
+	entries, changed, err := log.since(from)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusGone)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/x-ndjson")
+	rw.WriteHeader(http.StatusOK)
+	flusher, _ := rw.(http.Flusher)
+	encoder := json.NewEncoder(rw)
+	heartbeat := time.NewTicker(n.options.HeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		for _, entry := range entries {
+			if err := encoder.Encode(entry); err != nil {
+				return
+			}
+			from = entry.Seq
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if err := encoder.Encode(Entry{Seq: log.Last(), Time: time.Now().UTC()}); err != nil {
+				return
+			}
+			entries = nil
+		case <-changed:
+			if entries, changed, err = log.since(from); err != nil {
+				// The replica fell behind by more than the log keeps;
+				// it gets 410 Gone when it reconnects.
+				return
+			}
+		}
+	}
+}
+
+// ServeSnapshot writes a Snapshot of the primary. Commits wait while the
+// accounts are read, so that the snapshot is exactly the state as of its
+// Seq.
+func (n *Node) ServeSnapshot(rw http.ResponseWriter, r *http.Request) {
+	n.commitLock.Lock()
+	log := n.currentLog()
+	if log == nil {
+		n.commitLock.Unlock()
+		http.Error(rw, ErrNotPrimary.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	snapshot := Snapshot{LogID: log.ID(), Seq: log.Last(), Accounts: []Write{}}
+	err := n.Storage.Scan(r.Context(), storage.KeyRange{}, func(key storage.Key, value storage.Value) bool {
+		snapshot.Accounts = append(snapshot.Accounts, Write{Key: key, Account: &value})
+		return true
+	})
+	n.commitLock.Unlock()
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to read accounts: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(snapshot)
+}
+
+// Status describes a node. On a replica, LagEntries is how many entries it
+// is behind the latest Seq the primary reported, and LagSeconds how long
+// ago it last had all of them (or how long it has been waiting for its
+// first snapshot).
+type Status struct {
+	Role        Role      `json:"role"`
+	LogID       string    `json:"log_id,omitempty"`
+	Seq         uint64    `json:"seq"`
+	Primary     string    `json:"primary,omitempty"`
+	PrimarySeq  uint64    `json:"primary_seq,omitempty"`
+	LagEntries  uint64    `json:"lag_entries"`
+	LagSeconds  float64   `json:"lag_seconds"`
+	Connected   bool      `json:"connected,omitempty"`
+	LastContact time.Time `json:"last_contact,omitzero"`
+}
+
+// Status returns the role and replication position of the node.
+func (n *Node) Status() Status {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.role == RolePrimary {
+		return Status{Role: RolePrimary, LogID: n.log.ID(), Seq: n.log.Last()}
+	}
+	status := Status{
+		Role:        RoleReplica,
+		LogID:       n.replica.logID,
+		Seq:         n.replica.applied,
+		Primary:     n.primaryURL,
+		PrimarySeq:  n.replica.primarySeq,
+		Connected:   n.replica.connected,
+		LastContact: n.replica.lastContact,
+	}
+	if n.replica.primarySeq > n.replica.applied {
+		status.LagEntries = n.replica.primarySeq - n.replica.applied
+	}
+	if n.replica.logID == "" || status.LagEntries > 0 {
+		status.LagSeconds = time.Since(n.replica.caughtUp).Seconds()
+	}
+	return status
+}
+
+func (n *Node) ServeStatus(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(n.Status())
+}
+
+func (n *Node) ServePromote(rw http.ResponseWriter, r *http.Request) {
+	err := n.Promote()
+	if errors.Is(err, ErrCannotPromote) {
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to promote: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(n.Status())
+}
@@ -0,0 +1,105 @@
+package replication
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"main/storage"
+	"sync"
+	"time"
+)
+
+// ErrLogTruncated is returned when a replica asks for entries that the
+// primary no longer keeps, or that belong to a different log. The replica
+// has to start over from a snapshot.
+var ErrLogTruncated = errors.New("replication log does not have the requested entries")
+
+// Write is one key written by a replicated transaction.
+type Write struct {
+	Key storage.Key `json:"key"`
+	// Account is the new value of the key, or nil if it was deleted.
+	Account *storage.Account `json:"account,omitempty"`
+}
+
+// Entry is one transaction committed on the primary. Entries are numbered
+// by Seq without gaps, in the order the primary committed them. The
+// primary also sends entries without writes as heartbeats; their Seq is
+// that of the latest entry.
+type Entry struct {
+	Seq    uint64    `json:"seq"`
+	Time   time.Time `json:"time"`
+	Writes []Write   `json:"writes,omitempty"`
+}
+
+// Log keeps the most recent entries of a primary in memory so that
+// replicas can catch up after a disconnect. Every log has a random ID, so
+// a replica does not mistake the entries of a restarted or newly promoted
+// primary for the ones it has seen.
+type Log struct {
+	id   string
+	size int
+
+	lock    sync.Mutex
+	entries []Entry // consecutive, oldest first
+	last    uint64
+	// changed is closed and replaced whenever an entry is appended.
+	changed chan struct{}
+}
+
+// newLog returns an empty log that continues after entry last and keeps
+// up to size entries.
+func newLog(last uint64, size int) *Log {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &Log{
+		id:      hex.EncodeToString(id),
+		size:    max(size, 1),
+		last:    last,
+		changed: make(chan struct{}),
+	}
+}
+
+// ID returns the random ID of the log.
+func (l *Log) ID() string {
+	return l.id
+}
+
+// Last returns the Seq of the latest entry.
+func (l *Log) Last() uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.last
+}
+
+// append adds an entry for writes and drops the oldest entry if the log is
+// full.
+func (l *Log) append(writes []Write) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.last++
+	l.entries = append(l.entries, Entry{Seq: l.last, Time: time.Now().UTC(), Writes: writes})
+	if len(l.entries) > l.size {
+		l.entries = l.entries[len(l.entries)-l.size:]
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// since returns the entries after seq and a channel that is closed when
+// the next entry is appended. It fails with ErrLogTruncated if entries
+// after seq have been dropped, or if seq is ahead of the log.
+func (l *Log) since(seq uint64) ([]Entry, <-chan struct{}, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if seq > l.last {
+		return nil, nil, ErrLogTruncated
+	}
+	if seq == l.last {
+		return nil, l.changed, nil
+	}
+	if len(l.entries) == 0 || l.entries[0].Seq > seq+1 {
+		return nil, nil, ErrLogTruncated
+	}
+	first := seq + 1 - l.entries[0].Seq
+	return append([]Entry(nil), l.entries[first:]...), l.changed, nil
+}
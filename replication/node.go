@@ -0,0 +1,325 @@
+// Package replication copies the accounts of a primary server to replicas.
+// The primary records every committed transaction in a Log and streams it
+// over HTTP; each replica applies the entries in order through a
+// storage.StorageTransaction of its own backend and serves reads only,
+// until it is promoted to primary.
+package replication
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"main/storage"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ErrNotPrimary is returned by the writes of a replica.
+var ErrNotPrimary = errors.New("node is not the primary")
+
+// ErrCannotPromote is returned by Promote on a node that is already the
+// primary, or on a replica that has not loaded a snapshot yet.
+var ErrCannotPromote = errors.New("cannot promote node")
+
+type Role string
+
+const (
+	RolePrimary Role = "primary"
+	RoleReplica Role = "replica"
+)
+
+type Options struct {
+	// LogSize is the number of entries a primary keeps for replicas that
+	// fall behind. A replica further behind starts over from a snapshot.
+	LogSize int
+	// HeartbeatInterval is how often a primary tells idle replicas its
+	// latest Seq.
+	HeartbeatInterval time.Duration
+	// RetryInterval is how long a replica waits before reconnecting to
+	// its primary.
+	RetryInterval time.Duration
+	// Client makes the requests of a replica; http.DefaultClient if nil.
+	Client *http.Client
+}
+
+var DefaultOptions = Options{
+	LogSize:           10000,
+	HeartbeatInterval: time.Second,
+	RetryInterval:     time.Second,
+}
+
+func (options Options) withDefaults() Options {
+	if options.LogSize <= 0 {
+		options.LogSize = DefaultOptions.LogSize
+	}
+	if options.HeartbeatInterval <= 0 {
+		options.HeartbeatInterval = DefaultOptions.HeartbeatInterval
+	}
+	if options.RetryInterval <= 0 {
+		options.RetryInterval = DefaultOptions.RetryInterval
+	}
+	if options.Client == nil {
+		options.Client = http.DefaultClient
+	}
+	return options
+}
+
+// Node is a storage.Storage that takes part in replication as primary or
+// replica. Reads go straight to the backend. On a primary, every commit is
+// appended to the log; on a replica, every transaction is read-only and
+// WriteBatch fails with ErrNotPrimary, so that only replicated entries
+// change the backend.
+type Node struct {
+	storage.Storage
+	options Options
+
+	// commitLock makes commits reach the log in the order they reach the
+	// backend, and keeps a snapshot consistent with its Seq. It is taken
+	// before any lock of the backend.
+	commitLock sync.Mutex
+
+	// lock guards the fields below.
+	lock       sync.Mutex
+	role       Role
+	log        *Log // nil on a replica
+	primaryURL string
+	replica    replicaState
+	stop       context.CancelFunc
+	stopped    chan struct{}
+}
+
+// NewPrimary returns a primary node for backend with an empty log. Replicas
+// start with a snapshot of the backend, so it may already hold accounts.
+func NewPrimary(backend storage.Storage, options Options) *Node {
+	options = options.withDefaults()
+	return &Node{
+		Storage: backend,
+		options: options,
+		role:    RolePrimary,
+		log:     newLog(0, options.LogSize),
+	}
+}
+
+// NewReplica returns a replica node for backend that follows the primary at
+// primaryURL, such as "http://localhost:8080", until it is promoted. The
+// backend is overwritten by the primary's snapshot.
+func NewReplica(backend storage.Storage, primaryURL string, options Options) *Node {
+	n := &Node{
+		Storage:    backend,
+		options:    options.withDefaults(),
+		role:       RoleReplica,
+		primaryURL: primaryURL,
+		replica:    replicaState{caughtUp: time.Now()},
+		stopped:    make(chan struct{}),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	n.stop = cancel
+	go n.follow(ctx)
+	return n
+}
+
+// Role returns the current role of the node.
+func (n *Node) Role() Role {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.role
+}
+
+// currentLog returns the log of a primary, or nil on a replica.
+func (n *Node) currentLog() *Log {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.log
+}
+
+// Promote turns a replica into a primary. It stops following the old
+// primary, so entries that had not arrived yet are lost, and starts a new
+// log that continues from the last applied entry.
+func (n *Node) Promote() error {
+	n.lock.Lock()
+	if n.role == RolePrimary {
+		n.lock.Unlock()
+		return fmt.Errorf("%w: already primary", ErrCannotPromote)
+	}
+	if n.replica.logID == "" {
+		n.lock.Unlock()
+		return fmt.Errorf("%w: no snapshot loaded from the primary yet", ErrCannotPromote)
+	}
+	n.stop()
+	n.lock.Unlock()
+	<-n.stopped
+
+	n.commitLock.Lock()
+	defer n.commitLock.Unlock()
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.role == RolePrimary {
+		return fmt.Errorf("%w: already primary", ErrCannotPromote)
+	}
+	n.role = RolePrimary
+	n.log = newLog(n.replica.applied, n.options.LogSize)
+	n.replica.connected = false
+	return nil
+}
+
+// Close stops a replica from following its primary.
+func (n *Node) Close() error {
+	n.lock.Lock()
+	stop, stopped := n.stop, n.stopped
+	n.lock.Unlock()
+	if stop != nil {
+		stop()
+		<-stopped
+	}
+	return nil
+}
+
+// Begin starts a transaction whose commit is logged on a primary, or a
+// read-only transaction on a replica. A pessimistic transaction takes
+// commitLock at Begin, so that it is always taken before the backend's
+// write lock.
+func (n *Node) Begin(ctx context.Context, opts storage.TxOptions) (storage.StorageTransaction, error) {
+	if n.Role() == RoleReplica {
+		opts.ReadOnly, opts.Lock = true, storage.LockOptimistic
+		return n.Storage.Begin(ctx, opts)
+	}
+	locked := opts.Lock == storage.LockPessimistic
+	if locked {
+		n.commitLock.Lock()
+	}
+	tx, err := n.Storage.Begin(ctx, opts)
+	if err != nil {
+		if locked {
+			n.commitLock.Unlock()
+		}
+		return nil, err
+	}
+	return &transaction{StorageTransaction: tx, node: n, locked: locked, writes: make(map[storage.Key]*storage.Account)}, nil
+}
+
+// WriteBatch applies batch on a primary and logs it as one entry.
+func (n *Node) WriteBatch(ctx context.Context, batch storage.Batch) error {
+	n.commitLock.Lock()
+	defer n.commitLock.Unlock()
+	log := n.currentLog()
+	if log == nil {
+		return ErrNotPrimary
+	}
+	if err := n.Storage.WriteBatch(ctx, batch); err != nil {
+		return err
+	}
+	var writes []Write
+	batch.Each(func(key storage.Key, value storage.Value, deleted bool) {
+		w := Write{Key: key}
+		if !deleted {
+			w.Account = &value
+		}
+		writes = append(writes, w)
+	})
+	if len(writes) > 0 {
+		slices.SortFunc(writes, compareWrites)
+		log.append(writes)
+	}
+	return nil
+}
+
+func compareWrites(a, b Write) int {
+	return cmp.Compare(a.Key, b.Key)
+}
+
+// transaction remembers the writes of a primary's transaction, so that
+// they can be logged when it commits.
+type transaction struct {
+	storage.StorageTransaction
+	node *Node
+	// locked is set while a pessimistic transaction holds commitLock.
+	locked bool
+	lock   sync.Mutex
+	writes map[storage.Key]*storage.Account // nil for a delete
+}
+
+func (tx *transaction) record(key storage.Key, account *storage.Account) {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	tx.writes[key] = account
+}
+
+func (tx *transaction) Set(key storage.Key, value storage.Value) error {
+	if err := tx.StorageTransaction.Set(key, value); err != nil {
+		return err
+	}
+	tx.record(key, &value)
+	return nil
+}
+
+func (tx *transaction) Insert(key storage.Key, value storage.Value) error {
+	if err := tx.StorageTransaction.Insert(key, value); err != nil {
+		return err
+	}
+	tx.record(key, &value)
+	return nil
+}
+
+func (tx *transaction) CompareAndSet(key storage.Key, expected, value storage.Value) error {
+	if err := tx.StorageTransaction.CompareAndSet(key, expected, value); err != nil {
+		return err
+	}
+	tx.record(key, &value)
+	return nil
+}
+
+func (tx *transaction) Delete(key storage.Key) error {
+	if err := tx.StorageTransaction.Delete(key); err != nil {
+		return err
+	}
+	tx.record(key, nil)
+	return nil
+}
+
+// Commit commits the transaction and, if it wrote anything, appends it to
+// the log while still holding commitLock.
+func (tx *transaction) Commit() error {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	if !tx.locked {
+		tx.node.commitLock.Lock()
+	}
+	defer tx.unlock()
+	if err := tx.StorageTransaction.Commit(); err != nil {
+		return err
+	}
+	if len(tx.writes) == 0 {
+		return nil
+	}
+	writes := make([]Write, 0, len(tx.writes))
+	for key, account := range tx.writes {
+		writes = append(writes, Write{Key: key, Account: account})
+	}
+	clear(tx.writes)
+	slices.SortFunc(writes, compareWrites)
+	if log := tx.node.currentLog(); log != nil {
+		log.append(writes)
+	}
+	return nil
+}
+
+func (tx *transaction) Rollback() error {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	clear(tx.writes)
+	err := tx.StorageTransaction.Rollback()
+	if tx.locked {
+		tx.unlock()
+	}
+	return err
+}
+
+// unlock releases commitLock, which the caller holds either because the
+// transaction is pessimistic or for its commit. Callers must hold tx.lock.
+func (tx *transaction) unlock() {
+	tx.locked = false
+	tx.node.commitLock.Unlock()
+}
@@ -0,0 +1,225 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"main/storage"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// replicaState is what a replica knows about its progress. Guarded by
+// Node.lock.
+type replicaState struct {
+	// logID is the ID of the primary's log the replica follows, or empty
+	// before the first snapshot.
+	logID   string
+	applied uint64
+	// primarySeq is the latest Seq the primary has reported.
+	primarySeq uint64
+	// caughtUp is when the replica last had every entry the primary had
+	// reported.
+	caughtUp    time.Time
+	lastContact time.Time
+	connected   bool
+}
+
+// Snapshot is every account of a primary as of the entry Seq of the log
+// with ID LogID.
+type Snapshot struct {
+	LogID    string  `json:"log_id"`
+	Seq      uint64  `json:"seq"`
+	Accounts []Write `json:"accounts"`
+}
+
+// follow keeps the replica in sync with its primary until ctx is done:
+// it loads a snapshot when it has none, or its log is gone, and otherwise
+// applies the streamed entries.
+func (n *Node) follow(ctx context.Context) {
+	defer close(n.stopped)
+	for {
+		err := n.sync(ctx)
+		n.lock.Lock()
+		n.replica.connected = false
+		n.lock.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Warn("Replication from primary interrupted", "primary", n.primaryURL, "error", err)
+		if errors.Is(err, ErrLogTruncated) {
+			n.lock.Lock()
+			n.replica.logID = ""
+			n.lock.Unlock()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(n.options.RetryInterval):
+		}
+	}
+}
+
+// sync loads a snapshot if needed and then applies entries until the
+// stream breaks.
+func (n *Node) sync(ctx context.Context) error {
+	n.lock.Lock()
+	logID, applied := n.replica.logID, n.replica.applied
+	n.lock.Unlock()
+	if logID == "" {
+		snapshot, err := n.fetchSnapshot(ctx)
+		if err != nil {
+			return err
+		}
+		if err := n.applySnapshot(ctx, snapshot); err != nil {
+			return err
+		}
+		logID, applied = snapshot.LogID, snapshot.Seq
+		slog.Info("Loaded snapshot from primary", "primary", n.primaryURL, "seq", applied, "accounts", len(snapshot.Accounts))
+	}
+
+	query := url.Values{"log_id": {logID}, "from": {strconv.FormatUint(applied, 10)}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, n.primaryURL+"/replication/log?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := n.options.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return ErrLogTruncated
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("primary answered %s", resp.Status)
+	}
+	n.lock.Lock()
+	n.replica.connected = true
+	n.lock.Unlock()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var entry Entry
+		if err := decoder.Decode(&entry); err != nil {
+			return err
+		}
+		if len(entry.Writes) == 0 {
+			n.heard(entry.Seq, false)
+			continue
+		}
+		if entry.Seq != applied+1 {
+			return fmt.Errorf("%w: expected entry %d, got %d", ErrLogTruncated, applied+1, entry.Seq)
+		}
+		if err := n.apply(ctx, entry.Writes); err != nil {
+			return fmt.Errorf("cannot apply entry %d: %w", entry.Seq, err)
+		}
+		applied = entry.Seq
+		n.heard(entry.Seq, true)
+	}
+}
+
+// heard records that the primary is at seq, and that the replica applied
+// it if applied is set.
+func (n *Node) heard(seq uint64, applied bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	now := time.Now()
+	n.replica.lastContact = now
+	n.replica.primarySeq = max(n.replica.primarySeq, seq)
+	if applied {
+		n.replica.applied = seq
+	}
+	if n.replica.applied >= n.replica.primarySeq {
+		n.replica.caughtUp = now
+	}
+}
+
+func (n *Node) fetchSnapshot(ctx context.Context) (Snapshot, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, n.primaryURL+"/replication/snapshot", nil)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	resp, err := n.options.Client.Do(req)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Snapshot{}, fmt.Errorf("primary answered %s to the snapshot request", resp.Status)
+	}
+	var snapshot Snapshot
+	if err := json.NewDecoder(resp.Body).Decode(&snapshot); err != nil {
+		return Snapshot{}, fmt.Errorf("cannot decode snapshot: %w", err)
+	}
+	return snapshot, nil
+}
+
+// applySnapshot replaces the contents of the backend with snapshot in one
+// transaction.
+func (n *Node) applySnapshot(ctx context.Context, snapshot Snapshot) error {
+	stale := make(map[storage.Key]struct{})
+	err := n.Storage.Scan(ctx, storage.KeyRange{}, func(key storage.Key, _ storage.Value) bool {
+		stale[key] = struct{}{}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	writes := snapshot.Accounts
+	for _, w := range writes {
+		delete(stale, w.Key)
+	}
+	for key := range stale {
+		writes = append(writes, Write{Key: key})
+	}
+	if err := n.apply(ctx, writes); err != nil {
+		return err
+	}
+	n.lock.Lock()
+	// The Seqs of a new log start over, so forget those of the old one.
+	n.replica.logID, n.replica.primarySeq = snapshot.LogID, snapshot.Seq
+	n.lock.Unlock()
+	n.heard(snapshot.Seq, true)
+	return nil
+}
+
+// apply writes one entry to the backend in a single transaction, retrying
+// conflicts with the replica's readers. Deleting a key that is already
+// gone is not an error, so an entry can be applied twice.
+func (n *Node) apply(ctx context.Context, writes []Write) error {
+	n.commitLock.Lock()
+	defer n.commitLock.Unlock()
+	for {
+		err := n.applyOnce(ctx, writes)
+		if !errors.Is(err, storage.ErrConflict) {
+			return err
+		}
+	}
+}
+
+func (n *Node) applyOnce(ctx context.Context, writes []Write) error {
+	tx, err := n.Storage.Begin(ctx, storage.TxOptions{})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, w := range writes {
+		if w.Account == nil {
+			err = tx.Delete(w.Key)
+			if errors.Is(err, storage.ErrKeyNotFound) {
+				err = nil
+			}
+		} else {
+			err = tx.Set(w.Key, *w.Account)
+		}
+		if err != nil {
+			return fmt.Errorf("key %d: %w", w.Key, err)
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,189 @@
+package replication_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"main/api"
+	"main/model"
+	"main/replication"
+	"main/storage"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var testOptions = replication.Options{
+	HeartbeatInterval: 10 * time.Millisecond,
+	RetryInterval:     10 * time.Millisecond,
+}
+
+// server runs a node behind the same routes as the server, on localhost.
+// The node can be replaced while the server runs, as in a restart.
+type server struct {
+	*httptest.Server
+	handler atomic.Pointer[http.Handler]
+}
+
+func serve(t *testing.T, node *replication.Node) *server {
+	s := &server{}
+	s.setNode(node)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		(*s.handler.Load()).ServeHTTP(rw, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *server) setNode(node *replication.Node) {
+	handlers := api.NewAccountHandlers(node)
+	router := mux.NewRouter()
+	node.Routes(router)
+	router.HandleFunc("/accounts", node.PrimaryOnly(handlers.CreateAccount)).Methods("POST")
+	router.HandleFunc("/accounts/{account_id}", handlers.GetAccount).Methods("GET")
+	router.HandleFunc("/transactions", node.PrimaryOnly(handlers.SubmitTransaction)).Methods("POST")
+	var handler http.Handler = router
+	s.handler.Store(&handler)
+}
+
+func post(t *testing.T, url string, body any) int {
+	t.Helper()
+	data, _ := json.Marshal(body)
+	resp, err := http.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// balance returns the balance of an account as served by url, or "" if it
+// is not found.
+func balance(t *testing.T, url string, id uint64) string {
+	t.Helper()
+	resp, err := http.Get(url + "/accounts/" + strconv.FormatUint(id, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var account model.AccountResponse
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&account) != nil {
+		return ""
+	}
+	return account.Balance
+}
+
+// eventually fails the test if condition does not become true soon.
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReplication_ReplicaFollowsPrimary(t *testing.T) {
+	primary := replication.NewPrimary(storage.NewInMemoryStorage(), testOptions)
+	primaryServer := serve(t, primary)
+	// Created before the replica starts, so it arrives with the snapshot.
+	if code := post(t, primaryServer.URL+"/accounts", model.AccountRequest{AccountId: 1, InitialBalance: "100"}); code != http.StatusOK {
+		t.Fatalf("Expected account 1 to be created, got %d", code)
+	}
+
+	replica := replication.NewReplica(storage.NewInMemoryStorage(), primaryServer.URL, testOptions)
+	defer replica.Close()
+	replicaServer := serve(t, replica)
+
+	post(t, primaryServer.URL+"/accounts", model.AccountRequest{AccountId: 2, InitialBalance: "0"})
+	post(t, primaryServer.URL+"/transactions", model.TransactionRequest{SourceAccountId: 1, DestinationAccountId: 2, Amount: "30"})
+	eventually(t, "the transfer to reach the replica", func() bool {
+		return balance(t, replicaServer.URL, 2) == "30.0000000000000000000"
+	})
+	if got := balance(t, replicaServer.URL, 1); got != "70.0000000000000000000" {
+		t.Errorf("Expected balance 70 on the replica, got %q", got)
+	}
+
+	eventually(t, "the replica to report no lag", func() bool {
+		status := replica.Status()
+		return status.Seq == primary.Status().Seq && status.LagEntries == 0 && status.Connected
+	})
+
+	if code := post(t, replicaServer.URL+"/accounts", model.AccountRequest{AccountId: 3, InitialBalance: "1"}); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the replica to refuse writes with 503, got %d", code)
+	}
+	tx, _ := replica.Begin(context.Background(), storage.TxOptions{})
+	if err := tx.Set(3, storage.Account{}); err == nil {
+		t.Error("Expected transactions on the replica to be read-only")
+	}
+	tx.Rollback()
+}
+
+func TestReplication_PromotedReplicaAcceptsWrites(t *testing.T) {
+	primary := replication.NewPrimary(storage.NewInMemoryStorage(), testOptions)
+	primaryServer := serve(t, primary)
+	post(t, primaryServer.URL+"/accounts", model.AccountRequest{AccountId: 1, InitialBalance: "5"})
+
+	replica := replication.NewReplica(storage.NewInMemoryStorage(), primaryServer.URL, testOptions)
+	defer replica.Close()
+	replicaServer := serve(t, replica)
+	eventually(t, "the replica to load the snapshot", func() bool {
+		return balance(t, replicaServer.URL, 1) == "5.0000000000000000000"
+	})
+
+	primaryServer.CloseClientConnections()
+	primaryServer.Close()
+	if code := post(t, replicaServer.URL+"/replication/promote", nil); code != http.StatusOK {
+		t.Fatalf("Expected promotion to succeed, got %d", code)
+	}
+	if replica.Role() != replication.RolePrimary {
+		t.Fatalf("Expected the replica to be primary, got %s", replica.Role())
+	}
+	if code := post(t, replicaServer.URL+"/accounts", model.AccountRequest{AccountId: 2, InitialBalance: "1"}); code != http.StatusOK {
+		t.Errorf("Expected the promoted replica to accept writes, got %d", code)
+	}
+	if code := post(t, replicaServer.URL+"/replication/promote", nil); code != http.StatusConflict {
+		t.Errorf("Expected a second promotion to be refused with 409, got %d", code)
+	}
+}
+
+func TestReplication_ReplicaReloadsSnapshotFromRestartedPrimary(t *testing.T) {
+	backend := storage.NewInMemoryStorage()
+	primary := replication.NewPrimary(backend, testOptions)
+	primaryServer := serve(t, primary)
+	post(t, primaryServer.URL+"/accounts", model.AccountRequest{AccountId: 1, InitialBalance: "1"})
+	post(t, primaryServer.URL+"/accounts", model.AccountRequest{AccountId: 2, InitialBalance: "2"})
+
+	replica := replication.NewReplica(storage.NewInMemoryStorage(), primaryServer.URL, testOptions)
+	defer replica.Close()
+	replicaServer := serve(t, replica)
+	eventually(t, "the replica to load the snapshot", func() bool {
+		return balance(t, replicaServer.URL, 2) == "2.0000000000000000000"
+	})
+
+	// A restarted primary has a new log, whose entries the replica must
+	// not confuse with those it has applied.
+	restarted := replication.NewPrimary(backend, testOptions)
+	primaryServer.setNode(restarted)
+	primaryServer.CloseClientConnections()
+	var batch storage.Batch
+	batch.Delete(1)
+	batch.Set(3, storage.Account{})
+	if err := restarted.WriteBatch(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, "the replica to apply the new primary's state", func() bool {
+		return balance(t, replicaServer.URL, 1) == "" && balance(t, replicaServer.URL, 3) != ""
+	})
+	if status := replica.Status(); status.LogID != restarted.Status().LogID {
+		t.Errorf("Expected the replica to follow log %s, got %s", restarted.Status().LogID, status.LogID)
+	}
+}
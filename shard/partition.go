@@ -0,0 +1,102 @@
+package shard
+
+import (
+	"fmt"
+	"main/storage"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Partitioner maps every key to one of Shards() shards.
+type Partitioner interface {
+	Shard(key storage.Key) int
+	Shards() int
+}
+
+// HashPartitioner spreads keys evenly over its shards with jump consistent
+// hashing, which moves only the keys of the new shard when a shard is
+// added.
+type HashPartitioner struct {
+	shards int
+}
+
+func NewHashPartitioner(shards int) (HashPartitioner, error) {
+	if shards < 1 {
+		return HashPartitioner{}, fmt.Errorf("invalid shard count %d", shards)
+	}
+	return HashPartitioner{shards: shards}, nil
+}
+
+func (p HashPartitioner) Shards() int {
+	return p.shards
+}
+
+// Shard implements "A Fast, Minimal Memory, Consistent Hash Algorithm" by
+// Lamping and Veach.
+func (p HashPartitioner) Shard(key storage.Key) int {
+	var b, j int64 = -1, 0
+	for j < int64(p.shards) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// RangePartitioner gives each shard a contiguous range of keys: shard 0
+// holds the keys below Bounds[0], shard i those from Bounds[i-1] up to
+// Bounds[i], and the last shard the rest.
+type RangePartitioner struct {
+	bounds []storage.Key
+}
+
+// NewRangePartitioner returns a partitioner for len(bounds)+1 shards. The
+// bounds must be increasing.
+func NewRangePartitioner(bounds []storage.Key) (RangePartitioner, error) {
+	for i := 1; i < len(bounds); i++ {
+		if bounds[i] <= bounds[i-1] {
+			return RangePartitioner{}, fmt.Errorf("shard bounds must be increasing, got %d after %d", bounds[i], bounds[i-1])
+		}
+	}
+	return RangePartitioner{bounds: slices.Clone(bounds)}, nil
+}
+
+func (p RangePartitioner) Shards() int {
+	return len(p.bounds) + 1
+}
+
+func (p RangePartitioner) Shard(key storage.Key) int {
+	shard, found := slices.BinarySearch(p.bounds, key)
+	if found {
+		shard++
+	}
+	return shard
+}
+
+// ParsePartitioner returns the partitioner named by by, "hash" or "range",
+// for the given number of shards. A range partitioner takes its bounds
+// from a comma-separated list such as "1000,2000", which must have one
+// bound fewer than there are shards.
+func ParsePartitioner(by string, shards int, bounds string) (Partitioner, error) {
+	switch by {
+	case "hash":
+		return NewHashPartitioner(shards)
+	case "range":
+		var keys []storage.Key
+		if bounds != "" {
+			for _, field := range strings.Split(bounds, ",") {
+				key, err := strconv.ParseUint(strings.TrimSpace(field), 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid shard bound %q", field)
+				}
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) != shards-1 {
+			return nil, fmt.Errorf("%d shards need %d bounds, got %d", shards, shards-1, len(keys))
+		}
+		return NewRangePartitioner(keys)
+	}
+	return nil, fmt.Errorf("unknown partitioning %q", by)
+}
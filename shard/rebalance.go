@@ -0,0 +1,71 @@
+package shard
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"main/storage"
+	"main/twopc"
+	"slices"
+)
+
+// rebalanceChunk is the number of keys Rebalance moves at a time.
+const rebalanceChunk = 1000
+
+// Rebalance moves every key of shards to the shard partitioner maps it to,
+// after the number of shards or their mapping changed, and returns how many
+// keys it moved. It leaves twopc.MarkerKey where it is, as it belongs to
+// the shard and not to an account. shards lists every backend that may hold keys, in shard
+// order: the first partitioner.Shards() are those of the new layout, and
+// any after them are emptied.
+//
+// Keys are copied to their new shard before they are deleted from the old
+// one, so if Rebalance is interrupted a key may be on both, and running it
+// again finishes the move. Nothing else may write to the shards meanwhile.
+func Rebalance(ctx context.Context, shards []storage.Storage, partitioner Partitioner) (int, error) {
+	if len(shards) < partitioner.Shards() {
+		return 0, fmt.Errorf("partitioner has %d shards, got %d backends", partitioner.Shards(), len(shards))
+	}
+	moved := 0
+	for from, source := range shards {
+		var misplaced []storage.Key
+		err := source.Scan(ctx, storage.KeyRange{}, func(key storage.Key, _ storage.Value) bool {
+			if key != twopc.MarkerKey && partitioner.Shard(key) != from {
+				misplaced = append(misplaced, key)
+			}
+			return true
+		})
+		if err != nil {
+			return moved, fmt.Errorf("shard %d: %w", from, err)
+		}
+		for chunk := range slices.Chunk(misplaced, rebalanceChunk) {
+			values, err := source.GetMany(ctx, chunk)
+			if err != nil {
+				return moved, fmt.Errorf("shard %d: %w", from, err)
+			}
+			batches := make(map[int]*storage.Batch)
+			var deletes storage.Batch
+			for key, value := range values {
+				to := partitioner.Shard(key)
+				if batches[to] == nil {
+					batches[to] = &storage.Batch{}
+				}
+				batches[to].Set(key, value)
+				deletes.Delete(key)
+			}
+			for to, batch := range batches {
+				if err := shards[to].WriteBatch(ctx, *batch); err != nil {
+					return moved, fmt.Errorf("shard %d: %w", to, err)
+				}
+			}
+			if err := source.WriteBatch(ctx, deletes); err != nil {
+				return moved, fmt.Errorf("shard %d: %w", from, err)
+			}
+			moved += len(values)
+		}
+		if len(misplaced) > 0 {
+			slog.Info("Moved keys off shard", "shard", from, "keys", len(misplaced))
+		}
+	}
+	return moved, nil
+}
@@ -0,0 +1,221 @@
+package shard_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"main/api"
+	"main/model"
+	"main/money"
+	"main/shard"
+	"main/storage"
+	"main/storage/storagetest"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func newShards(n int) []storage.Storage {
+	shards := make([]storage.Storage, n)
+	for i := range shards {
+		shards[i] = storage.NewInMemoryStorage()
+	}
+	return shards
+}
+
+func TestHashPartitioner_MovesOnlyKeysOfTheNewShard(t *testing.T) {
+	three, _ := shard.NewHashPartitioner(3)
+	four, _ := shard.NewHashPartitioner(4)
+	counts := make([]int, 4)
+	for key := range storage.Key(10000) {
+		before, after := three.Shard(key), four.Shard(key)
+		if after != before && after != 3 {
+			t.Fatalf("Key %d moved from shard %d to %d", key, before, after)
+		}
+		counts[after]++
+	}
+	for i, count := range counts {
+		if count < 2000 || count > 3000 {
+			t.Errorf("Expected about 2500 keys on shard %d, got %d", i, count)
+		}
+	}
+}
+
+func TestRangePartitioner(t *testing.T) {
+	p, err := shard.ParsePartitioner("range", 3, "100,200")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[storage.Key]int{0: 0, 99: 0, 100: 1, 199: 1, 200: 2, 1 << 60: 2} {
+		if got := p.Shard(key); got != want {
+			t.Errorf("Expected key %d on shard %d, got %d", key, want, got)
+		}
+	}
+	if _, err := shard.ParsePartitioner("range", 3, "200,100"); err == nil {
+		t.Error("Expected decreasing bounds to be rejected")
+	}
+}
+
+func TestStorage_CrossShardTransactionIsAtomic(t *testing.T) {
+	ctx := context.Background()
+	shards := newShards(2)
+	p, _ := shard.NewRangePartitioner([]storage.Key{100})
+	s, err := shard.New(shards, p, shard.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var batch storage.Batch
+	batch.Set(1, storagetest.WithBalance("10"))
+	batch.Set(200, storagetest.WithBalance("10"))
+	if err := s.WriteBatch(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := shards[1].Get(ctx, 200); err != nil {
+		t.Fatalf("Expected key 200 on shard 1, got %v", err)
+	}
+
+	tx, err := s.Begin(ctx, storage.TxOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, _ := tx.Get(1)
+	destination, _ := tx.Get(200)
+	if err := tx.CompareAndSet(1, source, storagetest.WithBalance("5")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.CompareAndSet(200, destination, storagetest.WithBalance("15")); err != nil {
+		t.Fatal(err)
+	}
+	// Another transaction changes the source in the meantime.
+	other, _ := s.Begin(ctx, storage.TxOptions{})
+	other.Set(1, storagetest.WithBalance("0"))
+	if err := other.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("Expected ErrConflict, got %v", err)
+	}
+	if account, _ := s.Get(ctx, 200); account.Balance.Cmp(storagetest.WithBalance("10").Balance) != 0 {
+		t.Errorf("Expected the destination to keep 10, got %s", account.Balance)
+	}
+
+	values, err := s.GetMany(ctx, []storage.Key{1, 200, 300})
+	if err != nil || len(values) != 2 {
+		t.Errorf("Expected 2 accounts from GetMany, got %v, %v", values, err)
+	}
+	var keys []storage.Key
+	s.Scan(ctx, storage.KeyRange{}, func(key storage.Key, _ storage.Value) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if len(keys) != 2 || keys[0] != 1 || keys[1] != 200 {
+		t.Errorf("Expected Scan to visit 1 and 200 in order, got %v", keys)
+	}
+}
+
+func TestStorage_ConcurrentTransfersAcrossShardsConserveMoney(t *testing.T) {
+	const accounts, initial = 10, 1000
+	ctx := context.Background()
+	p, _ := shard.NewHashPartitioner(3)
+	s, err := shard.New(newShards(3), p, shard.Options{LogDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var batch storage.Batch
+	for id := range storage.Key(accounts) {
+		batch.Set(id+1, storagetest.WithBalance(strconv.Itoa(initial)))
+	}
+	if err := s.WriteBatch(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+
+	handlers := api.NewAccountHandlers(s)
+	var wg sync.WaitGroup
+	for range 500 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			source := uint64(rand.N(accounts) + 1)
+			body, _ := json.Marshal(model.TransactionRequest{
+				SourceAccountId:      source,
+				DestinationAccountId: source%accounts + 1,
+				Amount:               strconv.Itoa(rand.N(10) + 1),
+			})
+			rr := httptest.NewRecorder()
+			handlers.SubmitTransaction(rr, httptest.NewRequest(http.MethodPost, "/transactions", bytes.NewReader(body)))
+			if rr.Code != http.StatusOK {
+				t.Errorf("Transfer failed with status %d: %s", rr.Code, rr.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+
+	total := money.Zero()
+	s.Scan(ctx, storage.KeyRange{}, func(key storage.Key, value storage.Value) bool {
+		total = total.Add(value.Balance)
+		return true
+	})
+	if total.Cmp(storagetest.WithBalance(strconv.Itoa(accounts*initial)).Balance) != 0 {
+		t.Errorf("Expected %d in total, got %s", accounts*initial, total)
+	}
+}
+
+func TestRebalance_MovesKeysToTheirNewShard(t *testing.T) {
+	ctx := context.Background()
+	shards := newShards(3)
+	var batch storage.Batch
+	for id := range storage.Key(100) {
+		batch.Set(id, storagetest.WithBalance(strconv.Itoa(int(id))))
+	}
+	if err := shards[0].WriteBatch(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+
+	p, _ := shard.NewHashPartitioner(3)
+	moved, err := shard.Rebalance(ctx, shards, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved == 0 || moved == 100 {
+		t.Errorf("Expected some keys to move, got %d", moved)
+	}
+	for id := range storage.Key(100) {
+		account, err := shards[p.Shard(id)].Get(ctx, id)
+		if err != nil || account.Balance.Cmp(storagetest.WithBalance(strconv.Itoa(int(id))).Balance) != 0 {
+			t.Errorf("Expected key %d with balance %d on shard %d, got %v, %v", id, id, p.Shard(id), account.Balance, err)
+		}
+	}
+	if moved, _ := shard.Rebalance(ctx, shards, p); moved != 0 {
+		t.Errorf("Expected a second rebalance to move nothing, got %d", moved)
+	}
+
+	// Shrinking to two shards empties the third.
+	two, _ := shard.NewHashPartitioner(2)
+	if _, err := shard.Rebalance(ctx, shards, two); err != nil {
+		t.Fatal(err)
+	}
+	shards[2].Scan(ctx, storage.KeyRange{}, func(key storage.Key, _ storage.Value) bool {
+		t.Errorf("Expected shard 2 to be empty, found key %d", key)
+		return false
+	})
+}
+
+func TestConformance(t *testing.T) {
+	for _, count := range []int{1, 3} {
+		t.Run(strconv.Itoa(count)+" shards", func(t *testing.T) {
+			storagetest.Run(t, func(t *testing.T) storage.Storage {
+				p, _ := shard.NewHashPartitioner(count)
+				s, err := shard.New(newShards(count), p, shard.Options{LogDir: t.TempDir()})
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { s.Close() })
+				return s
+			})
+		})
+	}
+}
@@ -0,0 +1,293 @@
+// Package shard spreads the accounts over several storage backends, the
+// shards, by key. A transaction that touches one shard runs in a
+// transaction of that shard alone. One that touches several is committed
+// on all of them with two-phase commit (package twopc): each shard checks
+// that nothing the transaction read there has changed and prepares its
+// writes, and only then do they all commit.
+package shard
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"main/storage"
+	"main/twopc"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// Storage is a storage.Storage whose keys are spread over shards by a
+// Partitioner.
+type Storage struct {
+	shards      []storage.Storage
+	partitioner Partitioner
+
+	participants []*twopc.Participant
+	coordinator  *twopc.Coordinator
+
+	// crossShard is held by commits that span shards, and shared by reads
+	// that span shards, so that those reads see each such commit on every
+	// shard or on none.
+	crossShard sync.RWMutex
+}
+
+// Options configure a Storage.
+type Options struct {
+	// LogDir holds the journals of the two-phase commits across shards,
+	// so that those a crash interrupts are finished on restart. If empty,
+	// the journals are not kept, which is only safe if the backends do
+	// not survive a crash either.
+	LogDir string
+	// Keyring, if set, encrypts the journals.
+	Keyring *storage.Keyring
+}
+
+// New returns a Storage over shards, with partitioner choosing the shard of
+// each key. It first finishes the transactions across shards that were
+// interrupted, as recorded in options.LogDir.
+func New(shards []storage.Storage, partitioner Partitioner, options Options) (*Storage, error) {
+	if len(shards) != partitioner.Shards() {
+		return nil, fmt.Errorf("partitioner has %d shards, got %d backends", partitioner.Shards(), len(shards))
+	}
+	s := &Storage{shards: shards, partitioner: partitioner}
+	journal := func(name string) string {
+		if options.LogDir == "" {
+			return ""
+		}
+		return filepath.Join(options.LogDir, name)
+	}
+	if options.LogDir != "" {
+		if err := os.MkdirAll(options.LogDir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	for i, backend := range shards {
+		participant, err := twopc.NewParticipantWithOptions(backend, journal(fmt.Sprintf("participant-%d.log", i)), twopc.Options{Keyring: options.Keyring})
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.participants = append(s.participants, participant)
+	}
+	coordinator, err := twopc.NewCoordinatorWithOptions(journal("coordinator.log"), twopc.Options{Keyring: options.Keyring})
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.coordinator = coordinator
+	if err := coordinator.Recover(context.Background(), s.participants); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close closes the journals of the two-phase commits. It does not close
+// the shards.
+func (s *Storage) Close() error {
+	var errs []error
+	for _, participant := range s.participants {
+		errs = append(errs, participant.Close())
+	}
+	if s.coordinator != nil {
+		errs = append(errs, s.coordinator.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Reencrypt rewrites the journals with the current key of Options.Keyring,
+// after the keyring was rotated, and returns how many records it rewrote.
+// The shards are not re-encrypted: they are backends of their own.
+func (s *Storage) Reencrypt(ctx context.Context) (int, error) {
+	total := 0
+	for _, participant := range s.participants {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+		count, err := participant.Reencrypt()
+		total += count
+		if err != nil {
+			return total, err
+		}
+	}
+	count, err := s.coordinator.Reencrypt()
+	return total + count, err
+}
+
+func (s *Storage) shard(key storage.Key) storage.Storage {
+	return s.shards[s.partitioner.Shard(key)]
+}
+
+// reserved fails for twopc.MarkerKey, which the participants keep on every
+// shard and is not an account.
+func reserved(key storage.Key) error {
+	if key == twopc.MarkerKey {
+		return fmt.Errorf("%w: key %d is reserved", storage.ErrInvalidAccount, key)
+	}
+	return nil
+}
+
+func (s *Storage) Get(ctx context.Context, key storage.Key) (storage.Value, error) {
+	if key == twopc.MarkerKey {
+		return storage.Value{}, storage.ErrKeyNotFound
+	}
+	return s.shard(key).Get(ctx, key)
+}
+
+func (s *Storage) GetMany(ctx context.Context, keys []storage.Key) (map[storage.Key]storage.Value, error) {
+	byShard := make(map[int][]storage.Key)
+	for _, key := range keys {
+		if key == twopc.MarkerKey {
+			continue
+		}
+		shard := s.partitioner.Shard(key)
+		byShard[shard] = append(byShard[shard], key)
+	}
+	if len(byShard) > 1 {
+		s.crossShard.RLock()
+		defer s.crossShard.RUnlock()
+	}
+	values := make(map[storage.Key]storage.Value, len(keys))
+	for shard, keys := range byShard {
+		found, err := s.shards[shard].GetMany(ctx, keys)
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(values, found)
+	}
+	return values, nil
+}
+
+// entry is a key and value visited by a scan.
+type entry struct {
+	key   storage.Key
+	value storage.Value
+}
+
+// Scan visits the keys of every shard in r in key order.
+func (s *Storage) Scan(ctx context.Context, r storage.KeyRange, fn func(key storage.Key, value storage.Value) bool) error {
+	s.crossShard.RLock()
+	entries, err := scanShards(len(s.shards), r, func(shard int, visit func(storage.Key, storage.Value) bool) error {
+		return s.shards[shard].Scan(ctx, r, visit)
+	})
+	s.crossShard.RUnlock()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !fn(e.key, e.value) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// scanShards collects the first r.Limit keys in r of every shard through
+// scan, but for twopc.MarkerKey, and merges them in key order.
+func scanShards(shards int, r storage.KeyRange, scan func(shard int, visit func(storage.Key, storage.Value) bool) error) ([]entry, error) {
+	var entries []entry
+	for shard := range shards {
+		err := scan(shard, func(key storage.Key, value storage.Value) bool {
+			if key != twopc.MarkerKey {
+				entries = append(entries, entry{key, value})
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	slices.SortFunc(entries, func(a, b entry) int { return cmp.Compare(a.key, b.key) })
+	if r.Limit > 0 && len(entries) > r.Limit {
+		entries = entries[:r.Limit]
+	}
+	return entries, nil
+}
+
+// WriteBatch applies batch on its shard, or through the coordinator if it
+// writes to several.
+func (s *Storage) WriteBatch(ctx context.Context, batch storage.Batch) error {
+	byShard := make(map[int]*storage.Batch)
+	writes := make(map[storage.Key]*storage.Value)
+	var invalid error
+	batch.Each(func(key storage.Key, value storage.Value, deleted bool) {
+		if err := reserved(key); err != nil {
+			invalid = err
+		}
+		shard := s.partitioner.Shard(key)
+		if byShard[shard] == nil {
+			byShard[shard] = &storage.Batch{}
+		}
+		if deleted {
+			byShard[shard].Delete(key)
+			writes[key] = nil
+		} else {
+			byShard[shard].Set(key, value)
+			writes[key] = &value
+		}
+	})
+	if invalid != nil {
+		return invalid
+	}
+	if len(byShard) > 1 {
+		// A delete of a missing key fails the batch.
+		var deleted []storage.Key
+		for key, value := range writes {
+			if value == nil {
+				deleted = append(deleted, key)
+			}
+		}
+		return s.commit(ctx, nil, deleted, writes)
+	}
+	for shard, batch := range byShard {
+		return s.shards[shard].WriteBatch(ctx, *batch)
+	}
+	return nil
+}
+
+// read is what a transaction saw of a key before writing it: a value, or
+// that the key had a value it did not look at, or that the key was absent.
+type read struct {
+	account *storage.Account
+	exists  bool
+}
+
+// commit applies writes across shards with two-phase commit, provided that
+// reads still hold and the keys in mustExist have values. Each shard
+// involved prepares its part in turn, in shard order so that concurrent
+// commits cannot deadlock, holding its write lock until the coordinator
+// decides.
+func (s *Storage) commit(ctx context.Context, reads map[storage.Key]read, mustExist []storage.Key, writes map[storage.Key]*storage.Value) error {
+	branches := make(map[int]*twopc.Branch)
+	branch := func(key storage.Key) *twopc.Branch {
+		shard := s.partitioner.Shard(key)
+		if branches[shard] == nil {
+			branches[shard] = &twopc.Branch{Participant: s.participants[shard]}
+		}
+		return branches[shard]
+	}
+	for key, r := range reads {
+		b := branch(key)
+		b.Reads = append(b.Reads, twopc.Read{Key: key, Account: r.account, Exists: r.exists})
+	}
+	for _, key := range mustExist {
+		b := branch(key)
+		b.MustExist = append(b.MustExist, key)
+	}
+	for _, key := range slices.Sorted(maps.Keys(writes)) {
+		b := branch(key)
+		b.Writes = append(b.Writes, twopc.Write{Key: key, Account: writes[key]})
+	}
+	ordered := make([]twopc.Branch, 0, len(branches))
+	for _, shard := range slices.Sorted(maps.Keys(branches)) {
+		ordered = append(ordered, *branches[shard])
+	}
+
+	s.crossShard.Lock()
+	defer s.crossShard.Unlock()
+	return s.coordinator.Run(ctx, ordered)
+}
@@ -0,0 +1,243 @@
+package shard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"main/storage"
+	"main/twopc"
+	"sync"
+)
+
+// Begin starts a transaction that begins a transaction on each shard as it
+// first touches a key there. If it only ever touches one shard, it commits
+// there; otherwise its writes are committed by the coordinator, which fails
+// with ErrConflict if anything it read has changed, except that keys added
+// to a range it scanned are not detected. A pessimistic transaction is only
+// supported with a single shard, as it would lock the shards in the order
+// it touches them.
+func (s *Storage) Begin(ctx context.Context, opts storage.TxOptions) (storage.StorageTransaction, error) {
+	if opts.Lock == storage.LockPessimistic && len(s.shards) > 1 {
+		return nil, fmt.Errorf("%w: pessimistic transactions cannot span shards", storage.ErrUnsupportedTxOptions)
+	}
+	tx := &transaction{
+		storage: s,
+		ctx:     ctx,
+		opts:    opts,
+		subs:    make(map[int]storage.StorageTransaction),
+		reads:   make(map[storage.Key]read),
+		writes:  make(map[storage.Key]*storage.Value),
+	}
+	if len(s.shards) == 1 {
+		// The shard checks the options, and takes its locks, right away.
+		if _, err := tx.sub(0); err != nil {
+			return nil, err
+		}
+		return tx, nil
+	}
+	// The shards only see the options once the transaction touches them,
+	// so they are checked here as well.
+	if opts.Isolation < storage.IsolationDefault || opts.Isolation > storage.Serializable {
+		return nil, fmt.Errorf("%w: unknown isolation level %d", storage.ErrUnsupportedTxOptions, int(opts.Isolation))
+	}
+	if opts.Lock != storage.LockOptimistic {
+		return nil, fmt.Errorf("%w: unknown lock mode %d", storage.ErrUnsupportedTxOptions, int(opts.Lock))
+	}
+	return tx, nil
+}
+
+// errEnded is returned by a transaction used after Commit or Rollback.
+var errEnded = errors.New("transaction has ended")
+
+type transaction struct {
+	storage *Storage
+	ctx     context.Context
+	opts    storage.TxOptions
+
+	lock sync.Mutex
+	done bool
+	// subs are the transactions begun on each shard.
+	subs map[int]storage.StorageTransaction
+	// reads are what the transaction saw of keys before it wrote them, for
+	// the coordinator to check; writes are its writes, nil for deletes.
+	reads  map[storage.Key]read
+	writes map[storage.Key]*storage.Value
+}
+
+// sub returns the transaction on shard, beginning it if needed.
+func (tx *transaction) sub(shard int) (storage.StorageTransaction, error) {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	if tx.done {
+		return nil, errEnded
+	}
+	if sub, ok := tx.subs[shard]; ok {
+		return sub, nil
+	}
+	sub, err := tx.storage.shards[shard].Begin(tx.ctx, tx.opts)
+	if err != nil {
+		return nil, fmt.Errorf("shard %d: %w", shard, err)
+	}
+	tx.subs[shard] = sub
+	return sub, nil
+}
+
+func (tx *transaction) subFor(key storage.Key) (storage.StorageTransaction, error) {
+	return tx.sub(tx.storage.partitioner.Shard(key))
+}
+
+// record notes what the transaction saw of key, unless it already read or
+// wrote it, and its write of value if written is set.
+func (tx *transaction) record(key storage.Key, seen read, value *storage.Value, written bool) {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	if _, ok := tx.writes[key]; !ok {
+		if _, ok := tx.reads[key]; !ok {
+			tx.reads[key] = seen
+		}
+	}
+	if written {
+		tx.writes[key] = value
+	}
+}
+
+func (tx *transaction) Get(key storage.Key) (storage.Value, error) {
+	if key == twopc.MarkerKey {
+		return storage.Value{}, storage.ErrKeyNotFound
+	}
+	sub, err := tx.subFor(key)
+	if err != nil {
+		return storage.Value{}, err
+	}
+	value, err := sub.Get(key)
+	if errors.Is(err, storage.ErrKeyNotFound) {
+		tx.record(key, read{}, nil, false)
+	} else if err == nil {
+		tx.record(key, read{account: &value, exists: true}, nil, false)
+	}
+	return value, err
+}
+
+func (tx *transaction) Set(key storage.Key, value storage.Value) error {
+	if err := reserved(key); err != nil {
+		return err
+	}
+	sub, err := tx.subFor(key)
+	if err != nil {
+		return err
+	}
+	if err := sub.Set(key, value); err != nil {
+		return err
+	}
+	tx.lock.Lock()
+	tx.writes[key] = &value
+	tx.lock.Unlock()
+	return nil
+}
+
+func (tx *transaction) Insert(key storage.Key, value storage.Value) error {
+	if err := reserved(key); err != nil {
+		return err
+	}
+	sub, err := tx.subFor(key)
+	if err != nil {
+		return err
+	}
+	if err := sub.Insert(key, value); err != nil {
+		return err
+	}
+	tx.record(key, read{}, &value, true)
+	return nil
+}
+
+func (tx *transaction) CompareAndSet(key storage.Key, expected, value storage.Value) error {
+	if err := reserved(key); err != nil {
+		return err
+	}
+	sub, err := tx.subFor(key)
+	if err != nil {
+		return err
+	}
+	if err := sub.CompareAndSet(key, expected, value); err != nil {
+		return err
+	}
+	tx.record(key, read{account: &expected, exists: true}, &value, true)
+	return nil
+}
+
+func (tx *transaction) Delete(key storage.Key) error {
+	if err := reserved(key); err != nil {
+		return err
+	}
+	sub, err := tx.subFor(key)
+	if err != nil {
+		return err
+	}
+	if err := sub.Delete(key); err != nil {
+		return err
+	}
+	tx.record(key, read{exists: true}, nil, true)
+	return nil
+}
+
+// Scan visits the keys in r of every shard, merged in key order. The keys
+// visited count as read. fn may use the transaction.
+func (tx *transaction) Scan(r storage.KeyRange, fn func(key storage.Key, value storage.Value) bool) error {
+	entries, err := scanShards(len(tx.storage.shards), r, func(shard int, visit func(storage.Key, storage.Value) bool) error {
+		sub, err := tx.sub(shard)
+		if err != nil {
+			return err
+		}
+		return sub.Scan(r, visit)
+	})
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		tx.record(e.key, read{account: &e.value, exists: true}, nil, false)
+		if !fn(e.key, e.value) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Commit commits a transaction that touched a single shard on that shard,
+// and hands one that touched several to the coordinator.
+func (tx *transaction) Commit() error {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	if tx.done {
+		return nil
+	}
+	tx.done = true
+	if len(tx.subs) == 1 {
+		for _, sub := range tx.subs {
+			return sub.Commit()
+		}
+	}
+	if len(tx.subs) == 0 {
+		return nil
+	}
+	for _, sub := range tx.subs {
+		sub.Rollback()
+	}
+	if err := tx.ctx.Err(); err != nil {
+		return err
+	}
+	return tx.storage.commit(tx.ctx, tx.reads, nil, tx.writes)
+}
+
+func (tx *transaction) Rollback() error {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	if tx.done {
+		return nil
+	}
+	tx.done = true
+	var errs []error
+	for _, sub := range tx.subs {
+		errs = append(errs, sub.Rollback())
+	}
+	return errors.Join(errs...)
+}
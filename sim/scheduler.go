@@ -0,0 +1,181 @@
+// Package sim runs the account handlers in a deterministic simulation.
+// Simulated requests are goroutines, but a Scheduler lets only one of them
+// run at a time and switches between them at every storage operation,
+// picking the next one with a seeded random source. Time is virtual and
+// the handlers draw their randomness from the same seed, so a seed
+// replays exactly the same interleaving, including the storage faults
+// injected along the way.
+package sim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"time"
+)
+
+// ErrStuck is returned by Scheduler.Run when a task blocks on something
+// the scheduler does not control, such as a lock held by another task,
+// so no task can go on.
+var ErrStuck = errors.New("simulated task blocked outside the scheduler")
+
+// stuckAfter is how long Run waits in real time for the running task to
+// reach its next scheduling point before it gives up with ErrStuck.
+const stuckAfter = 10 * time.Second
+
+// epoch is the virtual time a Scheduler starts at.
+var epoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// task is a goroutine run by the Scheduler.
+type task struct {
+	id int
+	// wake hands the task its turn to run.
+	wake chan struct{}
+	// until is when a sleeping task wakes up; zero if it is runnable.
+	until time.Time
+	done  bool
+}
+
+// Scheduler runs tasks one at a time in an order decided by its seed.
+// A task runs until it calls Yield or Sleep, or returns; the scheduler
+// then picks the next task at random among those that can run. Once they
+// all sleep, virtual time jumps to the earliest wake-up.
+type Scheduler struct {
+	random *rand.Rand
+	now    time.Time
+	tasks  []*task
+	// current is the running task, nil outside Run.
+	current *task
+	// paused is signalled by the running task when it yields, sleeps or
+	// returns.
+	paused chan struct{}
+	// failure is the first panic of a task.
+	failure error
+	steps   int
+}
+
+// NewScheduler returns a scheduler whose choices, and whose Rand, follow
+// seed.
+func NewScheduler(seed uint64) *Scheduler {
+	return &Scheduler{
+		random: rand.New(rand.NewPCG(seed, seed)),
+		now:    epoch,
+		paused: make(chan struct{}),
+	}
+}
+
+// Rand returns the scheduler's random source. Tasks may use it freely,
+// as only one runs at a time.
+func (s *Scheduler) Rand() *rand.Rand {
+	return s.random
+}
+
+// Steps returns how many times the scheduler has picked a task to run.
+func (s *Scheduler) Steps() int {
+	return s.steps
+}
+
+// Go adds a task that runs fn once the scheduler picks it. It may be
+// called before Run or by a running task.
+func (s *Scheduler) Go(fn func()) {
+	t := &task{id: len(s.tasks), wake: make(chan struct{})}
+	s.tasks = append(s.tasks, t)
+	go func() {
+		<-t.wake
+		defer func() {
+			if r := recover(); r != nil && s.failure == nil {
+				s.failure = fmt.Errorf("task %d panicked: %v", t.id, r)
+			}
+			t.done = true
+			s.paused <- struct{}{}
+		}()
+		fn()
+	}()
+}
+
+// Run runs the tasks until they have all returned. It fails if a task
+// panicked, or with ErrStuck if the running task stops reaching
+// scheduling points.
+func (s *Scheduler) Run() error {
+	defer func() { s.current = nil }()
+	timer := time.NewTimer(stuckAfter)
+	defer timer.Stop()
+	for {
+		var runnable []*task
+		for _, t := range s.tasks {
+			if !t.done && t.until.IsZero() {
+				runnable = append(runnable, t)
+			}
+		}
+		if len(runnable) == 0 && !s.advance() {
+			return s.failure
+		}
+		if len(runnable) == 0 {
+			continue
+		}
+		s.steps++
+		s.current = runnable[s.random.IntN(len(runnable))]
+		s.current.wake <- struct{}{}
+		timer.Reset(stuckAfter)
+		select {
+		case <-s.paused:
+		case <-timer.C:
+			return fmt.Errorf("%w: task %d", ErrStuck, s.current.id)
+		}
+	}
+}
+
+// advance moves virtual time to the earliest wake-up of a sleeping task
+// and wakes every task due by then. It returns false if no task sleeps.
+func (s *Scheduler) advance() bool {
+	sleeping := slices.DeleteFunc(slices.Clone(s.tasks), func(t *task) bool { return t.done || t.until.IsZero() })
+	if len(sleeping) == 0 {
+		return false
+	}
+	s.now = slices.MinFunc(sleeping, func(a, b *task) int { return a.until.Compare(b.until) }).until
+	for _, t := range sleeping {
+		if !t.until.After(s.now) {
+			t.until = time.Time{}
+		}
+	}
+	return true
+}
+
+// pause hands control back to Run and waits for the running task's next
+// turn. Outside Run, where there is no other task to switch to, it does
+// nothing.
+func (s *Scheduler) pause() {
+	t := s.current
+	if t == nil {
+		return
+	}
+	s.paused <- struct{}{}
+	<-t.wake
+}
+
+// Yield lets the scheduler switch to another task: a scheduling point.
+func (s *Scheduler) Yield() {
+	s.pause()
+}
+
+// Now returns the virtual time.
+func (s *Scheduler) Now() time.Time {
+	return s.now
+}
+
+// Sleep suspends the running task until virtual time has advanced by d.
+// Outside Run it advances virtual time itself.
+func (s *Scheduler) Sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if s.current == nil {
+		s.now = s.now.Add(d)
+		return nil
+	}
+	s.current.until = s.now.Add(max(d, 1))
+	s.pause()
+	return ctx.Err()
+}
@@ -0,0 +1,115 @@
+package sim_test
+
+import (
+	"context"
+	"flag"
+	"main/sim"
+	"slices"
+	"testing"
+	"time"
+)
+
+var (
+	seed = flag.Uint64("sim.seed", 0, "simulate only this seed, as printed by a failing run")
+	runs = flag.Int("sim.runs", 2000, "number of seeds to simulate")
+)
+
+func TestSimulation_TransfersConserveMoney(t *testing.T) {
+	seeds := make([]uint64, 0, *runs)
+	if *seed != 0 {
+		seeds = append(seeds, *seed)
+	} else {
+		count := *runs
+		if testing.Short() {
+			count = min(count, 200)
+		}
+		for i := range count {
+			seeds = append(seeds, uint64(i)+1)
+		}
+	}
+	steps := 0
+	for _, seed := range seeds {
+		result, err := sim.Run(seed, sim.DefaultConfig)
+		if err != nil {
+			t.Fatalf("%v\nReproduce with: go test ./sim -run TestSimulation_TransfersConserveMoney -sim.seed=%d", err, seed)
+		}
+		steps += result.Steps
+	}
+	t.Logf("Simulated %d seeds, %d scheduling steps", len(seeds), steps)
+}
+
+func TestSimulation_SeedReplaysExactly(t *testing.T) {
+	first, err := sim.Run(42, sim.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := sim.Run(42, sim.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(first.Trace, second.Trace) || first.Steps != second.Steps {
+		t.Errorf("Expected seed 42 to replay the same run, got\n%v\nand\n%v", first.Trace, second.Trace)
+	}
+	other, _ := sim.Run(43, sim.DefaultConfig)
+	if slices.Equal(first.Trace, other.Trace) {
+		t.Error("Expected seeds 42 and 43 to run differently")
+	}
+}
+
+// TestScheduler_FindsLostUpdates checks that the scheduler finds, and
+// replays, the interleaving that breaks an unsynchronized read-modify-write.
+func TestScheduler_FindsLostUpdates(t *testing.T) {
+	increment := func(seed uint64) int {
+		scheduler := sim.NewScheduler(seed)
+		counter := 0
+		for range 2 {
+			scheduler.Go(func() {
+				read := counter
+				scheduler.Yield()
+				counter = read + 1
+			})
+		}
+		if err := scheduler.Run(); err != nil {
+			t.Fatal(err)
+		}
+		return counter
+	}
+	for seed := range uint64(100) {
+		if increment(seed) == 1 {
+			if increment(seed) != 1 {
+				t.Fatalf("Seed %d lost an update once but not when replayed", seed)
+			}
+			return
+		}
+	}
+	t.Error("Expected some seed to interleave the two increments")
+}
+
+func TestScheduler_SleepAdvancesVirtualTime(t *testing.T) {
+	scheduler := sim.NewScheduler(1)
+	start := scheduler.Now()
+	var woke []int
+	for i, hours := range []int{3, 1, 2} {
+		scheduler.Go(func() {
+			scheduler.Sleep(context.Background(), time.Duration(hours)*time.Hour)
+			woke = append(woke, i)
+		})
+	}
+	if err := scheduler.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(woke, []int{1, 2, 0}) {
+		t.Errorf("Expected the tasks to wake in order of their deadlines, got %v", woke)
+	}
+	if elapsed := scheduler.Now().Sub(start); elapsed != 3*time.Hour {
+		t.Errorf("Expected 3 hours of virtual time to pass, got %v", elapsed)
+	}
+}
+
+func TestScheduler_ReportsPanics(t *testing.T) {
+	scheduler := sim.NewScheduler(1)
+	scheduler.Go(func() { panic("boom") })
+	if err := scheduler.Run(); err == nil {
+		t.Error("Expected Run to report the panic of a task")
+	}
+}
@@ -0,0 +1,187 @@
+package sim
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"main/api"
+	"main/model"
+	"main/money"
+	"main/storage"
+	"net/http/httptest"
+	"strconv"
+	"time"
+)
+
+// ErrMoneyNotConserved is returned by Run when the accounts do not add up
+// to the money they were created with, or one of them is overdrawn.
+var ErrMoneyNotConserved = errors.New("money was not conserved")
+
+// Config describes a simulated workload: clients sending transfers between
+// a few accounts at the same time, through storage that fails now and then.
+type Config struct {
+	Accounts       int
+	InitialBalance string
+	Clients        int
+	// Transfers is how many transfers each client sends, one after another.
+	Transfers int
+	// MaxAmount bounds the amount of a transfer, in whole units.
+	MaxAmount int
+	// Faults are injected into the storage the handlers use; the seed is
+	// that of the simulation.
+	Faults storage.FaultOptions
+}
+
+// DefaultConfig is a small workload that contends on every account, with
+// faults on every kind of transaction operation and the occasional commit
+// that is applied but reported as failed.
+var DefaultConfig = Config{
+	Accounts:       3,
+	InitialBalance: "100",
+	Clients:        4,
+	Transfers:      5,
+	MaxAmount:      60,
+	Faults: storage.FaultOptions{
+		ErrorRates: map[string]float64{
+			storage.OpBegin:           0.02,
+			storage.OpTxGet:           0.02,
+			storage.OpTxCompareAndSet: 0.02,
+			storage.OpCommit:          0.02,
+		},
+		PartialCommitRate: 0.02,
+	},
+}
+
+// Result describes a simulation run.
+type Result struct {
+	// Steps is how many times the scheduler switched tasks.
+	Steps int
+	// Trace lists every request in the order it completed, with its
+	// response status. Two runs with the same seed have the same trace.
+	Trace []string
+	// Balances are the final balances by account.
+	Balances map[storage.Key]string
+}
+
+// Run simulates config with seed: it creates the accounts through the
+// handlers, lets the clients send their transfers, interleaved at every
+// storage operation, and checks that money is conserved whenever an
+// auditor gets to run and once more at the end. The error, if any, names
+// the seed that reproduces it.
+func Run(seed uint64, config Config) (Result, error) {
+	result, err := run(seed, config)
+	if err != nil {
+		return result, fmt.Errorf("seed %d: %w", seed, err)
+	}
+	return result, nil
+}
+
+func run(seed uint64, config Config) (Result, error) {
+	ctx := context.Background()
+	scheduler := NewScheduler(seed)
+	backend := storage.NewInMemoryStorage()
+	faults := config.Faults
+	faults.Seed = seed
+	handlers := api.NewAccountHandlersWithOptions(
+		NewStorage(storage.NewFaultyStorage(backend, faults), scheduler),
+		api.Options{Clock: scheduler, Rand: scheduler.Rand()},
+	)
+	var result Result
+
+	initial, err := money.Parse(config.InitialBalance)
+	if err != nil {
+		return result, err
+	}
+	// The accounts are created before the simulation starts, by handlers
+	// on the backend itself, so that no fault gets in the way.
+	setup := api.NewAccountHandlersWithOptions(backend, api.Options{Clock: scheduler, Rand: scheduler.Rand()})
+	total := money.Zero()
+	for id := range config.Accounts {
+		body, _ := json.Marshal(model.AccountRequest{AccountId: uint64(id), InitialBalance: config.InitialBalance})
+		rr := httptest.NewRecorder()
+		setup.CreateAccount(rr, httptest.NewRequest("POST", "/accounts", bytes.NewReader(body)))
+		if rr.Code >= 300 {
+			return result, fmt.Errorf("cannot create account %d: %s", id, rr.Body.String())
+		}
+		total = total.Add(initial)
+	}
+
+	// The auditor reads the backend without faults, in a snapshot, and
+	// checks every total it sees until the clients are done.
+	audited := NewStorage(backend, scheduler)
+	var auditErr error
+	clientsDone := 0
+	scheduler.Go(func() {
+		for clientsDone < config.Clients && auditErr == nil {
+			auditErr = audit(ctx, audited, total)
+			scheduler.Sleep(ctx, time.Millisecond)
+		}
+	})
+	for client := range config.Clients {
+		scheduler.Go(func() {
+			defer func() { clientsDone++ }()
+			for i := range config.Transfers {
+				random := scheduler.Rand()
+				source := random.IntN(config.Accounts)
+				destination := (source + 1 + random.IntN(config.Accounts-1)) % config.Accounts
+				amount := fmt.Sprintf("%d.%02d", random.IntN(config.MaxAmount), 1+random.IntN(99))
+				body, _ := json.Marshal(model.TransactionRequest{
+					SourceAccountId:      uint64(source),
+					DestinationAccountId: uint64(destination),
+					Amount:               amount,
+				})
+				rr := httptest.NewRecorder()
+				handlers.SubmitTransaction(rr, httptest.NewRequest("POST", "/transactions", bytes.NewReader(body)))
+				result.Trace = append(result.Trace, fmt.Sprintf("client %d transfer %d: %d -> %d %s: %d", client, i, source, destination, amount, rr.Code))
+			}
+		})
+	}
+	err = scheduler.Run()
+	result.Steps = scheduler.Steps()
+	if err != nil {
+		return result, err
+	}
+	if auditErr != nil {
+		return result, auditErr
+	}
+	if err := audit(ctx, backend, total); err != nil {
+		return result, err
+	}
+	result.Balances = make(map[storage.Key]string)
+	err = backend.Scan(ctx, storage.KeyRange{}, func(key storage.Key, value storage.Value) bool {
+		result.Balances[key] = value.Balance.String()
+		return true
+	})
+	return result, err
+}
+
+// audit checks that the accounts of s add up to total in a single
+// snapshot, and that none is overdrawn.
+func audit(ctx context.Context, s storage.Storage, total money.Amount) error {
+	tx, err := s.Begin(ctx, storage.TxOptions{ReadOnly: true, Isolation: storage.Snapshot})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	sum := money.Zero()
+	var overdrawn []string
+	err = tx.Scan(storage.KeyRange{}, func(key storage.Key, value storage.Value) bool {
+		sum = sum.Add(value.Balance)
+		if value.Balance.Sign() < 0 {
+			overdrawn = append(overdrawn, strconv.FormatUint(key, 10))
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if sum.Cmp(total) != 0 {
+		return fmt.Errorf("%w: the accounts hold %s instead of %s", ErrMoneyNotConserved, sum, total)
+	}
+	if len(overdrawn) > 0 {
+		return fmt.Errorf("%w: accounts %v are overdrawn", ErrMoneyNotConserved, overdrawn)
+	}
+	return nil
+}
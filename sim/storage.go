@@ -0,0 +1,96 @@
+package sim
+
+import (
+	"context"
+	"main/storage"
+)
+
+// Storage wraps a backend so that every operation on it, and on the
+// transactions it begins, is a scheduling point: the scheduler may switch
+// to another task just before the operation runs. The backend itself must
+// be deterministic and must not block on other tasks, as the in-memory
+// storage with optimistic transactions is.
+type Storage struct {
+	storage.Storage
+	scheduler *Scheduler
+}
+
+// Transaction is a transaction begun through Storage.
+type Transaction struct {
+	storage.StorageTransaction
+	scheduler *Scheduler
+}
+
+// NewStorage returns s with its operations scheduled by scheduler.
+func NewStorage(s storage.Storage, scheduler *Scheduler) *Storage {
+	return &Storage{Storage: s, scheduler: scheduler}
+}
+
+func (s *Storage) Get(ctx context.Context, key storage.Key) (storage.Value, error) {
+	s.scheduler.Yield()
+	return s.Storage.Get(ctx, key)
+}
+
+func (s *Storage) GetMany(ctx context.Context, keys []storage.Key) (map[storage.Key]storage.Value, error) {
+	s.scheduler.Yield()
+	return s.Storage.GetMany(ctx, keys)
+}
+
+func (s *Storage) Scan(ctx context.Context, r storage.KeyRange, fn func(key storage.Key, value storage.Value) bool) error {
+	s.scheduler.Yield()
+	return s.Storage.Scan(ctx, r, fn)
+}
+
+func (s *Storage) WriteBatch(ctx context.Context, batch storage.Batch) error {
+	s.scheduler.Yield()
+	return s.Storage.WriteBatch(ctx, batch)
+}
+
+func (s *Storage) Begin(ctx context.Context, opts storage.TxOptions) (storage.StorageTransaction, error) {
+	s.scheduler.Yield()
+	tx, err := s.Storage.Begin(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Transaction{StorageTransaction: tx, scheduler: s.scheduler}, nil
+}
+
+func (tx *Transaction) Get(key storage.Key) (storage.Value, error) {
+	tx.scheduler.Yield()
+	return tx.StorageTransaction.Get(key)
+}
+
+func (tx *Transaction) Set(key storage.Key, value storage.Value) error {
+	tx.scheduler.Yield()
+	return tx.StorageTransaction.Set(key, value)
+}
+
+func (tx *Transaction) Insert(key storage.Key, value storage.Value) error {
+	tx.scheduler.Yield()
+	return tx.StorageTransaction.Insert(key, value)
+}
+
+func (tx *Transaction) CompareAndSet(key storage.Key, expected, value storage.Value) error {
+	tx.scheduler.Yield()
+	return tx.StorageTransaction.CompareAndSet(key, expected, value)
+}
+
+func (tx *Transaction) Delete(key storage.Key) error {
+	tx.scheduler.Yield()
+	return tx.StorageTransaction.Delete(key)
+}
+
+func (tx *Transaction) Scan(r storage.KeyRange, fn func(key storage.Key, value storage.Value) bool) error {
+	tx.scheduler.Yield()
+	return tx.StorageTransaction.Scan(r, fn)
+}
+
+func (tx *Transaction) Commit() error {
+	tx.scheduler.Yield()
+	return tx.StorageTransaction.Commit()
+}
+
+func (tx *Transaction) Rollback() error {
+	tx.scheduler.Yield()
+	return tx.StorageTransaction.Rollback()
+}
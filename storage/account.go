@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"main/money"
+	"time"
+)
+
+type AccountStatus string
+
+const (
+	StatusActive AccountStatus = "active"
+	StatusFrozen AccountStatus = "frozen"
+	StatusClosed AccountStatus = "closed"
+)
+
+// DefaultCurrency is assumed for accounts that do not name one, including
+// every account stored before accounts had a currency.
+const DefaultCurrency = "USD"
+
+var ErrInvalidAccount = errors.New("invalid account")
+
+// Account is the record stored under every key.
+type Account struct {
+	Balance  money.Amount
+	Currency string
+	Status   AccountStatus
+	// Version counts the updates made to the account. It is maintained by
+	// the code that writes accounts, not by the storage backends.
+	Version   uint64
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Owner     string
+}
+
+// Equal reports whether a and b hold the same balance and fields, ignoring
+// the scale of the balance and the location of the times.
+func (a Account) Equal(b Account) bool {
+	return a.Balance.Cmp(b.Balance) == 0 &&
+		a.Currency == b.Currency &&
+		a.Status == b.Status &&
+		a.Version == b.Version &&
+		a.CreatedAt.Equal(b.CreatedAt) &&
+		a.UpdatedAt.Equal(b.UpdatedAt) &&
+		a.Owner == b.Owner
+}
+
+// accountRecord is the serialized form of an Account, used wherever a
+// backend stores accounts as bytes (log records, snapshots, data files):
+//
+//	{"balance":"100.2300000000000000000","currency":"USD","status":"active",
+//	 "version":3,"created_at":"2025-11-12T03:04:21Z","updated_at":"...","owner":"alice"}
+//
+// Values written before accounts were structured are bare balance strings
+// such as "100.2300000000000000000"; decodeAccount still reads those.
+type accountRecord struct {
+	Balance   string        `json:"balance"`
+	Currency  string        `json:"currency"`
+	Status    AccountStatus `json:"status"`
+	Version   uint64        `json:"version"`
+	CreatedAt time.Time     `json:"created_at"`
+	UpdatedAt time.Time     `json:"updated_at"`
+	Owner     string        `json:"owner,omitempty"`
+}
+
+func encodeAccount(account Account) []byte {
+	// Marshalling strings, integers and times cannot fail.
+	data, _ := json.Marshal(accountRecord{
+		Balance:   account.Balance.String(),
+		Currency:  account.Currency,
+		Status:    account.Status,
+		Version:   account.Version,
+		CreatedAt: account.CreatedAt,
+		UpdatedAt: account.UpdatedAt,
+		Owner:     account.Owner,
+	})
+	return data
+}
+
+func decodeAccount(data []byte) (Account, error) {
+	if len(data) == 0 || data[0] != '{' {
+		balance, err := money.ParseLegacy(string(data))
+		if err != nil {
+			return Account{}, fmt.Errorf("%w: %w", ErrInvalidAccount, err)
+		}
+		return normalizeAccount(Account{Balance: balance})
+	}
+	var record accountRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return Account{}, fmt.Errorf("%w: %w", ErrInvalidAccount, err)
+	}
+	balance, err := money.ParseLegacy(record.Balance)
+	if err != nil {
+		return Account{}, fmt.Errorf("%w: %w", ErrInvalidAccount, err)
+	}
+	return Account{
+		Balance:   balance,
+		Currency:  record.Currency,
+		Status:    record.Status,
+		Version:   record.Version,
+		CreatedAt: record.CreatedAt,
+		UpdatedAt: record.UpdatedAt,
+		Owner:     record.Owner,
+	}, nil
+}
+
+// MarshalJSON encodes the account as an accountRecord.
+func (a Account) MarshalJSON() ([]byte, error) {
+	return encodeAccount(a), nil
+}
+
+// UnmarshalJSON decodes an accountRecord.
+func (a *Account) UnmarshalJSON(data []byte) error {
+	account, err := decodeAccount(data)
+	if err != nil {
+		return err
+	}
+	*a = account
+	return nil
+}
+
+// Normalize returns the account as the backends store it, or an error
+// wrapping ErrInvalidAccount; see normalizeAccount. Storages that wrap a
+// backend use it to reject invalid accounts before they reach it.
+func (a Account) Normalize() (Account, error) {
+	return normalizeAccount(a)
+}
+
+// normalizeAccount validates an account before it is stored and brings it
+// into the form every backend stores: the balance at money.DefaultScale,
+// and the default currency and status filled in if missing.
+func normalizeAccount(account Account) (Account, error) {
+	if account.Balance.Scale() > money.DefaultScale {
+		return Account{}, fmt.Errorf("%w: %w", ErrInvalidAccount, money.ErrTooPrecise)
+	}
+	account.Balance = account.Balance.Rescale(money.DefaultScale)
+	if account.Currency == "" {
+		account.Currency = DefaultCurrency
+	}
+	if !validCurrency(account.Currency) {
+		return Account{}, fmt.Errorf("%w: currency %q is not a three-letter code", ErrInvalidAccount, account.Currency)
+	}
+	switch account.Status {
+	case "":
+		account.Status = StatusActive
+	case StatusActive, StatusFrozen, StatusClosed:
+	default:
+		return Account{}, fmt.Errorf("%w: unknown status %q", ErrInvalidAccount, account.Status)
+	}
+	return account, nil
+}
+
+func validCurrency(currency string) bool {
+	if len(currency) != 3 {
+		return false
+	}
+	for i := 0; i < len(currency); i++ {
+		if currency[i] < 'A' || currency[i] > 'Z' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,82 @@
+package storage_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"main/storage"
+	"main/storage/storagetest"
+	"path/filepath"
+	"testing"
+)
+
+func TestAccount_DefaultsAreFilledIn(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	tx := begin(store)
+	if err := tx.Set(1, storagetest.WithBalance("12.5")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	tx.Commit()
+
+	account, err := store.Get(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if account.Currency != storage.DefaultCurrency || account.Status != storage.StatusActive {
+		t.Errorf("Expected an active %s account, got %s %s", storage.DefaultCurrency, account.Status, account.Currency)
+	}
+	if account.Balance.String() != "12.5000000000000000000" {
+		t.Errorf("Expected the balance at the default scale, got %s", account.Balance)
+	}
+}
+
+func TestAccount_InvalidAccountsAreRejected(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	tx := begin(store)
+	defer tx.Rollback()
+
+	lowercase := storagetest.WithBalance("1")
+	lowercase.Currency = "usd"
+	unknown := storagetest.WithBalance("1")
+	unknown.Status = "dormant"
+	for _, account := range []storage.Account{lowercase, unknown} {
+		if err := tx.Set(1, account); !errors.Is(err, storage.ErrInvalidAccount) {
+			t.Errorf("Expected ErrInvalidAccount for %+v, got %v", account, err)
+		}
+	}
+}
+
+func TestSqliteStorage_MigratesKVStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.db")
+	legacy, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy.Exec(`CREATE TABLE kv_store (key INTEGER PRIMARY KEY, value TEXT);`)
+	legacy.Exec(`INSERT INTO kv_store (key, value) VALUES (1, '100.23'), (2, '0.1234567890123456789');`)
+	legacy.Close()
+
+	db := storage.NewSqliteStorage(path)
+	if db == nil {
+		t.Fatal("Cannot open legacy database")
+	}
+	defer db.Close()
+	expected := map[storage.Key]string{
+		1: "100.2300000000000000000",
+		2: "0.1234567890123456789",
+	}
+	for key, balance := range expected {
+		account, err := db.Get(context.Background(), key)
+		if err != nil {
+			t.Fatalf("Key %d was not migrated: %v", key, err)
+		}
+		if account.Balance.String() != balance || account.Version != 1 || account.Currency != storage.DefaultCurrency {
+			t.Errorf("Key %d: unexpected account %+v", key, account)
+		}
+	}
+	var tables int
+	db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE name = 'kv_store';`).Scan(&tables)
+	if tables != 0 {
+		t.Error("Expected kv_store to be dropped after the migration")
+	}
+}
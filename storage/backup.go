@@ -0,0 +1,225 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// backupAttempts bounds how often WriteBackup and Restore run a transaction
+// that conflicted with concurrent commits.
+const backupAttempts = 10
+
+// runTransaction runs op with opts, or with fallback if the backend does
+// not support opts, and runs it again while it fails with ErrConflict, up
+// to backupAttempts times.
+func runTransaction(opts, fallback TxOptions, op func(TxOptions) error) error {
+	err := op(opts)
+	if errors.Is(err, ErrUnsupportedTxOptions) {
+		opts = fallback
+		err = op(opts)
+	}
+	for attempt := 1; errors.Is(err, ErrConflict) && attempt < backupAttempts; attempt++ {
+		err = op(opts)
+	}
+	return err
+}
+
+// WriteBackup writes every account of s, as of a single point in time, to
+// w and returns how many it wrote. A backup is a snapshot file (see
+// snapshotMagic) with a timestamp of 0, whose accounts are encrypted with
+// keyring if it is not nil.
+//
+// The accounts are read in one read-only transaction, so that transfers
+// carry on meanwhile: at snapshot isolation if the backend supports it,
+// and otherwise at serializable isolation, which fails the transaction,
+// to be run again, if a commit changes the accounts before it is done.
+func WriteBackup(ctx context.Context, s Storage, w io.Writer, keyring *Keyring) (int, error) {
+	var accounts []mutation
+	err := runTransaction(TxOptions{ReadOnly: true, Isolation: Snapshot}, TxOptions{ReadOnly: true}, func(opts TxOptions) error {
+		tx, err := s.Begin(ctx, opts)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		accounts = accounts[:0]
+		err = tx.Scan(KeyRange{}, func(key Key, value Value) bool {
+			accounts = append(accounts, mutation{key: key, value: value})
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return 0, err
+	}
+	sw := newSnapshotWriter(w, 0, keyring)
+	for _, m := range accounts {
+		sw.add(m.key, m.value)
+	}
+	return len(accounts), sw.finish()
+}
+
+// ReadBackup reads a backup written by WriteBackup or SqliteStorage.Backup,
+// decrypting it with keyring, and returns its accounts. It reads the whole
+// backup first and fails with ErrCorruptRecord unless it is intact, or
+// with ErrDecrypt if keyring cannot decrypt it.
+func ReadBackup(r io.Reader, keyring *Keyring) (map[Key]Value, error) {
+	br := bufio.NewReader(r)
+	if header, _ := br.Peek(len(sqliteHeader)); string(header) == sqliteHeader {
+		return readSqliteBackup(br, keyring)
+	}
+	_, mutations, err := decodeSnapshot(br, keyring)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		return nil, ErrCorruptRecord
+	}
+	accounts := make(map[Key]Value, len(mutations))
+	for _, m := range mutations {
+		accounts[m.key] = m.value
+	}
+	return accounts, nil
+}
+
+// Restore replaces every account of s with accounts in a single
+// transaction, so that s holds either all of its old accounts or exactly
+// those of the backup. The transaction is pessimistic where the backend
+// supports it, so that concurrent commits wait for it; otherwise it is run
+// again if one of them conflicts with it.
+func Restore(ctx context.Context, s Storage, accounts map[Key]Value) error {
+	return runTransaction(TxOptions{Lock: LockPessimistic}, TxOptions{}, func(opts TxOptions) error {
+		tx, err := s.Begin(ctx, opts)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		var stale []Key
+		err = tx.Scan(KeyRange{}, func(key Key, _ Value) bool {
+			if _, ok := accounts[key]; !ok {
+				stale = append(stale, key)
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range stale {
+			if err := tx.Delete(key); err != nil {
+				return err
+			}
+		}
+		for _, key := range slices.Sorted(maps.Keys(accounts)) {
+			if err := tx.Set(key, accounts[key]); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+}
+
+// sqliteHeader starts every SQLite database file.
+const sqliteHeader = "SQLite format 3\x00"
+
+// Backup writes a copy of the database to w, made with VACUUM INTO, and
+// returns how many accounts it holds. The copy is taken in a single read
+// transaction, so it is consistent and, in WAL mode, does not hold up
+// writers. Unlike WriteBackup, it keeps the whole database, schema_version
+// included, with balances encrypted as they are in it.
+func (db *SqliteStorage) Backup(ctx context.Context, w io.Writer) (int, error) {
+	dir, err := os.MkdirTemp("", "sqlite-backup-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "backup.db")
+	err = db.retry(ctx, func() error {
+		// VACUUM INTO refuses to overwrite what a failed attempt left.
+		os.Remove(path)
+		_, err := db.ExecContext(ctx, `VACUUM INTO ?;`, path)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	copied, err := sql.Open("sqlite", path)
+	if err != nil {
+		return 0, err
+	}
+	var count int
+	err = copied.QueryRowContext(ctx, `SELECT COUNT(*) FROM accounts;`).Scan(&count)
+	copied.Close()
+	if err != nil {
+		return 0, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return count, err
+}
+
+// readSqliteBackup reads the accounts of a database written by
+// SqliteStorage.Backup. The database must pass an integrity check and is
+// migrated to the latest schema first, in a temporary copy.
+func readSqliteBackup(r io.Reader, keyring *Keyring) (map[Key]Value, error) {
+	dir, err := os.MkdirTemp("", "sqlite-restore-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "backup.db")
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(file, r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	db, err := OpenSqliteStorage(path, SqliteOptions{JournalMode: "DELETE", MaxOpenConns: 1, MaxRetries: -1, Keyring: keyring})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	var check string
+	err = db.QueryRow(`PRAGMA integrity_check;`).Scan(&check)
+	if err == nil && check != "ok" {
+		err = errors.New(check)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: integrity check: %w", ErrCorruptRecord, err)
+	}
+	if _, err := db.Migrate(); errors.Is(err, ErrSchemaTooNew) {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCorruptRecord, err)
+	}
+	accounts := make(map[Key]Value)
+	err = db.Scan(context.Background(), KeyRange{}, func(key Key, value Value) bool {
+		accounts[key] = value
+		return true
+	})
+	if err != nil && !errors.Is(err, ErrDecrypt) {
+		return nil, fmt.Errorf("%w: %w", ErrCorruptRecord, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
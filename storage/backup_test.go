@@ -0,0 +1,209 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"main/storage"
+	"main/storage/storagetest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestore_ReplacesEveryAccountWithTheBackup(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range scanBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			tx := begin(store)
+			tx.Set(1, storagetest.WithBalance("1"))
+			tx.Set(2, storagetest.WithBalance("2"))
+			tx.Set(3, storagetest.WithBalance("3"))
+			tx.Commit()
+			var backup bytes.Buffer
+			if count, err := storage.WriteBackup(ctx, store, &backup, nil); err != nil || count != 3 {
+				t.Fatalf("Expected a backup of 3 accounts, got %d, %v", count, err)
+			}
+
+			tx = begin(store)
+			tx.Set(1, storagetest.WithBalance("10"))
+			tx.Delete(2)
+			tx.Set(4, storagetest.WithBalance("4"))
+			tx.Commit()
+
+			accounts, err := storage.ReadBackup(&backup, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := storage.Restore(ctx, store, accounts); err != nil {
+				t.Fatal(err)
+			}
+			if keys := collect(t, store, storage.KeyRange{}); len(keys) != 3 || keys[0] != 1 || keys[1] != 2 || keys[2] != 3 {
+				t.Errorf("Expected keys [1 2 3] after restore, got %v", keys)
+			}
+			if account, _ := store.Get(ctx, 1); account.Balance.Cmp(storagetest.WithBalance("1").Balance) != 0 {
+				t.Errorf("Expected key 1 to hold 1 again, got %s", account.Balance)
+			}
+		})
+	}
+}
+
+func TestReadBackup_RejectsDamagedBackups(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewInMemoryStorage()
+	tx := begin(store)
+	tx.Set(1, storagetest.WithBalance("1"))
+	tx.Set(2, storagetest.WithBalance("2"))
+	tx.Commit()
+	var buf bytes.Buffer
+	storage.WriteBackup(ctx, store, &buf, nil)
+	backup := buf.Bytes()
+
+	flipped := bytes.Clone(backup)
+	flipped[len(flipped)/2] ^= 1
+	for name, damaged := range map[string][]byte{
+		"flipped":   flipped,
+		"truncated": backup[:len(backup)-1],
+		"extended":  append(bytes.Clone(backup), 0),
+		"empty":     nil,
+	} {
+		if _, err := storage.ReadBackup(bytes.NewReader(damaged), nil); !errors.Is(err, storage.ErrCorruptRecord) {
+			t.Errorf("Expected ErrCorruptRecord for a %s backup, got %v", name, err)
+		}
+	}
+
+	keyPath := filepath.Join(t.TempDir(), "keys")
+	addKey(t, keyPath, 1)
+	buf.Reset()
+	storage.WriteBackup(ctx, store, &buf, loadKeyring(t, keyPath))
+	if bytes.Contains(buf.Bytes(), []byte(`"balance"`)) {
+		t.Error("Expected the accounts of an encrypted backup to be encrypted")
+	}
+	if _, err := storage.ReadBackup(bytes.NewReader(buf.Bytes()), nil); !errors.Is(err, storage.ErrDecrypt) {
+		t.Errorf("Expected ErrDecrypt without the key, got %v", err)
+	}
+	if accounts, err := storage.ReadBackup(bytes.NewReader(buf.Bytes()), loadKeyring(t, keyPath)); err != nil || len(accounts) != 2 {
+		t.Errorf("Expected 2 accounts with the key, got %v, %v", accounts, err)
+	}
+}
+
+// transferring is a storage whose transactions commit a transfer of 100
+// from key 1 to key 2 halfway through the first scan, right after the
+// scan has visited key 1.
+type transferring struct {
+	storage.Storage
+	begins int
+}
+
+func (s *transferring) Begin(ctx context.Context, opts storage.TxOptions) (storage.StorageTransaction, error) {
+	tx, err := s.Storage.Begin(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	s.begins++
+	return &transferringTransaction{StorageTransaction: tx, storage: s}, nil
+}
+
+type transferringTransaction struct {
+	storage.StorageTransaction
+	storage *transferring
+}
+
+func (tx *transferringTransaction) Scan(r storage.KeyRange, fn func(key storage.Key, value storage.Value) bool) error {
+	first := tx.storage.begins == 1
+	return tx.StorageTransaction.Scan(r, func(key storage.Key, value storage.Value) bool {
+		more := fn(key, value)
+		if first && key == 1 {
+			var batch storage.Batch
+			batch.Set(1, storagetest.WithBalance("900"))
+			batch.Set(2, storagetest.WithBalance("100"))
+			if err := tx.storage.WriteBatch(context.Background(), batch); err != nil {
+				panic(err)
+			}
+		}
+		return more
+	})
+}
+
+func TestWriteBackup_IsConsistentDuringTransfers(t *testing.T) {
+	bitcask := openBitcask(t, t.TempDir(), storage.BitcaskOptions{})
+	defer bitcask.Close()
+	// In-memory storage reads the backup from a snapshot, which the
+	// transfer does not change; bitcask has no snapshot isolation, so its
+	// backup conflicts with the transfer and is taken again.
+	for _, test := range []struct {
+		name   string
+		store  storage.Storage
+		begins int
+		want   map[storage.Key]string
+	}{
+		{"inmemory", storage.NewInMemoryStorage(), 1, map[storage.Key]string{1: "1000", 2: "0"}},
+		{"bitcask", bitcask, 2, map[storage.Key]string{1: "900", 2: "100"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tx := begin(test.store)
+			tx.Set(1, storagetest.WithBalance("1000"))
+			tx.Set(2, storagetest.WithBalance("0"))
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+
+			store := &transferring{Storage: test.store}
+			var backup bytes.Buffer
+			if _, err := storage.WriteBackup(context.Background(), store, &backup, nil); err != nil {
+				t.Fatalf("Backup failed: %v", err)
+			}
+			if store.begins != test.begins {
+				t.Errorf("Expected the backup to take %d transactions, got %d", test.begins, store.begins)
+			}
+			accounts, err := storage.ReadBackup(&backup, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for key, balance := range test.want {
+				if accounts[key].Balance.Cmp(storagetest.WithBalance(balance).Balance) != 0 {
+					t.Errorf("Expected key %d to hold %s in the backup, got %s", key, balance, accounts[key].Balance)
+				}
+			}
+		})
+	}
+}
+
+func TestSqliteStorage_BackupCopiesTheDatabase(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "keys")
+	addKey(t, keyPath, 1)
+	keyring := loadKeyring(t, keyPath)
+	db := storage.NewSqliteStorageWithOptions(filepath.Join(dir, "store.db"), storage.SqliteOptions{Keyring: keyring})
+	defer db.Close()
+	tx := begin(db)
+	for key := range storage.Key(100) {
+		tx.Set(key, storagetest.WithBalance("1"))
+	}
+	tx.Commit()
+
+	var buf bytes.Buffer
+	if count, err := db.Backup(ctx, &buf); err != nil || count != 100 {
+		t.Fatalf("Expected a backup of 100 accounts, got %d, %v", count, err)
+	}
+	backup := buf.Bytes()
+	path := filepath.Join(dir, "backup.db")
+	os.WriteFile(path, backup, 0o600)
+	copied := storage.NewSqliteStorageWithOptions(path, storage.SqliteOptions{Keyring: keyring})
+	if version, err := copied.SchemaVersion(); err != nil || version != storage.LatestSchemaVersion() {
+		t.Errorf("Expected the backup at schema version %d, got %d, %v", storage.LatestSchemaVersion(), version, err)
+	}
+	copied.Close()
+
+	accounts, err := storage.ReadBackup(bytes.NewReader(backup), keyring)
+	if err != nil || len(accounts) != 100 {
+		t.Fatalf("Expected 100 accounts, got %d, %v", len(accounts), err)
+	}
+	if _, err := storage.ReadBackup(bytes.NewReader(backup), nil); !errors.Is(err, storage.ErrDecrypt) {
+		t.Errorf("Expected ErrDecrypt without the key, got %v", err)
+	}
+	if _, err := storage.ReadBackup(bytes.NewReader(backup[:len(backup)/2]), keyring); !errors.Is(err, storage.ErrCorruptRecord) {
+		t.Errorf("Expected ErrCorruptRecord for a truncated backup, got %v", err)
+	}
+}
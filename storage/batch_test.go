@@ -0,0 +1,75 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"main/storage"
+	"main/storage/storagetest"
+	"testing"
+)
+
+func TestGetMany_SkipsMissingKeys(t *testing.T) {
+	for name, store := range scanBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			tx := begin(store)
+			tx.Set(1, storagetest.WithBalance("1"))
+			tx.Set(3, storagetest.WithBalance("3"))
+			tx.Commit()
+
+			values, err := store.GetMany(context.Background(), []storage.Key{1, 2, 3})
+			if err != nil {
+				t.Fatalf("GetMany failed: %v", err)
+			}
+			if len(values) != 2 || values[1].Balance.String() != "1.0000000000000000000" || values[3].Balance.String() != "3.0000000000000000000" {
+				t.Errorf("Expected keys 1 and 3, got %v", values)
+			}
+		})
+	}
+}
+
+func TestWriteBatch_AppliesSetsAndDeletes(t *testing.T) {
+	for name, store := range scanBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			tx := begin(store)
+			tx.Set(1, storagetest.WithBalance("1"))
+			tx.Commit()
+
+			var batch storage.Batch
+			batch.Set(2, storagetest.WithBalance("2"))
+			batch.Set(3, storagetest.WithBalance("3"))
+			batch.Delete(1)
+			if err := store.WriteBatch(context.Background(), batch); err != nil {
+				t.Fatalf("WriteBatch failed: %v", err)
+			}
+			if keys := collect(t, store, storage.KeyRange{}); len(keys) != 2 || keys[0] != 2 || keys[1] != 3 {
+				t.Errorf("Expected keys [2 3], got %v", keys)
+			}
+		})
+	}
+}
+
+func TestWriteBatch_IsAllOrNothing(t *testing.T) {
+	for name, store := range scanBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			var batch storage.Batch
+			batch.Set(1, storagetest.WithBalance("1"))
+			batch.Delete(2)
+			if err := store.WriteBatch(context.Background(), batch); !errors.Is(err, storage.ErrKeyNotFound) {
+				t.Errorf("Expected ErrKeyNotFound for a missing key, got %v", err)
+			}
+
+			batch = storage.Batch{}
+			batch.Set(1, storagetest.WithBalance("1"))
+			invalid := storagetest.WithBalance("2")
+			invalid.Currency = "dollars"
+			batch.Set(2, invalid)
+			if err := store.WriteBatch(context.Background(), batch); !errors.Is(err, storage.ErrInvalidAccount) {
+				t.Errorf("Expected ErrInvalidAccount, got %v", err)
+			}
+
+			if keys := collect(t, store, storage.KeyRange{}); len(keys) != 0 {
+				t.Errorf("Expected the failed batches to write nothing, got %v", keys)
+			}
+		})
+	}
+}
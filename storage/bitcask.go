@@ -0,0 +1,961 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BitcaskStorage is a log-structured store in the style of Bitcask. Every
+// commit is appended to the active data file as one checksummed frame (the
+// same frame format as the write-ahead log), and an in-memory key directory
+// maps each key to the position of its latest value on disk. Data files are
+// immutable once rotated out; a background merge rewrites their live values
+// into a fresh file and deletes them. Each immutable file gets a hint file
+// listing its keys so that startup does not need to read every value.
+type BitcaskStorage struct {
+	dir     string
+	options BitcaskOptions
+
+	// lock guards keydir and files. Get holds it while reading a value so
+	// that a merge cannot close a file under it.
+	lock   sync.RWMutex
+	keydir map[Key]keydirEntry
+	files  map[uint32]*os.File
+
+	// commitLock serializes commits, which append to the active file.
+	commitLock  sync.Mutex
+	ts          uint64
+	nextID      uint32
+	active      *os.File
+	activeID    uint32
+	activeSize  int64
+	activeHints []hintEntry
+	// failed is set when a write to the active file could not be undone,
+	// or a sync failed; the file may then hold a frame that the key
+	// directory does not, and no further commits are accepted.
+	failed error
+
+	mergeLock sync.Mutex
+	stop      chan struct{}
+	done      sync.WaitGroup
+}
+
+type BitcaskOptions struct {
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+	// MaxFileSize is the size at which the active data file is rotated.
+	MaxFileSize int64
+	// MergeInterval is how often immutable data files are merged; zero
+	// disables background merges.
+	MergeInterval time.Duration
+	// Keyring, if set, encrypts the values in the data files. Hint files
+	// hold no values and are not encrypted.
+	Keyring *Keyring
+}
+
+// keydirEntry locates the latest value of a key.
+type keydirEntry struct {
+	fileID uint32
+	offset int64
+	size   uint32
+	ts     uint64
+}
+
+// hintEntry describes one record of a data file. A hint file is a list of
+// hint entries followed by the crc32c of all of them:
+//
+//	entry = key uint64 | ts uint64 | offset int64 | size uint32 | deleted uint8
+type hintEntry struct {
+	key     Key
+	deleted bool
+	keydirEntry
+}
+
+const hintEntrySize = 29
+
+// BitcaskStorageTransaction reads the latest committed values and buffers
+// its writes. There is only one version of each key, so it cannot read
+// from a snapshot; at the default, serializable level Commit instead fails
+// with ErrConflict if any key it read or any range it scanned has changed.
+type BitcaskStorageTransaction struct {
+	*BitcaskStorage
+	ctx  context.Context
+	opts TxOptions
+	// locked is set while a pessimistic transaction holds commitLock.
+	locked       bool
+	lock         sync.Mutex
+	transactions map[Key]*Value
+	reads        map[Key]uint64
+	// checked holds the commit timestamp each conditional write was
+	// checked against, 0 for none. It is validated at every level.
+	checked map[Key]uint64
+	// scans holds the part of each scanned range that was visited.
+	scans []KeyRange
+}
+
+const (
+	dataSuffix = ".data"
+	hintSuffix = ".hint"
+)
+
+func dataFileName(dir string, id uint32) string {
+	return filepath.Join(dir, fmt.Sprintf("%09d%s", id, dataSuffix))
+}
+
+func hintFileName(dir string, id uint32) string {
+	return filepath.Join(dir, fmt.Sprintf("%09d%s", id, hintSuffix))
+}
+
+// NewBitcaskStorage opens or creates a store in dir. Existing data files
+// are indexed from their hint files where possible and scanned otherwise;
+// new commits always go to a fresh data file.
+func NewBitcaskStorage(dir string, options BitcaskOptions) (*BitcaskStorage, error) {
+	if options.Sync == SyncInterval && options.SyncInterval <= 0 {
+		return nil, fmt.Errorf("bitcask sync interval must be positive, got %s", options.SyncInterval)
+	}
+	if options.MaxFileSize <= 0 {
+		options.MaxFileSize = 64 << 20
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	db := &BitcaskStorage{
+		dir:     dir,
+		options: options,
+		keydir:  make(map[Key]keydirEntry),
+		files:   make(map[uint32]*os.File),
+		stop:    make(chan struct{}),
+	}
+	if err := db.load(); err != nil {
+		db.closeFiles()
+		return nil, err
+	}
+	if err := db.openActive(); err != nil {
+		db.closeFiles()
+		return nil, err
+	}
+	if options.Sync == SyncInterval {
+		db.done.Add(1)
+		go db.syncLoop()
+	}
+	if options.MergeInterval > 0 {
+		db.done.Add(1)
+		go db.mergeLoop()
+	}
+	return db, nil
+}
+
+// load builds the key directory from every data file in the directory.
+// Entries are applied by commit timestamp rather than file order, because
+// a merged file can hold older values than files written before it.
+func (db *BitcaskStorage) load() error {
+	entries, err := os.ReadDir(db.dir)
+	if err != nil {
+		return err
+	}
+	var ids []uint32
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			os.Remove(filepath.Join(db.dir, name))
+			continue
+		}
+		if !strings.HasSuffix(name, dataSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, dataSuffix), 10, 32)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, uint32(id))
+	}
+	slices.Sort(ids)
+
+	tombstones := make(map[Key]uint64)
+	for _, id := range ids {
+		file, err := os.OpenFile(dataFileName(db.dir, id), os.O_RDWR, 0o644)
+		if err != nil {
+			return err
+		}
+		db.files[id] = file
+		db.nextID = max(db.nextID, id+1)
+		hints, err := readHintFile(hintFileName(db.dir, id))
+		if err != nil {
+			if hints, err = scanDataFile(file, db.options.Keyring); err != nil {
+				return fmt.Errorf("cannot read data file %d: %w", id, err)
+			}
+			if err := writeHintFile(hintFileName(db.dir, id), hints); err != nil {
+				slog.Warn("Cannot write hint file", "file_id", id, "error", err)
+			}
+		}
+		for _, hint := range hints {
+			hint.fileID = id
+			db.ts = max(db.ts, hint.ts)
+			if hint.ts < db.keydir[hint.key].ts || hint.ts < tombstones[hint.key] {
+				continue
+			}
+			if hint.deleted {
+				delete(db.keydir, hint.key)
+				tombstones[hint.key] = hint.ts
+			} else {
+				db.keydir[hint.key] = hint.keydirEntry
+			}
+		}
+	}
+	slog.Info("Loaded bitcask storage", "dir", db.dir, "files", len(ids), "keys", len(db.keydir))
+	return nil
+}
+
+// scanDataFile reads every frame of a data file and returns a hint entry
+// for each mutation in it. A torn frame at the end is truncated away, but
+// a frame that keyring cannot decrypt fails the scan.
+func scanDataFile(file *os.File, keyring *Keyring) ([]hintEntry, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(file)
+	var hints []hintEntry
+	var offset int64
+	for {
+		record, n, err := readRecord(reader, keyring)
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, ErrDecrypt) {
+			return nil, err
+		}
+		if err != nil {
+			slog.Warn("Truncating data file at corrupt record", "file", file.Name(), "offset", offset, "error", err)
+			if err := file.Truncate(offset); err != nil {
+				return nil, err
+			}
+			break
+		}
+		hints = append(hints, frameHints(record, offset)...)
+		offset += n
+	}
+	return hints, nil
+}
+
+// frameHints returns where each value of record lives when its frame is
+// written at offset. record.spans must have been filled in by encode or
+// readRecord.
+func frameHints(record walRecord, offset int64) []hintEntry {
+	hints := make([]hintEntry, 0, len(record.mutations))
+	for i, m := range record.mutations {
+		span := record.spans[i]
+		hints = append(hints, hintEntry{
+			key:         m.key,
+			deleted:     m.deleted,
+			keydirEntry: keydirEntry{offset: offset + span.offset, size: span.size, ts: record.ts},
+		})
+	}
+	return hints
+}
+
+func readHintFile(path string) ([]hintEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 4 || (len(data)-4)%hintEntrySize != 0 {
+		return nil, ErrCorruptRecord
+	}
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.Checksum(body, crcTable) != sum {
+		return nil, ErrCorruptRecord
+	}
+	hints := make([]hintEntry, 0, len(body)/hintEntrySize)
+	for ; len(body) > 0; body = body[hintEntrySize:] {
+		hints = append(hints, hintEntry{
+			key:     binary.LittleEndian.Uint64(body),
+			deleted: body[28] == 1,
+			keydirEntry: keydirEntry{
+				ts:     binary.LittleEndian.Uint64(body[8:]),
+				offset: int64(binary.LittleEndian.Uint64(body[16:])),
+				size:   binary.LittleEndian.Uint32(body[24:]),
+			},
+		})
+	}
+	return hints, nil
+}
+
+func writeHintFile(path string, hints []hintEntry) error {
+	buf := make([]byte, 0, len(hints)*hintEntrySize+4)
+	for _, hint := range hints {
+		buf = binary.LittleEndian.AppendUint64(buf, hint.key)
+		buf = binary.LittleEndian.AppendUint64(buf, hint.ts)
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(hint.offset))
+		buf = binary.LittleEndian.AppendUint32(buf, hint.size)
+		if hint.deleted {
+			buf = append(buf, 1)
+		} else {
+			buf = append(buf, 0)
+		}
+	}
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.Checksum(buf, crcTable))
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// openActive starts a new active data file. Callers must hold commitLock
+// or have exclusive access.
+func (db *BitcaskStorage) openActive() error {
+	id := db.nextID
+	file, err := os.OpenFile(dataFileName(db.dir, id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	db.nextID++
+	db.lock.Lock()
+	db.files[id] = file
+	db.lock.Unlock()
+	db.active, db.activeID, db.activeSize, db.activeHints = file, id, 0, nil
+	return nil
+}
+
+// rotate makes the active file immutable, writes its hint file and opens
+// a new active file. Callers must hold commitLock.
+func (db *BitcaskStorage) rotate() error {
+	if err := db.active.Sync(); err != nil {
+		return err
+	}
+	if err := writeHintFile(hintFileName(db.dir, db.activeID), db.activeHints); err != nil {
+		slog.Warn("Cannot write hint file", "file_id", db.activeID, "error", err)
+	}
+	return db.openActive()
+}
+
+func (db *BitcaskStorage) Get(ctx context.Context, key Key) (Value, error) {
+	if err := ctx.Err(); err != nil {
+		return Value{}, err
+	}
+	value, _, err := db.get(key)
+	return value, err
+}
+
+// get returns the latest value of key and its commit timestamp. The
+// timestamp is 0 for an absent key.
+func (db *BitcaskStorage) get(key Key) (Value, uint64, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	entry, exists := db.keydir[key]
+	if !exists {
+		return Value{}, 0, ErrKeyNotFound
+	}
+	value, err := db.read(key, entry)
+	if err != nil {
+		return Value{}, entry.ts, fmt.Errorf("cannot read key %d: %w", key, err)
+	}
+	return value, entry.ts, nil
+}
+
+// read loads and decodes the value of key at entry. Callers must hold
+// lock.
+func (db *BitcaskStorage) read(key Key, entry keydirEntry) (Value, error) {
+	buf := make([]byte, entry.size)
+	if _, err := db.files[entry.fileID].ReadAt(buf, entry.offset); err != nil {
+		return Value{}, err
+	}
+	return db.options.Keyring.decodeAccount(key, buf)
+}
+
+func (db *BitcaskStorage) Scan(ctx context.Context, r KeyRange, fn func(key Key, value Value) bool) error {
+	get := func(key Key) (Value, error) {
+		value, _, err := db.get(key)
+		return value, err
+	}
+	return scanSorted(ctx, db.keys(r), r, get, fn)
+}
+
+// GetMany reads every key under one read lock of the key directory, so no
+// commit is published in between.
+func (db *BitcaskStorage) GetMany(ctx context.Context, keys []Key) (map[Key]Value, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	values := make(map[Key]Value, len(keys))
+	for _, key := range keys {
+		entry, exists := db.keydir[key]
+		if !exists {
+			continue
+		}
+		value, err := db.read(key, entry)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read key %d: %w", key, err)
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// WriteBatch appends batch as a single frame, like a commit, so it
+// survives a crash completely or not at all.
+func (db *BitcaskStorage) WriteBatch(ctx context.Context, batch Batch) error {
+	mutations, err := batch.mutations()
+	if err != nil {
+		return err
+	}
+	db.commitLock.Lock()
+	defer db.commitLock.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.lock.RLock()
+	for _, m := range mutations {
+		if _, exists := db.keydir[m.key]; m.deleted && !exists {
+			db.lock.RUnlock()
+			return fmt.Errorf("cannot delete key %d: %w", m.key, ErrKeyNotFound)
+		}
+	}
+	db.lock.RUnlock()
+	return db.apply(mutations)
+}
+
+// keys returns every key in r that currently has a value.
+func (db *BitcaskStorage) keys(r KeyRange) []Key {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	var keys []Key
+	for key := range db.keydir {
+		if r.Contains(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Begin supports ReadCommitted and Serializable isolation and both lock
+// modes. Snapshot isolation is rejected, since no older versions are kept
+// to read from.
+func (db *BitcaskStorage) Begin(ctx context.Context, opts TxOptions) (StorageTransaction, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if opts.Isolation == Snapshot {
+		return nil, fmt.Errorf("%w: bitcask storage does not support %s isolation", ErrUnsupportedTxOptions, opts.Isolation)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	tx := &BitcaskStorageTransaction{
+		BitcaskStorage: db,
+		ctx:            ctx,
+		opts:           opts,
+		transactions:   make(map[Key]*Value),
+		reads:          make(map[Key]uint64),
+		checked:        make(map[Key]uint64),
+	}
+	if opts.Lock == LockPessimistic {
+		db.commitLock.Lock()
+		tx.locked = true
+	}
+	return tx, nil
+}
+
+// Merge rewrites the live values of every immutable data file into one new
+// file and deletes the old ones. Commits continue while it runs.
+func (db *BitcaskStorage) Merge() error {
+	_, err := db.merge()
+	return err
+}
+
+// Reencrypt rewrites every value with the current key of
+// BitcaskOptions.Keyring, after the keyring was rotated, and returns how
+// many values it rewrote. It rotates the active data file and merges every
+// file, so it also drops the values that are no longer live.
+func (db *BitcaskStorage) Reencrypt(ctx context.Context) (int, error) {
+	if db.options.Keyring == nil {
+		return 0, errors.New("re-encryption needs a keyring")
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return db.merge()
+}
+
+// merge does the work of Merge and returns how many values it rewrote.
+func (db *BitcaskStorage) merge() (int, error) {
+	db.mergeLock.Lock()
+	defer db.mergeLock.Unlock()
+
+	db.commitLock.Lock()
+	if db.activeSize > 0 {
+		if err := db.rotate(); err != nil {
+			db.commitLock.Unlock()
+			return 0, err
+		}
+	}
+	outID := db.nextID
+	db.nextID++
+	activeID := db.activeID
+	db.commitLock.Unlock()
+
+	// Commits may rotate to newer active files as soon as commitLock is
+	// released, so only the files older than activeID are merged.
+	db.lock.RLock()
+	var merged []uint32
+	for id := range db.files {
+		if id < activeID {
+			merged = append(merged, id)
+		}
+	}
+	live := make(map[Key]keydirEntry)
+	for key, entry := range db.keydir {
+		if entry.fileID < activeID {
+			live[key] = entry
+		}
+	}
+	db.lock.RUnlock()
+	if len(merged) == 0 {
+		return 0, nil
+	}
+
+	out, err := os.OpenFile(dataFileName(db.dir, outID), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	writer := bufio.NewWriter(out)
+	var hints []hintEntry
+	var offset int64
+	for key, entry := range live {
+		value, err := db.readAt(key, entry)
+		if err != nil {
+			out.Close()
+			os.Remove(out.Name())
+			return 0, err
+		}
+		record := walRecord{ts: entry.ts, mutations: []mutation{{key: key, value: value}}}
+		frame := record.encode(db.options.Keyring)
+		writer.Write(frame)
+		for _, hint := range frameHints(record, offset) {
+			hint.fileID = outID
+			hints = append(hints, hint)
+		}
+		offset += int64(len(frame))
+	}
+	if err := writer.Flush(); err == nil {
+		err = out.Sync()
+	}
+	if err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return 0, err
+	}
+	if err := writeHintFile(hintFileName(db.dir, outID), hints); err != nil {
+		slog.Warn("Cannot write hint file", "file_id", outID, "error", err)
+	}
+
+	db.lock.Lock()
+	for _, hint := range hints {
+		if db.keydir[hint.key] == live[hint.key] {
+			db.keydir[hint.key] = hint.keydirEntry
+		}
+	}
+	old := make([]*os.File, 0, len(merged))
+	for _, id := range merged {
+		old = append(old, db.files[id])
+		delete(db.files, id)
+	}
+	db.files[outID] = out
+	db.lock.Unlock()
+
+	for i, id := range merged {
+		old[i].Close()
+		os.Remove(dataFileName(db.dir, id))
+		os.Remove(hintFileName(db.dir, id))
+	}
+	slog.Info("Merged bitcask data files", "files", len(merged), "keys", len(hints))
+	return len(hints), nil
+}
+
+func (db *BitcaskStorage) readAt(key Key, entry keydirEntry) (Value, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return db.read(key, entry)
+}
+
+func (db *BitcaskStorage) mergeLoop() {
+	defer db.done.Done()
+	ticker := time.NewTicker(db.options.MergeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.stop:
+			return
+		case <-ticker.C:
+			if err := db.Merge(); err != nil {
+				slog.Error("Cannot merge bitcask data files", "error", err)
+			}
+		}
+	}
+}
+
+func (db *BitcaskStorage) syncLoop() {
+	defer db.done.Done()
+	ticker := time.NewTicker(db.options.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.stop:
+			return
+		case <-ticker.C:
+			db.commitLock.Lock()
+			if err := db.active.Sync(); err != nil {
+				slog.Error("Cannot sync bitcask data file", "error", err)
+			}
+			db.commitLock.Unlock()
+		}
+	}
+}
+
+// Close stops background work, writes the hint file of the active data
+// file and closes all files.
+func (db *BitcaskStorage) Close() error {
+	close(db.stop)
+	db.done.Wait()
+	db.commitLock.Lock()
+	defer db.commitLock.Unlock()
+	err := db.active.Sync()
+	if err == nil {
+		err = writeHintFile(hintFileName(db.dir, db.activeID), db.activeHints)
+	}
+	db.closeFiles()
+	return err
+}
+
+func (db *BitcaskStorage) closeFiles() {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	for id, file := range db.files {
+		file.Close()
+		delete(db.files, id)
+	}
+}
+
+func (tx *BitcaskStorageTransaction) Set(key Key, value Value) error {
+	if err := tx.ctx.Err(); err != nil {
+		return err
+	}
+	if tx.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	value, err := normalizeAccount(value)
+	if err != nil {
+		return err
+	}
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	tx.transactions[key] = &value
+	return nil
+}
+
+func (tx *BitcaskStorageTransaction) Insert(key Key, value Value) error {
+	return tx.setIf(key, value, checkAbsent)
+}
+
+func (tx *BitcaskStorageTransaction) CompareAndSet(key Key, expected, value Value) error {
+	return tx.setIf(key, value, checkEqual(expected))
+}
+
+// setIf writes value if check accepts the current value of key: the
+// transaction's own write, or else the latest committed value. The commit
+// timestamp of that value is remembered in checked, so the write does not
+// commit if someone else has replaced it by then.
+func (tx *BitcaskStorageTransaction) setIf(key Key, value Value, check setCheck) error {
+	if err := tx.ctx.Err(); err != nil {
+		return err
+	}
+	if tx.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	value, err := normalizeAccount(value)
+	if err != nil {
+		return err
+	}
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	var current Value
+	written, exists := tx.transactions[key]
+	if exists {
+		exists = written != nil
+		if exists {
+			current = *written
+		}
+	} else {
+		var ts uint64
+		current, ts, err = tx.BitcaskStorage.get(key)
+		if err != nil && !errors.Is(err, ErrKeyNotFound) {
+			return err
+		}
+		exists = err == nil
+		if _, seen := tx.checked[key]; !seen {
+			tx.checked[key] = ts
+		}
+	}
+	if err := check(key, current, exists); err != nil {
+		return err
+	}
+	tx.transactions[key] = &value
+	return nil
+}
+
+func (tx *BitcaskStorageTransaction) Get(key Key) (Value, error) {
+	if err := tx.ctx.Err(); err != nil {
+		return Value{}, err
+	}
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	value, written := tx.transactions[key]
+	if !written {
+		return tx.readCommitted(key)
+	}
+	if value == nil {
+		return Value{}, ErrKeyNotFound
+	}
+	return *value, nil
+}
+
+// readCommitted reads the latest committed value of key and records the
+// timestamp it saw in the read set. Callers must hold tx.lock.
+func (tx *BitcaskStorageTransaction) readCommitted(key Key) (Value, error) {
+	value, ts, err := tx.BitcaskStorage.get(key)
+	if _, seen := tx.reads[key]; !seen {
+		tx.reads[key] = ts
+	}
+	return value, err
+}
+
+// Scan visits the keys in r overlaid with the transaction's own writes.
+// Every key it returns joins the read set, and the part of r it visited is
+// remembered so that keys others insert into it are detected at commit.
+func (tx *BitcaskStorageTransaction) Scan(r KeyRange, fn func(key Key, value Value) bool) error {
+	tx.lock.Lock()
+	overlay := maps.Clone(tx.transactions)
+	tx.lock.Unlock()
+
+	keys := tx.keys(r)
+	for key := range overlay {
+		keys = append(keys, key)
+	}
+	get := func(key Key) (Value, error) {
+		if value, written := overlay[key]; written {
+			if value == nil {
+				return Value{}, ErrKeyNotFound
+			}
+			return *value, nil
+		}
+		tx.lock.Lock()
+		defer tx.lock.Unlock()
+		return tx.readCommitted(key)
+	}
+	visited, last, stopped := 0, Key(0), false
+	err := scanSorted(tx.ctx, keys, r, get, func(key Key, value Value) bool {
+		visited, last = visited+1, key
+		stopped = !fn(key, value)
+		return !stopped
+	})
+	if err != nil {
+		return err
+	}
+	covered := KeyRange{Start: r.Start, End: r.End}
+	if stopped || (r.Limit > 0 && visited >= r.Limit) {
+		covered.End = last + 1
+	}
+	tx.lock.Lock()
+	tx.scans = append(tx.scans, covered)
+	tx.lock.Unlock()
+	return nil
+}
+
+func (tx *BitcaskStorageTransaction) Delete(key Key) error {
+	if err := tx.ctx.Err(); err != nil {
+		return err
+	}
+	if tx.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	if value, written := tx.transactions[key]; written {
+		if value == nil {
+			return ErrKeyNotFound
+		}
+	} else if _, err := tx.readCommitted(key); err != nil {
+		return err
+	}
+	tx.transactions[key] = nil
+	return nil
+}
+
+// Commit appends all writes of the transaction as a single frame, so they
+// survive a crash together or not at all, and then publishes them in the
+// key directory. At the serializable level it fails with ErrConflict if a
+// key the transaction read was changed, or a key was inserted into a range
+// it scanned, by another commit in the meantime. That check applies to a
+// transaction that wrote nothing as well, so a read-only transaction does
+// not return values from before and after another commit.
+func (tx *BitcaskStorageTransaction) Commit() error {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	defer tx.reset()
+	if len(tx.transactions) == 0 && (tx.opts.isolation() != Serializable || len(tx.reads) == 0 && len(tx.scans) == 0) {
+		return nil
+	}
+	db := tx.BitcaskStorage
+	if !tx.locked {
+		db.commitLock.Lock()
+		defer db.commitLock.Unlock()
+	}
+	// Checked after waiting for commitLock, so a commit that was queued
+	// behind others past its deadline is not applied.
+	if err := tx.ctx.Err(); err != nil {
+		return err
+	}
+	if key, conflict := tx.conflictingKey(); conflict {
+		return fmt.Errorf("%w: key %d", ErrConflict, key)
+	}
+	if len(tx.transactions) == 0 {
+		return nil
+	}
+
+	mutations := make([]mutation, 0, len(tx.transactions))
+	for key, value := range tx.transactions {
+		m := mutation{key: key, deleted: value == nil}
+		if value != nil {
+			m.value = *value
+		}
+		mutations = append(mutations, m)
+	}
+	return db.apply(mutations)
+}
+
+// apply appends mutations to the active file as one frame and publishes
+// them in the key directory. Callers must hold commitLock.
+func (db *BitcaskStorage) apply(mutations []mutation) error {
+	if db.failed != nil {
+		return fmt.Errorf("bitcask data file unusable: %w", db.failed)
+	}
+	record := walRecord{ts: db.ts + 1, mutations: mutations}
+	frame := record.encode(db.options.Keyring)
+	if err := checkFrameSize(frame); err != nil {
+		return err
+	}
+	if _, err := db.active.Write(frame); err != nil {
+		// Cut off the partial frame so later commits are not appended
+		// after it.
+		if truncErr := db.active.Truncate(db.activeSize); truncErr != nil {
+			db.failed = truncErr
+		} else if _, seekErr := db.active.Seek(db.activeSize, io.SeekStart); seekErr != nil {
+			db.failed = seekErr
+		}
+		return fmt.Errorf("cannot write commit: %w", err)
+	}
+	if db.options.Sync == SyncAlways {
+		if err := db.active.Sync(); err != nil {
+			// The frame may or may not be durable, and it comes back after
+			// a restart if it is; refuse to go on rather than let the key
+			// directory and the file disagree.
+			db.failed = err
+			return fmt.Errorf("cannot sync commit: %w", err)
+		}
+	}
+	hints := frameHints(record, db.activeSize)
+	db.ts = record.ts
+	db.activeSize += int64(len(frame))
+
+	db.lock.Lock()
+	for _, hint := range hints {
+		hint.fileID = db.activeID
+		if hint.deleted {
+			delete(db.keydir, hint.key)
+		} else {
+			db.keydir[hint.key] = hint.keydirEntry
+		}
+		db.activeHints = append(db.activeHints, hint)
+	}
+	db.lock.Unlock()
+
+	if db.activeSize >= db.options.MaxFileSize {
+		if err := db.rotate(); err != nil {
+			slog.Error("Cannot rotate bitcask data file", "error", err)
+		}
+	}
+	return nil
+}
+
+// conflictingKey finds a key checked by a conditional write whose latest
+// commit differs from the one checked. At the serializable level it also
+// finds a key in the read set whose latest commit differs from the one the
+// transaction read, or a key in a scanned range that the transaction
+// neither read nor wrote. Callers must hold commitLock.
+func (tx *BitcaskStorageTransaction) conflictingKey() (Key, bool) {
+	db := tx.BitcaskStorage
+	db.lock.RLock()
+	for key, ts := range tx.checked {
+		if db.keydir[key].ts != ts {
+			db.lock.RUnlock()
+			return key, true
+		}
+	}
+	db.lock.RUnlock()
+	if tx.opts.isolation() != Serializable {
+		return 0, false
+	}
+	for _, r := range tx.scans {
+		for _, key := range db.keys(r) {
+			_, read := tx.reads[key]
+			_, written := tx.transactions[key]
+			if !read && !written {
+				return key, true
+			}
+		}
+	}
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	for key, ts := range tx.reads {
+		if db.keydir[key].ts != ts {
+			return key, true
+		}
+	}
+	return 0, false
+}
+
+func (tx *BitcaskStorageTransaction) Rollback() error {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	tx.reset()
+	return nil
+}
+
+// reset ends the transaction: it forgets its reads and writes and releases
+// commitLock if it is pessimistic. Callers must hold tx.lock.
+func (tx *BitcaskStorageTransaction) reset() {
+	clear(tx.transactions)
+	clear(tx.reads)
+	clear(tx.checked)
+	tx.scans = nil
+	if tx.locked {
+		tx.locked = false
+		tx.commitLock.Unlock()
+	}
+}
@@ -0,0 +1,199 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"main/storage"
+	"main/storage/storagetest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openBitcask(t *testing.T, dir string, options storage.BitcaskOptions) *storage.BitcaskStorage {
+	t.Helper()
+	db, err := storage.NewBitcaskStorage(dir, options)
+	if err != nil {
+		t.Fatalf("Cannot open bitcask storage: %v", err)
+	}
+	return db
+}
+
+func TestBitcaskStorage_ReopenRestoresKeys(t *testing.T) {
+	dir := t.TempDir()
+	db := openBitcask(t, dir, storage.BitcaskOptions{})
+	tx := begin(db)
+	tx.Set(1, storagetest.WithBalance("100"))
+	tx.Set(2, storagetest.WithBalance("50"))
+	tx.Commit()
+	tx = begin(db)
+	tx.Set(1, storagetest.WithBalance("75"))
+	tx.Delete(2)
+	tx.Commit()
+	db.Close()
+
+	// Once from the hint files written on Close and once by scanning the
+	// data files.
+	for _, removeHints := range []bool{false, true} {
+		if removeHints {
+			hints, _ := filepath.Glob(filepath.Join(dir, "*.hint"))
+			for _, hint := range hints {
+				os.Remove(hint)
+			}
+		}
+		db = openBitcask(t, dir, storage.BitcaskOptions{})
+		if balance, _ := db.Get(context.Background(), 1); balance.Balance.String() != "75.0000000000000000000" {
+			t.Errorf("Expected 75 after reopening, got %q", balance.Balance)
+		}
+		if _, err := db.Get(context.Background(), 2); !errors.Is(err, storage.ErrKeyNotFound) {
+			t.Errorf("Expected deleted key to stay deleted, got %v", err)
+		}
+		db.Close()
+	}
+}
+
+func TestBitcaskStorage_CommitIsAtomicAcrossCrash(t *testing.T) {
+	dir := t.TempDir()
+	db := openBitcask(t, dir, storage.BitcaskOptions{})
+	tx := begin(db)
+	tx.Set(1, storagetest.WithBalance("100"))
+	tx.Set(2, storagetest.WithBalance("100"))
+	tx.Commit()
+	tx = begin(db)
+	tx.Set(1, storagetest.WithBalance("90"))
+	tx.Set(2, storagetest.WithBalance("110"))
+	tx.Commit()
+	db.Close()
+
+	// Tear the last commit as a crash in the middle of the write would,
+	// and drop the hint so the data file is scanned.
+	data, _ := filepath.Glob(filepath.Join(dir, "*.data"))
+	info, _ := os.Stat(data[len(data)-1])
+	os.Truncate(data[len(data)-1], info.Size()-10)
+	hints, _ := filepath.Glob(filepath.Join(dir, "*.hint"))
+	for _, hint := range hints {
+		os.Remove(hint)
+	}
+
+	db = openBitcask(t, dir, storage.BitcaskOptions{})
+	defer db.Close()
+	first, _ := db.Get(context.Background(), 1)
+	second, _ := db.Get(context.Background(), 2)
+	if first.Balance.String() != "100.0000000000000000000" || second.Balance.String() != "100.0000000000000000000" {
+		t.Errorf("Expected the torn commit to be dropped as a whole, got %s and %s", first.Balance, second.Balance)
+	}
+}
+
+func TestBitcaskStorage_FailedWriteRefusesLaterCommits(t *testing.T) {
+	db := openBitcask(t, t.TempDir(), storage.BitcaskOptions{})
+	defer db.Close()
+	tx := begin(db)
+	tx.Set(1, storagetest.WithBalance("100"))
+	tx.Commit()
+
+	repair := db.BreakActiveFile()
+	tx = begin(db)
+	tx.Set(2, storagetest.WithBalance("50"))
+	if err := tx.Commit(); err == nil {
+		t.Fatal("Expected the commit to fail")
+	}
+	// The torn frame could not be cut off, so even a working file must
+	// not take more commits after it.
+	repair()
+	tx = begin(db)
+	tx.Set(3, storagetest.WithBalance("50"))
+	if err := tx.Commit(); err == nil {
+		t.Error("Expected commits after an undone write to be refused")
+	}
+	if balance, _ := db.Get(context.Background(), 1); balance.Balance.String() != "100.0000000000000000000" {
+		t.Errorf("Expected earlier commits to stay readable, got %s", balance.Balance)
+	}
+}
+
+func TestBitcaskStorage_CommitDetectsConflict(t *testing.T) {
+	db := openBitcask(t, t.TempDir(), storage.BitcaskOptions{})
+	defer db.Close()
+	tx := begin(db)
+	tx.Set(1, storagetest.WithBalance("100"))
+	tx.Commit()
+
+	first := begin(db)
+	second := begin(db)
+	first.Get(1)
+	second.Get(1)
+	first.Set(1, storagetest.WithBalance("90"))
+	second.Set(1, storagetest.WithBalance("80"))
+	if err := first.Commit(); err != nil {
+		t.Fatalf("First commit failed: %v", err)
+	}
+	if err := second.Commit(); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("Expected ErrConflict, got %v", err)
+	}
+}
+
+func TestBitcaskStorage_MergeKeepsLiveValues(t *testing.T) {
+	dir := t.TempDir()
+	db := openBitcask(t, dir, storage.BitcaskOptions{MaxFileSize: 256})
+	for round := range 20 {
+		for key := range storage.Key(10) {
+			tx := begin(db)
+			if round == 19 && key%2 == 0 {
+				tx.Delete(key)
+			} else {
+				tx.Set(key, storagetest.WithBalance("1"))
+			}
+			tx.Commit()
+		}
+	}
+	before, _ := filepath.Glob(filepath.Join(dir, "*.data"))
+	if err := db.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	after, _ := filepath.Glob(filepath.Join(dir, "*.data"))
+	if len(after) >= len(before) {
+		t.Errorf("Expected merge to reduce the number of data files, had %d and now %d", len(before), len(after))
+	}
+	db.Close()
+
+	db = openBitcask(t, dir, storage.BitcaskOptions{})
+	defer db.Close()
+	for key := range storage.Key(10) {
+		_, err := db.Get(context.Background(), key)
+		if key%2 == 0 && !errors.Is(err, storage.ErrKeyNotFound) {
+			t.Errorf("Expected key %d to be deleted, got %v", key, err)
+		}
+		if key%2 == 1 && err != nil {
+			t.Errorf("Expected key %d to survive the merge, got %v", key, err)
+		}
+	}
+}
+
+func TestBitcaskStorage_MergeWhileCommitting(t *testing.T) {
+	dir := t.TempDir()
+	db := openBitcask(t, dir, storage.BitcaskOptions{Sync: storage.SyncNever, MaxFileSize: 1024})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for key := range storage.Key(500) {
+			tx := begin(db)
+			tx.Set(key%50, storagetest.WithBalance("1"))
+			tx.Set(1000+key, storagetest.WithBalance("2"))
+			tx.Commit()
+		}
+	}()
+	for range 20 {
+		if err := db.Merge(); err != nil {
+			t.Errorf("Merge failed: %v", err)
+		}
+	}
+	<-done
+	db.Close()
+
+	db = openBitcask(t, dir, storage.BitcaskOptions{})
+	defer db.Close()
+	for key := range storage.Key(500) {
+		if _, err := db.Get(context.Background(), 1000+key); err != nil {
+			t.Fatalf("Key %d lost during merge: %v", 1000+key, err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"main/storage"
+	"main/storage/storagetest"
+	"testing"
+)
+
+func TestInsert_RejectsExistingKey(t *testing.T) {
+	for name, store := range scanBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			tx := begin(store)
+			if err := tx.Insert(1, storagetest.WithBalance("1")); err != nil {
+				t.Fatalf("Insert failed: %v", err)
+			}
+			if err := tx.Insert(1, storagetest.WithBalance("2")); !errors.Is(err, storage.ErrKeyExists) {
+				t.Errorf("Expected ErrKeyExists within the transaction, got %v", err)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatalf("Commit failed: %v", err)
+			}
+
+			tx = begin(store)
+			if err := tx.Insert(1, storagetest.WithBalance("3")); !errors.Is(err, storage.ErrKeyExists) {
+				t.Errorf("Expected ErrKeyExists for a committed key, got %v", err)
+			}
+			tx.Rollback()
+			if account, _ := store.Get(context.Background(), 1); account.Balance.String() != "1.0000000000000000000" {
+				t.Errorf("Expected the first insert to stand, got %s", account.Balance)
+			}
+		})
+	}
+}
+
+func TestCompareAndSet_RequiresExpectedValue(t *testing.T) {
+	for name, store := range scanBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			tx := begin(store)
+			tx.Set(1, storagetest.WithBalance("1"))
+			tx.Commit()
+
+			tx = begin(store)
+			defer tx.Rollback()
+			current, _ := tx.Get(1)
+			stale := current
+			stale.Version++
+			if err := tx.CompareAndSet(1, stale, storagetest.WithBalance("6")); !errors.Is(err, storage.ErrCompareFailed) {
+				t.Errorf("Expected ErrCompareFailed for a stale value, got %v", err)
+			}
+			if err := tx.CompareAndSet(2, current, storagetest.WithBalance("2")); !errors.Is(err, storage.ErrKeyNotFound) {
+				t.Errorf("Expected ErrKeyNotFound for a missing key, got %v", err)
+			}
+			if err := tx.CompareAndSet(1, current, storagetest.WithBalance("2")); err != nil {
+				t.Errorf("Expected CompareAndSet to succeed, got %v", err)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatalf("Commit failed: %v", err)
+			}
+			if account, _ := store.Get(context.Background(), 1); account.Balance.String() != "2.0000000000000000000" {
+				t.Errorf("Expected balance 2, got %s", account.Balance)
+			}
+		})
+	}
+}
+
+func TestInMemoryStorage_CompareAndSetConflictsAtReadCommitted(t *testing.T) {
+	// Read committed does not check reads at commit, but a CompareAndSet
+	// still must not overwrite a value committed after it compared.
+	store := storage.NewInMemoryStorage()
+	tx := begin(store)
+	tx.Set(1, storagetest.WithBalance("1"))
+	tx.Commit()
+
+	cas, _ := store.Begin(context.Background(), storage.TxOptions{Isolation: storage.ReadCommitted})
+	current, _ := cas.Get(1)
+	if err := cas.CompareAndSet(1, current, storagetest.WithBalance("2")); err != nil {
+		t.Fatalf("CompareAndSet failed: %v", err)
+	}
+	writer := begin(store)
+	writer.Set(1, storagetest.WithBalance("3"))
+	writer.Commit()
+
+	if err := cas.Commit(); !errors.Is(err, storage.ErrConflict) {
+		t.Errorf("Expected ErrConflict, got %v", err)
+	}
+}
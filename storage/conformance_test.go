@@ -0,0 +1,65 @@
+package storage_test
+
+import (
+	"main/storage"
+	"main/storage/storagetest"
+	"path/filepath"
+	"testing"
+)
+
+func TestConformance_InMemory(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return storage.NewInMemoryStorage()
+	})
+}
+
+func TestConformance_InMemoryWithWAL(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		dir := t.TempDir()
+		store, err := storage.NewInMemoryStorageWithWAL(filepath.Join(dir, "store.wal"), storage.WALOptions{SnapshotDir: filepath.Join(dir, "snapshots")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Close() })
+		return store
+	})
+}
+
+func TestConformance_Sqlite(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		db := storage.NewSqliteStorage(filepath.Join(t.TempDir(), "store.db"))
+		t.Cleanup(func() { db.Close() })
+		return db
+	})
+}
+
+func TestConformance_EncryptedSqlite(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		dir := t.TempDir()
+		keyPath := filepath.Join(dir, "keys")
+		addKey(t, keyPath, 1)
+		db := storage.NewSqliteStorageWithOptions(filepath.Join(dir, "store.db"), storage.SqliteOptions{Keyring: loadKeyring(t, keyPath)})
+		t.Cleanup(func() { db.Close() })
+		return db
+	})
+}
+
+func TestConformance_Bitcask(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		db := openBitcask(t, t.TempDir(), storage.BitcaskOptions{})
+		t.Cleanup(func() { db.Close() })
+		return db
+	})
+}
+
+func TestConformance_Instrumented(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return storage.NewInstrumentedStorage(storage.NewInMemoryStorage())
+	})
+}
+
+func TestConformance_FaultyWithoutFaults(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return storage.NewFaultyStorage(storage.NewInMemoryStorage(), storage.FaultOptions{})
+	})
+}
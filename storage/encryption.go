@@ -0,0 +1,211 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrDecrypt is returned when a stored value cannot be decrypted, because
+// its key is not in the keyring or because it was tampered with. Unlike a
+// torn record, such a value is not dropped: the key file must be fixed.
+var ErrDecrypt = errors.New("cannot decrypt stored value")
+
+// Keyring holds the AES-256 keys that encrypt accounts at rest with
+// AES-GCM. Every encrypted value names the ID of its key:
+//
+//	enc:<key id>:<base64 of nonce | ciphertext>
+//
+// and is authenticated together with the account key it is stored under,
+// so that a value copied to another account does not decrypt. New values
+// are encrypted with the current key, the one with the highest ID; the
+// others only decrypt values written before a rotation. Values in plain
+// text fail with ErrDecrypt, unless AllowPlaintext was called to migrate
+// storage written before encryption was enabled.
+//
+// A nil Keyring encrypts nothing.
+type Keyring struct {
+	path string
+
+	lock           sync.RWMutex
+	keys           map[uint32]cipher.AEAD
+	current        uint32
+	allowPlaintext bool
+}
+
+const encryptedPrefix = "enc:"
+
+// LoadKeyring reads the key file at path. Every line holds a key ID and a
+// base64-encoded 32-byte key, separated by a space:
+//
+//	1 mJ3a3yX0T9nXQm8FzB0r6x0m3rU9T2y3bE6wz0T1b2c=
+//	2 5l8yq3U3Yc4pHk0Wm2H2m7s1Vb9bX5J3xQ1c8f2Y9aQ=
+//
+// Blank lines and lines starting with # are ignored. To rotate, append a
+// key with a higher ID and call Reload; remove the old key only once every
+// value has been re-encrypted.
+func LoadKeyring(path string) (*Keyring, error) {
+	k := &Keyring{path: path}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Reload reads the key file again. New values are encrypted with its
+// current key from then on; if the file is invalid, the keyring is left
+// as it was.
+func (k *Keyring) Reload() error {
+	data, err := os.ReadFile(k.path)
+	if err != nil {
+		return err
+	}
+	keys := make(map[uint32]cipher.AEAD)
+	var current uint32
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		idText, keyText, ok := strings.Cut(text, " ")
+		if !ok {
+			return fmt.Errorf("%s:%d: want a key ID and a key", k.path, line)
+		}
+		id, err := strconv.ParseUint(idText, 10, 32)
+		if err != nil || id == 0 {
+			return fmt.Errorf("%s:%d: key ID must be a positive integer, got %q", k.path, line, idText)
+		}
+		if _, ok := keys[uint32(id)]; ok {
+			return fmt.Errorf("%s:%d: duplicate key ID %d", k.path, line, id)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(keyText))
+		if err != nil || len(key) != 32 {
+			return fmt.Errorf("%s:%d: key must be 32 bytes in base64", k.path, line)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+		keys[uint32(id)] = aead
+		current = max(current, uint32(id))
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("%s: no keys", k.path)
+	}
+	k.lock.Lock()
+	k.keys, k.current = keys, current
+	k.lock.Unlock()
+	return nil
+}
+
+// AllowPlaintext sets whether values stored in plain text are read as they
+// are rather than rejected. It is meant for the time it takes to encrypt
+// storage that existed before encryption was enabled: otherwise anyone who
+// can write to the storage could slip in a value that was never encrypted.
+func (k *Keyring) AllowPlaintext(allow bool) {
+	k.lock.Lock()
+	k.allowPlaintext = allow
+	k.lock.Unlock()
+}
+
+// Current returns the ID of the key that encrypts new values.
+func (k *Keyring) Current() uint32 {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	return k.current
+}
+
+// currentPrefix is the start of every value encrypted with the current key.
+func (k *Keyring) currentPrefix() string {
+	return fmt.Sprintf("%s%d:", encryptedPrefix, k.Current())
+}
+
+// Seal encrypts plaintext, stored under key, with the current key. The
+// key need not be an account: any number that Open is given back works,
+// such as the position of a log entry.
+func (k *Keyring) Seal(key Key, plaintext []byte) []byte {
+	if k == nil {
+		return plaintext
+	}
+	k.lock.RLock()
+	id, aead := k.current, k.keys[k.current]
+	k.lock.RUnlock()
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	rand.Read(nonce)
+	sealed := aead.Seal(nonce, nonce, plaintext, binary.LittleEndian.AppendUint64(nil, key))
+	out := fmt.Appendf(nil, "%s%d:", encryptedPrefix, id)
+	return base64.StdEncoding.AppendEncode(out, sealed)
+}
+
+// Open decrypts data that Seal encrypted under key. Data in plain text is
+// returned as it is if k is nil or allows plain text.
+func (k *Keyring) Open(key Key, data []byte) ([]byte, error) {
+	rest, ok := bytes.CutPrefix(data, []byte(encryptedPrefix))
+	if !ok {
+		if k != nil {
+			k.lock.RLock()
+			allow := k.allowPlaintext
+			k.lock.RUnlock()
+			if !allow {
+				return nil, fmt.Errorf("%w: key %d is stored in plain text", ErrDecrypt, key)
+			}
+		}
+		return data, nil
+	}
+	idText, encoded, ok := bytes.Cut(rest, []byte(":"))
+	if !ok {
+		return nil, fmt.Errorf("%w: key %d: malformed value", ErrDecrypt, key)
+	}
+	if k == nil {
+		return nil, fmt.Errorf("%w: key %d is encrypted but no key file is set", ErrDecrypt, key)
+	}
+	id, err := strconv.ParseUint(string(idText), 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("%w: key %d: malformed key ID", ErrDecrypt, key)
+	}
+	k.lock.RLock()
+	aead, ok := k.keys[uint32(id)]
+	k.lock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: key %d is encrypted with key ID %d, which is not in %s", ErrDecrypt, key, id, k.path)
+	}
+	sealed, err := base64.StdEncoding.AppendDecode(nil, encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("%w: key %d: malformed value", ErrDecrypt, key)
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, binary.LittleEndian.AppendUint64(nil, key))
+	if err != nil {
+		return nil, fmt.Errorf("%w: key %d: %w", ErrDecrypt, key, err)
+	}
+	return plaintext, nil
+}
+
+// encodeAccount serializes account, stored under key, and encrypts it.
+func (k *Keyring) encodeAccount(key Key, account Account) []byte {
+	return k.Seal(key, encodeAccount(account))
+}
+
+// decodeAccount decrypts and deserializes the account stored under key.
+func (k *Keyring) decodeAccount(key Key, data []byte) (Account, error) {
+	plaintext, err := k.Open(key, data)
+	if err != nil {
+		return Account{}, err
+	}
+	return decodeAccount(plaintext)
+}
@@ -0,0 +1,293 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"main/storage"
+	"main/storage/storagetest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// addKey appends a fresh key with id to the key file at path.
+func addKey(t *testing.T, path string, id int) {
+	t.Helper()
+	key := make([]byte, 32)
+	rand.Read(key)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	fmt.Fprintf(file, "%d %s\n", id, base64.StdEncoding.EncodeToString(key))
+}
+
+// dropKey removes the key with id from the key file at path.
+func dropKey(t *testing.T, path string, id int) {
+	t.Helper()
+	data, _ := os.ReadFile(path)
+	var kept []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if !strings.HasPrefix(line, fmt.Sprintf("%d ", id)) {
+			kept = append(kept, line)
+		}
+	}
+	os.WriteFile(path, []byte(strings.Join(kept, "\n")+"\n"), 0o600)
+}
+
+func loadKeyring(t *testing.T, path string) *storage.Keyring {
+	t.Helper()
+	keyring, err := storage.LoadKeyring(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+func TestLoadKeyring_RejectsInvalidKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	for _, contents := range []string{
+		"",
+		"1\n",
+		"0 " + base64.StdEncoding.EncodeToString(make([]byte, 32)) + "\n",
+		"1 " + base64.StdEncoding.EncodeToString(make([]byte, 16)) + "\n",
+		"1 " + base64.StdEncoding.EncodeToString(make([]byte, 32)) + "\n1 " + base64.StdEncoding.EncodeToString(make([]byte, 32)) + "\n",
+	} {
+		os.WriteFile(path, []byte(contents), 0o600)
+		if _, err := storage.LoadKeyring(path); err == nil {
+			t.Errorf("Expected key file %q to be rejected", contents)
+		}
+	}
+}
+
+func TestSqliteStorage_EncryptsBalancesAndRotatesKeys(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	dbPath, keyPath := filepath.Join(dir, "store.db"), filepath.Join(dir, "keys")
+
+	// Accounts stored before encryption was enabled are rejected, unless
+	// plain text is allowed while they are encrypted.
+	db := storage.NewSqliteStorage(dbPath)
+	tx := begin(db)
+	tx.Set(1, storagetest.WithBalance("100"))
+	tx.Commit()
+	db.Close()
+
+	addKey(t, keyPath, 1)
+	keyring := loadKeyring(t, keyPath)
+	db = storage.NewSqliteStorageWithOptions(dbPath, storage.SqliteOptions{Keyring: keyring})
+	defer db.Close()
+	if _, err := db.Get(ctx, 1); !errors.Is(err, storage.ErrDecrypt) {
+		t.Errorf("Expected ErrDecrypt for a balance in plain text, got %v", err)
+	}
+	if _, err := db.Reencrypt(ctx); !errors.Is(err, storage.ErrDecrypt) {
+		t.Errorf("Expected re-encryption to fail on a balance in plain text, got %v", err)
+	}
+	keyring.AllowPlaintext(true)
+	tx = begin(db)
+	tx.Set(2, storagetest.WithBalance("50"))
+	tx.Commit()
+	if count, err := db.Reencrypt(ctx); err != nil || count != 1 {
+		t.Fatalf("Expected 1 balance encrypted, got %d, %v", count, err)
+	}
+	keyring.AllowPlaintext(false)
+	balances := rawBalances(t, db.DB)
+	for key, balance := range balances {
+		if !strings.HasPrefix(balance, "enc:1:") {
+			t.Errorf("Expected the balance of %d encrypted with key 1, got %q", key, balance)
+		}
+	}
+
+	// A balance copied to another account does not decrypt.
+	db.Exec(`UPDATE accounts SET balance = ? WHERE id = 2;`, balances[1])
+	if _, err := db.Get(ctx, 2); !errors.Is(err, storage.ErrDecrypt) {
+		t.Errorf("Expected ErrDecrypt for a copied balance, got %v", err)
+	}
+	db.Exec(`UPDATE accounts SET balance = ? WHERE id = 2;`, balances[2])
+
+	addKey(t, keyPath, 2)
+	if err := keyring.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := db.Reencrypt(ctx); err != nil || count != 2 {
+		t.Fatalf("Expected 2 balances re-encrypted, got %d, %v", count, err)
+	}
+	if count, _ := db.Reencrypt(ctx); count != 0 {
+		t.Errorf("Expected nothing left to re-encrypt, got %d", count)
+	}
+	dropKey(t, keyPath, 1)
+	if err := keyring.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[storage.Key]string{1: "100", 2: "50"} {
+		account, err := db.Get(ctx, key)
+		if err != nil || account.Balance.Cmp(storagetest.WithBalance(want).Balance) != 0 {
+			t.Errorf("Expected %d to hold %s with key 2 alone, got %v, %v", key, want, account.Balance, err)
+		}
+	}
+}
+
+func rawBalances(t *testing.T, db *sql.DB) map[storage.Key]string {
+	t.Helper()
+	rows, err := db.Query(`SELECT id, balance FROM accounts;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	balances := make(map[storage.Key]string)
+	for rows.Next() {
+		var key storage.Key
+		var balance string
+		rows.Scan(&key, &balance)
+		balances[key] = balance
+	}
+	return balances
+}
+
+func TestInMemoryStorage_EncryptsLogAndSnapshots(t *testing.T) {
+	ctx := context.Background()
+	for _, snapshots := range []bool{false, true} {
+		t.Run(fmt.Sprintf("snapshots=%v", snapshots), func(t *testing.T) {
+			dir := t.TempDir()
+			walPath, keyPath := filepath.Join(dir, "store.wal"), filepath.Join(dir, "keys")
+			addKey(t, keyPath, 1)
+			keyring := loadKeyring(t, keyPath)
+			options := storage.WALOptions{Sync: storage.SyncAlways, Keyring: keyring}
+			if snapshots {
+				options.SnapshotDir = filepath.Join(dir, "snapshots")
+			}
+			open := func() (*storage.InMemoryStorage, error) {
+				return storage.NewInMemoryStorageWithWAL(walPath, options)
+			}
+
+			store, err := open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			tx := begin(store)
+			tx.Set(1, storage.Value{Balance: storagetest.WithBalance("123.45").Balance, Owner: "alice"})
+			tx.Commit()
+			if snapshots {
+				if err := store.Snapshot(); err != nil {
+					t.Fatal(err)
+				}
+				tx = begin(store)
+				tx.Set(2, storagetest.WithBalance("7"))
+				tx.Commit()
+			}
+			store.Close()
+			for _, path := range append(filesIn(t, options.SnapshotDir), walPath) {
+				data, _ := os.ReadFile(path)
+				if bytes.Contains(data, []byte("123.45")) || bytes.Contains(data, []byte("alice")) {
+					t.Errorf("Expected %s to be encrypted, found the account in plain text", path)
+				}
+			}
+
+			// Without the key the log is left alone rather than truncated.
+			options.Keyring = nil
+			if _, err := open(); !errors.Is(err, storage.ErrDecrypt) {
+				t.Fatalf("Expected ErrDecrypt without the key, got %v", err)
+			}
+			options.Keyring = keyring
+
+			addKey(t, keyPath, 2)
+			keyring.Reload()
+			store, err = open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count, err := store.Reencrypt(ctx); err != nil || count == 0 {
+				t.Fatalf("Expected values re-encrypted, got %d, %v", count, err)
+			}
+			store.Close()
+
+			dropKey(t, keyPath, 1)
+			keyring.Reload()
+			store, err = open()
+			if err != nil {
+				t.Fatalf("Expected the store to open with key 2 alone, got %v", err)
+			}
+			defer store.Close()
+			if account, err := store.Get(ctx, 1); err != nil || account.Owner != "alice" {
+				t.Errorf("Expected alice's account after re-encryption, got %v, %v", account, err)
+			}
+		})
+	}
+}
+
+func filesIn(t *testing.T, dir string) []string {
+	t.Helper()
+	if dir == "" {
+		return nil
+	}
+	entries, _ := os.ReadDir(dir)
+	var paths []string
+	for _, entry := range entries {
+		paths = append(paths, filepath.Join(dir, entry.Name()))
+	}
+	return paths
+}
+
+func TestBitcaskStorage_EncryptsDataFiles(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	dataDir, keyPath := filepath.Join(dir, "data"), filepath.Join(dir, "keys")
+	addKey(t, keyPath, 1)
+	keyring := loadKeyring(t, keyPath)
+	options := storage.BitcaskOptions{Sync: storage.SyncAlways, Keyring: keyring}
+
+	db, err := storage.NewBitcaskStorage(dataDir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := begin(db)
+	tx.Set(1, storage.Value{Balance: storagetest.WithBalance("123.45").Balance, Owner: "alice"})
+	tx.Commit()
+	db.Close()
+	for _, path := range filesIn(t, dataDir) {
+		data, _ := os.ReadFile(path)
+		if bytes.Contains(data, []byte("123.45")) || bytes.Contains(data, []byte("alice")) {
+			t.Errorf("Expected %s to be encrypted, found the account in plain text", path)
+		}
+	}
+
+	// Without the key the data files are left alone rather than truncated,
+	// even when they have to be scanned.
+	for _, path := range filesIn(t, dataDir) {
+		if strings.HasSuffix(path, ".hint") {
+			os.Remove(path)
+		}
+	}
+	if _, err := storage.NewBitcaskStorage(dataDir, storage.BitcaskOptions{}); !errors.Is(err, storage.ErrDecrypt) {
+		t.Fatalf("Expected ErrDecrypt without the key, got %v", err)
+	}
+
+	addKey(t, keyPath, 2)
+	keyring.Reload()
+	db, err = storage.NewBitcaskStorage(dataDir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, err := db.Reencrypt(ctx); err != nil || count != 1 {
+		t.Fatalf("Expected 1 value re-encrypted, got %d, %v", count, err)
+	}
+	db.Close()
+
+	dropKey(t, keyPath, 1)
+	keyring.Reload()
+	db, err = storage.NewBitcaskStorage(dataDir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if account, err := db.Get(ctx, 1); err != nil || account.Owner != "alice" {
+		t.Errorf("Expected alice's account after re-encryption, got %v, %v", account, err)
+	}
+}
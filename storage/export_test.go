@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"io"
+	"os"
+)
+
+// VersionCount reports how many versions of key are still retained.
+func (store *InMemoryStorage) VersionCount(key Key) int {
+	chain := store.chain(key)
+	if chain == nil {
+		return 0
+	}
+	count := 0
+	for v := chain.head.Load(); v != nil; v = v.prev.Load() {
+		count++
+	}
+	return count
+}
+
+// BreakActiveFile closes the active data file of db, so that the next
+// commit fails to write it and to cut its frame off again, and returns a
+// function that reopens the file.
+func (db *BitcaskStorage) BreakActiveFile() (repair func()) {
+	db.active.Close()
+	return func() {
+		file, err := os.OpenFile(dataFileName(db.dir, db.activeID), os.O_RDWR, 0o644)
+		if err != nil {
+			panic(err)
+		}
+		file.Seek(db.activeSize, io.SeekStart)
+		db.lock.Lock()
+		db.files[db.activeID] = file
+		db.lock.Unlock()
+		db.active = file
+	}
+}
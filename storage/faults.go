@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// ErrInjectedFault is returned by FaultyStorage for the failures it
+// injects.
+var ErrInjectedFault = errors.New("injected fault")
+
+// FaultOptions configures the failures FaultyStorage injects. The zero
+// FaultOptions injects nothing.
+type FaultOptions struct {
+	// ErrorRates maps operation names (OpGet, OpTxSet, OpCommit, ...) to
+	// the probability that a call fails with ErrInjectedFault without
+	// reaching the backend. A failed Commit rolls the transaction back.
+	ErrorRates map[string]float64
+	// PartialCommitRate is the probability that Commit applies the
+	// transaction but still fails with ErrInjectedFault, as when the
+	// connection drops after the backend committed. The caller cannot
+	// tell whether its writes were applied.
+	PartialCommitRate float64
+	// Latency is added to every operation, plus a random extra delay of
+	// up to LatencyJitter. The delay ends early if the context is done.
+	Latency       time.Duration
+	LatencyJitter time.Duration
+	// Seed seeds the random source. With the same seed and the same
+	// sequence of calls, the same calls fail; concurrent calls draw in
+	// whatever order they arrive.
+	Seed uint64
+}
+
+// FaultyStorage wraps any Storage and injects failures and latency into
+// its operations, for chaos testing.
+type FaultyStorage struct {
+	Storage
+	options FaultOptions
+	// lock guards random, which is not safe for concurrent use.
+	lock   sync.Mutex
+	random *rand.Rand
+}
+
+// FaultyStorageTransaction injects failures into a transaction started
+// through FaultyStorage.
+type FaultyStorageTransaction struct {
+	StorageTransaction
+	ctx     context.Context
+	storage *FaultyStorage
+}
+
+func NewFaultyStorage(s Storage, options FaultOptions) *FaultyStorage {
+	return &FaultyStorage{
+		Storage: s,
+		options: options,
+		random:  rand.New(rand.NewPCG(options.Seed, options.Seed)),
+	}
+}
+
+// chance reports true with the given probability.
+func (s *FaultyStorage) chance(probability float64) bool {
+	if probability <= 0 {
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.random.Float64() < probability
+}
+
+// inject delays op by the configured latency and then decides whether it
+// fails.
+func (s *FaultyStorage) inject(ctx context.Context, op string) error {
+	if delay := s.options.Latency + s.jitter(); delay > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+	if s.chance(s.options.ErrorRates[op]) {
+		return fmt.Errorf("%w: %s", ErrInjectedFault, op)
+	}
+	return nil
+}
+
+func (s *FaultyStorage) jitter() time.Duration {
+	if s.options.LatencyJitter <= 0 {
+		return 0
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return time.Duration(s.random.Int64N(int64(s.options.LatencyJitter) + 1))
+}
+
+func (s *FaultyStorage) Get(ctx context.Context, key Key) (Value, error) {
+	if err := s.inject(ctx, OpGet); err != nil {
+		return Value{}, err
+	}
+	return s.Storage.Get(ctx, key)
+}
+
+func (s *FaultyStorage) GetMany(ctx context.Context, keys []Key) (map[Key]Value, error) {
+	if err := s.inject(ctx, OpGetMany); err != nil {
+		return nil, err
+	}
+	return s.Storage.GetMany(ctx, keys)
+}
+
+func (s *FaultyStorage) Scan(ctx context.Context, r KeyRange, fn func(key Key, value Value) bool) error {
+	if err := s.inject(ctx, OpScan); err != nil {
+		return err
+	}
+	return s.Storage.Scan(ctx, r, fn)
+}
+
+func (s *FaultyStorage) WriteBatch(ctx context.Context, batch Batch) error {
+	if err := s.inject(ctx, OpWriteBatch); err != nil {
+		return err
+	}
+	return s.Storage.WriteBatch(ctx, batch)
+}
+
+func (s *FaultyStorage) Begin(ctx context.Context, opts TxOptions) (StorageTransaction, error) {
+	if err := s.inject(ctx, OpBegin); err != nil {
+		return nil, err
+	}
+	tx, err := s.Storage.Begin(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &FaultyStorageTransaction{StorageTransaction: tx, ctx: ctx, storage: s}, nil
+}
+
+func (tx *FaultyStorageTransaction) Get(key Key) (Value, error) {
+	if err := tx.storage.inject(tx.ctx, OpTxGet); err != nil {
+		return Value{}, err
+	}
+	return tx.StorageTransaction.Get(key)
+}
+
+func (tx *FaultyStorageTransaction) Set(key Key, value Value) error {
+	if err := tx.storage.inject(tx.ctx, OpTxSet); err != nil {
+		return err
+	}
+	return tx.StorageTransaction.Set(key, value)
+}
+
+func (tx *FaultyStorageTransaction) Insert(key Key, value Value) error {
+	if err := tx.storage.inject(tx.ctx, OpTxInsert); err != nil {
+		return err
+	}
+	return tx.StorageTransaction.Insert(key, value)
+}
+
+func (tx *FaultyStorageTransaction) CompareAndSet(key Key, expected, value Value) error {
+	if err := tx.storage.inject(tx.ctx, OpTxCompareAndSet); err != nil {
+		return err
+	}
+	return tx.StorageTransaction.CompareAndSet(key, expected, value)
+}
+
+func (tx *FaultyStorageTransaction) Delete(key Key) error {
+	if err := tx.storage.inject(tx.ctx, OpTxDelete); err != nil {
+		return err
+	}
+	return tx.StorageTransaction.Delete(key)
+}
+
+func (tx *FaultyStorageTransaction) Scan(r KeyRange, fn func(key Key, value Value) bool) error {
+	if err := tx.storage.inject(tx.ctx, OpTxScan); err != nil {
+		return err
+	}
+	return tx.StorageTransaction.Scan(r, fn)
+}
+
+func (tx *FaultyStorageTransaction) Commit() error {
+	if err := tx.storage.inject(tx.ctx, OpCommit); err != nil {
+		tx.StorageTransaction.Rollback()
+		return err
+	}
+	if err := tx.StorageTransaction.Commit(); err != nil {
+		return err
+	}
+	if tx.storage.chance(tx.storage.options.PartialCommitRate) {
+		return fmt.Errorf("%w: commit applied but reported as failed", ErrInjectedFault)
+	}
+	return nil
+}
+
+// Rollback is never failed, so that injected faults cannot leak
+// transactions.
+func (tx *FaultyStorageTransaction) Rollback() error {
+	return tx.StorageTransaction.Rollback()
+}
@@ -0,0 +1,75 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"main/storage"
+	"main/storage/storagetest"
+	"testing"
+	"time"
+)
+
+func TestFaultyStorage_SameSeedFailsSameCalls(t *testing.T) {
+	failures := func() []bool {
+		store := storage.NewFaultyStorage(storage.NewInMemoryStorage(), storage.FaultOptions{
+			ErrorRates: map[string]float64{storage.OpGet: 0.5},
+			Seed:       42,
+		})
+		var failed []bool
+		for range 32 {
+			_, err := store.Get(context.Background(), 1)
+			failed = append(failed, errors.Is(err, storage.ErrInjectedFault))
+		}
+		return failed
+	}
+	first, second := failures(), failures()
+	injected := 0
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("Expected the same failures for the same seed, differed at call %d", i)
+		}
+		if first[i] {
+			injected++
+		}
+	}
+	if injected == 0 || injected == len(first) {
+		t.Errorf("Expected some but not all calls to fail, %d of %d failed", injected, len(first))
+	}
+}
+
+func TestFaultyStorage_FailedCommitAppliesNothing(t *testing.T) {
+	backend := storage.NewInMemoryStorage()
+	store := storage.NewFaultyStorage(backend, storage.FaultOptions{
+		ErrorRates: map[string]float64{storage.OpCommit: 1},
+	})
+	tx := begin(store)
+	tx.Set(1, storagetest.WithBalance("1"))
+	if err := tx.Commit(); !errors.Is(err, storage.ErrInjectedFault) {
+		t.Fatalf("Expected ErrInjectedFault, got %v", err)
+	}
+	if _, err := backend.Get(context.Background(), 1); !errors.Is(err, storage.ErrKeyNotFound) {
+		t.Errorf("Expected the failed commit to write nothing, got %v", err)
+	}
+}
+
+func TestFaultyStorage_PartialCommitIsApplied(t *testing.T) {
+	backend := storage.NewInMemoryStorage()
+	store := storage.NewFaultyStorage(backend, storage.FaultOptions{PartialCommitRate: 1})
+	tx := begin(store)
+	tx.Set(1, storagetest.WithBalance("1"))
+	if err := tx.Commit(); !errors.Is(err, storage.ErrInjectedFault) {
+		t.Fatalf("Expected ErrInjectedFault, got %v", err)
+	}
+	if _, err := backend.Get(context.Background(), 1); err != nil {
+		t.Errorf("Expected the commit to be applied, got %v", err)
+	}
+}
+
+func TestFaultyStorage_LatencyStopsAtDeadline(t *testing.T) {
+	store := storage.NewFaultyStorage(storage.NewInMemoryStorage(), storage.FaultOptions{Latency: time.Minute})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := store.Get(ctx, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the added latency to end at the deadline, got %v", err)
+	}
+}
@@ -1,63 +1,472 @@
 package storage
 
-import "sync"
+import (
+	"context"
+	"fmt"
+	"maps"
+	"sync"
+	"sync/atomic"
+)
 
+// version is one committed state of a key. Versions of a key form a chain
+// from newest to oldest; a deleted key is recorded as a tombstone version.
+type version struct {
+	ts      uint64
+	value   Value
+	deleted bool
+	prev    atomic.Pointer[version]
+}
+
+type versionChain struct {
+	head atomic.Pointer[version]
+}
+
+// InMemoryStorage is a multi-version store. Every commit gets a timestamp
+// and adds a new version to each key it writes, so a transaction can keep
+// reading the state as of its Begin() while others commit. Readers only use
+// atomic loads and never wait for writers; commits are serialized among
+// themselves by commitLock.
 type InMemoryStorage struct {
-	data map[Key]Value
+	data       sync.Map // Key -> *versionChain
+	committed  atomic.Uint64
+	commitLock sync.Mutex
+	// garbage holds the keys that may have versions no open transaction
+	// can see any more. Guarded by commitLock.
+	garbage map[Key]struct{}
+
+	activeLock sync.Mutex
+	active     map[uint64]int // snapshot timestamp -> open transactions
+
+	// wal, when set, receives every commit before it becomes visible.
+	wal          *writeAheadLog
+	snapshotLock sync.Mutex
+	snapshotStop chan struct{}
+	snapshotDone chan struct{}
 }
 
+// InMemoryStorageTransaction reads from the snapshot taken at Begin() and
+// buffers its writes in transactions (the write set). At the default,
+// serializable level Commit fails with ErrConflict if any key it read or
+// wrote was committed by someone else after the snapshot was taken; the
+// weaker levels check less (see IsolationLevel).
 type InMemoryStorageTransaction struct {
 	*InMemoryStorage
-	lock         sync.RWMutex
+	ctx  context.Context
+	opts TxOptions
+	// locked is set while a pessimistic transaction holds commitLock.
+	locked       bool
+	lock         sync.Mutex
+	snapshot     uint64
 	transactions map[Key]*Value
+	reads        map[Key]struct{}
+	// checked holds the timestamp of the version each conditional write
+	// was checked against, 0 for none. It is validated at every level.
+	checked map[Key]uint64
+	// scans holds the ranges this transaction scanned, so that a commit by
+	// someone else into one of them is detected like any other read.
+	scans []KeyRange
+	done  bool
 }
 
 func NewInMemoryStorage() *InMemoryStorage {
 	return &InMemoryStorage{
-		data: make(map[Key]Value),
+		garbage: make(map[Key]struct{}),
+		active:  make(map[uint64]int),
+	}
+}
+
+// NewInMemoryStorageWithWAL returns an in-memory store that is durable
+// through a write-ahead log at walPath. If options.SnapshotDir is set, the
+// newest snapshot is loaded first and only later log records are replayed;
+// otherwise the whole log is replayed.
+func NewInMemoryStorageWithWAL(walPath string, options WALOptions) (*InMemoryStorage, error) {
+	store := NewInMemoryStorage()
+	if options.SnapshotDir != "" {
+		if _, err := store.loadNewestSnapshot(options.SnapshotDir, options.Keyring); err != nil {
+			return nil, err
+		}
+	}
+	wal, err := openWAL(walPath, options, func(record walRecord) error {
+		committed := store.committed.Load()
+		if record.ts <= committed {
+			// Already part of the snapshot.
+			return nil
+		}
+		if record.ts != committed+1 {
+			return fmt.Errorf("write-ahead log %s starts at commit %d but the state is at commit %d; records are missing", walPath, record.ts, committed)
+		}
+		store.install(record.ts, record.mutations)
+		store.committed.Store(record.ts)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	store.wal = wal
+	store.collectGarbage()
+	if options.SnapshotDir != "" && options.SnapshotInterval > 0 {
+		store.snapshotStop = make(chan struct{})
+		store.snapshotDone = make(chan struct{})
+		go store.snapshotLoop(options.SnapshotInterval)
+	}
+	return store, nil
+}
+
+// Close stops background snapshots and flushes and closes the write-ahead
+// log, if any.
+func (store *InMemoryStorage) Close() error {
+	if store.wal == nil {
+		return nil
+	}
+	if store.snapshotStop != nil {
+		close(store.snapshotStop)
+		<-store.snapshotDone
+	}
+	store.commitLock.Lock()
+	defer store.commitLock.Unlock()
+	return store.wal.Close()
+}
+
+func (store *InMemoryStorage) chain(key Key) *versionChain {
+	chain, ok := store.data.Load(key)
+	if !ok {
+		return nil
+	}
+	return chain.(*versionChain)
+}
+
+// Get returns the latest committed value of key.
+func (store *InMemoryStorage) Get(ctx context.Context, key Key) (Value, error) {
+	if err := ctx.Err(); err != nil {
+		return Value{}, err
+	}
+	// The read is pinned like a transaction's: a commit may be installing
+	// a newer version right now, and garbage collection must not cut the
+	// chain below it before the committed version has been read.
+	snapshot := store.pin()
+	defer store.unpin(snapshot)
+	return store.getAt(key, snapshot)
+}
+
+// getAt returns the value of key as of the snapshot timestamp.
+func (store *InMemoryStorage) getAt(key Key, snapshot uint64) (Value, error) {
+	v := store.versionAt(key, snapshot)
+	if v == nil || v.deleted {
+		return Value{}, ErrKeyNotFound
+	}
+	return v.value, nil
+}
+
+// versionAt returns the newest version of key at or before the snapshot
+// timestamp, or nil.
+func (store *InMemoryStorage) versionAt(key Key, snapshot uint64) *version {
+	chain := store.chain(key)
+	if chain == nil {
+		return nil
+	}
+	v := chain.head.Load()
+	for v != nil && v.ts > snapshot {
+		v = v.prev.Load()
+	}
+	return v
+}
+
+// latest returns the timestamp of the newest version of key, or 0.
+func (store *InMemoryStorage) latest(key Key) uint64 {
+	chain := store.chain(key)
+	if chain == nil {
+		return 0
+	}
+	if v := chain.head.Load(); v != nil {
+		return v.ts
+	}
+	return 0
+}
+
+// Scan visits the keys in r as of the latest commit. The whole scan reads
+// from one snapshot, so it is consistent even while commits go on.
+func (store *InMemoryStorage) Scan(ctx context.Context, r KeyRange, fn func(key Key, value Value) bool) error {
+	snapshot := store.pin()
+	defer store.unpin(snapshot)
+	get := func(key Key) (Value, error) { return store.getAt(key, snapshot) }
+	return scanSorted(ctx, store.keys(r), r, get, fn)
+}
+
+// GetMany reads every key from one snapshot, without waiting for commits.
+func (store *InMemoryStorage) GetMany(ctx context.Context, keys []Key) (map[Key]Value, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	snapshot := store.pin()
+	defer store.unpin(snapshot)
+	values := make(map[Key]Value, len(keys))
+	for _, key := range keys {
+		if value, err := store.getAt(key, snapshot); err == nil {
+			values[key] = value
+		}
 	}
+	return values, nil
 }
 
-func (store *InMemoryStorage) Get(key Key) (Value, error) {
-	value, exists := store.data[key]
-	if !exists {
-		return "", ErrKeyNotFound
+// WriteBatch applies batch as a single commit, in one critical section
+// under commitLock.
+func (store *InMemoryStorage) WriteBatch(ctx context.Context, batch Batch) error {
+	mutations, err := batch.mutations()
+	if err != nil {
+		return err
 	}
-	return value, nil
+	store.commitLock.Lock()
+	defer store.commitLock.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	committed := store.committed.Load()
+	for _, m := range mutations {
+		if !m.deleted {
+			continue
+		}
+		if _, err := store.getAt(m.key, committed); err != nil {
+			return fmt.Errorf("cannot delete key %d: %w", m.key, err)
+		}
+	}
+	return store.apply(mutations)
 }
 
-func (store *InMemoryStorage) Begin() StorageTransaction {
-	return &InMemoryStorageTransaction{
+// keys returns every key in r that has a version, including deleted ones.
+func (store *InMemoryStorage) keys(r KeyRange) []Key {
+	var keys []Key
+	store.data.Range(func(key, _ any) bool {
+		if r.Contains(key.(Key)) {
+			keys = append(keys, key.(Key))
+		}
+		return true
+	})
+	return keys
+}
+
+// Begin supports every isolation level and lock mode. A pessimistic
+// transaction holds commitLock from Begin until it ends, so no other
+// commit can change its snapshot.
+func (store *InMemoryStorage) Begin(ctx context.Context, opts TxOptions) (StorageTransaction, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	tx := &InMemoryStorageTransaction{
 		InMemoryStorage: store,
+		ctx:             ctx,
+		opts:            opts,
 		transactions:    make(map[Key]*Value),
+		reads:           make(map[Key]struct{}),
+		checked:         make(map[Key]uint64),
+	}
+	if opts.Lock == LockPessimistic {
+		store.commitLock.Lock()
+		tx.locked = true
+	}
+	tx.snapshot = store.pin()
+	return tx, nil
+}
+
+// pin takes a snapshot at the latest commit and keeps its versions from
+// being garbage-collected until unpin is called with the same timestamp.
+func (store *InMemoryStorage) pin() uint64 {
+	store.activeLock.Lock()
+	defer store.activeLock.Unlock()
+	snapshot := store.committed.Load()
+	store.active[snapshot]++
+	return snapshot
+}
+
+func (store *InMemoryStorage) unpin(snapshot uint64) {
+	store.activeLock.Lock()
+	defer store.activeLock.Unlock()
+	store.active[snapshot]--
+	if store.active[snapshot] == 0 {
+		delete(store.active, snapshot)
+	}
+}
+
+// oldestVisible returns the oldest timestamp any open transaction reads at.
+// Versions older than the newest one at or before it can be discarded.
+func (store *InMemoryStorage) oldestVisible() uint64 {
+	store.activeLock.Lock()
+	defer store.activeLock.Unlock()
+	oldest := store.committed.Load()
+	for snapshot := range store.active {
+		oldest = min(oldest, snapshot)
+	}
+	return oldest
+}
+
+// collectGarbage drops versions that no open transaction can see and
+// forgets keys whose only remaining version is a tombstone. Callers must
+// hold commitLock.
+func (store *InMemoryStorage) collectGarbage() {
+	oldest := store.oldestVisible()
+	for key := range store.garbage {
+		chain := store.chain(key)
+		if chain == nil {
+			delete(store.garbage, key)
+			continue
+		}
+		head := chain.head.Load()
+		v := head
+		for v != nil && v.ts > oldest {
+			v = v.prev.Load()
+		}
+		if v == nil {
+			continue
+		}
+		v.prev.Store(nil)
+		if v == head {
+			if v.deleted {
+				store.data.Delete(key)
+			}
+			delete(store.garbage, key)
+		}
 	}
 }
 
 func (tx *InMemoryStorageTransaction) Set(key Key, value Value) error {
+	if err := tx.ctx.Err(); err != nil {
+		return err
+	}
+	if tx.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	value, err := normalizeAccount(value)
+	if err != nil {
+		return err
+	}
 	tx.lock.Lock()
 	defer tx.lock.Unlock()
 	tx.transactions[key] = &value
 	return nil
 }
 
-func (tx *InMemoryStorageTransaction) Get(key Key) (Value, error) {
-	tx.lock.RLock()
-	defer tx.lock.RUnlock()
-	value, exists := tx.transactions[key]
-	if !exists || value == nil {
-		originalValue, ok := tx.data[key]
-		if !ok {
-			return "", ErrKeyNotFound
+func (tx *InMemoryStorageTransaction) Insert(key Key, value Value) error {
+	return tx.setIf(key, value, checkAbsent)
+}
+
+func (tx *InMemoryStorageTransaction) CompareAndSet(key Key, expected, value Value) error {
+	return tx.setIf(key, value, checkEqual(expected))
+}
+
+// setIf writes value if check accepts the current value of key: the
+// transaction's own write, or else the version it reads at. That version
+// is remembered in checked, so the write does not commit if someone else
+// has replaced it by then.
+func (tx *InMemoryStorageTransaction) setIf(key Key, value Value, check setCheck) error {
+	if err := tx.ctx.Err(); err != nil {
+		return err
+	}
+	if tx.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	value, err := normalizeAccount(value)
+	if err != nil {
+		return err
+	}
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	var current Value
+	written, exists := tx.transactions[key]
+	if exists {
+		exists = written != nil
+		if exists {
+			current = *written
+		}
+	} else {
+		v := tx.versionAt(key, tx.readTimestamp())
+		exists = v != nil && !v.deleted
+		if v == nil {
+			tx.checked[key] = 0
+		} else {
+			tx.checked[key], current = v.ts, v.value
 		}
-		return originalValue, nil
+	}
+	if err := check(key, current, exists); err != nil {
+		return err
+	}
+	tx.transactions[key] = &value
+	return nil
+}
+
+func (tx *InMemoryStorageTransaction) Get(key Key) (Value, error) {
+	if err := tx.ctx.Err(); err != nil {
+		return Value{}, err
+	}
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	value, written := tx.transactions[key]
+	if !written {
+		return tx.readSnapshot(key)
+	}
+	if value == nil {
+		return Value{}, ErrKeyNotFound
 	}
 	return *value, nil
 }
 
+// readSnapshot reads key as of the transaction's snapshot and adds it to
+// the read set. Callers must hold tx.lock.
+func (tx *InMemoryStorageTransaction) readSnapshot(key Key) (Value, error) {
+	tx.reads[key] = struct{}{}
+	return tx.getAt(key, tx.readTimestamp())
+}
+
+// readTimestamp returns the commit timestamp reads are served at: the
+// snapshot, or the latest commit at ReadCommitted.
+func (tx *InMemoryStorageTransaction) readTimestamp() uint64 {
+	if tx.opts.isolation() == ReadCommitted {
+		return tx.committed.Load()
+	}
+	return tx.snapshot
+}
+
+// Scan visits the keys in r as of the transaction's snapshot, overlaid
+// with its own writes. fn may use the transaction.
+func (tx *InMemoryStorageTransaction) Scan(r KeyRange, fn func(key Key, value Value) bool) error {
+	tx.lock.Lock()
+	tx.scans = append(tx.scans, r)
+	overlay := maps.Clone(tx.transactions)
+	tx.lock.Unlock()
+
+	keys := tx.keys(r)
+	for key := range overlay {
+		keys = append(keys, key)
+	}
+	ts := tx.readTimestamp()
+	get := func(key Key) (Value, error) {
+		if value, written := overlay[key]; written {
+			if value == nil {
+				return Value{}, ErrKeyNotFound
+			}
+			return *value, nil
+		}
+		return tx.getAt(key, ts)
+	}
+	return scanSorted(tx.ctx, keys, r, get, fn)
+}
+
 func (tx *InMemoryStorageTransaction) Delete(key Key) error {
-	_, exists := tx.data[key]
-	if !exists {
-		return ErrKeyNotFound
+	if err := tx.ctx.Err(); err != nil {
+		return err
+	}
+	if tx.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	if value, written := tx.transactions[key]; written {
+		if value == nil {
+			return ErrKeyNotFound
+		}
+	} else if _, err := tx.readSnapshot(key); err != nil {
+		return err
 	}
 	tx.transactions[key] = nil
 	return nil
@@ -66,17 +475,139 @@ func (tx *InMemoryStorageTransaction) Delete(key Key) error {
 func (tx *InMemoryStorageTransaction) Commit() error {
 	tx.lock.Lock()
 	defer tx.lock.Unlock()
+	if tx.done {
+		return nil
+	}
+	defer tx.unlock()
+	if len(tx.transactions) == 0 {
+		// Everything a read-only transaction saw came from one snapshot,
+		// so there is nothing to validate.
+		tx.end()
+		return nil
+	}
+	store := tx.InMemoryStorage
+	if !tx.locked {
+		store.commitLock.Lock()
+		defer store.commitLock.Unlock()
+	}
+	// Checked after waiting for commitLock, so a commit that was queued
+	// behind others past its deadline is not applied.
+	if err := tx.ctx.Err(); err != nil {
+		tx.end()
+		return err
+	}
+	if key, conflict := tx.conflictingKey(); conflict {
+		tx.end()
+		return fmt.Errorf("%w: key %d", ErrConflict, key)
+	}
+	mutations := make([]mutation, 0, len(tx.transactions))
 	for key, value := range tx.transactions {
-		if value == nil {
-			delete(tx.data, key)
-		} else {
-			tx.data[key] = *value
+		m := mutation{key: key, deleted: value == nil}
+		if value != nil {
+			m.value = *value
 		}
+		mutations = append(mutations, m)
 	}
+	tx.end()
+	return store.apply(mutations)
+}
+
+// apply logs mutations as the next commit, installs them and makes them
+// visible. Callers must hold commitLock.
+func (store *InMemoryStorage) apply(mutations []mutation) error {
+	ts := store.committed.Load() + 1
+	if store.wal != nil {
+		if err := store.wal.append(walRecord{ts: ts, mutations: mutations}); err != nil {
+			return fmt.Errorf("cannot write commit to log: %w", err)
+		}
+	}
+	store.install(ts, mutations)
+	store.committed.Store(ts)
+	store.collectGarbage()
 	return nil
 }
 
+// install adds a version at ts for every mutation. The versions stay
+// invisible until committed is advanced to ts. Callers must hold
+// commitLock, or have exclusive access during recovery.
+func (store *InMemoryStorage) install(ts uint64, mutations []mutation) {
+	for _, m := range mutations {
+		v := &version{ts: ts, value: m.value, deleted: m.deleted}
+		loaded, _ := store.data.LoadOrStore(m.key, &versionChain{})
+		chain := loaded.(*versionChain)
+		prev := chain.head.Load()
+		v.prev.Store(prev)
+		chain.head.Store(v)
+		if prev != nil || v.deleted {
+			store.garbage[m.key] = struct{}{}
+		}
+	}
+}
+
+// conflictingKey finds a key checked by a conditional write that has a
+// newer version than the one checked, or a key that has a version newer
+// than the snapshot among those the isolation level protects: none at
+// ReadCommitted, the write set at Snapshot, and the read set, write set
+// and scanned ranges at Serializable. Callers must hold commitLock.
+func (tx *InMemoryStorageTransaction) conflictingKey() (Key, bool) {
+	for key, ts := range tx.checked {
+		if tx.latest(key) > ts {
+			return key, true
+		}
+	}
+	level := tx.opts.isolation()
+	if level == ReadCommitted {
+		return 0, false
+	}
+	for key := range tx.transactions {
+		if tx.latest(key) > tx.snapshot {
+			return key, true
+		}
+	}
+	if level == Snapshot {
+		return 0, false
+	}
+	for key := range tx.reads {
+		if tx.latest(key) > tx.snapshot {
+			return key, true
+		}
+	}
+	for _, r := range tx.scans {
+		for _, key := range tx.keys(r) {
+			if tx.latest(key) > tx.snapshot {
+				return key, true
+			}
+		}
+	}
+	return 0, false
+}
+
 func (tx *InMemoryStorageTransaction) Rollback() error {
-	clear(tx.transactions)
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	tx.end()
+	tx.unlock()
 	return nil
 }
+
+// unlock releases commitLock if the transaction is pessimistic and still
+// holds it. Callers must hold tx.lock.
+func (tx *InMemoryStorageTransaction) unlock() {
+	if tx.locked {
+		tx.locked = false
+		tx.commitLock.Unlock()
+	}
+}
+
+// end releases the transaction's snapshot. Callers must hold tx.lock.
+func (tx *InMemoryStorageTransaction) end() {
+	if tx.done {
+		return
+	}
+	tx.done = true
+	clear(tx.transactions)
+	clear(tx.reads)
+	clear(tx.checked)
+	tx.scans = nil
+	tx.unpin(tx.snapshot)
+}
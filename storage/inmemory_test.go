@@ -0,0 +1,253 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"main/money"
+	"main/storage"
+	"main/storage/storagetest"
+	"sync"
+	"testing"
+)
+
+// begin starts a default transaction, for test setup.
+func begin(store storage.Storage) storage.StorageTransaction {
+	tx, err := store.Begin(context.Background(), storage.TxOptions{})
+	if err != nil {
+		panic(err)
+	}
+	return tx
+}
+
+func TestInMemoryStorage_CommitDetectsConflict(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	tx := begin(store)
+	tx.Set(1, storagetest.WithBalance("100"))
+	tx.Commit()
+
+	first := begin(store)
+	second := begin(store)
+	first.Get(1)
+	second.Get(1)
+	first.Set(1, storagetest.WithBalance("90"))
+	second.Set(1, storagetest.WithBalance("80"))
+
+	if err := first.Commit(); err != nil {
+		t.Fatalf("First commit failed: %v", err)
+	}
+	if err := second.Commit(); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("Expected ErrConflict, got %v", err)
+	}
+	balance, _ := store.Get(context.Background(), 1)
+	if balance.Balance.String() != "90.0000000000000000000" {
+		t.Errorf("Expected the first commit to win, got %s", balance.Balance)
+	}
+}
+
+func TestInMemoryStorage_ReadOfAbsentKeyConflictsWithInsert(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	reader := begin(store)
+	if _, err := reader.Get(7); !errors.Is(err, storage.ErrKeyNotFound) {
+		t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+	}
+	reader.Set(8, storagetest.WithBalance("1"))
+
+	writer := begin(store)
+	writer.Set(7, storagetest.WithBalance("5"))
+	writer.Commit()
+
+	if err := reader.Commit(); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("Expected ErrConflict, got %v", err)
+	}
+}
+
+// TestInMemoryStorage_ConcurrentIncrements checks that no update is lost
+// when many goroutines read-modify-write the same key without any lock.
+func TestInMemoryStorage_ConcurrentIncrements(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	tx := begin(store)
+	tx.Set(1, storagetest.WithBalance("0"))
+	tx.Commit()
+
+	one, _ := money.Parse("1")
+	numIncrements := 200
+	var wg sync.WaitGroup
+	for range numIncrements {
+		wg.Go(func() {
+			for {
+				tx := begin(store)
+				account, _ := tx.Get(1)
+				account.Balance = account.Balance.Add(one)
+				tx.Set(1, account)
+				err := tx.Commit()
+				if err == nil {
+					return
+				}
+				if !errors.Is(err, storage.ErrConflict) {
+					t.Errorf("Unexpected commit error: %v", err)
+					return
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	balance, _ := store.Get(context.Background(), 1)
+	if balance.Balance.String() != "200.0000000000000000000" {
+		t.Errorf("Expected 200 after %d increments, got %s", numIncrements, balance.Balance)
+	}
+}
+
+func TestInMemoryStorage_TransactionReadsFromSnapshot(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	tx := begin(store)
+	tx.Set(1, storagetest.WithBalance("100"))
+	tx.Set(2, storagetest.WithBalance("100"))
+	tx.Commit()
+
+	reader := begin(store)
+	first, _ := reader.Get(1)
+
+	writer := begin(store)
+	writer.Set(1, storagetest.WithBalance("50"))
+	writer.Set(2, storagetest.WithBalance("150"))
+	writer.Delete(1)
+	writer.Set(3, storagetest.WithBalance("1"))
+	if err := writer.Commit(); err != nil {
+		t.Fatalf("Writer commit failed: %v", err)
+	}
+
+	second, _ := reader.Get(2)
+	if first.Balance.String() != "100.0000000000000000000" || second.Balance.String() != "100.0000000000000000000" {
+		t.Errorf("Expected both balances from the snapshot, got %s and %s", first.Balance, second.Balance)
+	}
+	if _, err := reader.Get(3); !errors.Is(err, storage.ErrKeyNotFound) {
+		t.Errorf("Expected key committed after Begin to be invisible, got %v", err)
+	}
+	if err := reader.Commit(); err != nil {
+		t.Errorf("Read-only commit failed: %v", err)
+	}
+	if _, err := store.Get(context.Background(), 1); !errors.Is(err, storage.ErrKeyNotFound) {
+		t.Errorf("Expected deleted key to be gone, got %v", err)
+	}
+}
+
+func TestInMemoryStorage_OldVersionsAreCollected(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	tx := begin(store)
+	tx.Set(1, storagetest.WithBalance("1"))
+	tx.Commit()
+
+	reader := begin(store)
+	for _, balance := range []string{"2", "3", "4"} {
+		tx := begin(store)
+		tx.Set(1, storagetest.WithBalance(balance))
+		tx.Commit()
+	}
+	if count := store.VersionCount(1); count != 4 {
+		t.Errorf("Expected all versions to be kept for the open reader, got %d", count)
+	}
+	balance, _ := reader.Get(1)
+	if balance.Balance.String() != "1.0000000000000000000" {
+		t.Errorf("Expected reader to still see 1, got %s", balance.Balance)
+	}
+	reader.Rollback()
+
+	tx = begin(store)
+	tx.Delete(1)
+	tx.Commit()
+	if count := store.VersionCount(1); count != 0 {
+		t.Errorf("Expected deleted key to be collected, got %d versions", count)
+	}
+}
+
+// TestInMemoryStorage_GetDuringCommits reads keys while other goroutines
+// keep committing them: a Get that meets a version still being installed
+// must find the committed one below it, even as garbage collection runs.
+// Every commit writes many keys, to widen the window between installing
+// a version and publishing it.
+func TestInMemoryStorage_GetDuringCommits(t *testing.T) {
+	const keys = 100
+	store := storage.NewInMemoryStorage()
+	tx := begin(store)
+	for key := range storage.Key(keys) {
+		tx.Set(key, storagetest.WithBalance("1"))
+	}
+	tx.Commit()
+
+	var writers, readers sync.WaitGroup
+	stop := make(chan struct{})
+	for range 4 {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			for range 200 {
+				tx := begin(store)
+				for key := range storage.Key(keys) {
+					tx.Set(key, storagetest.WithBalance("2"))
+				}
+				tx.Commit()
+			}
+		}()
+	}
+	for reader := range 4 {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := storage.Key(reader+i) % keys
+				if _, err := store.Get(context.Background(), key); err != nil {
+					t.Errorf("Expected key %d to be readable during commits, got %v", key, err)
+					return
+				}
+			}
+		}()
+	}
+	writers.Wait()
+	close(stop)
+	readers.Wait()
+}
+
+func TestInMemoryStorage_ScanConflictsWithInsertIntoRange(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	auditor := begin(store)
+	auditor.Scan(storage.KeyRange{Start: 100, End: 200}, func(storage.Key, storage.Value) bool { return true })
+	auditor.Set(1, storagetest.WithBalance("0"))
+
+	writer := begin(store)
+	writer.Set(150, storagetest.WithBalance("10"))
+	writer.Commit()
+
+	if err := auditor.Commit(); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("Expected ErrConflict for an insert into the scanned range, got %v", err)
+	}
+}
+
+func TestInMemoryStorage_CancelledTransactionDoesNotCommit(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	ctx, cancel := context.WithCancel(context.Background())
+	tx, err := store.Begin(ctx, storage.TxOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Set(1, storagetest.WithBalance("10"))
+	cancel()
+
+	if err := tx.Set(2, storagetest.WithBalance("20")); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected Set to fail with context.Canceled, got %v", err)
+	}
+	if err := tx.Commit(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected Commit to fail with context.Canceled, got %v", err)
+	}
+	if _, err := store.Get(context.Background(), 1); !errors.Is(err, storage.ErrKeyNotFound) {
+		t.Errorf("Expected the cancelled write to be discarded, got %v", err)
+	}
+	if _, err := store.Get(ctx, 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected Get to fail with context.Canceled, got %v", err)
+	}
+}
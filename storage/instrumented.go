@@ -0,0 +1,304 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// InstrumentedStorage wraps any Storage and records the latency and errors
+// of every operation, the number of commits that failed with ErrConflict
+// and the number of open transactions. The metrics are read with Metrics.
+type InstrumentedStorage struct {
+	Storage
+	metrics *Metrics
+}
+
+// InstrumentedStorageTransaction records the operations of a transaction
+// started through InstrumentedStorage.
+type InstrumentedStorageTransaction struct {
+	StorageTransaction
+	metrics *Metrics
+	// ended is set by the first Commit or Rollback, which closes the
+	// transaction for the open-transaction gauge.
+	ended atomic.Bool
+}
+
+// Operation names used in MetricsSnapshot. Transaction operations are
+// prefixed with "tx_", except for commit and rollback.
+const (
+	OpGet             = "get"
+	OpGetMany         = "get_many"
+	OpScan            = "scan"
+	OpBegin           = "begin"
+	OpWriteBatch      = "write_batch"
+	OpTxGet           = "tx_get"
+	OpTxSet           = "tx_set"
+	OpTxInsert        = "tx_insert"
+	OpTxCompareAndSet = "tx_compare_and_set"
+	OpTxDelete        = "tx_delete"
+	OpTxScan          = "tx_scan"
+	OpCommit          = "commit"
+	OpRollback        = "rollback"
+)
+
+var operations = []string{OpGet, OpGetMany, OpScan, OpBegin, OpWriteBatch, OpTxGet, OpTxSet,
+	OpTxInsert, OpTxCompareAndSet, OpTxDelete, OpTxScan, OpCommit, OpRollback}
+
+// latencyBounds are the upper bounds of the latency histogram buckets. A
+// last bucket holds everything slower.
+var latencyBounds = []time.Duration{
+	50 * time.Microsecond, 100 * time.Microsecond, 250 * time.Microsecond, 500 * time.Microsecond,
+	time.Millisecond, 2500 * time.Microsecond, 5 * time.Millisecond, 10 * time.Millisecond,
+	25 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond, 250 * time.Millisecond,
+	500 * time.Millisecond, time.Second, 2500 * time.Millisecond, 5 * time.Second,
+}
+
+// Metrics holds the counters of an InstrumentedStorage. It is safe for
+// concurrent use.
+type Metrics struct {
+	operations       map[string]*operationMetrics
+	conflicts        atomic.Uint64
+	openTransactions atomic.Int64
+}
+
+type operationMetrics struct {
+	buckets []atomic.Uint64 // one per latency bound, and one for slower calls
+	total   atomic.Int64    // nanoseconds
+	errLock sync.Mutex
+	errors  map[string]uint64 // error kind -> count
+}
+
+func NewInstrumentedStorage(s Storage) *InstrumentedStorage {
+	metrics := &Metrics{operations: make(map[string]*operationMetrics, len(operations))}
+	for _, op := range operations {
+		metrics.operations[op] = &operationMetrics{
+			buckets: make([]atomic.Uint64, len(latencyBounds)+1),
+			errors:  make(map[string]uint64),
+		}
+	}
+	return &InstrumentedStorage{Storage: s, metrics: metrics}
+}
+
+// Metrics returns the metrics recorded so far; they keep being updated.
+func (s *InstrumentedStorage) Metrics() *Metrics {
+	return s.metrics
+}
+
+// record adds one call of op that started at start and returned err.
+func (m *Metrics) record(op string, start time.Time, err error) {
+	elapsed := time.Since(start)
+	metrics := m.operations[op]
+	bucket := len(latencyBounds)
+	for i, bound := range latencyBounds {
+		if elapsed <= bound {
+			bucket = i
+			break
+		}
+	}
+	metrics.buckets[bucket].Add(1)
+	metrics.total.Add(int64(elapsed))
+	if err == nil {
+		return
+	}
+	metrics.errLock.Lock()
+	metrics.errors[errorKind(err)]++
+	metrics.errLock.Unlock()
+}
+
+// errorKind names the kind of err for the error counts.
+func errorKind(err error) string {
+	switch {
+	case errors.Is(err, ErrKeyNotFound):
+		return "not_found"
+	case errors.Is(err, ErrConflict):
+		return "conflict"
+	case errors.Is(err, ErrKeyExists):
+		return "key_exists"
+	case errors.Is(err, ErrCompareFailed):
+		return "compare_failed"
+	case errors.Is(err, ErrReadOnly):
+		return "read_only"
+	case errors.Is(err, ErrInvalidAccount):
+		return "invalid_account"
+	case errors.Is(err, ErrUnsupportedTxOptions):
+		return "unsupported_tx_options"
+	case errors.Is(err, ErrInjectedFault):
+		return "injected"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "deadline_exceeded"
+	}
+	return "other"
+}
+
+// MetricsSnapshot is a copy of Metrics at one point in time, shaped for
+// encoding as JSON.
+type MetricsSnapshot struct {
+	Operations map[string]OperationSnapshot `json:"operations"`
+	// CommitConflicts counts the commits that failed with ErrConflict.
+	CommitConflicts  uint64 `json:"commit_conflicts"`
+	OpenTransactions int64  `json:"open_transactions"`
+}
+
+type OperationSnapshot struct {
+	Count        uint64  `json:"count"`
+	TotalSeconds float64 `json:"total_seconds"`
+	// Latency is the histogram of call durations. The count of each
+	// bucket includes the calls of the faster buckets, as in Prometheus.
+	Latency []LatencyBucket   `json:"latency"`
+	Errors  map[string]uint64 `json:"errors,omitempty"`
+}
+
+type LatencyBucket struct {
+	// UpperBound is the bucket's upper bound as a duration string, or
+	// "+Inf" for the last bucket.
+	UpperBound string `json:"le"`
+	Count      uint64 `json:"count"`
+}
+
+// Snapshot copies the current metrics. Operations that were never called
+// are left out.
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	snapshot := MetricsSnapshot{
+		Operations:       make(map[string]OperationSnapshot),
+		CommitConflicts:  m.conflicts.Load(),
+		OpenTransactions: m.openTransactions.Load(),
+	}
+	for op, metrics := range m.operations {
+		var copied OperationSnapshot
+		for i := range metrics.buckets {
+			copied.Count += metrics.buckets[i].Load()
+			bound := "+Inf"
+			if i < len(latencyBounds) {
+				bound = latencyBounds[i].String()
+			}
+			copied.Latency = append(copied.Latency, LatencyBucket{UpperBound: bound, Count: copied.Count})
+		}
+		if copied.Count == 0 {
+			continue
+		}
+		copied.TotalSeconds = time.Duration(metrics.total.Load()).Seconds()
+		metrics.errLock.Lock()
+		if len(metrics.errors) > 0 {
+			copied.Errors = maps.Clone(metrics.errors)
+		}
+		metrics.errLock.Unlock()
+		snapshot.Operations[op] = copied
+	}
+	return snapshot
+}
+
+func (s *InstrumentedStorage) Get(ctx context.Context, key Key) (Value, error) {
+	start := time.Now()
+	value, err := s.Storage.Get(ctx, key)
+	s.metrics.record(OpGet, start, err)
+	return value, err
+}
+
+func (s *InstrumentedStorage) GetMany(ctx context.Context, keys []Key) (map[Key]Value, error) {
+	start := time.Now()
+	values, err := s.Storage.GetMany(ctx, keys)
+	s.metrics.record(OpGetMany, start, err)
+	return values, err
+}
+
+// Scan records the duration of the whole scan, including the time spent
+// in fn.
+func (s *InstrumentedStorage) Scan(ctx context.Context, r KeyRange, fn func(key Key, value Value) bool) error {
+	start := time.Now()
+	err := s.Storage.Scan(ctx, r, fn)
+	s.metrics.record(OpScan, start, err)
+	return err
+}
+
+func (s *InstrumentedStorage) WriteBatch(ctx context.Context, batch Batch) error {
+	start := time.Now()
+	err := s.Storage.WriteBatch(ctx, batch)
+	s.metrics.record(OpWriteBatch, start, err)
+	return err
+}
+
+func (s *InstrumentedStorage) Begin(ctx context.Context, opts TxOptions) (StorageTransaction, error) {
+	start := time.Now()
+	tx, err := s.Storage.Begin(ctx, opts)
+	s.metrics.record(OpBegin, start, err)
+	if err != nil {
+		return nil, err
+	}
+	s.metrics.openTransactions.Add(1)
+	return &InstrumentedStorageTransaction{StorageTransaction: tx, metrics: s.metrics}, nil
+}
+
+func (tx *InstrumentedStorageTransaction) Get(key Key) (Value, error) {
+	start := time.Now()
+	value, err := tx.StorageTransaction.Get(key)
+	tx.metrics.record(OpTxGet, start, err)
+	return value, err
+}
+
+func (tx *InstrumentedStorageTransaction) Set(key Key, value Value) error {
+	start := time.Now()
+	err := tx.StorageTransaction.Set(key, value)
+	tx.metrics.record(OpTxSet, start, err)
+	return err
+}
+
+func (tx *InstrumentedStorageTransaction) Insert(key Key, value Value) error {
+	start := time.Now()
+	err := tx.StorageTransaction.Insert(key, value)
+	tx.metrics.record(OpTxInsert, start, err)
+	return err
+}
+
+func (tx *InstrumentedStorageTransaction) CompareAndSet(key Key, expected, value Value) error {
+	start := time.Now()
+	err := tx.StorageTransaction.CompareAndSet(key, expected, value)
+	tx.metrics.record(OpTxCompareAndSet, start, err)
+	return err
+}
+
+func (tx *InstrumentedStorageTransaction) Delete(key Key) error {
+	start := time.Now()
+	err := tx.StorageTransaction.Delete(key)
+	tx.metrics.record(OpTxDelete, start, err)
+	return err
+}
+
+func (tx *InstrumentedStorageTransaction) Scan(r KeyRange, fn func(key Key, value Value) bool) error {
+	start := time.Now()
+	err := tx.StorageTransaction.Scan(r, fn)
+	tx.metrics.record(OpTxScan, start, err)
+	return err
+}
+
+func (tx *InstrumentedStorageTransaction) Commit() error {
+	start := time.Now()
+	err := tx.StorageTransaction.Commit()
+	tx.metrics.record(OpCommit, start, err)
+	if errors.Is(err, ErrConflict) {
+		tx.metrics.conflicts.Add(1)
+	}
+	tx.end()
+	return err
+}
+
+func (tx *InstrumentedStorageTransaction) Rollback() error {
+	start := time.Now()
+	err := tx.StorageTransaction.Rollback()
+	tx.metrics.record(OpRollback, start, err)
+	tx.end()
+	return err
+}
+
+// end takes the transaction off the open-transaction gauge the first time
+// it is called.
+func (tx *InstrumentedStorageTransaction) end() {
+	if tx.ended.CompareAndSwap(false, true) {
+		tx.metrics.openTransactions.Add(-1)
+	}
+}
@@ -0,0 +1,55 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"main/storage"
+	"main/storage/storagetest"
+	"testing"
+)
+
+func TestInstrumentedStorage_RecordsOperations(t *testing.T) {
+	store := storage.NewInstrumentedStorage(storage.NewInMemoryStorage())
+	tx := begin(store)
+	tx.Set(1, storagetest.WithBalance("1"))
+	tx.Commit()
+	store.Get(context.Background(), 1)
+	store.Get(context.Background(), 2)
+
+	snapshot := store.Metrics().Snapshot()
+	if get := snapshot.Operations[storage.OpGet]; get.Count != 2 || get.Errors["not_found"] != 1 {
+		t.Errorf("Expected 2 gets with 1 not found, got %+v", get)
+	}
+	commit := snapshot.Operations[storage.OpCommit]
+	if commit.Count != 1 || commit.Latency[len(commit.Latency)-1].Count != 1 {
+		t.Errorf("Expected 1 commit in the latency histogram, got %+v", commit)
+	}
+	if _, called := snapshot.Operations[storage.OpScan]; called {
+		t.Error("Expected operations that were never called to be left out")
+	}
+}
+
+func TestInstrumentedStorage_CountsConflictsAndOpenTransactions(t *testing.T) {
+	store := storage.NewInstrumentedStorage(storage.NewInMemoryStorage())
+	first, second := begin(store), begin(store)
+	if open := store.Metrics().Snapshot().OpenTransactions; open != 2 {
+		t.Errorf("Expected 2 open transactions, got %d", open)
+	}
+	for _, tx := range []storage.StorageTransaction{first, second} {
+		tx.Get(1)
+		tx.Set(1, storagetest.WithBalance("1"))
+	}
+	first.Commit()
+	if err := second.Commit(); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("Expected ErrConflict, got %v", err)
+	}
+	second.Rollback()
+
+	snapshot := store.Metrics().Snapshot()
+	if snapshot.CommitConflicts != 1 || snapshot.Operations[storage.OpCommit].Errors["conflict"] != 1 {
+		t.Errorf("Expected 1 commit conflict, got %+v", snapshot)
+	}
+	if snapshot.OpenTransactions != 0 {
+		t.Errorf("Expected no open transactions, got %d", snapshot.OpenTransactions)
+	}
+}
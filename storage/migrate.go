@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// ErrSchemaTooNew is returned when a SQLite database has migrations applied
+// that this binary does not know about. Running against it could corrupt
+// data written by the newer version, so the database is left alone.
+var ErrSchemaTooNew = errors.New("database schema is newer than this binary")
+
+// Migration is one step of the SQLite schema. Migrations are applied in
+// order of Version, each in its own transaction together with the
+// schema_version row that records it.
+type Migration struct {
+	Version     int
+	Description string
+	up          func(tx *sql.Tx) error
+}
+
+// migrations lists every schema change in order. Append new migrations to
+// the end and never edit one that has been released. The first two predate
+// the schema_version table, so they must cope with databases on which
+// their effect is already in place.
+var migrations = []Migration{
+	{1, "create accounts table", createAccountsTable},
+	{2, "move kv_store balances into accounts", migrateKVStore},
+}
+
+// LatestSchemaVersion is the schema version this binary migrates to.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+type querier interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// schemaVersion returns the version of the last migration applied to the
+// database, or 0 for a database that has never been migrated.
+func schemaVersion(q querier) (int, error) {
+	var name string
+	err := q.QueryRow(`SELECT name FROM sqlite_master WHERE type = 'table' AND name = 'schema_version';`).Scan(&name)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var version int
+	if err := q.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version;`).Scan(&version); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// SchemaVersion returns the version of the last migration applied to the
+// database, or 0 if it has never been migrated.
+func (db *SqliteStorage) SchemaVersion() (int, error) {
+	return schemaVersion(db.DB)
+}
+
+// PendingMigrations returns the migrations that Migrate would apply, without
+// changing the database.
+func (db *SqliteStorage) PendingMigrations() ([]Migration, error) {
+	version, err := db.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	return pendingMigrations(version)
+}
+
+func pendingMigrations(version int) ([]Migration, error) {
+	if version > LatestSchemaVersion() {
+		return nil, fmt.Errorf("%w: database is at version %d, this binary knows up to %d", ErrSchemaTooNew, version, LatestSchemaVersion())
+	}
+	for i, m := range migrations {
+		if m.Version > version {
+			return migrations[i:], nil
+		}
+	}
+	return nil, nil
+}
+
+// Migrate brings the database up to LatestSchemaVersion and returns the
+// migrations it applied. If a migration fails, the ones before it stay
+// applied and the failing one is rolled back completely.
+func (db *SqliteStorage) Migrate() ([]Migration, error) {
+	var applied []Migration
+	for {
+		m, ok, err := db.applyNextMigration()
+		if err != nil {
+			return applied, err
+		}
+		if !ok {
+			return applied, nil
+		}
+		applied = append(applied, m)
+	}
+}
+
+// applyNextMigration applies the first pending migration, if any. The
+// version is read inside the transaction, so a migration applied
+// concurrently by another process is not applied twice.
+func (db *SqliteStorage) applyNextMigration() (Migration, bool, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return Migration{}, false, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		description TEXT NOT NULL,
+		applied_at TEXT NOT NULL
+	);`); err != nil {
+		return Migration{}, false, err
+	}
+	version, err := schemaVersion(tx)
+	if err != nil {
+		return Migration{}, false, err
+	}
+	pending, err := pendingMigrations(version)
+	if err != nil || len(pending) == 0 {
+		return Migration{}, false, err
+	}
+	m := pending[0]
+	if err := m.up(tx); err != nil {
+		return Migration{}, false, fmt.Errorf("migration %d (%s): %w", m.Version, m.Description, err)
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_version (version, description, applied_at) VALUES (?, ?, ?);`,
+		m.Version, m.Description, time.Now().UTC().Format(time.RFC3339Nano)); err != nil {
+		return Migration{}, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Migration{}, false, err
+	}
+	slog.Info("Applied schema migration", "version", m.Version, "description", m.Description)
+	return m, true, nil
+}
+
+func createAccountsTable(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS accounts (
+		id INTEGER PRIMARY KEY,
+		balance TEXT NOT NULL,
+		currency TEXT NOT NULL,
+		status TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		created_at TEXT NOT NULL,
+		updated_at TEXT NOT NULL,
+		owner TEXT NOT NULL DEFAULT ''
+	);`)
+	return err
+}
+
+// migrateKVStore moves accounts from the kv_store table of older versions,
+// which held nothing but a balance string per key, into accounts.
+func migrateKVStore(tx *sql.Tx) error {
+	var name string
+	err := tx.QueryRow(`SELECT name FROM sqlite_master WHERE type = 'table' AND name = 'kv_store';`).Scan(&name)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	rows, err := tx.Query(`SELECT key, value FROM kv_store;`)
+	if err != nil {
+		return err
+	}
+	migrated := make(map[Key]Value)
+	now := time.Now().UTC()
+	for rows.Next() {
+		var key Key
+		var balance string
+		if err := rows.Scan(&key, &balance); err != nil {
+			rows.Close()
+			return err
+		}
+		account, err := decodeAccount([]byte(balance))
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("key %d: %w", key, err)
+		}
+		account.Version, account.CreatedAt, account.UpdatedAt = 1, now, now
+		migrated[key] = account
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	// Balances are migrated in plain text; SqliteStorage.Reencrypt
+	// encrypts them if a keyring is set.
+	for key, account := range migrated {
+		if err := insertOrReplace(tx, nil, key, account); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`DROP TABLE kv_store;`); err != nil {
+		return err
+	}
+	slog.Info("Migrated kv_store to accounts", "count", len(migrated))
+	return nil
+}
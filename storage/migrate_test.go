@@ -0,0 +1,77 @@
+package storage_test
+
+import (
+	"errors"
+	"main/storage"
+	"path/filepath"
+	"testing"
+)
+
+func TestSqliteStorage_MigratesToLatestVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.db")
+	db := storage.NewSqliteStorage(path)
+	if db == nil {
+		t.Fatal("Cannot open database")
+	}
+	version, err := db.SchemaVersion()
+	if err != nil || version != storage.LatestSchemaVersion() {
+		t.Errorf("Expected schema version %d, got %d (%v)", storage.LatestSchemaVersion(), version, err)
+	}
+	db.Close()
+
+	reopened, err := storage.OpenSqliteStorage(path, storage.SqliteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	applied, err := reopened.Migrate()
+	if err != nil || len(applied) != 0 {
+		t.Errorf("Expected no migrations on reopen, applied %v (%v)", applied, err)
+	}
+}
+
+func TestSqliteStorage_PendingMigrationsIsADryRun(t *testing.T) {
+	db, err := storage.OpenSqliteStorage(filepath.Join(t.TempDir(), "store.db"), storage.SqliteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	pending, err := db.PendingMigrations()
+	if err != nil {
+		t.Fatalf("PendingMigrations failed: %v", err)
+	}
+	if len(pending) == 0 || pending[len(pending)-1].Version != storage.LatestSchemaVersion() {
+		t.Errorf("Expected every migration to be pending, got %v", pending)
+	}
+	if version, _ := db.SchemaVersion(); version != 0 {
+		t.Errorf("Expected the dry run to leave version 0, got %d", version)
+	}
+	var tables int
+	db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE type = 'table';`).Scan(&tables)
+	if tables != 0 {
+		t.Errorf("Expected the dry run to create no tables, found %d", tables)
+	}
+}
+
+func TestSqliteStorage_RefusesNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.db")
+	db := storage.NewSqliteStorage(path)
+	if db == nil {
+		t.Fatal("Cannot open database")
+	}
+	db.Exec(`INSERT INTO schema_version (version, description, applied_at) VALUES (?, 'from the future', '');`,
+		storage.LatestSchemaVersion()+1)
+	db.Close()
+
+	if storage.NewSqliteStorage(path) != nil {
+		t.Error("Expected NewSqliteStorage to refuse a newer schema")
+	}
+	reopened, err := storage.OpenSqliteStorage(path, storage.SqliteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if _, err := reopened.Migrate(); !errors.Is(err, storage.ErrSchemaTooNew) {
+		t.Errorf("Expected ErrSchemaTooNew, got %v", err)
+	}
+}
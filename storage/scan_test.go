@@ -0,0 +1,105 @@
+package storage_test
+
+import (
+	"context"
+	"main/storage"
+	"main/storage/storagetest"
+	"slices"
+	"testing"
+)
+
+func scanBackends(t *testing.T) map[string]storage.Storage {
+	bitcask := openBitcask(t, t.TempDir(), storage.BitcaskOptions{})
+	t.Cleanup(func() { bitcask.Close() })
+	return map[string]storage.Storage{
+		"inmemory": storage.NewInMemoryStorage(),
+		"sqlite":   storage.NewSqliteStorage(""),
+		"bitcask":  bitcask,
+	}
+}
+
+func collect(t *testing.T, store storage.Storage, r storage.KeyRange) []storage.Key {
+	t.Helper()
+	var keys []storage.Key
+	if err := store.Scan(context.Background(), r, func(key storage.Key, _ storage.Value) bool {
+		keys = append(keys, key)
+		return true
+	}); err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	return keys
+}
+
+func TestScan_RangesAndLimits(t *testing.T) {
+	for name, store := range scanBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			tx := begin(store)
+			for _, key := range []storage.Key{30, 10, 50, 20, 40} {
+				tx.Set(key, storagetest.WithBalance("1"))
+			}
+			tx.Commit()
+
+			cases := []struct {
+				r        storage.KeyRange
+				expected []storage.Key
+			}{
+				{storage.KeyRange{}, []storage.Key{10, 20, 30, 40, 50}},
+				{storage.KeyRange{Start: 20, End: 40}, []storage.Key{20, 30}},
+				{storage.KeyRange{Start: 25}, []storage.Key{30, 40, 50}},
+				{storage.KeyRange{Start: 15, Limit: 2}, []storage.Key{20, 30}},
+				{storage.Prefix(32, 59), []storage.Key{40, 50}},
+				{storage.Prefix(42, 61), []storage.Key{40}},
+			}
+			for _, c := range cases {
+				if keys := collect(t, store, c.r); !slices.Equal(keys, c.expected) {
+					t.Errorf("Scan(%+v): expected %v, got %v", c.r, c.expected, keys)
+				}
+			}
+
+			var visited []storage.Key
+			store.Scan(context.Background(), storage.KeyRange{}, func(key storage.Key, _ storage.Value) bool {
+				visited = append(visited, key)
+				return len(visited) < 3
+			})
+			if !slices.Equal(visited, []storage.Key{10, 20, 30}) {
+				t.Errorf("Expected scan to stop when fn returns false, got %v", visited)
+			}
+		})
+	}
+}
+
+func TestScan_TransactionSeesOwnWrites(t *testing.T) {
+	for name, store := range scanBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			tx := begin(store)
+			tx.Set(1, storagetest.WithBalance("1"))
+			tx.Set(2, storagetest.WithBalance("2"))
+			tx.Set(3, storagetest.WithBalance("3"))
+			tx.Commit()
+
+			tx = begin(store)
+			defer tx.Rollback()
+			tx.Delete(2)
+			tx.Set(4, storagetest.WithBalance("4"))
+			tx.Set(1, storagetest.WithBalance("10"))
+			values := map[storage.Key]string{}
+			tx.Scan(storage.KeyRange{}, func(key storage.Key, value storage.Value) bool {
+				values[key] = value.Balance.String()
+				return true
+			})
+			expected := map[storage.Key]string{
+				1: "10.0000000000000000000",
+				3: "3.0000000000000000000",
+				4: "4.0000000000000000000",
+			}
+			if len(values) != len(expected) {
+				t.Fatalf("Expected %v, got %v", expected, values)
+			}
+			for key, value := range expected {
+				if values[key] != value {
+					t.Errorf("Key %d: expected %s, got %s", key, value, values[key])
+				}
+			}
+		})
+	}
+}
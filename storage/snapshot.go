@@ -0,0 +1,348 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// A snapshot file holds every live key as of one commit timestamp:
+//
+//	header  = magic "ZZZSNAP1" | ts uint64
+//	entry   = 1 uint8 | key uint64 | len uint32 | serialized Account
+//	trailer = 0 uint8 | count uint64 | crc32c(everything before) uint32
+//
+// where the Account is encrypted if the write-ahead log has a Keyring.
+const snapshotMagic = "ZZZSNAP1"
+
+const (
+	snapshotPrefix = "snapshot-"
+	snapshotSuffix = ".snap"
+)
+
+func snapshotName(ts uint64) string {
+	return fmt.Sprintf("%s%020d%s", snapshotPrefix, ts, snapshotSuffix)
+}
+
+// Snapshot writes the state as of the latest commit to SnapshotDir and then
+// drops the part of the write-ahead log that the snapshot covers. Commits
+// carry on while the snapshot is written; only the final log compaction
+// briefly holds up appends.
+func (store *InMemoryStorage) Snapshot() error {
+	_, err := store.snapshot(false)
+	return err
+}
+
+// snapshot takes a snapshot and returns how many keys it holds, or 0 if
+// it was already on disk. If rewrite is set, a snapshot of the same commit
+// already on disk is written again, with the current encryption key.
+func (store *InMemoryStorage) snapshot(rewrite bool) (uint64, error) {
+	if store.wal == nil || store.wal.options.SnapshotDir == "" {
+		return 0, errors.New("snapshots need a write-ahead log and a snapshot directory")
+	}
+	store.snapshotLock.Lock()
+	defer store.snapshotLock.Unlock()
+
+	// Pin the snapshot and note where the log stands in one step, so that
+	// every record before walOffset is covered by the snapshot and every
+	// record after it is not.
+	store.commitLock.Lock()
+	ts := store.pin()
+	walOffset := store.wal.offset()
+	store.commitLock.Unlock()
+	defer store.unpin(ts)
+
+	dir := store.wal.options.SnapshotDir
+	path := filepath.Join(dir, snapshotName(ts))
+	var count uint64
+	if _, err := os.Stat(path); err != nil || rewrite {
+		start := time.Now()
+		count, err = store.writeSnapshot(path, ts)
+		if err != nil {
+			return 0, err
+		}
+		slog.Info("Wrote snapshot", "file", path, "keys", count, "duration", time.Since(start))
+	}
+	if err := store.wal.truncateFront(walOffset); err != nil {
+		return 0, fmt.Errorf("cannot compact write-ahead log: %w", err)
+	}
+	removeOtherSnapshots(dir, path)
+	return count, nil
+}
+
+// Reencrypt rewrites the accounts on disk with the current key of
+// WALOptions.Keyring, after the keyring was rotated, and returns how many
+// values it rewrote. With a snapshot directory it writes a new snapshot,
+// which drops the log records before it; otherwise it rewrites the whole
+// log. Commits carry on meanwhile.
+func (store *InMemoryStorage) Reencrypt(ctx context.Context) (int, error) {
+	if store.wal == nil || store.wal.options.Keyring == nil {
+		return 0, errors.New("re-encryption needs a write-ahead log and a keyring")
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if store.wal.options.SnapshotDir != "" {
+		count, err := store.snapshot(true)
+		return int(count), err
+	}
+	store.snapshotLock.Lock()
+	defer store.snapshotLock.Unlock()
+	return store.wal.reencrypt()
+}
+
+// writeSnapshot writes the state as of ts to a temporary file and renames
+// it into place once it is safely on disk.
+func (store *InMemoryStorage) writeSnapshot(path string, ts uint64) (uint64, error) {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp)
+	defer file.Close()
+
+	sw := newSnapshotWriter(file, ts, store.wal.options.Keyring)
+	store.data.Range(func(key, _ any) bool {
+		if value, err := store.getAt(key.(Key), ts); err == nil {
+			sw.add(key.(Key), value)
+		}
+		return true
+	})
+	if err := sw.finish(); err != nil {
+		return 0, err
+	}
+	if err := file.Sync(); err != nil {
+		return 0, err
+	}
+	if err := file.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return 0, err
+	}
+	return sw.count, syncDir(filepath.Dir(path))
+}
+
+// snapshotWriter writes entries in the snapshot file format.
+type snapshotWriter struct {
+	out      io.Writer
+	w        *bufio.Writer
+	checksum hash.Hash32
+	keyring  *Keyring
+	count    uint64
+	buf      []byte
+}
+
+// newSnapshotWriter writes the header of a snapshot as of ts to out. The
+// accounts are encrypted with keyring.
+func newSnapshotWriter(out io.Writer, ts uint64, keyring *Keyring) *snapshotWriter {
+	checksum := crc32.New(crcTable)
+	w := bufio.NewWriter(io.MultiWriter(out, checksum))
+	w.WriteString(snapshotMagic)
+	binary.Write(w, binary.LittleEndian, ts)
+	return &snapshotWriter{out: out, w: w, checksum: checksum, keyring: keyring}
+}
+
+func (sw *snapshotWriter) add(key Key, value Value) {
+	sw.buf = append(sw.buf[:0], 1)
+	sw.buf = binary.LittleEndian.AppendUint64(sw.buf, key)
+	data := sw.keyring.encodeAccount(key, value)
+	sw.buf = binary.LittleEndian.AppendUint32(sw.buf, uint32(len(data)))
+	sw.buf = append(sw.buf, data...)
+	sw.w.Write(sw.buf)
+	sw.count++
+}
+
+// finish writes the trailer. Errors writing entries are reported here.
+func (sw *snapshotWriter) finish() error {
+	sw.w.WriteByte(0)
+	binary.Write(sw.w, binary.LittleEndian, sw.count)
+	if err := sw.w.Flush(); err != nil {
+		return err
+	}
+	return binary.Write(sw.out, binary.LittleEndian, sw.checksum.Sum32())
+}
+
+// readSnapshot loads a snapshot file and returns its timestamp and keys,
+// decrypting them with keyring.
+func readSnapshot(path string, keyring *Keyring) (uint64, []mutation, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer file.Close()
+	return decodeSnapshot(bufio.NewReader(file), keyring)
+}
+
+// decodeSnapshot reads a snapshot from br. It fails with ErrCorruptRecord
+// unless the whole snapshot is intact.
+func decodeSnapshot(br *bufio.Reader, keyring *Keyring) (uint64, []mutation, error) {
+	checksum := crc32.New(crcTable)
+	r := &checksumReader{r: br, hash: checksum}
+
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != snapshotMagic {
+		return 0, nil, ErrCorruptRecord
+	}
+	var ts uint64
+	if err := binary.Read(r, binary.LittleEndian, &ts); err != nil {
+		return 0, nil, ErrCorruptRecord
+	}
+	var mutations []mutation
+	for {
+		var marker [1]byte
+		if _, err := io.ReadFull(r, marker[:]); err != nil {
+			return 0, nil, ErrCorruptRecord
+		}
+		if marker[0] == 0 {
+			break
+		}
+		var header [12]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return 0, nil, ErrCorruptRecord
+		}
+		length := binary.LittleEndian.Uint32(header[8:])
+		if length > maxRecordSize {
+			return 0, nil, ErrCorruptRecord
+		}
+		value := make([]byte, length)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return 0, nil, ErrCorruptRecord
+		}
+		key := binary.LittleEndian.Uint64(header[:])
+		account, err := keyring.decodeAccount(key, value)
+		if errors.Is(err, ErrDecrypt) {
+			return 0, nil, err
+		}
+		if err != nil {
+			return 0, nil, ErrCorruptRecord
+		}
+		mutations = append(mutations, mutation{key: key, value: account})
+	}
+	var count uint64
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil || count != uint64(len(mutations)) {
+		return 0, nil, ErrCorruptRecord
+	}
+	sum := checksum.Sum32()
+	var stored uint32
+	if err := binary.Read(r.r, binary.LittleEndian, &stored); err != nil || stored != sum {
+		return 0, nil, ErrCorruptRecord
+	}
+	return ts, mutations, nil
+}
+
+// loadNewestSnapshot installs the newest readable snapshot in dir and
+// returns its timestamp, or 0 if there is none. Leftover temporary files
+// from an interrupted snapshot are removed. A snapshot that keyring cannot
+// decrypt is an error rather than skipped, since older snapshots may no
+// longer have the log records that follow them.
+func (store *InMemoryStorage) loadNewestSnapshot(dir string, keyring *Keyring) (uint64, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return 0, err
+	}
+	names, err := snapshotFiles(dir)
+	if err != nil {
+		return 0, err
+	}
+	for _, name := range slices.Backward(names) {
+		path := filepath.Join(dir, name)
+		ts, mutations, err := readSnapshot(path, keyring)
+		if errors.Is(err, ErrDecrypt) {
+			return 0, fmt.Errorf("snapshot %s: %w", path, err)
+		}
+		if err != nil {
+			slog.Warn("Skipping unreadable snapshot", "file", path, "error", err)
+			continue
+		}
+		store.install(ts, mutations)
+		store.committed.Store(ts)
+		slog.Info("Loaded snapshot", "file", path, "keys", len(mutations))
+		return ts, nil
+	}
+	return 0, nil
+}
+
+// snapshotFiles lists the snapshots in dir, oldest first.
+func snapshotFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, snapshotPrefix) {
+			continue
+		}
+		if strings.HasSuffix(name, snapshotSuffix+".tmp") {
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if strings.HasSuffix(name, snapshotSuffix) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+func removeOtherSnapshots(dir, keep string) {
+	names, err := snapshotFiles(dir)
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		if path := filepath.Join(dir, name); path != keep {
+			os.Remove(path)
+		}
+	}
+}
+
+func (store *InMemoryStorage) snapshotLoop(interval time.Duration) {
+	defer close(store.snapshotDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-store.snapshotStop:
+			return
+		case <-ticker.C:
+			if err := store.Snapshot(); err != nil {
+				slog.Error("Cannot write snapshot", "error", err)
+			}
+		}
+	}
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// checksumReader feeds everything read through it into hash.
+type checksumReader struct {
+	r    *bufio.Reader
+	hash hash.Hash32
+}
+
+func (cr *checksumReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.hash.Write(p[:n])
+	return n, err
+}
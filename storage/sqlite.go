@@ -1,60 +1,550 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
+	"main/money"
+	"math/rand/v2"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
 
 	_ "github.com/glebarez/go-sqlite"
 )
 
 type SqliteStorage struct {
 	*sql.DB
+	options SqliteOptions
 }
 
+// SqliteStorageTransaction is a transaction of SqliteStorage. Once the
+// context of Begin is done, database/sql rolls the transaction back and
+// answers every call with sql.ErrTxDone, so its methods check the context
+// first and return its error instead.
 type SqliteStorageTransaction struct {
 	*sql.Tx
-	db *SqliteStorage
+	ctx      context.Context
+	db       *SqliteStorage
+	readOnly bool
 }
 
+// SqliteOptions configures the connections to a SQLite database. Fields
+// left at zero take their value from DefaultSqliteOptions.
+type SqliteOptions struct {
+	// JournalMode is the journal_mode pragma. WAL lets readers run while
+	// a transaction writes.
+	JournalMode string
+	// Synchronous is the synchronous pragma. NORMAL in WAL mode can lose
+	// the last commits on power loss but never corrupts the database.
+	Synchronous string
+	// BusyTimeout is how long a statement waits for another connection's
+	// lock before it fails with SQLITE_BUSY.
+	BusyTimeout time.Duration
+	// MaxOpenConns limits the connection pool; negative means no limit.
+	MaxOpenConns int
+	// MaxRetries is how often an operation that failed with SQLITE_BUSY or
+	// SQLITE_LOCKED is retried; negative disables retries.
+	MaxRetries int
+	// RetryBackoff is the delay before the first retry. It doubles with
+	// every further retry, up to maxRetryBackoff, and is jittered.
+	RetryBackoff time.Duration
+	// Keyring, when set, encrypts the balance column. Balances stored in
+	// plain text fail to read with ErrDecrypt unless the keyring allows
+	// them with AllowPlaintext, for Reencrypt to encrypt.
+	Keyring *Keyring
+}
+
+var DefaultSqliteOptions = SqliteOptions{
+	JournalMode:  "WAL",
+	Synchronous:  "NORMAL",
+	BusyTimeout:  5 * time.Second,
+	MaxOpenConns: -1,
+	MaxRetries:   5,
+	RetryBackoff: 10 * time.Millisecond,
+}
+
+const maxRetryBackoff = time.Second
+
+var (
+	journalModes      = []string{"DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF"}
+	synchronousLevels = []string{"OFF", "NORMAL", "FULL", "EXTRA"}
+)
+
+// withDefaults fills in the zero fields of options and validates the
+// pragmas, which end up in the connection string.
+func (options SqliteOptions) withDefaults() (SqliteOptions, error) {
+	if options.JournalMode == "" {
+		options.JournalMode = DefaultSqliteOptions.JournalMode
+	}
+	if options.Synchronous == "" {
+		options.Synchronous = DefaultSqliteOptions.Synchronous
+	}
+	if options.BusyTimeout == 0 {
+		options.BusyTimeout = DefaultSqliteOptions.BusyTimeout
+	}
+	if options.MaxOpenConns == 0 {
+		options.MaxOpenConns = DefaultSqliteOptions.MaxOpenConns
+	}
+	if options.MaxRetries == 0 {
+		options.MaxRetries = DefaultSqliteOptions.MaxRetries
+	}
+	if options.RetryBackoff == 0 {
+		options.RetryBackoff = DefaultSqliteOptions.RetryBackoff
+	}
+	options.JournalMode = strings.ToUpper(options.JournalMode)
+	options.Synchronous = strings.ToUpper(options.Synchronous)
+	if !slices.Contains(journalModes, options.JournalMode) {
+		return SqliteOptions{}, fmt.Errorf("unknown sqlite journal mode %q: want one of %s", options.JournalMode, strings.Join(journalModes, ", "))
+	}
+	if !slices.Contains(synchronousLevels, options.Synchronous) {
+		return SqliteOptions{}, fmt.Errorf("unknown sqlite synchronous level %q: want one of %s", options.Synchronous, strings.Join(synchronousLevels, ", "))
+	}
+	if options.BusyTimeout < 0 {
+		return SqliteOptions{}, fmt.Errorf("sqlite busy timeout must not be negative, got %s", options.BusyTimeout)
+	}
+	return options, nil
+}
+
+// NewSqliteStorage opens the database at filePath with
+// DefaultSqliteOptions and migrates it to the latest schema. It returns
+// nil if the database cannot be opened or migrated, including when its
+// schema is newer than this binary.
 func NewSqliteStorage(filePath string) *SqliteStorage {
+	return NewSqliteStorageWithOptions(filePath, SqliteOptions{})
+}
+
+// NewSqliteStorageWithOptions is like NewSqliteStorage but configures the
+// connections with options.
+func NewSqliteStorageWithOptions(filePath string, options SqliteOptions) *SqliteStorage {
+	store, err := OpenSqliteStorage(filePath, options)
+	if err != nil {
+		slog.Error("Cannot create sqlite DB", "error", err)
+		return nil
+	}
+	if _, err := store.Migrate(); err != nil {
+		slog.Error("Cannot migrate sqlite DB", "error", err)
+		store.Close()
+		return nil
+	}
+	return store
+}
+
+// OpenSqliteStorage opens the database at filePath without migrating it.
+// The schema must be brought up to date with Migrate before the storage is
+// used. Every connection is set up with the pragmas in options.
+func OpenSqliteStorage(filePath string, options SqliteOptions) (*SqliteStorage, error) {
+	options, err := options.withDefaults()
+	if err != nil {
+		return nil, err
+	}
 	if filePath == "" {
 		filePath = ":memory:"
 	}
-	slog.Error(filePath)
-	db, err := sql.Open("sqlite", filePath)
+	pragmas := url.Values{"_pragma": {
+		fmt.Sprintf("busy_timeout(%d)", options.BusyTimeout.Milliseconds()),
+		fmt.Sprintf("journal_mode(%s)", options.JournalMode),
+		fmt.Sprintf("synchronous(%s)", options.Synchronous),
+	}}
+	db, err := sql.Open("sqlite", filePath+"?"+pragmas.Encode())
 	if err != nil {
-		slog.Error("Cannot create sqlite DB", "error", err)
-		return nil
+		return nil, err
+	}
+	if filePath == ":memory:" {
+		// Every connection to :memory: opens a database of its own, so the
+		// pool is held to the one connection that holds the accounts.
+		options.MaxOpenConns = 1
 	}
-	db.Exec(`CREATE TABLE IF NOT EXISTS kv_store (key INTEGER PRIMARY KEY, value TEXT);`)
-	return &SqliteStorage{db}
+	if options.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(options.MaxOpenConns)
+		db.SetMaxIdleConns(options.MaxOpenConns)
+	}
+	return &SqliteStorage{DB: db, options: options}, nil
 }
 
-func (db *SqliteStorage) Get(key Key) (Value, error) {
+// SQLite result codes, as reported by the driver's extended result codes.
+const (
+	sqliteBusy                 = 5
+	sqliteLocked               = 6
+	sqliteBusySnapshot         = sqliteBusy | 2<<8
+	sqliteConstraintPrimaryKey = 19 | 6<<8
+)
+
+func sqliteCode(err error) (int, bool) {
+	var sqliteErr interface{ Code() int }
+	if !errors.As(err, &sqliteErr) {
+		return 0, false
+	}
+	return sqliteErr.Code(), true
+}
+
+// isBusy reports whether err means that another connection held a lock
+// for longer than the busy timeout. The statement can simply be run again.
+func isBusy(err error) bool {
+	code, ok := sqliteCode(err)
+	if !ok || code == sqliteBusySnapshot {
+		return false
+	}
+	return code&0xff == sqliteBusy || code&0xff == sqliteLocked
+}
+
+// conflictError turns SQLITE_BUSY_SNAPSHOT, which a transaction gets when
+// it tries to write after another connection committed since its first
+// read, into ErrConflict. Only a new transaction can succeed then.
+func conflictError(err error) error {
+	if code, ok := sqliteCode(err); ok && code == sqliteBusySnapshot {
+		return fmt.Errorf("%w: %w", ErrConflict, err)
+	}
+	return err
+}
+
+// retry runs op until it succeeds, fails with an error other than
+// SQLITE_BUSY or SQLITE_LOCKED, or has been retried MaxRetries times,
+// backing off exponentially with jitter between attempts.
+func (db *SqliteStorage) retry(ctx context.Context, op func() error) error {
+	backoff := db.options.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if !isBusy(err) || attempt >= db.options.MaxRetries {
+			return conflictError(err)
+		}
+		delay := backoff/2 + rand.N(backoff/2+1)
+		slog.Debug("Retrying busy sqlite operation", "attempt", attempt+1, "delay", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		backoff = min(2*backoff, maxRetryBackoff)
+	}
+}
+
+const accountColumns = `id, balance, currency, status, version, created_at, updated_at, owner`
+
+// scanAccount reads a row selected with accountColumns, decrypting the
+// balance with keyring.
+func scanAccount(row interface{ Scan(...any) error }, keyring *Keyring) (Key, Value, error) {
+	var key Key
+	var balance, status, createdAt, updatedAt string
+	var account Account
+	err := row.Scan(&key, &balance, &account.Currency, &status, &account.Version, &createdAt, &updatedAt, &account.Owner)
+	if err != nil {
+		return 0, Value{}, err
+	}
+	account.Status = AccountStatus(status)
+	plaintext, err := keyring.Open(key, []byte(balance))
+	if err != nil {
+		return 0, Value{}, err
+	}
+	if account.Balance, err = money.ParseLegacy(string(plaintext)); err != nil {
+		return 0, Value{}, fmt.Errorf("account %d: %w", key, err)
+	}
+	if account.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt); err != nil {
+		return 0, Value{}, fmt.Errorf("account %d: %w", key, err)
+	}
+	if account.UpdatedAt, err = time.Parse(time.RFC3339Nano, updatedAt); err != nil {
+		return 0, Value{}, fmt.Errorf("account %d: %w", key, err)
+	}
+	return key, account, nil
+}
+
+func insertOrReplace(tx *sql.Tx, keyring *Keyring, key Key, account Account) error {
+	return insertAccount(tx, keyring, `INSERT OR REPLACE`, key, account)
+}
+
+// insertAccount runs verb, an INSERT statement with or without a conflict
+// clause, to store account under key.
+func insertAccount(tx *sql.Tx, keyring *Keyring, verb string, key Key, account Account) error {
+	_, err := tx.Exec(insertStatement(verb), accountArgs(key, account, keyring)...)
+	return err
+}
+
+// insertStatement returns the statement that insertAccount runs.
+func insertStatement(verb string) string {
+	return verb + ` INTO accounts (` + accountColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?);`
+}
+
+// accountArgs returns the arguments of insertStatement, with the balance
+// encrypted with keyring.
+func accountArgs(key Key, account Account, keyring *Keyring) []any {
+	return []any{key, string(keyring.Seal(key, []byte(account.Balance.String()))), account.Currency, string(account.Status), account.Version,
+		account.CreatedAt.UTC().Format(time.RFC3339Nano), account.UpdatedAt.UTC().Format(time.RFC3339Nano), account.Owner}
+}
+
+func (db *SqliteStorage) Get(ctx context.Context, key Key) (Value, error) {
 	var value Value
-	err := db.QueryRow(`SELECT value FROM kv_store WHERE key = ?;`, key).Scan(&value)
+	err := db.retry(ctx, func() (err error) {
+		_, value, err = scanAccount(db.QueryRowContext(ctx, `SELECT `+accountColumns+` FROM accounts WHERE id = ?;`, key), db.options.Keyring)
+		return err
+	})
 	if err == sql.ErrNoRows {
-		return "", ErrKeyNotFound
+		return Value{}, ErrKeyNotFound
 	}
 	return value, err
 }
 
-func (db *SqliteStorage) Begin() StorageTransaction {
-	tx, err := db.DB.Begin()
+// GetMany reads every key with a single statement, which passes the keys
+// as one JSON array, so it sees one snapshot however many keys there are.
+func (db *SqliteStorage) GetMany(ctx context.Context, keys []Key) (map[Key]Value, error) {
+	list, err := json.Marshal(keys)
 	if err != nil {
-		slog.Error("Cannot begin transaction", "error", err)
-		return nil
+		return nil, err
+	}
+	var values map[Key]Value
+	err = db.retry(ctx, func() error {
+		rows, err := db.QueryContext(ctx, `SELECT `+accountColumns+` FROM accounts WHERE id IN (SELECT value FROM json_each(?));`, string(list))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		values = make(map[Key]Value, len(keys))
+		for rows.Next() {
+			key, value, err := scanAccount(rows, db.options.Keyring)
+			if err != nil {
+				return err
+			}
+			values[key] = value
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// WriteBatch applies batch in one transaction, running one prepared
+// statement for the sets and one for the deletes. The transaction starts
+// with a write, so it waits for the write lock rather than conflicting,
+// and is retried as a whole if the lock stays busy.
+func (db *SqliteStorage) WriteBatch(ctx context.Context, batch Batch) error {
+	mutations, err := batch.mutations()
+	if err != nil {
+		return err
+	}
+	return db.retry(ctx, func() error {
+		tx, err := db.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		set, err := tx.PrepareContext(ctx, insertStatement(`INSERT OR REPLACE`))
+		if err != nil {
+			return err
+		}
+		defer set.Close()
+		del, err := tx.PrepareContext(ctx, `DELETE FROM accounts WHERE id = ?;`)
+		if err != nil {
+			return err
+		}
+		defer del.Close()
+		for _, m := range mutations {
+			if !m.deleted {
+				if _, err := set.ExecContext(ctx, accountArgs(m.key, m.value, db.options.Keyring)...); err != nil {
+					return err
+				}
+				continue
+			}
+			result, err := del.ExecContext(ctx, m.key)
+			if err != nil {
+				return err
+			}
+			rowsAffected, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if rowsAffected == 0 {
+				return fmt.Errorf("cannot delete key %d: %w", m.key, ErrKeyNotFound)
+			}
+		}
+		return tx.Commit()
+	})
+}
+
+// Scan visits the keys in r from a single read transaction, so the result
+// is consistent even if it takes several pages.
+func (db *SqliteStorage) Scan(ctx context.Context, r KeyRange, fn func(key Key, value Value) bool) error {
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
 	}
-	return &SqliteStorageTransaction{tx, db}
+	defer tx.Rollback()
+	return scanPages(tx, db.options.Keyring, r, func(op func() error) error { return db.retry(ctx, op) }, fn)
+}
+
+// Reencrypt encrypts every balance that is in plain text, or encrypted
+// with another key, with the current key of SqliteOptions.Keyring, and
+// returns how many it rewrote. It rewrites a page of rows at a time, each
+// in a transaction of its own, so other transactions carry on meanwhile.
+func (db *SqliteStorage) Reencrypt(ctx context.Context) (int, error) {
+	keyring := db.options.Keyring
+	if keyring == nil {
+		return 0, errors.New("re-encryption needs a keyring")
+	}
+	prefix := keyring.currentPrefix()
+	var start Key
+	rewritten := 0
+	for {
+		var page []Key
+		err := db.retry(ctx, func() error {
+			page = page[:0]
+			tx, err := db.DB.BeginTx(ctx, nil)
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback()
+			// Take the write lock first, so that the page cannot change
+			// between reading and rewriting it.
+			if _, err := tx.Exec(`DELETE FROM accounts WHERE 0;`); err != nil {
+				return err
+			}
+			rows, err := tx.Query(`SELECT id, balance FROM accounts WHERE id >= ? AND substr(balance, 1, ?) != ? ORDER BY id LIMIT ?;`,
+				start, len(prefix), prefix, scanPageSize)
+			if err != nil {
+				return err
+			}
+			balances := make(map[Key]string)
+			for rows.Next() {
+				var key Key
+				var balance string
+				if err := rows.Scan(&key, &balance); err != nil {
+					rows.Close()
+					return err
+				}
+				page = append(page, key)
+				balances[key] = balance
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			for _, key := range page {
+				plaintext, err := keyring.Open(key, []byte(balances[key]))
+				if err != nil {
+					return err
+				}
+				if _, err := tx.Exec(`UPDATE accounts SET balance = ? WHERE id = ?;`, string(keyring.Seal(key, plaintext)), key); err != nil {
+					return err
+				}
+			}
+			return tx.Commit()
+		})
+		if err != nil {
+			return rewritten, err
+		}
+		rewritten += len(page)
+		if len(page) < scanPageSize {
+			return rewritten, nil
+		}
+		start = page[len(page)-1] + 1
+	}
+}
+
+// Begin starts a transaction with sql.DB.BeginTx, which rolls it back and
+// interrupts any running statement when ctx is done. SQLite transactions
+// are always serializable, which satisfies every isolation level. A
+// pessimistic transaction takes the database's write lock straight away,
+// like BEGIN IMMEDIATE, by running a write that changes nothing.
+func (db *SqliteStorage) Begin(ctx context.Context, opts TxOptions) (StorageTransaction, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Lock == LockPessimistic {
+		err := db.retry(ctx, func() error {
+			_, err := tx.Exec(`DELETE FROM accounts WHERE 0;`)
+			return err
+		})
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("cannot take the write lock: %w", err)
+		}
+	}
+	return &SqliteStorageTransaction{Tx: tx, ctx: ctx, db: db, readOnly: opts.ReadOnly}, nil
+}
+
+// retry retries a statement of the transaction that failed because another
+// connection held a lock. A statement that fails leaves the rest of the
+// transaction in place, so it can be run again on its own. SQLite does not
+// wait for the write lock on behalf of a transaction that already read, so
+// under steady write traffic the retries can run out; the transaction is
+// then reported as conflicting, to be retried as a whole.
+func (tx *SqliteStorageTransaction) retry(op func() error) error {
+	err := tx.db.retry(tx.ctx, op)
+	if isBusy(err) {
+		return fmt.Errorf("%w: %w", ErrConflict, err)
+	}
+	return err
 }
 
 func (tx *SqliteStorageTransaction) Set(key Key, value Value) error {
-	_, err := tx.Exec(`INSERT OR REPLACE INTO kv_store (key, value) VALUES (?, ?);`, key, value)
+	if err := tx.ctx.Err(); err != nil {
+		return err
+	}
+	if tx.readOnly {
+		return ErrReadOnly
+	}
+	value, err := normalizeAccount(value)
+	if err != nil {
+		return err
+	}
+	return tx.retry(func() error { return insertOrReplace(tx.Tx, tx.db.options.Keyring, key, value) })
+}
+
+// Insert relies on the primary key of accounts to reject existing keys.
+func (tx *SqliteStorageTransaction) Insert(key Key, value Value) error {
+	if err := tx.ctx.Err(); err != nil {
+		return err
+	}
+	if tx.readOnly {
+		return ErrReadOnly
+	}
+	value, err := normalizeAccount(value)
+	if err != nil {
+		return err
+	}
+	err = tx.retry(func() error { return insertAccount(tx.Tx, tx.db.options.Keyring, `INSERT`, key, value) })
+	if code, ok := sqliteCode(err); ok && code == sqliteConstraintPrimaryKey {
+		return fmt.Errorf("%w: key %d", ErrKeyExists, key)
+	}
 	return err
 }
 
+// CompareAndSet reads and writes key in the same transaction. SQLite
+// transactions are serializable, so the value cannot change in between.
+func (tx *SqliteStorageTransaction) CompareAndSet(key Key, expected, value Value) error {
+	if tx.readOnly {
+		return ErrReadOnly
+	}
+	current, err := tx.Get(key)
+	if err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return err
+	}
+	if err := checkEqual(expected)(key, current, err == nil); err != nil {
+		return err
+	}
+	return tx.Set(key, value)
+}
+
 func (tx *SqliteStorageTransaction) Delete(key Key) error {
-	result, err := tx.Exec(`DELETE FROM kv_store WHERE key = ?;`, key)
+	if err := tx.ctx.Err(); err != nil {
+		return err
+	}
+	if tx.readOnly {
+		return ErrReadOnly
+	}
+	var result sql.Result
+	err := tx.retry(func() (err error) {
+		result, err = tx.Exec(`DELETE FROM accounts WHERE id = ?;`, key)
+		return err
+	})
 	if err != nil {
 		return err
 	}
@@ -69,10 +559,92 @@ func (tx *SqliteStorageTransaction) Delete(key Key) error {
 }
 
 func (tx *SqliteStorageTransaction) Get(key Key) (Value, error) {
+	if err := tx.ctx.Err(); err != nil {
+		return Value{}, err
+	}
 	var value Value
-	err := tx.QueryRow(`SELECT value FROM kv_store WHERE key = ?;`, key).Scan(&value)
+	err := tx.retry(func() (err error) {
+		_, value, err = scanAccount(tx.QueryRow(`SELECT `+accountColumns+` FROM accounts WHERE id = ?;`, key), tx.db.options.Keyring)
+		return err
+	})
 	if err == sql.ErrNoRows {
-		return "", ErrKeyNotFound
+		return Value{}, ErrKeyNotFound
 	}
 	return value, err
 }
+
+func (tx *SqliteStorageTransaction) Scan(r KeyRange, fn func(key Key, value Value) bool) error {
+	if err := tx.ctx.Err(); err != nil {
+		return err
+	}
+	return scanPages(tx.Tx, tx.db.options.Keyring, r, tx.retry, fn)
+}
+
+// Commit is not retried: database/sql ends the transaction even if COMMIT
+// fails with SQLITE_BUSY.
+func (tx *SqliteStorageTransaction) Commit() error {
+	if err := tx.ctx.Err(); err != nil {
+		tx.Tx.Rollback()
+		return err
+	}
+	return conflictError(tx.Tx.Commit())
+}
+
+// scanPageSize is how many rows scanPages reads per query. Rows are read a
+// page at a time and closed before fn runs, so fn may use the transaction,
+// and reading a page can be retried without visiting any key twice.
+const scanPageSize = 1000
+
+func scanPages(tx *sql.Tx, keyring *Keyring, r KeyRange, retry func(func() error) error, fn func(key Key, value Value) bool) error {
+	type row struct {
+		key   Key
+		value Value
+	}
+	start, visited := r.Start, 0
+	for {
+		query := `SELECT ` + accountColumns + ` FROM accounts WHERE id >= ?`
+		args := []any{start}
+		if r.End != 0 {
+			query += ` AND id < ?`
+			args = append(args, r.End)
+		}
+		limit := scanPageSize
+		if r.Limit > 0 {
+			limit = min(limit, r.Limit-visited)
+		}
+		query += ` ORDER BY id LIMIT ?;`
+		args = append(args, limit)
+
+		var page []row
+		err := retry(func() error {
+			page = page[:0]
+			rows, err := tx.Query(query, args...)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var kv row
+				var err error
+				if kv.key, kv.value, err = scanAccount(rows, keyring); err != nil {
+					return err
+				}
+				page = append(page, kv)
+			}
+			return rows.Err()
+		})
+		if err != nil {
+			return err
+		}
+		for _, kv := range page {
+			visited++
+			if !fn(kv.key, kv.value) {
+				return nil
+			}
+		}
+		if len(page) < limit || (r.Limit > 0 && visited >= r.Limit) {
+			return nil
+		}
+		start = page[len(page)-1].key + 1
+	}
+}
@@ -0,0 +1,127 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"main/storage"
+	"main/storage/storagetest"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestSqliteStorage_ConcurrentTransfersWithoutExternalLock(t *testing.T) {
+	db := storage.NewSqliteStorage(filepath.Join(t.TempDir(), "store.db"))
+	if db == nil {
+		t.Fatal("Cannot open database")
+	}
+	defer db.Close()
+	tx := begin(db)
+	tx.Set(1, storagetest.WithBalance("1000"))
+	tx.Set(2, storagetest.WithBalance("0"))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	const workers, transfers = 8, 25
+	one := storagetest.WithBalance("1").Balance
+	transfer := func() error {
+		tx, err := db.Begin(context.Background(), storage.TxOptions{})
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		source, err := tx.Get(1)
+		if err != nil {
+			return err
+		}
+		destination, err := tx.Get(2)
+		if err != nil {
+			return err
+		}
+		source.Balance = source.Balance.Sub(one)
+		destination.Balance = destination.Balance.Add(one)
+		if err := tx.Set(1, source); err != nil {
+			return err
+		}
+		if err := tx.Set(2, destination); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*transfers)
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range transfers {
+				err := transfer()
+				for errors.Is(err, storage.ErrConflict) {
+					err = transfer()
+				}
+				if err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Transfer failed: %v", err)
+	}
+
+	source, _ := db.Get(context.Background(), 1)
+	destination, _ := db.Get(context.Background(), 2)
+	if source.Balance.String() != "800.0000000000000000000" || destination.Balance.String() != "200.0000000000000000000" {
+		t.Errorf("Expected 800 and 200 after all transfers, got %s and %s", source.Balance, destination.Balance)
+	}
+}
+
+func TestSqliteStorage_RejectsUnknownPragmas(t *testing.T) {
+	for _, options := range []storage.SqliteOptions{
+		{JournalMode: "WAL; DROP TABLE accounts"},
+		{Synchronous: "SOMETIMES"},
+	} {
+		if _, err := storage.OpenSqliteStorage(filepath.Join(t.TempDir(), "store.db"), options); err == nil {
+			t.Errorf("Expected %+v to be rejected", options)
+		}
+	}
+}
+
+func TestSqliteStorage_TransactionReportsItsCancelledContext(t *testing.T) {
+	db := storage.NewSqliteStorage(filepath.Join(t.TempDir(), "store.db"))
+	defer db.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	tx, err := db.Begin(ctx, storage.TxOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	tx.Set(1, storagetest.WithBalance("1"))
+	cancel()
+	_, getErr := tx.Get(1)
+	for what, err := range map[string]error{
+		"Get":    getErr,
+		"Set":    tx.Set(2, storagetest.WithBalance("2")),
+		"Insert": tx.Insert(3, storagetest.WithBalance("3")),
+		"Delete": tx.Delete(1),
+		"Scan":   tx.Scan(storage.KeyRange{}, func(storage.Key, storage.Value) bool { return true }),
+		"Commit": tx.Commit(),
+	} {
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected %s after cancellation to fail with context.Canceled, got %v", what, err)
+		}
+	}
+}
+
+func TestSqliteStorage_InMemoryUsesOneConnection(t *testing.T) {
+	db := storage.NewSqliteStorage("")
+	defer db.Close()
+	// A second connection would open an empty database of its own.
+	if max := db.Stats().MaxOpenConnections; max != 1 {
+		t.Errorf("Expected an in-memory database to use 1 connection, got a limit of %d", max)
+	}
+}
@@ -1,21 +1,287 @@
 package storage
 
-import "errors"
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+)
 
 type Key = uint64
-type Value = string
+type Value = Account
 
 var ErrKeyNotFound = errors.New("key not found")
 
+// ErrConflict is returned by Commit when another transaction committed a
+// change to a key this transaction read. The transaction can be retried.
+var ErrConflict = errors.New("transaction conflict")
+
+// ErrKeyExists is returned by Insert when the key already has a value.
+var ErrKeyExists = errors.New("key already exists")
+
+// ErrCompareFailed is returned by CompareAndSet when the current value is
+// not the expected one.
+var ErrCompareFailed = errors.New("value is not the expected one")
+
+// ErrReadOnly is returned by Set and Delete in a read-only transaction.
+var ErrReadOnly = errors.New("transaction is read-only")
+
+// ErrUnsupportedTxOptions is returned by Begin when the backend cannot
+// provide the requested transaction options.
+var ErrUnsupportedTxOptions = errors.New("unsupported transaction options")
+
+// Storage is implemented by every backend. Methods that take a context stop
+// and return its error once it is done.
 type Storage interface {
-	Get(key Key) (Value, error)
-	Begin() StorageTransaction
+	Get(ctx context.Context, key Key) (Value, error)
+	// Scan calls fn for every key in r in ascending key order until fn
+	// returns false or r.Limit keys have been visited.
+	Scan(ctx context.Context, r KeyRange, fn func(key Key, value Value) bool) error
+	// Begin starts a transaction bound to ctx, as with sql.DB.BeginTx: once
+	// ctx is done, every method of the transaction returns its error and
+	// Commit applies nothing. It fails with ErrUnsupportedTxOptions if the
+	// backend cannot honor opts.
+	Begin(ctx context.Context, opts TxOptions) (StorageTransaction, error)
+	// GetMany returns the latest committed values of keys, all read at the
+	// same point in time. Keys that have no value are left out of the map.
+	GetMany(ctx context.Context, keys []Key) (map[Key]Value, error)
+	// WriteBatch applies every write of batch atomically: all of them are
+	// committed together or none is. It fails with ErrKeyNotFound if a
+	// deleted key has no value, and with ErrInvalidAccount if a value is
+	// not a valid account.
+	WriteBatch(ctx context.Context, batch Batch) error
 }
 
 type StorageTransaction interface {
 	Commit() error
 	Rollback() error
 	Set(key Key, value Value) error
+	// Insert is like Set but fails with ErrKeyExists if key has a value.
+	Insert(key Key, value Value) error
+	// CompareAndSet is like Set but fails with ErrCompareFailed unless the
+	// current value of key equals expected, or with ErrKeyNotFound if key
+	// has no value. At every isolation level, Commit fails with
+	// ErrConflict if another commit changes key in the meantime.
+	CompareAndSet(key Key, expected, value Value) error
 	Get(key Key) (Value, error)
 	Delete(key Key) error
+	// Scan is like Storage.Scan but sees the transaction's own writes.
+	Scan(r KeyRange, fn func(key Key, value Value) bool) error
+}
+
+// TxOptions configures a transaction. The zero TxOptions gives the
+// backend's default: a read-write, serializable, optimistic transaction.
+type TxOptions struct {
+	// ReadOnly makes Set and Delete fail with ErrReadOnly.
+	ReadOnly  bool
+	Isolation IsolationLevel
+	Lock      LockMode
+}
+
+type IsolationLevel int
+
+const (
+	// IsolationDefault is the backend's default level, Serializable.
+	IsolationDefault IsolationLevel = iota
+	// ReadCommitted reads the latest committed value on every read and
+	// does not check for conflicts, so concurrent updates can be lost.
+	ReadCommitted
+	// Snapshot reads from the state as of Begin and fails the commit
+	// only if another transaction wrote one of the same keys.
+	Snapshot
+	// Serializable additionally fails the commit if anything the
+	// transaction read, including the ranges it scanned, has changed.
+	Serializable
+)
+
+func (level IsolationLevel) String() string {
+	switch level {
+	case IsolationDefault:
+		return "default"
+	case ReadCommitted:
+		return "read committed"
+	case Snapshot:
+		return "snapshot"
+	case Serializable:
+		return "serializable"
+	}
+	return fmt.Sprintf("IsolationLevel(%d)", int(level))
+}
+
+type LockMode int
+
+const (
+	// LockOptimistic lets transactions run concurrently and detects
+	// conflicts when they commit.
+	LockOptimistic LockMode = iota
+	// LockPessimistic takes the backend's write lock at Begin and holds
+	// it until the transaction ends, so Commit never fails with
+	// ErrConflict but other writers wait. The transaction must always be
+	// committed or rolled back.
+	LockPessimistic
+)
+
+// validate rejects options that make no sense on any backend.
+func (opts TxOptions) validate() error {
+	if opts.Isolation < IsolationDefault || opts.Isolation > Serializable {
+		return fmt.Errorf("%w: unknown isolation level %d", ErrUnsupportedTxOptions, int(opts.Isolation))
+	}
+	if opts.Lock != LockOptimistic && opts.Lock != LockPessimistic {
+		return fmt.Errorf("%w: unknown lock mode %d", ErrUnsupportedTxOptions, int(opts.Lock))
+	}
+	if opts.ReadOnly && opts.Lock == LockPessimistic {
+		return fmt.Errorf("%w: a read-only transaction cannot take the write lock", ErrUnsupportedTxOptions)
+	}
+	return nil
+}
+
+// isolation returns the level the transaction runs at.
+func (opts TxOptions) isolation() IsolationLevel {
+	if opts.Isolation == IsolationDefault {
+		return Serializable
+	}
+	return opts.Isolation
+}
+
+// Batch collects sets and deletes for Storage.WriteBatch. The zero Batch
+// is empty and ready to use. A later write to a key replaces an earlier
+// one.
+type Batch struct {
+	writes map[Key]*Value // nil for a delete
+}
+
+// Set adds a write of value to key.
+func (b *Batch) Set(key Key, value Value) {
+	if b.writes == nil {
+		b.writes = make(map[Key]*Value)
+	}
+	b.writes[key] = &value
+}
+
+// Delete adds a delete of key.
+func (b *Batch) Delete(key Key) {
+	if b.writes == nil {
+		b.writes = make(map[Key]*Value)
+	}
+	b.writes[key] = nil
+}
+
+// Len returns the number of keys the batch writes.
+func (b *Batch) Len() int {
+	return len(b.writes)
+}
+
+// Each calls fn for every write of the batch, in no particular order.
+// deleted is true for a delete, which has the zero value.
+func (b *Batch) Each(fn func(key Key, value Value, deleted bool)) {
+	for key, value := range b.writes {
+		if value == nil {
+			fn(key, Value{}, true)
+		} else {
+			fn(key, *value, false)
+		}
+	}
+}
+
+// mutations returns the writes of the batch in key order, with the values
+// normalized.
+func (b *Batch) mutations() ([]mutation, error) {
+	mutations := make([]mutation, 0, len(b.writes))
+	for key, value := range b.writes {
+		m := mutation{key: key, deleted: value == nil}
+		if value != nil {
+			normalized, err := normalizeAccount(*value)
+			if err != nil {
+				return nil, fmt.Errorf("key %d: %w", key, err)
+			}
+			m.value = normalized
+		}
+		mutations = append(mutations, m)
+	}
+	slices.SortFunc(mutations, func(a, b mutation) int { return cmp.Compare(a.key, b.key) })
+	return mutations, nil
+}
+
+// KeyRange selects the keys visited by Scan. The zero KeyRange selects
+// every key.
+type KeyRange struct {
+	// Start is the first key in the range.
+	Start Key
+	// End is the first key after the range; zero means no upper bound.
+	End Key
+	// Limit is the maximum number of keys visited; zero means no limit.
+	Limit int
+}
+
+// Prefix returns the range of keys whose top bits equal those of prefix.
+func Prefix(prefix Key, bits int) KeyRange {
+	if bits <= 0 {
+		return KeyRange{}
+	}
+	if bits >= 64 {
+		return KeyRange{Start: prefix, End: prefix + 1}
+	}
+	start := prefix &^ (1<<(64-bits) - 1)
+	return KeyRange{Start: start, End: start + 1<<(64-bits)}
+}
+
+// Contains reports whether key lies between Start and End.
+func (r KeyRange) Contains(key Key) bool {
+	return key >= r.Start && (r.End == 0 || key < r.End)
+}
+
+// scanSorted visits those of keys that lie in r, in order, reading
+// each value through get. Keys for which get returns ErrKeyNotFound are
+// skipped. It backs Scan for the backends that keep keys unordered.
+func scanSorted(ctx context.Context, keys []Key, r KeyRange, get func(Key) (Value, error), fn func(Key, Value) bool) error {
+	keys = slices.DeleteFunc(keys, func(key Key) bool { return !r.Contains(key) })
+	slices.Sort(keys)
+	keys = slices.Compact(keys)
+	visited := 0
+	for _, key := range keys {
+		if r.Limit > 0 && visited >= r.Limit {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		value, err := get(key)
+		if errors.Is(err, ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		visited++
+		if !fn(key, value) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// setCheck decides whether a conditional write may replace the current
+// value of key; exists is false if key has no value.
+type setCheck func(key Key, current Value, exists bool) error
+
+// checkAbsent is the setCheck of Insert.
+func checkAbsent(key Key, _ Value, exists bool) error {
+	if exists {
+		return fmt.Errorf("%w: key %d", ErrKeyExists, key)
+	}
+	return nil
+}
+
+// checkEqual returns the setCheck of CompareAndSet.
+func checkEqual(expected Value) setCheck {
+	return func(key Key, current Value, exists bool) error {
+		if !exists {
+			return ErrKeyNotFound
+		}
+		if !current.Equal(expected) {
+			return fmt.Errorf("%w: key %d", ErrCompareFailed, key)
+		}
+		return nil
+	}
 }
@@ -0,0 +1,515 @@
+// Package storagetest is a conformance suite for storage.Storage
+// implementations. Run checks the behavior every caller of the interface
+// relies on: what a transaction sees of its own writes and of others',
+// rollback, delete semantics, conditional writes, concurrent commits and
+// the errors each method returns. Every backend of this module runs it,
+// and so should any new one.
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"main/money"
+	"main/storage"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// Opener returns a new, empty storage for a single test. If the storage
+// needs closing, the opener registers that with t.Cleanup.
+type Opener func(t *testing.T) storage.Storage
+
+// Run runs the conformance suite, each check in a subtest of t against a
+// storage of its own from open.
+func Run(t *testing.T, open Opener) {
+	for _, test := range []struct {
+		name string
+		run  func(*testing.T, storage.Storage)
+	}{
+		{"MissingKeys", testMissingKeys},
+		{"Visibility", testVisibility},
+		{"Rollback", testRollback},
+		{"Delete", testDelete},
+		{"ConditionalWrites", testConditionalWrites},
+		{"ReadOnly", testReadOnly},
+		{"InvalidInput", testInvalidInput},
+		{"WriteBatch", testWriteBatch},
+		{"Cancellation", testCancellation},
+		{"LostUpdate", testLostUpdate},
+		{"ReadSkew", testReadSkew},
+		{"ConcurrentCommits", testConcurrentCommits},
+	} {
+		t.Run(test.name, func(t *testing.T) { test.run(t, open(t)) })
+	}
+}
+
+// WithBalance returns an account holding balance, in the form every
+// backend stores it: with the default currency and status filled in. It
+// panics if balance is not a valid amount, so it is for fixtures.
+func WithBalance(balance string) storage.Value {
+	amount, err := money.Parse(balance)
+	if err != nil {
+		panic(err)
+	}
+	account, err := storage.Value{Balance: amount}.Normalize()
+	if err != nil {
+		panic(err)
+	}
+	return account
+}
+
+func begin(t *testing.T, s storage.Storage, opts storage.TxOptions) storage.StorageTransaction {
+	t.Helper()
+	tx, err := s.Begin(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Begin(%+v) failed: %v", opts, err)
+	}
+	return tx
+}
+
+// seed commits balances to s in one transaction.
+func seed(t *testing.T, s storage.Storage, balances map[storage.Key]string) {
+	t.Helper()
+	tx := begin(t, s, storage.TxOptions{})
+	for key, balance := range balances {
+		if err := tx.Set(key, WithBalance(balance)); err != nil {
+			t.Fatalf("Set(%d) failed: %v", key, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+}
+
+// expectBalance fails t unless value, err is an account holding balance.
+func expectBalance(t *testing.T, what string, value storage.Value, err error, balance string) {
+	t.Helper()
+	if err != nil {
+		t.Errorf("%s: expected %s, got %v", what, balance, err)
+	} else if value.Balance.Cmp(WithBalance(balance).Balance) != 0 {
+		t.Errorf("%s: expected %s, got %s", what, balance, value.Balance)
+	}
+}
+
+// expectError fails t unless err is target.
+func expectError(t *testing.T, what string, err, target error) {
+	t.Helper()
+	if !errors.Is(err, target) {
+		t.Errorf("%s: expected %v, got %v", what, target, err)
+	}
+}
+
+// stored returns the committed balances of s by key, as Scan reports
+// them.
+func stored(t *testing.T, s storage.Storage) map[storage.Key]string {
+	t.Helper()
+	balances := make(map[storage.Key]string)
+	err := s.Scan(context.Background(), storage.KeyRange{}, func(key storage.Key, value storage.Value) bool {
+		balances[key] = value.Balance.String()
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	return balances
+}
+
+// expectStored fails t unless s holds exactly balances.
+func expectStored(t *testing.T, s storage.Storage, balances map[storage.Key]string) {
+	t.Helper()
+	got := stored(t, s)
+	for key, balance := range balances {
+		if _, ok := got[key]; !ok {
+			t.Errorf("Expected key %d to hold %s, found nothing", key, balance)
+		} else if got[key] != WithBalance(balance).Balance.Rescale(money.DefaultScale).String() {
+			t.Errorf("Expected key %d to hold %s, got %s", key, balance, got[key])
+		}
+	}
+	for key, balance := range got {
+		if _, ok := balances[key]; !ok {
+			t.Errorf("Expected no key %d, got %s", key, balance)
+		}
+	}
+}
+
+// txKeys returns the keys tx.Scan visits.
+func txKeys(t *testing.T, tx storage.StorageTransaction) []storage.Key {
+	t.Helper()
+	var keys []storage.Key
+	if err := tx.Scan(storage.KeyRange{}, func(key storage.Key, _ storage.Value) bool {
+		keys = append(keys, key)
+		return true
+	}); err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	return keys
+}
+
+func testMissingKeys(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	_, err := s.Get(ctx, 1)
+	expectError(t, "Get of a missing key", err, storage.ErrKeyNotFound)
+	values, err := s.GetMany(ctx, []storage.Key{1, 2})
+	if err != nil || len(values) != 0 {
+		t.Errorf("Expected GetMany to leave out missing keys, got %v, %v", values, err)
+	}
+	tx := begin(t, s, storage.TxOptions{})
+	defer tx.Rollback()
+	_, err = tx.Get(1)
+	expectError(t, "Get of a missing key in a transaction", err, storage.ErrKeyNotFound)
+	expectError(t, "Delete of a missing key", tx.Delete(1), storage.ErrKeyNotFound)
+}
+
+// testVisibility checks that a transaction sees its own writes, and that
+// nobody else does until it commits.
+func testVisibility(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	seed(t, s, map[storage.Key]string{1: "10"})
+
+	tx := begin(t, s, storage.TxOptions{})
+	defer tx.Rollback()
+	tx.Set(1, WithBalance("20"))
+	tx.Set(2, WithBalance("5"))
+	value, err := tx.Get(1)
+	expectBalance(t, "Get of an overwritten key in the transaction", value, err, "20")
+	value, err = tx.Get(2)
+	expectBalance(t, "Get of a new key in the transaction", value, err, "5")
+	if keys := txKeys(t, tx); !slices.Equal(keys, []storage.Key{1, 2}) {
+		t.Errorf("Expected the transaction to scan keys [1 2], got %v", keys)
+	}
+
+	value, err = s.Get(ctx, 1)
+	expectBalance(t, "Get outside the transaction before it commits", value, err, "10")
+	_, err = s.Get(ctx, 2)
+	expectError(t, "Get of a key inserted by an uncommitted transaction", err, storage.ErrKeyNotFound)
+	reader := begin(t, s, storage.TxOptions{ReadOnly: true})
+	value, err = reader.Get(1)
+	expectBalance(t, "Get in another transaction before the commit", value, err, "10")
+	reader.Rollback()
+
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	value, err = s.Get(ctx, 1)
+	expectBalance(t, "Get after the commit", value, err, "20")
+	values, err := s.GetMany(ctx, []storage.Key{1, 2, 3})
+	if err != nil || len(values) != 2 {
+		t.Errorf("Expected GetMany to return keys 1 and 2 after the commit, got %v, %v", values, err)
+	}
+	tx = begin(t, s, storage.TxOptions{})
+	defer tx.Rollback()
+	value, err = tx.Get(2)
+	expectBalance(t, "Get in a later transaction", value, err, "5")
+}
+
+// testRollback checks that a rolled back transaction leaves nothing
+// behind, including the write lock of a pessimistic transaction.
+func testRollback(t *testing.T, s storage.Storage) {
+	seed(t, s, map[storage.Key]string{1: "10", 2: "20"})
+	for _, opts := range []storage.TxOptions{{}, {Lock: storage.LockPessimistic}} {
+		tx, err := s.Begin(context.Background(), opts)
+		if errors.Is(err, storage.ErrUnsupportedTxOptions) {
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Begin(%+v) failed: %v", opts, err)
+		}
+		tx.Set(1, WithBalance("11"))
+		tx.Delete(2)
+		tx.Insert(3, WithBalance("30"))
+		if err := tx.Rollback(); err != nil {
+			t.Errorf("Rollback(%+v) failed: %v", opts, err)
+		}
+		expectStored(t, s, map[storage.Key]string{1: "10", 2: "20"})
+	}
+	// Nothing of the rolled back transactions stands in the way of the
+	// next one.
+	seed(t, s, map[storage.Key]string{3: "3"})
+	expectStored(t, s, map[storage.Key]string{1: "10", 2: "20", 3: "3"})
+}
+
+// testDelete checks that Delete works on the value the transaction sees,
+// its own writes included, and fails with ErrKeyNotFound where there is
+// none.
+func testDelete(t *testing.T, s storage.Storage) {
+	seed(t, s, map[storage.Key]string{1: "10", 2: "20"})
+
+	tx := begin(t, s, storage.TxOptions{})
+	defer tx.Rollback()
+	if err := tx.Delete(1); err != nil {
+		t.Fatalf("Delete of a committed key failed: %v", err)
+	}
+	_, err := tx.Get(1)
+	expectError(t, "Get of a key deleted in the transaction", err, storage.ErrKeyNotFound)
+	expectError(t, "Second Delete of a key", tx.Delete(1), storage.ErrKeyNotFound)
+	tx.Set(3, WithBalance("30"))
+	if err := tx.Delete(3); err != nil {
+		t.Errorf("Delete of a key set in the transaction failed: %v", err)
+	}
+	_, err = tx.Get(3)
+	expectError(t, "Get of a key set and deleted in the transaction", err, storage.ErrKeyNotFound)
+	if err := tx.Delete(2); err != nil {
+		t.Fatalf("Delete of a committed key failed: %v", err)
+	}
+	if err := tx.Insert(2, WithBalance("21")); err != nil {
+		t.Errorf("Insert of a key deleted in the transaction failed: %v", err)
+	}
+	if keys := txKeys(t, tx); !slices.Equal(keys, []storage.Key{2}) {
+		t.Errorf("Expected the transaction to scan keys [2], got %v", keys)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	expectStored(t, s, map[storage.Key]string{2: "21"})
+}
+
+// testConditionalWrites checks Set, Insert and CompareAndSet against
+// committed values and the transaction's own writes.
+func testConditionalWrites(t *testing.T, s storage.Storage) {
+	seed(t, s, map[storage.Key]string{1: "10"})
+
+	tx := begin(t, s, storage.TxOptions{})
+	defer tx.Rollback()
+	expectError(t, "Insert of a committed key", tx.Insert(1, WithBalance("11")), storage.ErrKeyExists)
+	if err := tx.Insert(2, WithBalance("20")); err != nil {
+		t.Errorf("Insert of a new key failed: %v", err)
+	}
+	expectError(t, "Insert of a key inserted in the transaction", tx.Insert(2, WithBalance("21")), storage.ErrKeyExists)
+
+	current, err := tx.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectError(t, "CompareAndSet with a stale value", tx.CompareAndSet(1, WithBalance("9"), WithBalance("12")), storage.ErrCompareFailed)
+	expectError(t, "CompareAndSet of a missing key", tx.CompareAndSet(3, WithBalance("0"), WithBalance("30")), storage.ErrKeyNotFound)
+	if err := tx.CompareAndSet(1, current, WithBalance("12")); err != nil {
+		t.Errorf("CompareAndSet with the current value failed: %v", err)
+	}
+	written, err := tx.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.CompareAndSet(1, written, WithBalance("13")); err != nil {
+		t.Errorf("CompareAndSet against the transaction's own write failed: %v", err)
+	}
+	// Set creates a key or replaces its value, whichever applies.
+	if err := tx.Set(2, WithBalance("22")); err != nil {
+		t.Errorf("Set of an existing key failed: %v", err)
+	}
+	if err := tx.Set(4, WithBalance("40")); err != nil {
+		t.Errorf("Set of a new key failed: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	expectStored(t, s, map[storage.Key]string{1: "13", 2: "22", 4: "40"})
+}
+
+func testReadOnly(t *testing.T, s storage.Storage) {
+	seed(t, s, map[storage.Key]string{1: "10"})
+	tx := begin(t, s, storage.TxOptions{ReadOnly: true})
+	defer tx.Rollback()
+	value, err := tx.Get(1)
+	expectBalance(t, "Get in a read-only transaction", value, err, "10")
+	expectError(t, "Set in a read-only transaction", tx.Set(2, WithBalance("1")), storage.ErrReadOnly)
+	expectError(t, "Insert in a read-only transaction", tx.Insert(2, WithBalance("1")), storage.ErrReadOnly)
+	expectError(t, "CompareAndSet in a read-only transaction", tx.CompareAndSet(1, value, WithBalance("1")), storage.ErrReadOnly)
+	expectError(t, "Delete in a read-only transaction", tx.Delete(1), storage.ErrReadOnly)
+	if err := tx.Commit(); err != nil {
+		t.Errorf("Commit of a read-only transaction failed: %v", err)
+	}
+	expectStored(t, s, map[storage.Key]string{1: "10"})
+}
+
+func testInvalidInput(t *testing.T, s storage.Storage) {
+	for _, opts := range []storage.TxOptions{
+		{ReadOnly: true, Lock: storage.LockPessimistic},
+		{Isolation: storage.Serializable + 1},
+		{Lock: storage.LockPessimistic + 1},
+	} {
+		if _, err := s.Begin(context.Background(), opts); !errors.Is(err, storage.ErrUnsupportedTxOptions) {
+			t.Errorf("Expected ErrUnsupportedTxOptions from Begin(%+v), got %v", opts, err)
+		}
+	}
+
+	invalid := WithBalance("1")
+	invalid.Currency = "usd"
+	tx := begin(t, s, storage.TxOptions{})
+	defer tx.Rollback()
+	expectError(t, "Set of an invalid account", tx.Set(1, invalid), storage.ErrInvalidAccount)
+	expectError(t, "Insert of an invalid account", tx.Insert(1, invalid), storage.ErrInvalidAccount)
+	// A rejected write leaves the transaction usable.
+	if err := tx.Set(2, WithBalance("2")); err != nil {
+		t.Errorf("Set after a rejected write failed: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	expectStored(t, s, map[storage.Key]string{2: "2"})
+}
+
+// testWriteBatch checks that a batch applies all of its writes or none.
+func testWriteBatch(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	seed(t, s, map[storage.Key]string{1: "10", 2: "20"})
+
+	var batch storage.Batch
+	batch.Set(1, WithBalance("11"))
+	batch.Delete(3)
+	expectError(t, "WriteBatch deleting a missing key", s.WriteBatch(ctx, batch), storage.ErrKeyNotFound)
+	invalid := WithBalance("1")
+	invalid.Status = "lost"
+	batch = storage.Batch{}
+	batch.Set(1, WithBalance("11"))
+	batch.Set(4, invalid)
+	expectError(t, "WriteBatch of an invalid account", s.WriteBatch(ctx, batch), storage.ErrInvalidAccount)
+	expectStored(t, s, map[storage.Key]string{1: "10", 2: "20"})
+
+	batch = storage.Batch{}
+	batch.Set(1, WithBalance("11"))
+	batch.Delete(2)
+	batch.Set(3, WithBalance("30"))
+	if err := s.WriteBatch(ctx, batch); err != nil {
+		t.Fatalf("WriteBatch failed: %v", err)
+	}
+	expectStored(t, s, map[storage.Key]string{1: "11", 3: "30"})
+}
+
+// testCancellation checks that a transaction whose context is done
+// applies nothing.
+func testCancellation(t *testing.T, s storage.Storage) {
+	ctx, cancel := context.WithCancel(context.Background())
+	tx, err := s.Begin(ctx, storage.TxOptions{})
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	tx.Set(1, WithBalance("10"))
+	cancel()
+	if err := tx.Commit(); err == nil {
+		t.Error("Expected Commit to fail once the context is cancelled")
+	}
+	if _, err := s.Get(ctx, 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected Get with a cancelled context to fail with context.Canceled, got %v", err)
+	}
+	expectStored(t, s, map[storage.Key]string{})
+}
+
+// testLostUpdate checks that of two transactions that read a key and then
+// write it, the second to commit fails with ErrConflict, when it writes or
+// when it commits.
+func testLostUpdate(t *testing.T, s storage.Storage) {
+	seed(t, s, map[storage.Key]string{1: "10"})
+	first := begin(t, s, storage.TxOptions{})
+	defer first.Rollback()
+	second := begin(t, s, storage.TxOptions{})
+	defer second.Rollback()
+	if _, err := first.Get(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := second.Get(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Set(1, WithBalance("11")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := first.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	err := second.Set(1, WithBalance("12"))
+	if err == nil {
+		err = second.Commit()
+	}
+	expectError(t, "Second read-modify-write of a key", err, storage.ErrConflict)
+	expectStored(t, s, map[storage.Key]string{1: "11"})
+}
+
+// testReadSkew checks that a read-only serializable transaction that reads
+// one account before a transfer commits and the other after either sees
+// balances that add up or fails to commit with ErrConflict.
+func testReadSkew(t *testing.T, s storage.Storage) {
+	seed(t, s, map[storage.Key]string{1: "1000", 2: "0"})
+	tx := begin(t, s, storage.TxOptions{ReadOnly: true, Isolation: storage.Serializable})
+	defer tx.Rollback()
+	from, err := tx.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var batch storage.Batch
+	batch.Set(1, WithBalance("900"))
+	batch.Set(2, WithBalance("100"))
+	if err := s.WriteBatch(context.Background(), batch); err != nil {
+		t.Fatalf("WriteBatch failed: %v", err)
+	}
+	to, err := tx.Get(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		expectError(t, "Commit of a read-only transaction that saw a transfer halfway", err, storage.ErrConflict)
+		return
+	}
+	if total := from.Balance.Add(to.Balance); total.Cmp(WithBalance("1000").Balance) != 0 {
+		t.Errorf("Expected the balances read to add up to 1000, got %s + %s", from.Balance, to.Balance)
+	}
+}
+
+// testConcurrentCommits runs read-modify-write transactions from several
+// goroutines, retrying those that conflict, and checks that no update is
+// lost.
+func testConcurrentCommits(t *testing.T, s storage.Storage) {
+	const workers, increments = 8, 20
+	seed(t, s, map[storage.Key]string{1: "0"})
+	one := WithBalance("1").Balance
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for worker := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range increments {
+				for {
+					err := func() error {
+						tx, err := s.Begin(context.Background(), storage.TxOptions{})
+						if err != nil {
+							return err
+						}
+						defer tx.Rollback()
+						value, err := tx.Get(1)
+						if err != nil {
+							return err
+						}
+						value.Balance = value.Balance.Add(one)
+						if err := tx.Set(1, value); err != nil {
+							return err
+						}
+						// Each worker also writes a key of its own, which no
+						// other transaction touches.
+						if err := tx.Set(storage.Key(100+worker), value); err != nil {
+							return err
+						}
+						return tx.Commit()
+					}()
+					if errors.Is(err, storage.ErrConflict) {
+						continue
+					}
+					if err != nil {
+						errs <- err
+						return
+					}
+					break
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Transaction failed: %v", err)
+	}
+	value, err := s.Get(context.Background(), 1)
+	expectBalance(t, "Counter after the concurrent increments", value, err, "160")
+	if balances := stored(t, s); len(balances) != workers+1 {
+		t.Errorf("Expected %d keys, got %v", workers+1, balances)
+	}
+}
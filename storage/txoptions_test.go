@@ -0,0 +1,168 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"main/storage"
+	"main/storage/storagetest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTxOptions_ReadOnlyRejectsWrites(t *testing.T) {
+	for name, store := range scanBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			tx := begin(store)
+			tx.Set(1, storagetest.WithBalance("1"))
+			tx.Commit()
+
+			reader, err := store.Begin(context.Background(), storage.TxOptions{ReadOnly: true})
+			if err != nil {
+				t.Fatalf("Begin failed: %v", err)
+			}
+			defer reader.Rollback()
+			if _, err := reader.Get(1); err != nil {
+				t.Errorf("Expected a read-only transaction to read, got %v", err)
+			}
+			if err := reader.Set(2, storagetest.WithBalance("2")); !errors.Is(err, storage.ErrReadOnly) {
+				t.Errorf("Expected ErrReadOnly from Set, got %v", err)
+			}
+			if err := reader.Delete(1); !errors.Is(err, storage.ErrReadOnly) {
+				t.Errorf("Expected ErrReadOnly from Delete, got %v", err)
+			}
+		})
+	}
+}
+
+func TestTxOptions_InvalidOptionsAreRejected(t *testing.T) {
+	for name, store := range scanBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, opts := range []storage.TxOptions{
+				{ReadOnly: true, Lock: storage.LockPessimistic},
+				{Isolation: storage.Serializable + 1},
+			} {
+				if _, err := store.Begin(context.Background(), opts); !errors.Is(err, storage.ErrUnsupportedTxOptions) {
+					t.Errorf("Expected ErrUnsupportedTxOptions for %+v, got %v", opts, err)
+				}
+			}
+		})
+	}
+}
+
+func TestInMemoryStorage_IsolationLevels(t *testing.T) {
+	// Two transactions each read both keys and write a different one (write
+	// skew). Only serializable isolation rejects the second commit.
+	for level, expected := range map[storage.IsolationLevel]error{
+		storage.ReadCommitted: nil,
+		storage.Snapshot:      nil,
+		storage.Serializable:  storage.ErrConflict,
+	} {
+		t.Run(level.String(), func(t *testing.T) {
+			store := storage.NewInMemoryStorage()
+			tx := begin(store)
+			tx.Set(1, storagetest.WithBalance("1"))
+			tx.Set(2, storagetest.WithBalance("1"))
+			tx.Commit()
+
+			opts := storage.TxOptions{Isolation: level}
+			first, _ := store.Begin(context.Background(), opts)
+			second, _ := store.Begin(context.Background(), opts)
+			for _, tx := range []storage.StorageTransaction{first, second} {
+				tx.Get(1)
+				tx.Get(2)
+			}
+			first.Set(1, storagetest.WithBalance("0"))
+			second.Set(2, storagetest.WithBalance("0"))
+			if err := first.Commit(); err != nil {
+				t.Fatalf("First commit failed: %v", err)
+			}
+			if err := second.Commit(); !errors.Is(err, expected) {
+				t.Errorf("Expected %v from the second commit, got %v", expected, err)
+			}
+		})
+	}
+}
+
+func TestInMemoryStorage_ReadCommittedSeesLaterCommits(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	reader, _ := store.Begin(context.Background(), storage.TxOptions{Isolation: storage.ReadCommitted})
+	defer reader.Rollback()
+
+	tx := begin(store)
+	tx.Set(1, storagetest.WithBalance("5"))
+	tx.Commit()
+
+	if account, err := reader.Get(1); err != nil || account.Balance.String() != "5.0000000000000000000" {
+		t.Errorf("Expected read committed to see the later commit, got %+v (%v)", account, err)
+	}
+}
+
+func TestInMemoryStorage_PessimisticTransactionNeverConflicts(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	tx := begin(store)
+	tx.Set(1, storagetest.WithBalance("1"))
+	tx.Commit()
+
+	locked, _ := store.Begin(context.Background(), storage.TxOptions{Lock: storage.LockPessimistic})
+	committed := make(chan error)
+	go func() {
+		tx := begin(store)
+		tx.Get(1)
+		tx.Set(1, storagetest.WithBalance("3"))
+		committed <- tx.Commit()
+	}()
+	locked.Get(1)
+	locked.Set(1, storagetest.WithBalance("2"))
+	if err := locked.Commit(); err != nil {
+		t.Fatalf("Pessimistic commit failed: %v", err)
+	}
+	if err := <-committed; !errors.Is(err, storage.ErrConflict) && err != nil {
+		t.Fatalf("Unexpected error from the optimistic commit: %v", err)
+	}
+}
+
+func TestBitcaskStorage_RejectsSnapshotIsolation(t *testing.T) {
+	db := openBitcask(t, t.TempDir(), storage.BitcaskOptions{})
+	defer db.Close()
+	if _, err := db.Begin(context.Background(), storage.TxOptions{Isolation: storage.Snapshot}); !errors.Is(err, storage.ErrUnsupportedTxOptions) {
+		t.Errorf("Expected ErrUnsupportedTxOptions, got %v", err)
+	}
+}
+
+func TestBitcaskStorage_ScanConflictsWithInsertIntoRange(t *testing.T) {
+	db := openBitcask(t, t.TempDir(), storage.BitcaskOptions{})
+	defer db.Close()
+	auditor := begin(db)
+	auditor.Scan(storage.KeyRange{Start: 100, End: 200}, func(storage.Key, storage.Value) bool { return true })
+	auditor.Set(1, storagetest.WithBalance("0"))
+
+	writer := begin(db)
+	writer.Set(150, storagetest.WithBalance("10"))
+	writer.Commit()
+
+	if err := auditor.Commit(); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("Expected ErrConflict for an insert into the scanned range, got %v", err)
+	}
+}
+
+func TestSqliteStorage_PessimisticTransactionTakesWriteLock(t *testing.T) {
+	db := storage.NewSqliteStorage(filepath.Join(t.TempDir(), "store.db"))
+	if db == nil {
+		t.Fatal("Cannot open database")
+	}
+	defer db.Close()
+	opts := storage.TxOptions{Lock: storage.LockPessimistic}
+	locked, err := db.Begin(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	defer locked.Rollback()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if second, err := db.Begin(ctx, opts); err == nil {
+		second.Rollback()
+		t.Error("Expected a second pessimistic transaction to wait for the write lock")
+	}
+}
@@ -0,0 +1,457 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// SyncPolicy controls when the write-ahead log is fsynced.
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs before every commit returns. No acknowledged
+	// commit is ever lost.
+	SyncAlways SyncPolicy = iota
+	// SyncInterval fsyncs in the background every WALOptions.SyncInterval.
+	// A crash can lose the commits of the last interval.
+	SyncInterval
+	// SyncNever leaves flushing to the operating system.
+	SyncNever
+)
+
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch s {
+	case "always":
+		return SyncAlways, nil
+	case "interval":
+		return SyncInterval, nil
+	case "never":
+		return SyncNever, nil
+	}
+	return 0, fmt.Errorf("unknown wal sync policy %q: want 'always', 'interval' or 'never'", s)
+}
+
+type WALOptions struct {
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+	// SnapshotDir, when set, is where snapshots of the whole store are
+	// kept. Startup loads the newest one and replays only the log records
+	// written after it.
+	SnapshotDir string
+	// SnapshotInterval is how often a snapshot is taken in the background;
+	// zero disables periodic snapshots.
+	SnapshotInterval time.Duration
+	// Keyring, when set, encrypts the accounts in the log and in
+	// snapshots.
+	Keyring *Keyring
+}
+
+var ErrCorruptRecord = errors.New("corrupt log record")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// maxRecordSize guards against allocating a huge buffer for a frame whose
+// length field was damaged.
+const maxRecordSize = 64 << 20
+
+// ErrCommitTooLarge is returned when a commit would not fit in a single log
+// frame of at most maxRecordSize bytes, and so could not be read back.
+var ErrCommitTooLarge = errors.New("commit too large for the log")
+
+// mutation is one key change made by a committed transaction. A nil
+// transaction overlay entry becomes a mutation with deleted set.
+type mutation struct {
+	key     Key
+	value   Value
+	deleted bool
+}
+
+// walRecord is everything one commit changed. It is written to the log as
+// a single frame so that a commit is either replayed completely or not at
+// all:
+//
+//	frame   = length uint32 | crc32c(payload) uint32 | payload
+//	payload = ts uint64 | count uint32 | count * (key uint64 | deleted uint8 | len uint32 | value)
+//
+// where value is the serialized Account, encrypted if the log has a
+// Keyring, and empty for a deletion.
+type walRecord struct {
+	ts        uint64
+	mutations []mutation
+	// spans locates each mutation's serialized value within the frame. It
+	// is filled in by encode and by readRecord.
+	spans []valueSpan
+}
+
+type valueSpan struct {
+	offset int64
+	size   uint32
+}
+
+const frameHeaderSize = 8
+
+func (record *walRecord) encode(keyring *Keyring) []byte {
+	frame := make([]byte, frameHeaderSize, 64)
+	frame = binary.LittleEndian.AppendUint64(frame, record.ts)
+	frame = binary.LittleEndian.AppendUint32(frame, uint32(len(record.mutations)))
+	record.spans = record.spans[:0]
+	for _, m := range record.mutations {
+		frame = binary.LittleEndian.AppendUint64(frame, m.key)
+		var value []byte
+		if m.deleted {
+			frame = append(frame, 1)
+		} else {
+			frame = append(frame, 0)
+			value = keyring.encodeAccount(m.key, m.value)
+		}
+		frame = binary.LittleEndian.AppendUint32(frame, uint32(len(value)))
+		record.spans = append(record.spans, valueSpan{offset: int64(len(frame)), size: uint32(len(value))})
+		frame = append(frame, value...)
+	}
+	payload := frame[frameHeaderSize:]
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.Checksum(payload, crcTable))
+	return frame
+}
+
+// checkFrameSize fails with ErrCommitTooLarge if frame, made by encode,
+// would be rejected by readRecord.
+func checkFrameSize(frame []byte) error {
+	if size := len(frame) - frameHeaderSize; size > maxRecordSize {
+		return fmt.Errorf("%w: %d bytes, at most %d", ErrCommitTooLarge, size, maxRecordSize)
+	}
+	return nil
+}
+
+// readRecord reads the next frame. It returns io.EOF at a clean end of the
+// log, ErrCorruptRecord for a torn or damaged frame, and ErrDecrypt for an
+// intact frame that keyring cannot decrypt.
+func readRecord(r io.Reader, keyring *Keyring) (walRecord, int64, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return walRecord{}, 0, ErrCorruptRecord
+		}
+		return walRecord{}, 0, err
+	}
+	length := binary.LittleEndian.Uint32(header[0:4])
+	checksum := binary.LittleEndian.Uint32(header[4:8])
+	if length > maxRecordSize {
+		return walRecord{}, 0, ErrCorruptRecord
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return walRecord{}, 0, ErrCorruptRecord
+	}
+	if crc32.Checksum(payload, crcTable) != checksum {
+		return walRecord{}, 0, ErrCorruptRecord
+	}
+	record, err := decodeRecord(payload, keyring)
+	return record, int64(len(header)) + int64(length), err
+}
+
+func decodeRecord(payload []byte, keyring *Keyring) (walRecord, error) {
+	if len(payload) < 12 {
+		return walRecord{}, ErrCorruptRecord
+	}
+	record := walRecord{ts: binary.LittleEndian.Uint64(payload)}
+	count := binary.LittleEndian.Uint32(payload[8:])
+	pos := 12
+	for range count {
+		if len(payload)-pos < 13 {
+			return walRecord{}, ErrCorruptRecord
+		}
+		m := mutation{
+			key:     binary.LittleEndian.Uint64(payload[pos:]),
+			deleted: payload[pos+8] == 1,
+		}
+		length := int(binary.LittleEndian.Uint32(payload[pos+9:]))
+		pos += 13
+		if len(payload)-pos < length {
+			return walRecord{}, ErrCorruptRecord
+		}
+		if !m.deleted {
+			account, err := keyring.decodeAccount(m.key, payload[pos:pos+length])
+			if errors.Is(err, ErrDecrypt) {
+				return walRecord{}, err
+			}
+			if err != nil {
+				return walRecord{}, ErrCorruptRecord
+			}
+			m.value = account
+		}
+		record.spans = append(record.spans, valueSpan{offset: int64(frameHeaderSize + pos), size: uint32(length)})
+		pos += length
+		record.mutations = append(record.mutations, m)
+	}
+	if pos != len(payload) {
+		return walRecord{}, ErrCorruptRecord
+	}
+	return record, nil
+}
+
+// writeAheadLog appends one frame per committed transaction to a file.
+type writeAheadLog struct {
+	lock    sync.Mutex
+	path    string
+	file    *os.File
+	size    int64
+	options WALOptions
+	// failed is set when a write could not be undone; the log may then
+	// hold a partial frame and no further commits are accepted.
+	failed error
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// openWAL replays every valid record in path through apply and opens the
+// file for appending. A torn or corrupt tail, left behind by a crash in the
+// middle of a write, is truncated away. An error from apply aborts the
+// replay and leaves the file untouched, and so does a record that the
+// keyring cannot decrypt: it is intact, so the key file must be wrong.
+func openWAL(path string, options WALOptions, apply func(walRecord) error) (*writeAheadLog, error) {
+	if options.Sync == SyncInterval && options.SyncInterval <= 0 {
+		return nil, fmt.Errorf("wal sync interval must be positive, got %s", options.SyncInterval)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(file)
+	var size int64
+	var replayed int
+	for {
+		record, n, err := readRecord(reader, options.Keyring)
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, ErrDecrypt) {
+			file.Close()
+			return nil, fmt.Errorf("write-ahead log %s: %w", path, err)
+		}
+		if err != nil {
+			slog.Warn("Truncating write-ahead log at corrupt record", "file", path, "offset", size, "error", err)
+			break
+		}
+		if err := apply(record); err != nil {
+			file.Close()
+			return nil, err
+		}
+		size += n
+		replayed++
+	}
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(size, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	slog.Info("Replayed write-ahead log", "file", path, "records", replayed)
+
+	wal := &writeAheadLog{path: path, file: file, size: size, options: options}
+	if options.Sync == SyncInterval {
+		wal.stop = make(chan struct{})
+		wal.done = make(chan struct{})
+		go wal.syncLoop()
+	}
+	return wal, nil
+}
+
+func (wal *writeAheadLog) append(record walRecord) error {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	if wal.failed != nil {
+		return fmt.Errorf("write-ahead log unusable: %w", wal.failed)
+	}
+	frame := record.encode(wal.options.Keyring)
+	if err := checkFrameSize(frame); err != nil {
+		return err
+	}
+	if _, err := wal.file.Write(frame); err != nil {
+		// Drop whatever part of the frame made it to the file, so later
+		// records are not appended after a torn one.
+		if truncErr := wal.file.Truncate(wal.size); truncErr != nil {
+			wal.failed = truncErr
+		} else if _, seekErr := wal.file.Seek(wal.size, io.SeekStart); seekErr != nil {
+			wal.failed = seekErr
+		}
+		return err
+	}
+	wal.size += int64(len(frame))
+	if wal.options.Sync == SyncAlways {
+		if err := wal.file.Sync(); err != nil {
+			// The frame may or may not be durable; refuse to go on rather
+			// than acknowledge commits we cannot vouch for.
+			wal.failed = err
+			return err
+		}
+	}
+	return nil
+}
+
+// offset returns the size of the log, i.e. where the next record will go.
+func (wal *writeAheadLog) offset() int64 {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	return wal.size
+}
+
+// truncateFront drops the first offset bytes of the log. The remaining
+// records are copied to a new file that atomically replaces the log, so a
+// crash leaves either the old or the new file behind, never a mix.
+func (wal *writeAheadLog) truncateFront(offset int64) error {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	if offset == 0 {
+		return nil
+	}
+	if wal.failed != nil {
+		return wal.failed
+	}
+	tmp := wal.path + ".tmp"
+	next, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(next, io.NewSectionReader(wal.file, offset, wal.size-offset)); err != nil {
+		next.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := wal.replace(next, tmp); err != nil {
+		return err
+	}
+	wal.size -= offset
+	return nil
+}
+
+// replace syncs next, the temporary file tmp, and renames it over the log.
+// On failure tmp is removed and the log is left as it was.
+func (wal *writeAheadLog) replace(next *os.File, tmp string) error {
+	if err := next.Sync(); err != nil {
+		next.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, wal.path); err != nil {
+		next.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := syncDir(filepath.Dir(wal.path)); err != nil {
+		slog.Warn("Cannot sync write-ahead log directory", "error", err)
+	}
+	wal.file.Close()
+	wal.file = next
+	return nil
+}
+
+// reencrypt rewrites every record of the log with the current key of its
+// keyring, into a new file that atomically replaces the log, and returns
+// how many values it rewrote. Appends carry on while the records present
+// at the start are rewritten, and are only held up while those appended
+// meanwhile are. It must not run at the same time as truncateFront.
+func (wal *writeAheadLog) reencrypt() (int, error) {
+	tmp := wal.path + ".tmp"
+	next, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	w := bufio.NewWriter(next)
+	var size int64
+	values := 0
+	rewrite := func(from, to int64) error {
+		r := bufio.NewReader(io.NewSectionReader(wal.file, from, to-from))
+		for {
+			record, _, err := readRecord(r, wal.options.Keyring)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			frame := record.encode(wal.options.Keyring)
+			if err := checkFrameSize(frame); err != nil {
+				return err
+			}
+			if _, err := w.Write(frame); err != nil {
+				return err
+			}
+			size += int64(len(frame))
+			for _, m := range record.mutations {
+				if !m.deleted {
+					values++
+				}
+			}
+		}
+	}
+	fail := func(err error) (int, error) {
+		next.Close()
+		os.Remove(tmp)
+		return 0, err
+	}
+
+	end := wal.offset()
+	if err := rewrite(0, end); err != nil {
+		return fail(err)
+	}
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	if wal.failed != nil {
+		return fail(wal.failed)
+	}
+	if err := rewrite(end, wal.size); err != nil {
+		return fail(err)
+	}
+	if err := w.Flush(); err != nil {
+		return fail(err)
+	}
+	if err := wal.replace(next, tmp); err != nil {
+		return 0, err
+	}
+	wal.size = size
+	return values, nil
+}
+
+func (wal *writeAheadLog) syncLoop() {
+	defer close(wal.done)
+	ticker := time.NewTicker(wal.options.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-wal.stop:
+			return
+		case <-ticker.C:
+			wal.lock.Lock()
+			if err := wal.file.Sync(); err != nil {
+				slog.Error("Cannot sync write-ahead log", "error", err)
+			}
+			wal.lock.Unlock()
+		}
+	}
+}
+
+func (wal *writeAheadLog) Close() error {
+	if wal.stop != nil {
+		close(wal.stop)
+		<-wal.done
+	}
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	if err := wal.file.Sync(); err != nil {
+		wal.file.Close()
+		return err
+	}
+	return wal.file.Close()
+}
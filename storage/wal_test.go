@@ -0,0 +1,205 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"main/storage"
+	"main/storage/storagetest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func openDurable(t *testing.T, path string) *storage.InMemoryStorage {
+	t.Helper()
+	store, err := storage.NewInMemoryStorageWithWAL(path, storage.WALOptions{Sync: storage.SyncAlways})
+	if err != nil {
+		t.Fatalf("Cannot open storage with WAL: %v", err)
+	}
+	return store
+}
+
+func TestInMemoryStorage_WALReplaysCommits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.wal")
+	store := openDurable(t, path)
+	tx := begin(store)
+	tx.Set(1, storagetest.WithBalance("100"))
+	tx.Set(2, storagetest.WithBalance("50"))
+	tx.Commit()
+	tx = begin(store)
+	tx.Set(1, storagetest.WithBalance("75"))
+	tx.Delete(2)
+	tx.Commit()
+	tx = begin(store)
+	tx.Set(3, storagetest.WithBalance("1"))
+	tx.Rollback()
+	store.Close()
+
+	store = openDurable(t, path)
+	defer store.Close()
+	if balance, _ := store.Get(context.Background(), 1); balance.Balance.String() != "75.0000000000000000000" {
+		t.Errorf("Expected 75 after replay, got %q", balance.Balance)
+	}
+	for _, key := range []storage.Key{2, 3} {
+		if _, err := store.Get(context.Background(), key); !errors.Is(err, storage.ErrKeyNotFound) {
+			t.Errorf("Expected key %d to be absent after replay, got %v", key, err)
+		}
+	}
+
+	tx = begin(store)
+	tx.Get(1)
+	tx.Set(1, storagetest.WithBalance("80"))
+	if err := tx.Commit(); err != nil {
+		t.Errorf("Commit after replay failed: %v", err)
+	}
+}
+
+func TestInMemoryStorage_WALDropsTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.wal")
+	store := openDurable(t, path)
+	tx := begin(store)
+	tx.Set(1, storagetest.WithBalance("100"))
+	tx.Commit()
+	tx = begin(store)
+	tx.Set(1, storagetest.WithBalance("200"))
+	tx.Commit()
+	store.Close()
+
+	// Simulate a crash in the middle of writing the second commit.
+	info, _ := os.Stat(path)
+	os.Truncate(path, info.Size()-3)
+
+	store = openDurable(t, path)
+	if balance, _ := store.Get(context.Background(), 1); balance.Balance.String() != "100.0000000000000000000" {
+		t.Errorf("Expected only the first commit to survive, got %q", balance.Balance)
+	}
+	tx = begin(store)
+	tx.Set(2, storagetest.WithBalance("5"))
+	tx.Commit()
+	store.Close()
+
+	store = openDurable(t, path)
+	defer store.Close()
+	if balance, _ := store.Get(context.Background(), 2); balance.Balance.String() != "5.0000000000000000000" {
+		t.Errorf("Expected commit after truncation to be replayed, got %q", balance.Balance)
+	}
+}
+
+func TestInMemoryStorage_WALRejectsCorruptRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.wal")
+	store := openDurable(t, path)
+	tx := begin(store)
+	tx.Set(1, storagetest.WithBalance("100"))
+	tx.Commit()
+	store.Close()
+
+	data, _ := os.ReadFile(path)
+	data[len(data)-1] ^= 0xff
+	os.WriteFile(path, data, 0o644)
+
+	store = openDurable(t, path)
+	defer store.Close()
+	if _, err := store.Get(context.Background(), 1); !errors.Is(err, storage.ErrKeyNotFound) {
+		t.Errorf("Expected record with bad checksum to be ignored, got %v", err)
+	}
+}
+
+func TestInMemoryStorage_SnapshotCompactsWAL(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "store.wal")
+	options := storage.WALOptions{Sync: storage.SyncAlways, SnapshotDir: filepath.Join(dir, "snapshots")}
+	store, err := storage.NewInMemoryStorageWithWAL(path, options)
+	if err != nil {
+		t.Fatalf("Cannot open storage: %v", err)
+	}
+	for key := range storage.Key(100) {
+		tx := begin(store)
+		tx.Set(key, storagetest.WithBalance("10"))
+		tx.Commit()
+	}
+	before, _ := os.Stat(path)
+	if err := store.Snapshot(); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	after, _ := os.Stat(path)
+	if after.Size() != 0 {
+		t.Errorf("Expected the log to be empty after a snapshot, it shrank from %d to %d bytes", before.Size(), after.Size())
+	}
+	tx := begin(store)
+	tx.Set(1, storagetest.WithBalance("20"))
+	tx.Delete(2)
+	tx.Commit()
+	store.Close()
+
+	store, err = storage.NewInMemoryStorageWithWAL(path, options)
+	if err != nil {
+		t.Fatalf("Cannot reopen storage: %v", err)
+	}
+	defer store.Close()
+	if balance, _ := store.Get(context.Background(), 1); balance.Balance.String() != "20.0000000000000000000" {
+		t.Errorf("Expected log tail to be replayed over the snapshot, got %q", balance.Balance)
+	}
+	if _, err := store.Get(context.Background(), 2); !errors.Is(err, storage.ErrKeyNotFound) {
+		t.Errorf("Expected deleted key to stay deleted, got %v", err)
+	}
+	if balance, _ := store.Get(context.Background(), 99); balance.Balance.String() != "10.0000000000000000000" {
+		t.Errorf("Expected key from the snapshot, got %q", balance.Balance)
+	}
+}
+
+func TestInMemoryStorage_RefusesLogWithMissingRecords(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "store.wal")
+	options := storage.WALOptions{Sync: storage.SyncAlways, SnapshotDir: filepath.Join(dir, "snapshots")}
+	store, _ := storage.NewInMemoryStorageWithWAL(path, options)
+	tx := begin(store)
+	tx.Set(1, storagetest.WithBalance("10"))
+	tx.Commit()
+	store.Snapshot()
+	tx = begin(store)
+	tx.Set(1, storagetest.WithBalance("20"))
+	tx.Commit()
+	store.Close()
+
+	// Without the snapshot the compacted log no longer starts at the
+	// first commit.
+	os.RemoveAll(options.SnapshotDir)
+	if _, err := storage.NewInMemoryStorageWithWAL(path, options); err == nil {
+		t.Errorf("Expected an error for a log with missing records")
+	}
+}
+
+func TestInMemoryStorage_SnapshotDoesNotStopCommits(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "store.wal")
+	options := storage.WALOptions{Sync: storage.SyncNever, SnapshotDir: filepath.Join(dir, "snapshots")}
+	store, _ := storage.NewInMemoryStorageWithWAL(path, options)
+
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		for key := range storage.Key(500) {
+			tx := begin(store)
+			tx.Set(key, storagetest.WithBalance("1"))
+			tx.Commit()
+		}
+	})
+	for range 10 {
+		if err := store.Snapshot(); err != nil {
+			t.Errorf("Snapshot failed: %v", err)
+		}
+	}
+	wg.Wait()
+	store.Close()
+
+	store, err := storage.NewInMemoryStorageWithWAL(path, options)
+	if err != nil {
+		t.Fatalf("Cannot reopen storage: %v", err)
+	}
+	defer store.Close()
+	for key := range storage.Key(500) {
+		if _, err := store.Get(context.Background(), key); err != nil {
+			t.Fatalf("Key %d lost across snapshots: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+// Package twopc commits transactions that span several storage backends
+// atomically with the two-phase commit protocol. Each backend has a
+// Participant, which prepares its part of a transaction in a storage
+// transaction of its own and keeps it open; the Coordinator commits the
+// transaction everywhere once every participant has prepared, and aborts
+// it everywhere otherwise. Both keep journals, so that transactions left
+// in doubt by a crash are finished by Coordinator.Recover.
+package twopc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"main/storage"
+	"sync"
+)
+
+// ErrInDoubt is returned when a transaction was decided to commit but a
+// participant failed to commit its part. The transaction counts as
+// committed: Recover applies the missing part.
+var ErrInDoubt = errors.New("transaction committed but not yet applied everywhere")
+
+// Branch is the part of a transaction that falls on one participant.
+type Branch struct {
+	Participant *Participant
+	Reads       []Read
+	MustExist   []storage.Key
+	Writes      []Write
+}
+
+// Coordinator decides the outcome of transactions. Its decision to commit
+// is synced to its journal before any participant commits; a transaction
+// without one was never committed anywhere, so presumed aborted.
+type Coordinator struct {
+	journal *journal
+
+	lock sync.Mutex
+	// committed are the transactions decided to commit that some
+	// participant may not have applied yet.
+	committed map[string]struct{}
+}
+
+// Options configure a Coordinator or a Participant.
+type Options struct {
+	// Keyring, if set, encrypts the journal, which holds the accounts a
+	// transaction writes.
+	Keyring *storage.Keyring
+}
+
+// NewCoordinator returns a coordinator that records its decisions in the
+// journal at path, or nowhere if path is empty.
+func NewCoordinator(path string) (*Coordinator, error) {
+	return NewCoordinatorWithOptions(path, Options{})
+}
+
+// NewCoordinatorWithOptions is NewCoordinator with options.
+func NewCoordinatorWithOptions(path string, options Options) (*Coordinator, error) {
+	c := &Coordinator{committed: make(map[string]struct{})}
+	if path == "" {
+		return c, nil
+	}
+	j, records, err := openJournal(path, options.Keyring)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		switch r.Type {
+		case recordCommit:
+			c.committed[r.ID] = struct{}{}
+		case recordEnd:
+			delete(c.committed, r.ID)
+		}
+	}
+	c.journal = j
+	if err := c.compact(); err != nil {
+		j.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// compact rewrites the journal with the decisions still needed.
+func (c *Coordinator) compact() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	pending := make([]record, 0, len(c.committed))
+	for id := range c.committed {
+		pending = append(pending, record{Type: recordCommit, ID: id})
+	}
+	return c.journal.rewrite(pending)
+}
+
+func (c *Coordinator) Close() error {
+	return c.journal.Close()
+}
+
+// Reencrypt rewrites the journal with the current key of Options.Keyring,
+// after the keyring was rotated, and returns how many records it rewrote.
+func (c *Coordinator) Reencrypt() (int, error) {
+	return c.journal.reencrypt()
+}
+
+func newID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// Run commits a transaction made of branches. In the first phase, every
+// participant prepares its branch; if any refuses, the prepared ones are
+// aborted and Run returns its error. Otherwise the coordinator records its
+// decision to commit, which is the moment the transaction commits, and in
+// the second phase every participant commits its branch. The participants
+// must be prepared in the same order by every caller, such as the order of
+// their backends, so that their locks cannot deadlock.
+func (c *Coordinator) Run(ctx context.Context, branches []Branch) error {
+	id := newID()
+	prepared := make([]*Participant, 0, len(branches))
+	abort := func() {
+		for _, p := range prepared {
+			p.Abort(id)
+		}
+	}
+	for _, b := range branches {
+		if err := b.Participant.Prepare(ctx, id, b.Reads, b.MustExist, b.Writes); err != nil {
+			abort()
+			return err
+		}
+		prepared = append(prepared, b.Participant)
+	}
+
+	c.lock.Lock()
+	err := c.journal.append(record{Type: recordCommit, ID: id}, true)
+	if err == nil {
+		c.committed[id] = struct{}{}
+	}
+	c.lock.Unlock()
+	if err != nil {
+		abort()
+		return fmt.Errorf("cannot record commit decision: %w", err)
+	}
+
+	var errs []error
+	for _, p := range prepared {
+		if err := p.Commit(id); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: %w", ErrInDoubt, errors.Join(errs...))
+	}
+	c.end(id)
+	return nil
+}
+
+// end forgets the decision on transaction id, which every participant has
+// applied.
+func (c *Coordinator) end(id string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.committed, id)
+	// Not synced: every participant synced its done record before, so if
+	// this is lost, Recover finds nothing left to do.
+	c.journal.append(record{Type: recordEnd, ID: id}, false)
+}
+
+// Recover resolves every in-doubt transaction of participants: those the
+// coordinator decided to commit are committed, and the others aborted. It
+// must be given every participant the coordinator has run transactions on,
+// before they serve new transactions.
+func (c *Coordinator) Recover(ctx context.Context, participants []*Participant) error {
+	for _, p := range participants {
+		for _, id := range p.InDoubt() {
+			c.lock.Lock()
+			_, commit := c.committed[id]
+			c.lock.Unlock()
+			if err := p.Resolve(ctx, id, commit); err != nil {
+				return fmt.Errorf("cannot resolve transaction %s: %w", id, err)
+			}
+			slog.Info("Resolved in-doubt transaction", "id", id, "commit", commit)
+		}
+	}
+	c.lock.Lock()
+	clear(c.committed)
+	c.lock.Unlock()
+	return c.compact()
+}
@@ -0,0 +1,205 @@
+package twopc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"main/storage"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Read is a value a transaction based its writes on. A nil Account with
+// Exists set means the key had a value the transaction did not look at.
+type Read struct {
+	Key     storage.Key      `json:"key"`
+	Account *storage.Account `json:"account,omitempty"`
+	Exists  bool             `json:"exists"`
+}
+
+// Write is the new value of a key, or nil for a delete.
+type Write struct {
+	Key     storage.Key      `json:"key"`
+	Account *storage.Account `json:"account,omitempty"`
+}
+
+// Record types of the journals.
+const (
+	// recordPrepare is written by a participant before it votes to commit,
+	// with the writes and the values they replace.
+	recordPrepare = "prepare"
+	// recordDone is written by a participant once it has committed or
+	// aborted a prepared transaction.
+	recordDone = "done"
+	// recordCommit is the coordinator's decision to commit. A transaction
+	// without one is aborted.
+	recordCommit = "commit"
+	// recordEnd is written by the coordinator once every participant has
+	// committed.
+	recordEnd = "end"
+)
+
+type record struct {
+	Type   string  `json:"type"`
+	ID     string  `json:"id"`
+	Before []Write `json:"before,omitempty"`
+	Writes []Write `json:"writes,omitempty"`
+}
+
+// journal is an append-only file of records, one JSON object per line,
+// each encrypted with keyring if it is not nil. A nil journal keeps
+// nothing.
+type journal struct {
+	path    string
+	keyring *storage.Keyring
+
+	// lock guards file, which rewrite and reencrypt replace.
+	lock sync.Mutex
+	file *os.File
+}
+
+// openJournal opens the journal at path, creating it if needed, and
+// returns its records. A torn last line, left by a crash mid-write, is
+// dropped: it was never synced, so nothing relied on it. A line that
+// keyring cannot decrypt fails with storage.ErrDecrypt instead.
+func openJournal(path string, keyring *storage.Keyring) (*journal, []record, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+	j := &journal{path: path, keyring: keyring, file: file}
+	records, err := j.read()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return j, records, nil
+}
+
+// read returns the records of the journal file. Callers must hold lock,
+// or not have shared the journal yet.
+func (j *journal) read() ([]record, error) {
+	var records []record
+	reader := bufio.NewReader(io.NewSectionReader(j.file, 0, math.MaxInt64))
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := j.keyring.Open(0, bytes.TrimSuffix(line, []byte("\n")))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", j.path, err)
+		}
+		var r record
+		if err := json.Unmarshal(data, &r); err != nil {
+			return records, nil
+		}
+		records = append(records, r)
+	}
+}
+
+// encode returns the line of r.
+func (j *journal) encode(r record) []byte {
+	data, _ := json.Marshal(r)
+	return append(j.keyring.Seal(0, data), '\n')
+}
+
+// append adds r to the journal, and syncs it to disk if sync is set.
+func (j *journal) append(r record, sync bool) error {
+	if j == nil {
+		return nil
+	}
+	line := j.encode(r)
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if _, err := j.file.Write(line); err != nil {
+		return err
+	}
+	if sync {
+		return j.file.Sync()
+	}
+	return nil
+}
+
+// rewrite replaces the contents of the journal with records.
+func (j *journal) rewrite(records []record) error {
+	if j == nil {
+		return nil
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.replace(records)
+}
+
+// reencrypt rewrites the records of the journal with the current key of
+// its keyring, and returns how many there are.
+func (j *journal) reencrypt() (int, error) {
+	if j == nil {
+		return 0, nil
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	records, err := j.read()
+	if err != nil {
+		return 0, err
+	}
+	return len(records), j.replace(records)
+}
+
+// replace writes records to a new file that is synced and then renamed
+// over the journal, so a crash leaves either the old or the new journal
+// behind, never a mix. On failure the journal is left as it was. Callers
+// must hold lock.
+func (j *journal) replace(records []record) error {
+	tmp := j.path + ".tmp"
+	next, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(next)
+	for _, r := range records {
+		w.Write(j.encode(r))
+	}
+	err = w.Flush()
+	if err == nil {
+		err = next.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, j.path)
+	}
+	if err != nil {
+		next.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := syncDir(filepath.Dir(j.path)); err != nil {
+		slog.Warn("Cannot sync two-phase commit journal directory", "error", err)
+	}
+	j.file.Close()
+	j.file = next
+	return nil
+}
+
+func (j *journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	return j.file.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,367 @@
+package twopc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"main/storage"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// MarkerKey is where a participant records, in its backend, the
+// transactions it has committed there: an account whose Owner lists their
+// IDs. The marker is written in the same storage transaction as the writes
+// of each transaction, so it tells Resolve for certain whether those were
+// applied. IDs leave the list once the participant's journal says the
+// transaction is done. A Storage that hands its backends to participants
+// must keep accounts off this key and hide it from its readers.
+const MarkerKey storage.Key = 1<<63 - 1
+
+// Participant runs the part of distributed transactions that falls on one
+// backend. Prepare applies the part in a pessimistic storage transaction
+// and leaves it open, holding the backend's write lock, until the
+// coordinator decides to Commit or Abort it.
+type Participant struct {
+	storage storage.Storage
+	journal *journal
+
+	lock     sync.Mutex
+	prepared map[string]*branch
+	// inDoubt are the transactions prepared before a restart and not yet
+	// resolved, by ID.
+	inDoubt map[string]record
+	// settled are the transactions in the marker whose done record is
+	// synced, so the next marker written can leave them out.
+	settled map[string]struct{}
+}
+
+// branch is a prepared transaction.
+type branch struct {
+	tx     storage.StorageTransaction
+	record record
+	// settled are the IDs it leaves out of the marker.
+	settled []string
+}
+
+// NewParticipant returns a participant for backend that records prepared
+// transactions in the journal at path, or nowhere if path is empty. Those
+// left undecided by a crash are resolved by Coordinator.Recover.
+func NewParticipant(backend storage.Storage, path string) (*Participant, error) {
+	return NewParticipantWithOptions(backend, path, Options{})
+}
+
+// NewParticipantWithOptions is NewParticipant with options.
+func NewParticipantWithOptions(backend storage.Storage, path string, options Options) (*Participant, error) {
+	p := &Participant{
+		storage:  backend,
+		prepared: make(map[string]*branch),
+		inDoubt:  make(map[string]record),
+		settled:  make(map[string]struct{}),
+	}
+	if path == "" {
+		return p, nil
+	}
+	j, records, err := openJournal(path, options.Keyring)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		switch r.Type {
+		case recordPrepare:
+			p.inDoubt[r.ID] = r
+		case recordDone:
+			delete(p.inDoubt, r.ID)
+		}
+	}
+	pending := make([]record, 0, len(p.inDoubt))
+	for _, r := range p.inDoubt {
+		pending = append(pending, r)
+	}
+	if err := j.rewrite(pending); err != nil {
+		j.Close()
+		return nil, err
+	}
+	// Every transaction in the marker that is not in doubt had its done
+	// record synced before the journal forgot it.
+	marker, err := backend.Get(context.Background(), MarkerKey)
+	if err != nil && !errors.Is(err, storage.ErrKeyNotFound) {
+		j.Close()
+		return nil, fmt.Errorf("cannot read transaction marker: %w", err)
+	}
+	for _, id := range strings.Fields(marker.Owner) {
+		if _, ok := p.inDoubt[id]; !ok {
+			p.settled[id] = struct{}{}
+		}
+	}
+	p.journal = j
+	return p, nil
+}
+
+// Close closes the journal. Transactions still prepared are left in doubt.
+func (p *Participant) Close() error {
+	return p.journal.Close()
+}
+
+// Reencrypt rewrites the journal with the current key of Options.Keyring,
+// after the keyring was rotated, and returns how many records it rewrote.
+func (p *Participant) Reencrypt() (int, error) {
+	return p.journal.reencrypt()
+}
+
+// Prepare applies the writes of transaction id in a pessimistic transaction
+// without committing it, provided that reads still hold and the keys in
+// mustExist have values, and records them in the journal. It fails with
+// ErrConflict if a read has changed, or ErrKeyNotFound if a key in
+// mustExist has no value; the transaction is then rolled back, and the
+// participant votes to abort. Once Prepare succeeds, the participant can
+// no longer refuse to commit.
+func (p *Participant) Prepare(ctx context.Context, id string, reads []Read, mustExist []storage.Key, writes []Write) (err error) {
+	// The prepared transaction must outlive the request that started it:
+	// only the coordinator's decision may end it.
+	tx, err := p.storage.Begin(context.WithoutCancel(ctx), storage.TxOptions{Lock: storage.LockPessimistic})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for _, r := range reads {
+		current, err := tx.Get(r.Key)
+		if err != nil && !errors.Is(err, storage.ErrKeyNotFound) {
+			return err
+		}
+		found := err == nil
+		if found != r.Exists || found && r.Account != nil && !current.Equal(*r.Account) {
+			return fmt.Errorf("%w: key %d changed", storage.ErrConflict, r.Key)
+		}
+	}
+	for _, key := range mustExist {
+		if _, err := tx.Get(key); err != nil {
+			return fmt.Errorf("key %d: %w", key, err)
+		}
+	}
+	before, err := apply(tx, writes)
+	if err != nil {
+		return err
+	}
+	settled, err := p.mark(tx, id)
+	if err != nil {
+		return err
+	}
+	r := record{Type: recordPrepare, ID: id, Before: before, Writes: writes}
+	if err := p.journal.append(r, true); err != nil {
+		return fmt.Errorf("cannot record prepared transaction: %w", err)
+	}
+	p.lock.Lock()
+	p.prepared[id] = &branch{tx: tx, record: r, settled: settled}
+	p.lock.Unlock()
+	return nil
+}
+
+// mark adds transaction id to the marker in tx, and drops the settled
+// transactions from it, which it returns.
+func (p *Participant) mark(tx storage.StorageTransaction, id string) ([]string, error) {
+	marker, err := tx.Get(MarkerKey)
+	if err != nil && !errors.Is(err, storage.ErrKeyNotFound) {
+		return nil, fmt.Errorf("cannot read transaction marker: %w", err)
+	}
+	var kept, settled []string
+	p.lock.Lock()
+	for _, other := range strings.Fields(marker.Owner) {
+		if _, ok := p.settled[other]; ok {
+			settled = append(settled, other)
+		} else {
+			kept = append(kept, other)
+		}
+	}
+	p.lock.Unlock()
+	marker.Owner = strings.Join(append(kept, id), " ")
+	if err := tx.Set(MarkerKey, marker); err != nil {
+		return nil, fmt.Errorf("cannot write transaction marker: %w", err)
+	}
+	return settled, nil
+}
+
+// inMarker reports whether the backend has applied transaction id.
+func (p *Participant) inMarker(tx storage.StorageTransaction, id string) (bool, error) {
+	marker, err := tx.Get(MarkerKey)
+	if errors.Is(err, storage.ErrKeyNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("cannot read transaction marker: %w", err)
+	}
+	return slices.Contains(strings.Fields(marker.Owner), id), nil
+}
+
+// apply writes writes in tx, and returns the values they replace.
+func apply(tx storage.StorageTransaction, writes []Write) ([]Write, error) {
+	before := make([]Write, len(writes))
+	for i, w := range writes {
+		before[i].Key = w.Key
+		current, err := tx.Get(w.Key)
+		if err == nil {
+			before[i].Account = &current
+		} else if !errors.Is(err, storage.ErrKeyNotFound) {
+			return nil, err
+		}
+		switch {
+		case w.Account != nil:
+			err = tx.Set(w.Key, *w.Account)
+		case before[i].Account != nil:
+			err = tx.Delete(w.Key)
+		default:
+			// Deleting a key that has no value leaves nothing to do.
+			err = nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", w.Key, err)
+		}
+	}
+	return before, nil
+}
+
+// take removes the prepared transaction id.
+func (p *Participant) take(id string) (*branch, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	b, ok := p.prepared[id]
+	if !ok {
+		return nil, fmt.Errorf("transaction %s is not prepared", id)
+	}
+	delete(p.prepared, id)
+	return b, nil
+}
+
+// Commit commits the prepared transaction id. If the backend fails to
+// commit it, it stays in doubt until Coordinator.Recover.
+func (p *Participant) Commit(id string) error {
+	b, err := p.take(id)
+	if err != nil {
+		return err
+	}
+	if err := b.tx.Commit(); err != nil {
+		p.lock.Lock()
+		p.inDoubt[id] = b.record
+		p.lock.Unlock()
+		return err
+	}
+	p.forget(b.settled)
+	return p.committed(id)
+}
+
+// Abort rolls back the prepared transaction id.
+func (p *Participant) Abort(id string) error {
+	b, err := p.take(id)
+	if err != nil {
+		return err
+	}
+	b.tx.Rollback()
+	return p.done(id)
+}
+
+// done records that transaction id is resolved. It is synced before the
+// coordinator forgets its decision, so that Recover never resolves the
+// transaction again.
+func (p *Participant) done(id string) error {
+	return p.journal.append(record{Type: recordDone, ID: id}, true)
+}
+
+// committed records that transaction id, which the backend has applied,
+// is resolved, and lets the next marker leave it out.
+func (p *Participant) committed(id string) error {
+	if err := p.done(id); err != nil {
+		return err
+	}
+	p.lock.Lock()
+	p.settled[id] = struct{}{}
+	p.lock.Unlock()
+	return nil
+}
+
+// forget drops the settled transactions that a committed marker left out.
+func (p *Participant) forget(settled []string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, id := range settled {
+		delete(p.settled, id)
+	}
+}
+
+// InDoubt returns the IDs of the transactions that were prepared but not
+// resolved before the participant restarted, or whose commit failed.
+func (p *Participant) InDoubt() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	ids := make([]string, 0, len(p.inDoubt))
+	for id := range p.inDoubt {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Resolve finishes the in-doubt transaction id as the coordinator decided.
+// To commit, it first checks the marker: if the backend has applied the
+// transaction, there is nothing left to do. Otherwise it applies each
+// write whose key still holds the value the write replaced, along with
+// the marker; a key holding anything else was written by a later
+// transaction, after this one failed to commit.
+func (p *Participant) Resolve(ctx context.Context, id string, commit bool) error {
+	p.lock.Lock()
+	r, ok := p.inDoubt[id]
+	p.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	if !commit {
+		p.lock.Lock()
+		delete(p.inDoubt, id)
+		p.lock.Unlock()
+		return p.done(id)
+	}
+	tx, err := p.storage.Begin(ctx, storage.TxOptions{Lock: storage.LockPessimistic})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	applied, err := p.inMarker(tx, id)
+	if err != nil {
+		return err
+	}
+	if !applied {
+		var pending []Write
+		for i, w := range r.Writes {
+			current, err := tx.Get(w.Key)
+			if err != nil && !errors.Is(err, storage.ErrKeyNotFound) {
+				return err
+			}
+			found := err == nil
+			before := r.Before[i].Account
+			if found == (before != nil) && (!found || current.Equal(*before)) {
+				pending = append(pending, w)
+			}
+		}
+		if _, err := apply(tx, pending); err != nil {
+			return err
+		}
+		settled, err := p.mark(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		p.forget(settled)
+	}
+	p.lock.Lock()
+	delete(p.inDoubt, id)
+	p.lock.Unlock()
+	return p.committed(id)
+}
@@ -0,0 +1,321 @@
+package twopc_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"main/storage"
+	"main/storage/storagetest"
+	"main/twopc"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// ptr returns a pointer to a copy of v, for the pointer fields of a Write.
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// crashable is a backend whose open transactions can be lost, as on a
+// crash, and whose commits can be made to fail.
+type crashable struct {
+	storage.Storage
+
+	lock       sync.Mutex
+	open       map[*crashableTransaction]struct{}
+	failCommit bool
+}
+
+type crashableTransaction struct {
+	storage.StorageTransaction
+	backend *crashable
+}
+
+func newCrashable() *crashable {
+	return &crashable{Storage: storage.NewInMemoryStorage(), open: make(map[*crashableTransaction]struct{})}
+}
+
+func (c *crashable) Begin(ctx context.Context, opts storage.TxOptions) (storage.StorageTransaction, error) {
+	tx, err := c.Storage.Begin(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	wrapped := &crashableTransaction{StorageTransaction: tx, backend: c}
+	c.lock.Lock()
+	c.open[wrapped] = struct{}{}
+	c.lock.Unlock()
+	return wrapped, nil
+}
+
+// crash rolls back every open transaction.
+func (c *crashable) crash() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for tx := range c.open {
+		tx.StorageTransaction.Rollback()
+	}
+	clear(c.open)
+}
+
+func (tx *crashableTransaction) end() bool {
+	tx.backend.lock.Lock()
+	defer tx.backend.lock.Unlock()
+	_, open := tx.backend.open[tx]
+	delete(tx.backend.open, tx)
+	return open
+}
+
+func (tx *crashableTransaction) Commit() error {
+	if !tx.end() {
+		return errors.New("transaction lost")
+	}
+	tx.backend.lock.Lock()
+	fail := tx.backend.failCommit
+	tx.backend.lock.Unlock()
+	if fail {
+		tx.StorageTransaction.Rollback()
+		return errors.New("commit failed")
+	}
+	return tx.StorageTransaction.Commit()
+}
+
+func (tx *crashableTransaction) Rollback() error {
+	if !tx.end() {
+		return nil
+	}
+	return tx.StorageTransaction.Rollback()
+}
+
+func expectBalance(t *testing.T, s storage.Storage, key storage.Key, balance string) {
+	t.Helper()
+	account, err := s.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Expected key %d to hold %s, got %v", key, balance, err)
+	}
+	if account.Balance.Cmp(storagetest.WithBalance(balance).Balance) != 0 {
+		t.Errorf("Expected key %d to hold %s, got %s", key, balance, account.Balance)
+	}
+}
+
+// setUp stores key with balance in each backend.
+func setUp(t *testing.T, balance string, backends map[storage.Key]storage.Storage) {
+	t.Helper()
+	for key, backend := range backends {
+		var batch storage.Batch
+		batch.Set(key, storagetest.WithBalance(balance))
+		if err := backend.WriteBatch(context.Background(), batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCoordinator_RefusedPrepareAbortsEveryBranch(t *testing.T) {
+	ctx := context.Background()
+	a, b := storage.NewInMemoryStorage(), storage.NewInMemoryStorage()
+	setUp(t, "10", map[storage.Key]storage.Storage{1: a, 2: b})
+	pa, _ := twopc.NewParticipant(a, "")
+	pb, _ := twopc.NewParticipant(b, "")
+	c, _ := twopc.NewCoordinator("")
+
+	err := c.Run(ctx, []twopc.Branch{
+		{Participant: pa, Writes: []twopc.Write{{Key: 1, Account: ptr(storagetest.WithBalance("5"))}}},
+		// The destination no longer holds what the transaction read.
+		{Participant: pb, Reads: []twopc.Read{{Key: 2, Account: ptr(storagetest.WithBalance("7")), Exists: true}}, Writes: []twopc.Write{{Key: 2, Account: ptr(storagetest.WithBalance("12"))}}},
+	})
+	if !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("Expected ErrConflict, got %v", err)
+	}
+	expectBalance(t, a, 1, "10")
+	expectBalance(t, b, 2, "10")
+
+	// The aborted branch released its lock.
+	err = c.Run(ctx, []twopc.Branch{
+		{Participant: pa, MustExist: []storage.Key{1}, Writes: []twopc.Write{{Key: 1, Account: ptr(storagetest.WithBalance("5"))}}},
+		{Participant: pb, Reads: []twopc.Read{{Key: 2, Account: ptr(storagetest.WithBalance("10")), Exists: true}}, Writes: []twopc.Write{{Key: 2, Account: ptr(storagetest.WithBalance("15"))}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectBalance(t, a, 1, "5")
+	expectBalance(t, b, 2, "15")
+}
+
+func TestCoordinator_RecoverCommitsDecidedTransactions(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	a, b := newCrashable(), newCrashable()
+	setUp(t, "10", map[storage.Key]storage.Storage{1: a, 2: b})
+	pa, _ := twopc.NewParticipant(a, filepath.Join(dir, "a.log"))
+	pb, _ := twopc.NewParticipant(b, filepath.Join(dir, "b.log"))
+	c, _ := twopc.NewCoordinator(filepath.Join(dir, "coordinator.log"))
+
+	b.failCommit = true
+	err := c.Run(ctx, []twopc.Branch{
+		{Participant: pa, Writes: []twopc.Write{{Key: 1, Account: ptr(storagetest.WithBalance("5"))}}},
+		{Participant: pb, Writes: []twopc.Write{{Key: 2, Account: ptr(storagetest.WithBalance("15"))}}},
+	})
+	if !errors.Is(err, twopc.ErrInDoubt) {
+		t.Fatalf("Expected ErrInDoubt, got %v", err)
+	}
+	expectBalance(t, a, 1, "5")
+	expectBalance(t, b, 2, "10")
+	b.failCommit = false
+	pa.Close()
+	pb.Close()
+	c.Close()
+
+	// Restart from the journals.
+	for range 2 {
+		pa, _ = twopc.NewParticipant(a, filepath.Join(dir, "a.log"))
+		pb, _ = twopc.NewParticipant(b, filepath.Join(dir, "b.log"))
+		c, _ = twopc.NewCoordinator(filepath.Join(dir, "coordinator.log"))
+		if err := c.Recover(ctx, []*twopc.Participant{pa, pb}); err != nil {
+			t.Fatal(err)
+		}
+		expectBalance(t, a, 1, "5")
+		expectBalance(t, b, 2, "15")
+		if len(pa.InDoubt())+len(pb.InDoubt()) > 0 {
+			t.Errorf("Expected nothing left in doubt, got %v and %v", pa.InDoubt(), pb.InDoubt())
+		}
+		pa.Close()
+		pb.Close()
+		c.Close()
+	}
+}
+
+func TestCoordinator_RecoverAbortsUndecidedTransactions(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	a := newCrashable()
+	setUp(t, "10", map[storage.Key]storage.Storage{1: a})
+	pa, _ := twopc.NewParticipant(a, filepath.Join(dir, "a.log"))
+	if err := pa.Prepare(ctx, "undecided", nil, nil, []twopc.Write{{Key: 1, Account: ptr(storagetest.WithBalance("5"))}}); err != nil {
+		t.Fatal(err)
+	}
+	// The participant crashes before the coordinator decides.
+	a.crash()
+	pa.Close()
+
+	pa, _ = twopc.NewParticipant(a, filepath.Join(dir, "a.log"))
+	defer pa.Close()
+	if ids := pa.InDoubt(); len(ids) != 1 || ids[0] != "undecided" {
+		t.Fatalf("Expected the prepared transaction in doubt, got %v", ids)
+	}
+	c, _ := twopc.NewCoordinator(filepath.Join(dir, "coordinator.log"))
+	defer c.Close()
+	if err := c.Recover(ctx, []*twopc.Participant{pa}); err != nil {
+		t.Fatal(err)
+	}
+	expectBalance(t, a, 1, "10")
+	if ids := pa.InDoubt(); len(ids) != 0 {
+		t.Errorf("Expected nothing left in doubt, got %v", ids)
+	}
+}
+
+func TestParticipant_ResolveDoesNotCommitTwice(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.log")
+	a := storage.NewInMemoryStorage()
+	setUp(t, "10", map[storage.Key]storage.Storage{1: a})
+	pa, _ := twopc.NewParticipant(a, path)
+	if err := pa.Prepare(ctx, "first", nil, nil, []twopc.Write{{Key: 1, Account: ptr(storagetest.WithBalance("5"))}}); err != nil {
+		t.Fatal(err)
+	}
+	prepared, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pa.Commit("first"); err != nil {
+		t.Fatal(err)
+	}
+	// A later transaction puts back the value the first one replaced.
+	setUp(t, "10", map[storage.Key]storage.Storage{1: a})
+	pa.Close()
+
+	// The journal loses the done record of the first transaction.
+	if err := os.WriteFile(path, prepared, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	pa, _ = twopc.NewParticipant(a, path)
+	defer pa.Close()
+	if err := pa.Resolve(ctx, "first", true); err != nil {
+		t.Fatal(err)
+	}
+	expectBalance(t, a, 1, "10")
+}
+
+func TestParticipant_FailedCompactionKeepsTheJournal(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "a.log")
+	a := newCrashable()
+	setUp(t, "10", map[storage.Key]storage.Storage{1: a})
+	pa, _ := twopc.NewParticipant(a, path)
+	if err := pa.Prepare(ctx, "undecided", nil, nil, []twopc.Write{{Key: 1, Account: ptr(storagetest.WithBalance("5"))}}); err != nil {
+		t.Fatal(err)
+	}
+	a.crash()
+	pa.Close()
+
+	// The journal cannot be compacted on restart.
+	if err := os.Mkdir(path+".tmp", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := twopc.NewParticipant(a, path); err == nil {
+		t.Fatal("Expected the participant to fail to compact its journal")
+	}
+	os.Remove(path + ".tmp")
+	pa, err := twopc.NewParticipant(a, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pa.Close()
+	if ids := pa.InDoubt(); len(ids) != 1 || ids[0] != "undecided" {
+		t.Errorf("Expected the prepared transaction still in doubt, got %v", ids)
+	}
+}
+
+func TestParticipant_EncryptsItsJournal(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path, keyPath := filepath.Join(dir, "a.log"), filepath.Join(dir, "keys")
+	os.WriteFile(keyPath, []byte("1 "+base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))+"\n"), 0o600)
+	keyring, err := storage.LoadKeyring(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := twopc.Options{Keyring: keyring}
+	a := newCrashable()
+	setUp(t, "10", map[storage.Key]storage.Storage{1: a})
+	pa, _ := twopc.NewParticipantWithOptions(a, path, options)
+	account := storagetest.WithBalance("123.45")
+	account.Owner = "alice"
+	if err := pa.Prepare(ctx, "undecided", nil, nil, []twopc.Write{{Key: 1, Account: &account}}); err != nil {
+		t.Fatal(err)
+	}
+	a.crash()
+	pa.Close()
+	data, _ := os.ReadFile(path)
+	if bytes.Contains(data, []byte("123.45")) || bytes.Contains(data, []byte("alice")) {
+		t.Error("Expected the journal to be encrypted, found the account in plain text")
+	}
+
+	// Without the key the journal is left alone rather than truncated.
+	if _, err := twopc.NewParticipant(a, path); !errors.Is(err, storage.ErrDecrypt) {
+		t.Fatalf("Expected ErrDecrypt without the key, got %v", err)
+	}
+	pa, err = twopc.NewParticipantWithOptions(a, path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pa.Close()
+	if count, err := pa.Reencrypt(); err != nil || count != 1 {
+		t.Errorf("Expected 1 record re-encrypted, got %d, %v", count, err)
+	}
+	if ids := pa.InDoubt(); len(ids) != 1 || ids[0] != "undecided" {
+		t.Errorf("Expected the prepared transaction in doubt, got %v", ids)
+	}
+}